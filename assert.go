@@ -1,21 +1,53 @@
 package bptree
 
 import (
+	"fmt"
 	"os"
 	"strings"
 )
 
 //ASSERT is a global variable to be used a block calls to the assert() function.
 //ASSERT is initially set by the BPTREE_DEBUG env var. If
-//BPTREE_DEBUG is set to t, true, yes, or on, then ASSERT=true,
+//BPTREE_DEBUG is set to t, true, yes, on, or full, then ASSERT=true,
 //else ASSERT=false. Capitalization in the BPTREE_DEBUG env var does not
 //matter as its contents are always lower cased.
 var ASSERT = strings.ToLower(os.Getenv("BPTREE_DEBUG")) == "t" ||
 	strings.ToLower(os.Getenv("BPTREE_DEBUG")) == "true" ||
 	strings.ToLower(os.Getenv("BPTREE_DEBUG")) == "yes" ||
-	strings.ToLower(os.Getenv("BPTREE_DEBUG")) == "on"
+	strings.ToLower(os.Getenv("BPTREE_DEBUG")) == "on" ||
+	strings.ToLower(os.Getenv("BPTREE_DEBUG")) == "full"
 
-//assert tests cond is false, then call lgr.Panic(msg).
+//CheckLevel is how much checking of its invariants a tree does as it is
+//modified; see SetCheckLevel().
+type CheckLevel int
+
+const (
+	//CheckOff does no checking.
+	CheckOff CheckLevel = iota
+	//CheckNodes checks every node a Put() or Del() inserts into, splits,
+	//steals between or merges, right after it does so.
+	CheckNodes
+	//CheckTree does CheckNodes, and runs Validate() on the whole tree
+	//after every Put() and Del().
+	CheckTree
+)
+
+//DefaultCheckLevel is the CheckLevel of every new tree. It is CheckTree if
+//BPTREE_DEBUG is set to full, CheckNodes if ASSERT is otherwise true, else
+//CheckOff.
+var DefaultCheckLevel = defaultCheckLevel()
+
+func defaultCheckLevel() CheckLevel {
+	switch {
+	case strings.ToLower(os.Getenv("BPTREE_DEBUG")) == "full":
+		return CheckTree
+	case ASSERT:
+		return CheckNodes
+	}
+	return CheckOff
+}
+
+//assert tests cond is false, then call panic(msg).
 //The best way to use this is to make it conditional with ASSERT.
 //The multiline version of this conditional is:
 //
@@ -29,17 +61,18 @@ var ASSERT = strings.ToLower(os.Getenv("BPTREE_DEBUG")) == "t" ||
 //
 func assert(cond bool, msg string) {
 	if !cond {
-		lgr.Panic("ASSERT: " + msg)
+		panic("ASSERT: " + msg)
 	}
 }
 
-//assertf tests cond is false, then call lgr.Panicf(format, args...).
+//assertf tests cond is false, then panic with the message
+//fmt.Sprintf(format, args...) formats.
 //to the format as in fmt.Printf. For example:
 //
 //    _ = ASSERT && assertf(foo == 0, "foo != 0; foo == %d", foo)
 //
 func assertf(cond bool, format string, args ...interface{}) {
 	if !cond {
-		lgr.Panicf("ASSERT: "+format, args...)
+		panic(fmt.Sprintf("ASSERT: "+format, args...))
 	}
 }
@@ -0,0 +1,408 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"reflect"
+)
+
+//ErrBadEncoding is matched, via errors.Is(), by the error returned when
+//UnmarshalBinary() or ReadFrom() is given data that is not a tree written by
+//MarshalBinary() or WriteTo().
+var ErrBadEncoding = errors.New("bptree: invalid binary encoding")
+
+//ErrChecksum is matched, via errors.Is(), by the error returned when the
+//checksum of an encoded tree does not match its contents.
+var ErrChecksum = errors.New("bptree: checksum mismatch")
+
+//RecordError is returned when a record of an encoded tree is damaged: its
+//checksum does not match, or it can not be decoded. Err matches ErrChecksum
+//or ErrBadEncoding, via errors.Is(), and so does the *RecordError. See
+//SalvageBinary().
+type RecordError struct {
+	Offset int64 //of the record in the encoding; 0 for the header
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%v; record at offset %d", e.Err, e.Offset)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+//The binary encoding of a tree is, with every integer little endian:
+//
+//    magic    [4]byte  "BPT+"
+//    version  uint8    binaryVersion
+//    order    uint32   of the encoded tree; informational
+//    keyCodec uint16 length, then the name the KeyCodec is registered as;
+//                      empty for a tree that never held a key
+//    count    uint64   number of entries
+//    hdrSum   uint32   CRC-32C of the header, every byte before it
+//    entries  count times, a record of:
+//                      uint32 length, then the encoded key;
+//                      uint32 length, then the encoded value;
+//                      uint32 CRC-32C of the record, every byte before it
+//    checksum uint32   CRC-32C of every byte before it
+//
+//The entries are in ascending key order. The checksum of each record lets
+//a damaged encoding be read up to the first damaged record; see
+//SalvageBinary().
+const (
+	binaryMagic   = "BPT+"
+	binaryVersion = 2
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+//binaryWriter writes the encoding, keeping the checksum of the whole
+//encoding and of the record being written, and the count of bytes written.
+//The first error sticks; every later write is a no-op.
+type binaryWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	rec hash.Hash32
+	n   int64
+	err error
+}
+
+func (bw *binaryWriter) write(p []byte) {
+	if bw.err != nil {
+		return
+	}
+	var n int
+	n, bw.err = bw.w.Write(p)
+	bw.n += int64(n)
+	bw.crc.Write(p[:n])
+	bw.rec.Write(p[:n])
+}
+
+//endRecord() writes the checksum of the record, or header, written since the
+//last endRecord().
+func (bw *binaryWriter) endRecord() {
+	bw.uint32(bw.rec.Sum32())
+	bw.rec.Reset()
+}
+
+func (bw *binaryWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	bw.write(b[:])
+}
+
+func (bw *binaryWriter) bytes32(p []byte) {
+	bw.uint32(uint32(len(p)))
+	bw.write(p)
+}
+
+//writeBinary(w, order, count, vc, scan) writes the encoding of count entries
+//to w. The scan calls its fn with each entry in ascending key order; it is
+//also used to find the type of the keys.
+func writeBinary(w io.Writer, order, count int, vc ValueCodec, scan func(fn func(BptKey, interface{}) bool)) (int64, error) {
+	var keyType reflect.Type
+	scan(func(k BptKey, v interface{}) bool {
+		keyType = reflect.TypeOf(k)
+		return false
+	})
+	var name string
+	var kc KeyCodec
+	if keyType != nil {
+		var err error
+		if name, kc, err = keyCodecFor(keyType); err != nil {
+			return 0, err
+		}
+	}
+
+	bw := &binaryWriter{w: w, crc: crc32.New(castagnoli), rec: crc32.New(castagnoli)}
+	bw.write([]byte(binaryMagic))
+	bw.write([]byte{binaryVersion})
+	bw.uint32(uint32(order))
+	var b [8]byte
+	binary.LittleEndian.PutUint16(b[:2], uint16(len(name)))
+	bw.write(b[:2])
+	bw.write([]byte(name))
+	binary.LittleEndian.PutUint64(b[:], uint64(count))
+	bw.write(b[:])
+	bw.endRecord()
+
+	written := 0
+	scan(func(k BptKey, v interface{}) bool {
+		kb, err := kc.Encode(k)
+		if err != nil {
+			bw.err = fmt.Errorf("bptree: encoding key %q: %w", k, err)
+			return false
+		}
+		vb, err := vc.Encode(v)
+		if err != nil {
+			bw.err = fmt.Errorf("bptree: encoding value of key %q: %w", k, err)
+			return false
+		}
+		bw.bytes32(kb)
+		bw.bytes32(vb)
+		bw.endRecord()
+		written++
+		return bw.err == nil
+	})
+	if bw.err == nil && written != count {
+		bw.err = fmt.Errorf("bptree: %d entries were encoded; expected %d", written, count)
+	}
+
+	if bw.err != nil {
+		return bw.n, bw.err
+	}
+	bw.uint32(bw.crc.Sum32())
+	return bw.n, bw.err
+}
+
+//binaryReader reads the encoding, keeping the checksum of the whole
+//encoding and of the record being read, and the count of bytes read. It
+//reads exactly the bytes of the encoding from r, so a stream may hold more
+//after it.
+type binaryReader struct {
+	r   io.Reader
+	crc hash.Hash32
+	rec hash.Hash32
+	n   int64
+}
+
+func (br *binaryReader) read(p []byte) error {
+	n, err := io.ReadFull(br.r, p)
+	br.n += int64(n)
+	br.crc.Write(p[:n])
+	br.rec.Write(p[:n])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated", ErrBadEncoding)
+		}
+		return err
+	}
+	return nil
+}
+
+func (br *binaryReader) uint32() (uint32, error) {
+	var b [4]byte
+	if err := br.read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+//maxBinaryLen is the most bytes a key or value may claim, so a corrupt
+//length can not make readBinary() allocate without bound.
+const maxBinaryLen = 1 << 30
+
+func (br *binaryReader) bytes32() ([]byte, error) {
+	n, err := br.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBinaryLen {
+		return nil, fmt.Errorf("%w: length %d", ErrBadEncoding, n)
+	}
+	p := make([]byte, n)
+	return p, br.read(p)
+}
+
+//endRecord() reads the checksum of the record, or header, read since the
+//last endRecord() and checks it.
+func (br *binaryReader) endRecord() error {
+	sum := br.rec.Sum32()
+	stored, err := br.uint32()
+	if err != nil {
+		return err
+	}
+	br.rec.Reset()
+	if stored != sum {
+		return fmt.Errorf("%w: stored %08x; computed %08x", ErrChecksum, stored, sum)
+	}
+	return nil
+}
+
+//scanBinary(r, vc, fn) reads an encoded tree from r and calls fn(key, val)
+//for each entry, in order, once its record is checked; until fn returns
+//false. It returns the number of bytes read and of entries passed to fn. A
+//damaged record, or header, is a *RecordError.
+func scanBinary(r io.Reader, vc ValueCodec, fn func(BptKey, interface{}) bool) (int64, int, error) {
+	br := &binaryReader{r: r, crc: crc32.New(castagnoli), rec: crc32.New(castagnoli)}
+	damaged := func(off int64, err error) error {
+		if errors.Is(err, ErrBadEncoding) || errors.Is(err, ErrChecksum) {
+			return &RecordError{off, err}
+		}
+		return err
+	}
+
+	var hdr [len(binaryMagic) + 1 + 4 + 2]byte
+	if err := br.read(hdr[:]); err != nil {
+		return br.n, 0, err
+	}
+	if string(hdr[:len(binaryMagic)]) != binaryMagic {
+		return br.n, 0, fmt.Errorf("%w: bad magic %q", ErrBadEncoding, hdr[:len(binaryMagic)])
+	}
+	if v := hdr[len(binaryMagic)]; v != binaryVersion {
+		return br.n, 0, fmt.Errorf("%w: unsupported version %d", ErrBadEncoding, v)
+	}
+	name := make([]byte, binary.LittleEndian.Uint16(hdr[len(hdr)-2:]))
+	if err := br.read(name); err != nil {
+		return br.n, 0, damaged(0, err)
+	}
+	var b [8]byte
+	if err := br.read(b[:]); err != nil {
+		return br.n, 0, damaged(0, err)
+	}
+	count := binary.LittleEndian.Uint64(b[:])
+	if err := br.endRecord(); err != nil {
+		return br.n, 0, damaged(0, err)
+	}
+
+	var kc KeyCodec
+	if count > 0 {
+		var err error
+		if kc, err = keyCodecNamed(string(name)); err != nil {
+			return br.n, 0, err
+		}
+	}
+
+	var last BptKey
+	n := 0
+	for i := uint64(0); i < count; i++ {
+		off := br.n
+		kb, err := br.bytes32()
+		if err != nil {
+			return br.n, n, damaged(off, err)
+		}
+		vb, err := br.bytes32()
+		if err != nil {
+			return br.n, n, damaged(off, err)
+		}
+		if err := br.endRecord(); err != nil {
+			return br.n, n, damaged(off, err)
+		}
+		k, err := kc.Decode(kb)
+		if err != nil {
+			return br.n, n, damaged(off, fmt.Errorf("%w: key: %v", ErrBadEncoding, err))
+		}
+		v, err := vc.Decode(vb)
+		if err != nil {
+			return br.n, n, damaged(off, fmt.Errorf("%w: value of key %q: %v", ErrBadEncoding, k, err))
+		}
+		if last != nil && !last.LessThan(k) {
+			return br.n, n, damaged(off, fmt.Errorf("%w: key %q is not greater than %q", ErrBadEncoding, k, last))
+		}
+		last = k
+		n++
+		if !fn(k, v) {
+			return br.n, n, nil
+		}
+	}
+
+	off := br.n
+	sum := br.crc.Sum32()
+	stored, err := br.uint32()
+	if err != nil {
+		return br.n, n, damaged(off, err)
+	}
+	if stored != sum {
+		return br.n, n, damaged(off, fmt.Errorf("%w: stored %08x; computed %08x", ErrChecksum, stored, sum))
+	}
+	return br.n, n, nil
+}
+
+//readBinary(r, vc) reads an encoded tree from r and returns its entries,
+//in strictly ascending key order, and the number of bytes read. No entries
+//are returned with an error.
+func readBinary(r io.Reader, vc ValueCodec) (keys []BptKey, vals []interface{}, n int64, err error) {
+	n, _, err = scanBinary(r, vc, func(k BptKey, v interface{}) bool {
+		keys = append(keys, k)
+		vals = append(vals, v)
+		return true
+	})
+	if err != nil {
+		return nil, nil, n, err
+	}
+	return keys, vals, n, nil
+}
+
+//SalvageBinary(r, vc, fn) calls fn(key, val), in ascending key order, for
+//every entry of the encoded tree in r, as written by WriteTo(), before its
+//first damaged record; the values decoded with vc. It returns the number of
+//entries passed to fn and the *RecordError of that record; nil if there was
+//none, or fn returned false. Any other error, such as ErrNoCodec, is
+//returned as is.
+//
+//So the entries passed to fn are the intact prefix of the encoding; copying
+//them to a new tree recovers it.
+func SalvageBinary(r io.Reader, vc ValueCodec, fn func(BptKey, interface{}) bool) (int, error) {
+	_, n, err := scanBinary(r, vc, fn)
+	return n, err
+}
+
+//MarshalBinary() encodes the entries of the *tree; see WriteTo().
+//
+func (t *tree) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := t.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//WriteTo(w) writes the entries of the *tree to w, in ascending key order,
+//in a versioned and checksummed binary format. The keys are encoded by the
+//KeyCodec registered for their type, and the values by the ValueCodec of
+//the *tree.
+//
+func (t *tree) WriteTo(w io.Writer) (int64, error) {
+	return writeBinary(w, t.order, t.numEnts, t.valueCodec(), func(fn func(BptKey, interface{}) bool) {
+		t.Range(nil, nil, fn)
+	})
+}
+
+//UnmarshalBinary(data) replaces the entries of the *tree with those encoded
+//in data; see ReadFrom().
+//
+func (t *tree) UnmarshalBinary(data []byte) error {
+	_, err := t.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+//ReadFrom(r) reads a tree encoded by WriteTo() from r and replaces the
+//entries of the *tree with its entries. The *tree keeps its own order. It is
+//left unchanged if any error is returned; a damaged record is a
+//*RecordError, and SalvageBinary() recovers the entries before it.
+//
+func (t *tree) ReadFrom(r io.Reader) (int64, error) {
+	keys, vals, n, err := readBinary(r, t.valueCodec())
+	if err != nil {
+		return n, err
+	}
+	return n, t.loadEntries(keys, vals)
+}
+
+//t.loadEntries(keys, vals) replaces the entries of the *tree with keys[i],
+//vals[i] after checking the *tree may be modified and the keys are of its
+//type.
+func (t *tree) loadEntries(keys []BptKey, vals []interface{}) error {
+	if err := t.checkLoad(keys); err != nil {
+		return err
+	}
+	t.bulkLoad(keys, vals)
+	return nil
+}
+
+//t.checkLoad(keys) returns the error loadEntries() would for keys.
+func (t *tree) checkLoad(keys []BptKey) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	if len(keys) > 0 {
+		return t.checkKey(keys[0])
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+//_entries(bpt) returns every entry of bpt in key order.
+func _entries(bpt BpTree) []entry {
+	var ents []entry
+	bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+		ents = append(ents, entry{k, v.(int)})
+		return true
+	})
+	return ents
+}
+
+func TestBulkLoad(t *testing.T) {
+	for order := 3; order <= 6; order++ {
+		for n := 0; n <= 100; n++ {
+			keys := make([]BptKey, n)
+			vals := make([]interface{}, n)
+			for i := range keys {
+				keys[i] = largeNumEnts[i].key
+				vals[i] = largeNumEnts[i].val
+			}
+			for _, bpt := range []BpTree{NewBpTree(order), NewBLinkBpTree(order)} {
+				var tr *tree
+				if bt, ok := bpt.(*blinkTree); ok {
+					tr = bt.t
+				} else {
+					tr = bpt.(*tree)
+				}
+				tr.bulkLoad(keys, vals)
+				if err := bpt.Validate(); err != nil {
+					t.Fatalf("order=%d n=%d: bulkLoad() made an invalid tree: %v", order, n, err)
+				}
+			}
+		}
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	trees := map[string]BpTree{
+		"plain":      NewBpTree(3),
+		"mvcc":       NewMVCCBpTree(4),
+		"concurrent": NewConcurrentBpTree(5),
+		"latched":    NewLatchedBpTree(3),
+		"blink":      NewBLinkBpTree(3),
+		"optimistic": NewOptimisticBpTree(4),
+		"sharded":    NewShardedBpTree(3, shardSplits(3)),
+	}
+	for name, bpt := range trees {
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Put(ent.key, ent.val)
+		}
+		data, err := bpt.(Encodable).MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: MarshalBinary() = %v", name, err)
+		}
+
+		for _, into := range []Encodable{NewBpTree(7).(Encodable), NewBLinkBpTree(3).(Encodable), NewShardedBpTree(4, shardSplits(5)).(Encodable), NewMVCCBpTree(3).(Encodable)} {
+			into.Put(StringKey("gone"), 0)
+			if err := into.UnmarshalBinary(data); err != nil {
+				t.Fatalf("%s: UnmarshalBinary() = %v", name, err)
+			}
+			if err := into.Validate(); err != nil {
+				t.Fatalf("%s: UnmarshalBinary() made an invalid tree: %v", name, err)
+			}
+			if !reflect.DeepEqual(_entries(into), largeNumEnts) {
+				t.Fatalf("%s: UnmarshalBinary() did not restore the entries", name)
+			}
+		}
+	}
+}
+
+func TestBinaryStream(t *testing.T) {
+	a, b := NewBpTree(3).(Encodable), NewBpTree(4).(Encodable)
+	for i, ent := range largeNumEnts {
+		if i%2 == 0 {
+			a.Put(ent.key, ent.val)
+		} else {
+			b.Put(ent.key, ent.val)
+		}
+	}
+
+	var buf bytes.Buffer
+	na, _ := a.WriteTo(&buf)
+	nb, _ := b.WriteTo(&buf)
+	if na+nb != int64(buf.Len()) {
+		t.Fatalf("WriteTo() returned %d+%d bytes; %d were written", na, nb, buf.Len())
+	}
+
+	ra, rb := NewBpTree(3).(Encodable), NewBpTree(3).(Encodable)
+	if n, err := ra.ReadFrom(&buf); err != nil || n != na {
+		t.Fatalf("ReadFrom() = %d, %v; expected %d, nil", n, err, na)
+	}
+	if n, err := rb.ReadFrom(&buf); err != nil || n != nb {
+		t.Fatalf("ReadFrom() = %d, %v; expected %d, nil", n, err, nb)
+	}
+	if !reflect.DeepEqual(_entries(ra), _entries(a)) || !reflect.DeepEqual(_entries(rb), _entries(b)) {
+		t.Fatalf("ReadFrom() did not restore the entries")
+	}
+}
+
+func TestBinaryCorrupt(t *testing.T) {
+	bpt := NewBpTree(3).(Encodable)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	data, _ := bpt.MarshalBinary()
+
+	bad := func(mod func([]byte) []byte) []byte {
+		return mod(append([]byte(nil), data...))
+	}
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"flipped", bad(func(d []byte) []byte { d[len(d)/2] ^= 0x10; return d }), ErrChecksum},
+		{"truncated", bad(func(d []byte) []byte { return d[:len(d)-1] }), ErrBadEncoding},
+		{"magic", bad(func(d []byte) []byte { d[0] = 'X'; return d }), ErrBadEncoding},
+		{"version", bad(func(d []byte) []byte { d[len(binaryMagic)] = 99; return d }), ErrBadEncoding},
+		{"empty", nil, ErrBadEncoding},
+	}
+	for _, c := range cases {
+		into := NewBpTree(3).(Encodable)
+		into.Put(StringKey("kept"), 1)
+		if err := into.UnmarshalBinary(c.data); !errors.Is(err, c.err) {
+			t.Fatalf("%s: UnmarshalBinary() = %v; expected %v", c.name, err, c.err)
+		}
+		if v, ok := into.Get(StringKey("kept")); !ok || v != 1 || into.NumberOfEntries() != 1 {
+			t.Fatalf("%s: a failed UnmarshalBinary() changed the tree", c.name)
+		}
+	}
+
+	//the header checksum is checked
+	d := bad(func(d []byte) []byte { d[len(binaryMagic)+1] ^= 0x01; return d })
+	var re *RecordError
+	if err := NewBpTree(3).(Encodable).UnmarshalBinary(d); !errors.As(err, &re) || re.Offset != 0 || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("UnmarshalBinary() with a damaged header = %v; expected a *RecordError at 0", err)
+	}
+
+	//the key codec name is checked too, in a header with a good checksum
+	d = bad(func(d []byte) []byte {
+		name := len(binaryMagic) + 1 + 4 + 2
+		copy(d[name:], "ByteSliceKeX")
+		binary.LittleEndian.PutUint16(d[name-2:], uint16(len("ByteSliceKeX")))
+		hdr := name + len("ByteSliceKeX") + 8
+		binary.LittleEndian.PutUint32(d[hdr:], crc32.Checksum(d[:hdr], castagnoli))
+		return d
+	})
+	if err := NewBpTree(3).(Encodable).UnmarshalBinary(d); !errors.Is(err, ErrNoCodec) {
+		t.Fatalf("UnmarshalBinary() with an unknown key codec = %v; expected ErrNoCodec", err)
+	}
+}
+
+func TestSalvageBinary(t *testing.T) {
+	bpt := NewBpTree(3).(Encodable)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	data, _ := bpt.MarshalBinary()
+	want := _entries(bpt)
+
+	var got []entry
+	collect := func(k BptKey, v interface{}) bool {
+		got = append(got, entry{k, v.(int)})
+		return true
+	}
+	n, err := SalvageBinary(bytes.NewReader(data), DefaultValueCodec, collect)
+	if err != nil || n != len(want) || !reflect.DeepEqual(got, want) {
+		t.Fatalf("SalvageBinary() of an intact encoding = %d, %v; expected %d, nil", n, err, len(want))
+	}
+
+	bad := append([]byte(nil), data...)
+	at := len(bad) / 2
+	bad[at] ^= 0x10
+	got = nil
+	n, err = SalvageBinary(bytes.NewReader(bad), DefaultValueCodec, collect)
+	var re *RecordError
+	if !errors.As(err, &re) || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("SalvageBinary() of a damaged encoding = %v; expected a *RecordError", err)
+	}
+	if re.Offset <= 0 || re.Offset > int64(at) {
+		t.Fatalf("RecordError.Offset = %d; expected in (0, %d]", re.Offset, at)
+	}
+	if n == 0 || n >= len(want) || n != len(got) || !reflect.DeepEqual(got, want[:n]) {
+		t.Fatalf("SalvageBinary() passed %d entries; expected the %d before the damage of %d", len(got), n, len(want))
+	}
+
+	//the salvaged prefix makes a tree
+	into := NewBpTree(3).(Encodable)
+	for _, ent := range got {
+		into.Put(ent.key, ent.val)
+	}
+	if err := into.Validate(); err != nil || into.NumberOfEntries() != n {
+		t.Fatalf("tree of the salvaged entries: %v, %d entries", err, into.NumberOfEntries())
+	}
+}
+
+type intKey int
+
+func (k intKey) Equals(o BptKey) bool   { return k == o.(intKey) }
+func (k intKey) LessThan(o BptKey) bool { return k < o.(intKey) }
+func (k intKey) String() string         { return strconv.Itoa(int(k)) }
+
+type point struct{ X, Y int }
+
+func TestBinaryCodecs(t *testing.T) {
+	bpt := NewBpTree(4).(Encodable)
+	for i := 0; i < 50; i++ {
+		bpt.Put(intKey(i), point{i, -i})
+	}
+	if _, err := bpt.MarshalBinary(); !errors.Is(err, ErrNoCodec) {
+		t.Fatalf("MarshalBinary() of an unregistered key type = %v; expected ErrNoCodec", err)
+	}
+
+	RegisterKeyCodec("bptree.intKey", intKey(0), KeyCodec{
+		Encode: func(k BptKey) ([]byte, error) { return []byte(k.String()), nil },
+		Decode: func(b []byte) (BptKey, error) {
+			i, err := strconv.Atoi(string(b))
+			return intKey(i), err
+		},
+	})
+	if _, err := bpt.MarshalBinary(); !errors.Is(err, ErrNoCodec) {
+		t.Fatalf("MarshalBinary() of point values = %v; expected ErrNoCodec", err)
+	}
+
+	pointCodec := ValueCodec{
+		Encode: json.Marshal,
+		Decode: func(b []byte) (interface{}, error) {
+			var p point
+			err := json.Unmarshal(b, &p)
+			return p, err
+		},
+	}
+	bpt.SetValueCodec(pointCodec)
+	data, err := bpt.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() = %v", err)
+	}
+
+	into := NewConcurrentBpTree(3).(Encodable)
+	into.SetValueCodec(pointCodec)
+	if err := into.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() = %v", err)
+	}
+	if v, ok := into.Get(intKey(7)); !ok || v != (point{7, -7}) {
+		t.Fatalf("Get(7) = %v, %v; expected {7 -7}, true", v, ok)
+	}
+}
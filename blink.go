@@ -0,0 +1,525 @@
+package bptree
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+//blinkTree is a B-link tree (Lehman and Yao, "Efficient Locking for
+//Concurrent Operations on B-Trees", 1981). Every node has a right-link, next,
+//to its peer at the same level and a high key, the least key that belongs to
+//next instead of to it.
+//
+//split() publishes the new right node via the right-link before the parent
+//is updated. A reader, or writer, that reaches a node whose high key is <=
+//the key it is looking for knows the node was split after it read the
+//parent, and follows the right-link instead of starting over or waiting.
+//Readers hold at most one node latch at a time and never wait for a split
+//to finish.
+//
+//Del() is not part of the Lehman-Yao protocol. It, and every operation on
+//the whole tree, takes mu exclusively and runs the plain *tree code; the
+//node ops keep the right-links up to date for steals and merges.
+type blinkTree struct {
+	mu        sync.RWMutex //shared by Get/Put/Range; exclusive for the rest
+	rootLatch sync.RWMutex //guards t.root
+	cntMu     sync.Mutex   //guards t.numEnts
+	t         *tree
+}
+
+//NewBLinkBpTree instantiates a new B+Tree, for a given order, that is safe
+//for concurrent use by multiple goroutines; see NewBpTree() for the meaning
+//of order.
+//
+//It is a B-link tree: Get() and Range() are never blocked by a Put() that is
+//splitting nodes, and Put() calls that touch different nodes run in
+//parallel. Del() excludes every other operation.
+//
+//Range() does not see a consistent snapshot; it sees every entry that was in
+//the tree for the whole Range() call exactly once, and may or may not see
+//entries Put() while it runs. Its fn must not call any method of the tree.
+//
+//Snapshot() is a full copy of the tree, and it is not Transactional.
+//
+//NewBLinkBpTree panics if order is less than 3; see NewBLinkBpTreeE().
+func NewBLinkBpTree(order int) BpTree {
+	bt, err := NewBLinkBpTreeE(order)
+	if err != nil {
+		panic(err)
+	}
+	return bt
+}
+
+//NewBLinkBpTreeE is NewBLinkBpTree() that returns ErrInvalidOrder instead of
+//panicking.
+func NewBLinkBpTreeE(order int) (BpTree, error) {
+	if order < 3 {
+		return nil, ErrInvalidOrder
+	}
+	var t = new(tree)
+	t.order = order
+	t.gen = nextGen()
+	t.latched = true
+	t.blink = true
+	t.root = t.newLeaf()
+	t.check = newChecker(DefaultCheckLevel)
+	t.counters = new(opCounters)
+
+	var bt = new(blinkTree)
+	bt.t = t
+	return bt, nil
+}
+
+//moveRight(node, key, write) follows right-links, starting at node, until
+//it reaches the node at the same level that key belongs in. The node passed
+//in must be latched (write latched if write is true); the node returned is
+//latched the same way and every other latch taken is released.
+func moveRight(node nodeI, key BptKey, write bool) nodeI {
+	for {
+		next, highKey := node.link()
+		if highKey == nil || key.LessThan(highKey) {
+			return node
+		}
+		if write {
+			next.nodeLatch().Lock()
+			node.nodeLatch().Unlock()
+		} else {
+			next.nodeLatch().RLock()
+			node.nodeLatch().RUnlock()
+		}
+		node = next
+	}
+}
+
+//childFor(key) returns the child of node that key belongs in.
+func (node *interiorNodeS) childFor(key BptKey) nodeI {
+	var i int
+	for i = 0; i < len(node.keys); i++ {
+		if key.LessThan(node.keys[i]) {
+			break
+		}
+	}
+	return node.vals[i]
+}
+
+func (bt *blinkTree) loadRoot() nodeI {
+	bt.rootLatch.RLock()
+	defer bt.rootLatch.RUnlock()
+	return bt.t.root
+}
+
+//findLeaf(key, path) descends to the leaf key belongs in, holding one read
+//latch at a time. The interior nodes it went thru are pushed on path, if
+//path is not nil. The returned leaf is read latched.
+//
+//The parent's latch is released before the child's is taken; a writer
+//holds a child's latch while it takes the parent's, so coupling downward
+//could deadlock. If the child is split in between, moveRight() finds the
+//right node.
+func (bt *blinkTree) findLeaf(key BptKey, path *pathT) *leafNodeS {
+	node := bt.loadRoot()
+	node.nodeLatch().RLock()
+	for {
+		node = moveRight(node, key, false)
+		if node.isLeaf() {
+			return node.(*leafNodeS)
+		}
+		curNode := node.(*interiorNodeS)
+		if path != nil {
+			path.push(curNode)
+		}
+		child := curNode.childFor(key)
+		curNode.nodeLatch().RUnlock()
+		child.nodeLatch().RLock()
+		node = child
+	}
+}
+
+//findAtHeight(key, height) returns, unlatched, the node at the given height
+//(leaves are height 0) on the way from the root to key. It is used when a
+//split reaches what used to be the root, but the tree has since grown.
+func (bt *blinkTree) findAtHeight(key BptKey, height int) *interiorNodeS {
+	path := newPathT()
+	leaf := bt.findLeaf(key, &path)
+	leaf.nodeLatch().RUnlock()
+	return path[len(path)-height]
+}
+
+func (bt *blinkTree) Order() int {
+	//the order never changes
+	return bt.t.order
+}
+
+func (bt *blinkTree) Get(key BptKey, opts ...ReadOption) (interface{}, bool) {
+	if readOpts(opts).asOfSet {
+		panic("Get: AsOf() requires an MVCC tree")
+	}
+
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
+
+	if err := bt.t.checkKey(key); err != nil {
+		bt.t.logErr("get", key, err)
+		return nil, false
+	}
+
+	leaf := bt.findLeaf(key, nil)
+	defer leaf.nodeLatch().RUnlock()
+
+	for i, k := range leaf.keys {
+		if key.Equals(k) {
+			return leaf.vals[i], true
+		}
+	}
+	return nil, false
+}
+
+//Put(key, val) is exclusive for the first key, which sets the key type of
+//the tree; see checkKey().
+func (bt *blinkTree) Put(key BptKey, val interface{}) bool {
+	bt.mu.RLock()
+	if bt.t.undo != nil || bt.t.checkingTree() || bt.t.keyType == nil {
+		bt.mu.RUnlock()
+		bt.mu.Lock()
+		defer bt.mu.Unlock()
+		return bt.t.Put(key, val)
+	}
+	defer bt.mu.RUnlock()
+
+	t := bt.t
+	if err := t.checkKey(key); err != nil {
+		t.logErr("put", key, err)
+		return false
+	}
+	t.checkOp("put", key)
+
+	//path remembers the node read at each level; a node on it may since
+	//have split, moveRight() takes care of that.
+	path := newPathT()
+	leaf := bt.findLeaf(key, &path)
+	leaf.nodeLatch().RUnlock()
+	return bt.insertAt(leaf, key, val, &path)
+}
+
+//insertAt(leaf, key, val, path) inserts key into leaf, or the leaf to its
+//right that key belongs in, and inserts the separators of the nodes it
+//splits into their parents. leaf and path are as found by an unlatched
+//findLeaf(key, path).
+func (bt *blinkTree) insertAt(leaf *leafNodeS, key BptKey, val interface{}, path *pathT) bool {
+	t := bt.t
+	leaf.nodeLatch().Lock()
+	node := moveRight(leaf, key, true)
+
+	added := node.insert(key, val)
+
+	for height := 0; node.isToBig(); height++ {
+		rightNode, rightKey := node.split()
+		//rightNode is now reachable from node's right-link
+		t.counters.split()
+		t.checkNodes("put", "split", false, node, rightNode)
+		t.checkSep("put", "split", node, rightKey, rightNode)
+
+		parent := bt.lockParent(node, rightKey, rightNode, height, path)
+		if parent == nil {
+			break
+		}
+		parent.insert(rightKey, rightNode)
+		node = parent
+	}
+	t.checkNodes("put", "insert", true, node)
+	node.nodeLatch().Unlock()
+
+	if added {
+		bt.cntMu.Lock()
+		t.numEnts++
+		bt.cntMu.Unlock()
+	}
+	return added
+}
+
+//lockParent(node, key, right, height, path) returns, write latched, the node
+//at height+1 that key, the separator of right split off node, belongs in,
+//and releases node's latch. If node is the root, it makes a new root of node
+//and right instead, and returns nil with node still latched.
+func (bt *blinkTree) lockParent(node nodeI, key BptKey, right nodeI, height int, path *pathT) nodeI {
+	t := bt.t
+	if !path.isEmpty() {
+		//hold node's latch until its parent is latched
+		parent := path.pop()
+		parent.nodeLatch().Lock()
+		parentNode := moveRight(parent, key, true)
+		node.nodeLatch().Unlock()
+		return parentNode
+	}
+
+	bt.rootLatch.Lock()
+	if t.root == node {
+		t.root = t.newNode(key, node, right)
+		t.checkNodes("put", "new root", true, t.root)
+		bt.rootLatch.Unlock()
+		return nil
+	}
+	bt.rootLatch.Unlock()
+
+	//node was the root when we read it, but the tree has grown. The way
+	//down to the parent latches nodes at node's height, maybe node, so its
+	//latch is released first; right is reachable from node's right-link
+	//meanwhile, and moveRight() finds the parent key belongs in even if
+	//node or right split again.
+	node.nodeLatch().Unlock()
+	parent := bt.findAtHeight(key, height+1)
+	parent.nodeLatch().Lock()
+	return moveRight(parent, key, true)
+}
+
+func (bt *blinkTree) Del(key BptKey) (interface{}, bool) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.Del(key)
+}
+
+//Range(lo, hi, fn) walks the leaves via their right-links, holding one read
+//latch at a time, and calls fn with no latch held. Del() is excluded for the
+//whole Range(), so fn must not call any method of the tree.
+func (bt *blinkTree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) {
+	bt.RangeContext(context.Background(), lo, hi, fn, opts...)
+}
+
+//RangeContext(ctx, lo, hi, fn) is Range(lo, hi, fn) that checks ctx before
+//latching each leaf.
+func (bt *blinkTree) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error {
+	if readOpts(opts).asOfSet {
+		panic("Range: AsOf() requires an MVCC tree")
+	}
+
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var leaf *leafNodeS
+	if lo != nil {
+		leaf = bt.findLeaf(lo, nil)
+	} else {
+		//the left most leaf never moves; splits only move keys right
+		node := bt.loadRoot()
+		node.nodeLatch().RLock()
+		for !node.isLeaf() {
+			child := node.(*interiorNodeS).vals[0]
+			node.nodeLatch().RUnlock()
+			child.nodeLatch().RLock()
+			node = child
+		}
+		leaf = node.(*leafNodeS)
+	}
+
+	//last is the last key handed to fn; a split may have moved keys we
+	//already saw into the next leaf.
+	last := lo
+	seen := false
+	for {
+		keys := append([]BptKey(nil), leaf.keys...)
+		vals := append([]interface{}(nil), leaf.vals...)
+		next := leaf.sync.next
+		leaf.nodeLatch().RUnlock()
+
+		for i, k := range keys {
+			if last != nil && (k.LessThan(last) || (seen && k.Equals(last))) {
+				continue
+			}
+			if hi != nil && !k.LessThan(hi) {
+				return nil
+			}
+			if !fn(k, vals[i]) {
+				return nil
+			}
+			last, seen = k, true
+		}
+
+		if next == nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		leaf = next.(*leafNodeS)
+		leaf.nodeLatch().RLock()
+	}
+}
+
+func (bt *blinkTree) String() string {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.String()
+}
+
+func (bt *blinkTree) Validate() error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.Validate()
+}
+
+func (bt *blinkTree) Graph(opts ...GraphOption) string {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.Graph(opts...)
+}
+
+//DumpJSON(w, opts...) encodes the tree with the lock held, and writes it to w
+//without.
+func (bt *blinkTree) DumpJSON(w io.Writer, opts ...JSONOption) error {
+	bt.mu.Lock()
+	doc, err := bt.t.jsonTree(jsonOpts(opts))
+	bt.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, doc)
+}
+
+//MarshalBinary() encodes a Snapshot() of the tree; see WriteTo().
+func (bt *blinkTree) MarshalBinary() ([]byte, error) {
+	return bt.Snapshot().(*tree).MarshalBinary()
+}
+
+//WriteTo(w) writes a Snapshot() of the tree to w, without the lock held.
+func (bt *blinkTree) WriteTo(w io.Writer) (int64, error) {
+	return bt.Snapshot().(*tree).WriteTo(w)
+}
+
+func (bt *blinkTree) UnmarshalBinary(data []byte) error {
+	_, err := bt.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+//ReadFrom(r) decodes the entries without the lock held, and then replaces
+//the entries of the tree with them.
+func (bt *blinkTree) ReadFrom(r io.Reader) (int64, error) {
+	bt.mu.Lock()
+	vc := bt.t.valueCodec()
+	bt.mu.Unlock()
+
+	keys, vals, n, err := readBinary(r, vc)
+	if err != nil {
+		return n, err
+	}
+
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	err = bt.t.loadEntries(keys, vals)
+	return n, err
+}
+
+func (bt *blinkTree) SetValueCodec(vc ValueCodec) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.t.SetValueCodec(vc)
+}
+
+//MarshalJSON() encodes a Snapshot() of the tree.
+func (bt *blinkTree) MarshalJSON() ([]byte, error) {
+	return bt.Snapshot().(*tree).MarshalJSON()
+}
+
+func (bt *blinkTree) UnmarshalJSON(data []byte) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.UnmarshalJSON(data)
+}
+
+//GobEncode() encodes a Snapshot() of the tree.
+func (bt *blinkTree) GobEncode() ([]byte, error) {
+	return bt.Snapshot().(*tree).GobEncode()
+}
+
+func (bt *blinkTree) GobDecode(data []byte) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.GobDecode(data)
+}
+
+func (bt *blinkTree) SetKeyFactory(f KeyFactory) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.t.SetKeyFactory(f)
+}
+
+func (bt *blinkTree) Stats() Stats {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.Stats()
+}
+
+func (bt *blinkTree) ResetStats() {
+	//the counters are atomic
+	bt.t.ResetStats()
+}
+
+func (bt *blinkTree) NumberOfEntries() int {
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
+	bt.cntMu.Lock()
+	defer bt.cntMu.Unlock()
+	return bt.t.numEnts
+}
+
+func (bt *blinkTree) Clear() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.t.Clear()
+}
+
+//Clone() returns a plain, not concurrency safe, copy of the tree.
+func (bt *blinkTree) Clone() BpTree {
+	return bt.CloneWith(nil)
+}
+
+//CloneWith(copyVal) returns a plain, not concurrency safe, copy of the tree.
+func (bt *blinkTree) CloneWith(copyVal func(interface{}) interface{}) BpTree {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.CloneWith(copyVal)
+}
+
+//Snapshot() returns a read-only full copy of the tree. The B-link tree
+//modifies nodes in place, so it can not share them with a Snapshot.
+func (bt *blinkTree) Snapshot() BpTree {
+	snap := bt.Clone().(*tree)
+	snap.readOnly = true
+	return snap
+}
+
+func (bt *blinkTree) EnableUndo(maxEntries int) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.t.EnableUndo(maxEntries)
+}
+
+func (bt *blinkTree) Savepoint() Savepoint {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.Savepoint()
+}
+
+func (bt *blinkTree) RollbackTo(sp Savepoint) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.t.RollbackTo(sp)
+}
+
+func (bt *blinkTree) SetLogger(l *slog.Logger) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.t.SetLogger(l)
+}
+
+func (bt *blinkTree) SetCheckLevel(level CheckLevel) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.t.SetCheckLevel(level)
+}
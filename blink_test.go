@@ -0,0 +1,138 @@
+package bptree
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBLinkParallelPutAndGet(t *testing.T) {
+	for _, order := range []int{3, 4, 7} {
+		bpt := NewBLinkBpTree(order)
+
+		nWorkers := 8
+		var wg sync.WaitGroup
+		for w := 0; w < nWorkers; w++ {
+			wg.Add(2)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(largeNumEnts); i += nWorkers {
+					ent := largeNumEnts[i]
+					bpt.Put(ent.key, ent.val)
+					val, found := bpt.Get(ent.key)
+					if !found || val.(int) != ent.val {
+						t.Errorf("Get(%q) = %v, %v; expected %d", ent.key, val, found, ent.val)
+						return
+					}
+				}
+			}(w)
+			go func() {
+				defer wg.Done()
+				//entries are only ever added, so Range must stay ordered
+				var prev BptKey
+				bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+					if prev != nil && !prev.LessThan(k) {
+						t.Errorf("Range out of order: %q then %q", prev, k)
+						return false
+					}
+					prev = k
+					return true
+				})
+			}()
+		}
+		wg.Wait()
+
+		bt := bpt.(*blinkTree)
+		if !_validTree(t, bt.t) {
+			t.Fatalf("order=%d; !_validTree(t, bt.t)", order)
+		}
+		if bpt.NumberOfEntries() != len(largeNumEnts) {
+			t.Fatalf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts))
+		}
+		var n int
+		bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+			if !k.Equals(largeNumEnts[n].key) {
+				t.Fatalf("Range entry %d = %q; expected %q", n, k, largeNumEnts[n].key)
+			}
+			n++
+			return true
+		})
+		if n != len(largeNumEnts) {
+			t.Fatalf("Range visited %d entries; expected %d", n, len(largeNumEnts))
+		}
+	}
+}
+
+func TestBLinkDelKeepsRightLinks(t *testing.T) {
+	bpt := NewBLinkBpTree(3)
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	half := len(largeNumEnts) / 2
+	delEnts := genRandomizedEntries(largeNumEnts)
+	for _, ent := range delEnts[:half] {
+		bpt.Del(ent.key)
+	}
+
+	bt := bpt.(*blinkTree)
+	if !_validTree(t, bt.t) {
+		t.Fatalf("!_validTree(t, bt.t)")
+	}
+
+	//walking the right-links must visit exactly the remaining entries
+	var n int
+	bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != len(largeNumEnts)-half {
+		t.Fatalf("Range visited %d entries; expected %d", n, len(largeNumEnts)-half)
+	}
+	for _, ent := range delEnts[half:] {
+		if _, found := bpt.Get(ent.key); !found {
+			t.Fatalf("did not find ent.key=%q", ent.key)
+		}
+	}
+}
+
+//TestBLinkRootGrew splits what a Put() read as the root, a leaf, after
+//another Put() has grown the tree above it; the parent must be found
+//without latching the leaf again.
+func TestBLinkRootGrew(t *testing.T) {
+	bt := NewBLinkBpTree(3).(*blinkTree)
+	bt.Put(StringKey("m0"), 0)
+	oldRoot := bt.t.root.(*leafNodeS)
+
+	//another writer grows the tree to the right of oldRoot
+	for c := 'n'; c <= 'z'; c++ {
+		bt.Put(StringKey(string(c)+"0"), int(c))
+	}
+	if bt.t.root.isLeaf() {
+		t.Fatal("the tree did not grow")
+	}
+	for c := 'a'; len(oldRoot.keys) < bt.t.order-1; c++ {
+		bt.Put(StringKey(string(c)+"0"), int(c))
+	}
+
+	done := make(chan bool)
+	go func() {
+		path := newPathT()
+		done <- bt.insertAt(oldRoot, StringKey("l5"), 5, &path)
+	}()
+	select {
+	case added := <-done:
+		if !added {
+			t.Fatal("insertAt() did not add the key")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("insertAt() deadlocked finding the parent of the old root")
+	}
+
+	if !_validTree(t, bt.t) {
+		t.Fatal("!_validTree(t, bt.t)")
+	}
+	if val, found := bt.Get(StringKey("l5")); !found || val != 5 {
+		t.Fatalf("Get(\"l5\") = %v, %v", val, found)
+	}
+}
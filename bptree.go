@@ -4,20 +4,75 @@ Package bptree implements a B+Tree in go.
 package bptree
 
 import (
+	"context"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
 )
 
 //BpTree implements all the User facing API of the B+Tree implementation.
 //
+//What only some of the trees support is in the optional interfaces
+//Transactional, Undoable and Encodable, which a BpTree may be type-asserted
+//to.
 type BpTree interface {
 	Order() int
-	Get(BptKey) (interface{}, bool)
+	Get(BptKey, ...ReadOption) (interface{}, bool)
 	Put(BptKey, interface{}) bool
 	Del(BptKey) (interface{}, bool)
+	Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption)
+	RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error
 	String() string
+	Validate() error
+	Graph(opts ...GraphOption) string
+	DumpJSON(w io.Writer, opts ...JSONOption) error
+	Stats() Stats
+	ResetStats()
 	NumberOfEntries() int
+	Clear()
+	Clone() BpTree
+	CloneWith(copyVal func(interface{}) interface{}) BpTree
+	Snapshot() BpTree
+	SetLogger(*slog.Logger)
+	SetCheckLevel(CheckLevel)
+}
+
+//Transactional is implemented by a BpTree that supports Txns; every one but
+//the B-link and sharded trees. See Txn.
+type Transactional interface {
+	BpTree
+	Begin() *Txn
+}
+
+//Undoable is implemented by a BpTree that can keep an undo journal; every
+//one but the sharded tree. See EnableUndo().
+type Undoable interface {
+	BpTree
+	EnableUndo(maxEntries int)
+	Savepoint() Savepoint
+	RollbackTo(Savepoint) error
+}
+
+//Encodable is implemented by a BpTree that can be encoded, and decoded, in
+//the binary format, as JSON and with encoding/gob; every BpTree of this
+//package. See binary.go, marshal.go and codec.go.
+type Encodable interface {
+	BpTree
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	io.WriterTo
+	io.ReaderFrom
+	json.Marshaler
+	json.Unmarshaler
+	gob.GobEncoder
+	gob.GobDecoder
+	SetValueCodec(ValueCodec)
+	SetKeyFactory(KeyFactory)
 }
 
 type nodeI interface {
@@ -28,35 +83,64 @@ type nodeI interface {
 	findPeerRight(*interiorNodeS) (nodeI, BptKey)
 	isLeaf() bool
 	findLeftMostKey() BptKey
+	clone(gen uint64, copyVal func(interface{}) interface{}) nodeI
+	copyNode(gen uint64) nodeI
+	generation() uint64
+	nodeLatch() *sync.RWMutex
+	syncState() *nodeSync
+	link() (next nodeI, highKey BptKey)
 	order() int
 	size() int
 	halfFullSize() int
 	//Modifying Ops
 	insert(key BptKey, val interface{}) bool
 	split() (nodeI, BptKey)
-	stealLeft(nodeI)
-	stealRight(nodeI)
-	mergeRight(nodeI)
+	stealLeft(peer nodeI, sep BptKey) BptKey
+	stealRight(peer nodeI, sep BptKey) BptKey
+	mergeRight(peer nodeI, sep BptKey)
 }
 
-var lgr = log.New(os.Stderr, "[bptree] ", log.Lshortfile)
-
 type tree struct {
-	root    nodeI
-	order   int
-	numEnts int
+	root     nodeI
+	order    int
+	numEnts  int
+	gen      uint64
+	readOnly bool
+	txnMu    sync.Mutex //serializes Begin() and Txn.Commit()
+	undo     *undoJournal
+	latched  bool         //new nodes get a nodeSync; see latch.go
+	blink    bool         //new nodes maintain B-link right-links; see blink.go
+	keyType  reflect.Type //type of the first key Put(); see checkKey()
+	log      *slog.Logger //nil is silent; see SetLogger()
+	check    *checker     //nil is CheckOff; see SetCheckLevel()
+	counters *opCounters  //nil for a Snapshot; see Stats()
+	vcodec   *ValueCodec  //nil is DefaultValueCodec; see SetValueCodec()
+
+	keyFactory KeyFactory //nil decodes keys as keyType; see SetKeyFactory()
 }
 
 func mkTree(order int) *tree {
 	var t = new(tree)
-	t.root = mkLeaf(order)
 	t.order = order
+	t.gen = nextGen()
+	t.root = t.newLeaf()
 	t.numEnts = 0
+	t.check = newChecker(DefaultCheckLevel)
+	t.counters = new(opCounters)
 	return t
 }
 
+func (t *tree) newLeaf() *leafNodeS {
+	leaf := mkLeaf(t.order)
+	leaf.gen = t.gen
+	leaf.sync = t.newSync()
+	return leaf
+}
+
 func (t *tree) newNode(k BptKey, l, r nodeI) *interiorNodeS {
 	node := mkNode(t.order)
+	node.gen = t.gen
+	node.sync = t.newSync()
 	node.keys = append(node.keys, k)
 	node.vals = append(node.vals, l, r)
 	return node
@@ -74,11 +158,14 @@ func (t *tree) newNode(k BptKey, l, r nodeI) *interiorNodeS {
 //practically that is more towards 16 than 31 and 6 times is more common than 7.
 //
 //The B+Tree order is a constant for the life of a B+Tree.
+//
+//NewBpTree panics if order is less than 3; see NewBpTreeE().
 func NewBpTree(order int) BpTree {
-	if order < 3 {
-		lgr.Panic("Cannot make a BpTree with lessthan order=3")
+	bpt, err := NewBpTreeE(order)
+	if err != nil {
+		panic(err)
 	}
-	return mkTree(order)
+	return bpt
 }
 
 //Order returns the order of the *tree
@@ -122,6 +209,49 @@ func (t *tree) String() string {
 	return s
 }
 
+//Clear() resets the *tree to an empty root leaf with zero entries. The
+//order of the *tree is unchanged.
+//
+func (t *tree) Clear() {
+	if t.readOnly {
+		panic("Clear: tree is a read-only Snapshot")
+	}
+	if t.undo != nil {
+		t.undo.recordRoot(t.root, t.numEnts)
+	}
+	t.root = t.newLeaf()
+	t.numEnts = 0
+}
+
+//Clone() returns a structural copy of the *tree. Every interiorNodeS and
+//leafNodeS is copied, but the keys and values are shared with the original.
+//Mutating the clone (Put/Del) does not effect the original or vice versa.
+//
+func (t *tree) Clone() BpTree {
+	return t.CloneWith(nil)
+}
+
+//CloneWith(copyVal) is like Clone() except each value stored in the leaves
+//is passed thru copyVal and the result is stored in the clone. If copyVal is
+//nil the values are shared, exactly as Clone() does.
+//
+func (t *tree) CloneWith(copyVal func(interface{}) interface{}) BpTree {
+	var nt = new(tree)
+	nt.gen = nextGen()
+	nt.root = t.root.clone(nt.gen, copyVal)
+	nt.order = t.order
+	nt.numEnts = t.numEnts
+	nt.keyType = t.keyType
+	nt.log = t.log
+	if t.check != nil {
+		nt.check = newChecker(t.check.level)
+	}
+	nt.counters = new(opCounters)
+	nt.vcodec = t.vcodec
+	nt.keyFactory = t.keyFactory
+	return nt
+}
+
 //NumberOfEntries() returns the number of entries in the B+Tree.
 //
 func (t *tree) NumberOfEntries() int {
@@ -131,7 +261,26 @@ func (t *tree) NumberOfEntries() int {
 //Get(key) returns the value stored for key, and a boolean that indicates
 //if it was found or not.
 //
-func (t *tree) Get(key BptKey) (interface{}, bool) {
+//The AsOf() ReadOption is only supported by trees made with NewMVCCBpTree().
+//
+func (t *tree) Get(key BptKey, opts ...ReadOption) (interface{}, bool) {
+	val, found, err := t.GetE(key, opts...)
+	panicUnlessKeyErr(err)
+	return val, found
+}
+
+//GetE(key) is Get(key) that returns a *KeyTypeError for a bad key, and
+//ErrAsOfUnsupported if given AsOf().
+//
+func (t *tree) GetE(key BptKey, opts ...ReadOption) (interface{}, bool, error) {
+	if readOpts(opts).asOfSet {
+		return nil, false, ErrAsOfUnsupported
+	}
+	if err := t.checkKey(key); err != nil {
+		t.logErr("get", key, err)
+		return nil, false, err
+	}
+
 	path := newPathT()
 
 	//Find a Leaf matching BptKey from the root of *tree
@@ -139,36 +288,150 @@ func (t *tree) Get(key BptKey) (interface{}, bool) {
 
 	for i, k := range leaf.keys {
 		if key.Equals(k) {
-			return leaf.vals[i], true
+			return leaf.vals[i], true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+//Range(lo, hi, fn) calls fn(key, val) for every entry with lo <= key < hi in
+//ascending key order. A nil lo starts at the first entry and a nil hi runs to
+//the last entry. Range stops early if fn returns false.
+//
+//The *tree must not be modified by fn.
+//
+//The AsOf() ReadOption is only supported by trees made with NewMVCCBpTree().
+//
+func (t *tree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) {
+	t.RangeContext(context.Background(), lo, hi, fn, opts...)
+}
+
+//RangeContext(ctx, lo, hi, fn) is Range(lo, hi, fn) that stops, and returns
+//ctx.Err(), once ctx is cancelled. ctx is checked before each leaf is
+//scanned, so fn may be called for the rest of a leaf after ctx is cancelled.
+//It returns nil if the scan was not cancelled.
+//
+func (t *tree) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error {
+	if readOpts(opts).asOfSet {
+		panic("Range: AsOf() requires an MVCC tree")
+	}
+
+	_, err := rangeNode(ctx, t.root, lo, hi, fn)
+	return err
+}
+
+//rangeNode() does the work of RangeContext() for the subtree rooted at node.
+//It returns false once the scan is finished; either hi was reached, fn
+//returned false or ctx was cancelled, in which case ctx.Err() is returned.
+func rangeNode(ctx context.Context, node nodeI, lo, hi BptKey, fn func(BptKey, interface{}) bool) (bool, error) {
+	if node.isLeaf() {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		leaf := node.(*leafNodeS)
+		for i, k := range leaf.keys {
+			if lo != nil && k.LessThan(lo) {
+				continue
+			}
+			if hi != nil && !k.LessThan(hi) {
+				return false, nil
+			}
+			if !fn(k, leaf.vals[i]) {
+				return false, nil
+			}
 		}
+		return true, nil
 	}
 
-	return nil, false
+	curNode := node.(*interiorNodeS)
+	for i, v := range curNode.vals {
+		//every key in or below curNode.vals[i] is less than curNode.keys[i]
+		if lo != nil && i < len(curNode.keys) && !lo.LessThan(curNode.keys[i]) {
+			continue
+		}
+		//every key in or below curNode.vals[i] is >= curNode.keys[i-1]
+		if hi != nil && i > 0 && !curNode.keys[i-1].LessThan(hi) {
+			return false, nil
+		}
+		if more, err := rangeNode(ctx, v, lo, hi, fn); !more {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
 // tree.Put(k, v) returns true iff a new a new (key,value) pair was inserted
 // tree.Put(k, v) returns false iff a value for key was replaced
 func (t *tree) Put(key BptKey, val interface{}) bool {
+	added, err := t.PutE(key, val)
+	panicUnlessKeyErr(err)
+	return added
+}
+
+// tree.PutE(k, v) is Put(k, v) that returns an error instead of panicking;
+// ErrReadOnly for a Snapshot, a *KeyTypeError for a bad key or a
+// *CorruptError.
+func (t *tree) PutE(key BptKey, val interface{}) (added bool, err error) {
+	if t.readOnly {
+		return false, ErrReadOnly
+	}
+	if err := t.checkKey(key); err != nil {
+		t.logErr("put", key, err)
+		return false, err
+	}
+	defer t.recoverCorrupt("put", key, &err)
+	t.checkOp("put", key)
+
 	path := newPathT()
 
-	//Find a Leaf matching BptKey from the root of *tree
-	leaf := t.findLeaf(key, &path)
+	//Find a Leaf matching BptKey from the root of *tree; every node on the
+	//path is owned by this generation of the tree.
+	leaf := t.findLeafMut(key, &path)
 
-	added := leaf.insert(key, val)
+	var inverse undoEntry
+	if t.undo != nil {
+		inverse = putInverse(leaf, key)
+	}
+
+	added = t.putLeaf(leaf, key, val, &path)
 	if added {
 		t.numEnts++
 	}
+	if t.undo != nil {
+		t.undo.record(inverse)
+	}
+	if t.keyType == nil {
+		t.keyType = reflect.TypeOf(key)
+	}
+
+	t.checkTree("put")
+	return added, nil
+}
+
+//putLeaf(leaf, key, val, path) inserts key,val into leaf and splits leaf,
+//and its ancestors on path, as needed. The path must hold every ancestor
+//that could split, and the root iff it could split, as the latched tree
+//relies on. It returns the same as Put().
+func (t *tree) putLeaf(leaf *leafNodeS, key BptKey, val interface{}, path *pathT) bool {
+	added := leaf.insert(key, val)
 
 	if leaf.isToBig() {
 		//Found a full Leaf=n
 		// split Leaf
 		rightLeaf, rightKey := leaf.split()
+		t.debugNode("put", "split leaf", leaf, nodeAttr("right", rightLeaf), slog.String("key", rightKey.String()))
+		t.counters.split()
+		t.checkNodes("put", "split leaf", false, leaf, rightLeaf)
+		t.checkSep("put", "split leaf", leaf, rightKey, rightLeaf)
 
 		//leaf is shrunk to half its size the rest is rightLeaf
 		// this preserves the leafs spot in the parent keys & vals
 
 		if path.isEmpty() {
 			t.root = t.newNode(rightKey, leaf, rightLeaf)
+			t.debugNode("put", "new root", t.root)
+			t.checkNodes("put", "new root", true, t.root)
 		} else {
 			parent := path.pop()
 
@@ -176,10 +439,16 @@ func (t *tree) Put(key BptKey, val interface{}) bool {
 
 			for parent.isToBig() {
 				rightNode, rightKey := parent.split()
+				t.debugNode("put", "split node", parent, nodeAttr("right", rightNode), slog.String("key", rightKey.String()))
+				t.counters.split()
+				t.checkNodes("put", "split node", false, parent, rightNode)
+				t.checkSep("put", "split node", parent, rightKey, rightNode)
 
 				//if len(path) == 0 {
 				if path.isEmpty() {
 					t.root = t.newNode(rightKey, parent, rightNode)
+					t.debugNode("put", "new root", t.root)
+					t.checkNodes("put", "new root", true, t.root)
 					break
 				}
 
@@ -187,7 +456,10 @@ func (t *tree) Put(key BptKey, val interface{}) bool {
 
 				parent.insert(rightKey, rightNode)
 			}
+			t.checkNodes("put", "insert", true, parent)
 		}
+	} else {
+		t.checkNodes("put", "insert", true, leaf)
 	}
 
 	return added
@@ -196,12 +468,49 @@ func (t *tree) Put(key BptKey, val interface{}) bool {
 // tree.Del(key) returns the (value, true) if the key was found.
 // tree.Del(key) returns (nil, false) if the key was not found.
 func (t *tree) Del(key BptKey) (interface{}, bool) {
+	val, found, err := t.DelE(key)
+	panicUnlessKeyErr(err)
+	return val, found
+}
+
+// tree.DelE(key) is Del(key) that returns an error instead of panicking;
+// ErrReadOnly for a Snapshot, a *KeyTypeError for a bad key or a
+// *CorruptError.
+func (t *tree) DelE(key BptKey) (val interface{}, found bool, err error) {
+	if t.readOnly {
+		return nil, false, ErrReadOnly
+	}
+	if err := t.checkKey(key); err != nil {
+		t.logErr("del", key, err)
+		return nil, false, err
+	}
+	defer t.recoverCorrupt("del", key, &err)
+	t.checkOp("del", key)
+
 	path := newPathT()
 
-	//Find a Leaf matching BptKey from the root of *tree
-	//leaf := t.findLeaf(key, &path)
-	leaf := t.findLeaf(key, &path)
+	//Find a Leaf matching BptKey from the root of *tree; every node on the
+	//path is owned by this generation of the tree.
+	leaf := t.findLeafMut(key, &path)
 
+	val, found = t.delLeaf(leaf, key, &path, nil)
+	if found {
+		if t.undo != nil {
+			t.undo.recordDel(key, val)
+		}
+		t.numEnts--
+	}
+
+	t.checkTree("del")
+	return val, found, nil
+}
+
+//delLeaf(leaf, key, path, ls) removes key from leaf and rebalances leaf, and
+//its ancestors on path, as needed. The path must hold every ancestor that
+//could underflow, and the root iff it could collapse, as the latched tree
+//relies on. Any peer node is latched in ls before it is looked at, unless
+//ls is nil. It returns the same as Del().
+func (t *tree) delLeaf(leaf *leafNodeS, key BptKey, path *pathT, ls *latchSet) (interface{}, bool) {
 	var val interface{}
 	var found bool
 	for i, k := range leaf.keys {
@@ -212,13 +521,13 @@ func (t *tree) Del(key BptKey) (interface{}, bool) {
 			leaf.keys = append(leaf.keys[:i], leaf.keys[i+1:]...)
 			leaf.vals = append(leaf.vals[:i], leaf.vals[i+1:]...)
 
-			t.numEnts--
-
 			break
 		}
 	}
 
-	if t.isRoot(leaf) {
+	//leaf is the root, or (for the latched tree) can not underflow
+	if path.isEmpty() {
+		t.checkNodes("del", "delete", true, leaf)
 		return val, found
 	}
 
@@ -226,17 +535,24 @@ func (t *tree) Del(key BptKey) (interface{}, bool) {
 
 	if leaf.size() >= leaf.halfFullSize() {
 		//fine nothing more to do
+		t.checkNodes("del", "delete", false, leaf)
 		return val, found
 	}
 	// ELSE leaf.size() < leaf.halfFullSize()
 
 	leftLeaf, leftKey := leaf.findPeerLeft(parent)
 	if leftLeaf != nil {
+		ls.lock(leftLeaf)
 
 		if leftLeaf.size() > leftLeaf.halfFullSize() {
-			leaf.stealLeft(leftLeaf)
-
-			parent.swapKeys(leftKey, leaf.findLeftMostKey())
+			leftLeaf = t.ownChild(parent, leftLeaf)
+			newKey := leaf.stealLeft(leftLeaf, leftKey)
+			t.debugNode("del", "steal left", leaf, nodeAttr("peer", leftLeaf))
+			t.counters.steal()
+			t.checkNodes("del", "steal left", false, leftLeaf, leaf)
+			t.checkSep("del", "steal left", leftLeaf, newKey, leaf)
+
+			parent.swapKeys(leftKey, newKey)
 			return val, found
 		}
 
@@ -245,11 +561,17 @@ func (t *tree) Del(key BptKey) (interface{}, bool) {
 	rightLeaf, rightKey := leaf.findPeerRight(parent)
 
 	if rightLeaf != nil {
+		ls.lock(rightLeaf)
 
 		if rightLeaf.size() > rightLeaf.halfFullSize() {
-			leaf.stealRight(rightLeaf)
+			rightLeaf = t.ownChild(parent, rightLeaf)
+			newKey := leaf.stealRight(rightLeaf, rightKey)
+			t.debugNode("del", "steal right", leaf, nodeAttr("peer", rightLeaf))
+			t.counters.steal()
+			t.checkNodes("del", "steal right", false, leaf, rightLeaf)
+			t.checkSep("del", "steal right", leaf, newKey, rightLeaf)
 
-			parent.swapKeys(rightKey, rightLeaf.findLeftMostKey())
+			parent.swapKeys(rightKey, newKey)
 
 			return val, found
 		}
@@ -264,28 +586,28 @@ func (t *tree) Del(key BptKey) (interface{}, bool) {
 	var mergedLeaf nodeI
 	var deadLeaf nodeI
 	if leftLeaf == nil && rightLeaf == nil {
-		lgr.Panic("leftLeaf == nil && rightLeaf == nil; should not be able to happend outside order==2 which we don't support.")
+		corrupt("leftLeaf == nil && rightLeaf == nil; should not be able to happend outside order==2 which we don't support.")
 	}
 	//else either or both leftLeaf&rightLeaf != nil
 	if leftLeaf != nil {
-		leftLeaf.mergeRight(leaf)
+		leftLeaf = t.ownChild(parent, leftLeaf)
+		leftLeaf.mergeRight(leaf, leftKey)
 		mergedLeaf = leftLeaf
 		deadLeaf = leaf
 	} else if rightLeaf != nil {
-		leaf.mergeRight(rightLeaf)
+		leaf.mergeRight(rightLeaf, rightKey)
 		mergedLeaf = leaf
 		deadLeaf = rightLeaf
 	}
 
-	t.delUp(parent, mergedLeaf, deadLeaf, path)
+	t.debugNode("del", "merge leaves", mergedLeaf, nodeAttr("dead", deadLeaf))
+	t.counters.merge()
+	t.checkNodes("del", "merge leaves", false, mergedLeaf)
+	t.delUp(parent, mergedLeaf, deadLeaf, path, ls)
 
 	return val, found
 }
 
-func (t *tree) Graph() string {
-	return ""
-}
-
 func (t *tree) isRoot(node nodeI) bool {
 	return t.root.equals(node)
 }
@@ -316,7 +638,7 @@ func (t *tree) findLeaf(key BptKey, path *pathT) *leafNodeS {
 	return leafNode
 }
 
-func (t *tree) delUp(parent *interiorNodeS, mergedNode, deadNode nodeI, path pathT) {
+func (t *tree) delUp(parent *interiorNodeS, mergedNode, deadNode nodeI, path *pathT, ls *latchSet) {
 	//ALL merges are rNode.mergeRight(lNode)
 
 	//mergedNode is an unchanged except it appended the keys&vals of deadNode
@@ -337,12 +659,17 @@ func (t *tree) delUp(parent *interiorNodeS, mergedNode, deadNode nodeI, path pat
 		}
 	}
 
-	//Did I just shrink the Root?
-	if t.isRoot(parent) {
+	//Did I just shrink the Root? (or, for the latched tree, a node that
+	//can not underflow; it has more than one key left)
+	if path.isEmpty() {
 
 		//And is it small enough to kill in the bath tub?
 		if len(parent.keys) == 0 {
 			t.root = parent.vals[0]
+			t.debugNode("del", "collapse root", t.root, nodeAttr("dead", parent))
+			t.checkNodes("del", "collapse root", true, t.root)
+		} else {
+			t.checkNodes("del", "delete", true, parent)
 		}
 
 		return
@@ -352,6 +679,7 @@ func (t *tree) delUp(parent *interiorNodeS, mergedNode, deadNode nodeI, path pat
 
 	if parent.size() >= parent.halfFullSize() {
 		//nothing to do
+		t.checkNodes("del", "delete", false, parent)
 
 		return
 	}
@@ -362,12 +690,18 @@ func (t *tree) delUp(parent *interiorNodeS, mergedNode, deadNode nodeI, path pat
 	leftNode, leftKey := parent.findPeerLeft(grandParent)
 
 	if leftNode != nil {
+		ls.lock(leftNode)
 
 		if leftNode.size() > leftNode.halfFullSize() {
 			//parent.nodeStealLeft(leftNode, leftKey, grandParent)
-			parent.stealLeft(leftNode)
+			leftNode = t.ownChild(grandParent, leftNode)
+			newKey := parent.stealLeft(leftNode, leftKey)
+			t.debugNode("del", "steal left", parent, nodeAttr("peer", leftNode))
+			t.counters.steal()
+			t.checkNodes("del", "steal left", false, leftNode, parent)
+			t.checkSep("del", "steal left", leftNode, newKey, parent)
 
-			grandParent.swapKeys(leftKey, parent.findLeftMostKey())
+			grandParent.swapKeys(leftKey, newKey)
 
 			return
 		}
@@ -378,11 +712,17 @@ func (t *tree) delUp(parent *interiorNodeS, mergedNode, deadNode nodeI, path pat
 	rightNode, rightKey := parent.findPeerRight(grandParent)
 
 	if rightNode != nil {
+		ls.lock(rightNode)
 
 		if rightNode.size() > rightNode.halfFullSize() {
-			parent.stealRight(rightNode)
+			rightNode = t.ownChild(grandParent, rightNode)
+			newKey := parent.stealRight(rightNode, rightKey)
+			t.debugNode("del", "steal right", parent, nodeAttr("peer", rightNode))
+			t.counters.steal()
+			t.checkNodes("del", "steal right", false, parent, rightNode)
+			t.checkSep("del", "steal right", parent, newKey, rightNode)
 
-			grandParent.swapKeys(rightKey, rightNode.findLeftMostKey())
+			grandParent.swapKeys(rightKey, newKey)
 
 			return
 		}
@@ -393,20 +733,25 @@ func (t *tree) delUp(parent *interiorNodeS, mergedNode, deadNode nodeI, path pat
 	var mNode nodeI
 	var dNode nodeI
 	if leftNode == nil && rightNode == nil {
-		lgr.Panic("leftNode == nil && rightNode == nil; should not be able to happend outside order==2 which we don't support.")
+		corrupt("leftNode == nil && rightNode == nil; should not be able to happend outside order==2 which we don't support.")
 	}
 	if leftNode != nil {
-		leftNode.mergeRight(parent)
+		leftNode = t.ownChild(grandParent, leftNode)
+		leftNode.mergeRight(parent, leftKey)
 		mNode = leftNode
 		dNode = parent
 	} else if rightNode != nil {
-		parent.mergeRight(rightNode)
+		parent.mergeRight(rightNode, rightKey)
 		mNode = parent
 		dNode = rightNode
 	}
 
+	t.debugNode("del", "merge nodes", mNode, nodeAttr("dead", dNode))
+	t.counters.merge()
+	t.checkNodes("del", "merge nodes", false, mNode)
+
 	//recursing into grandParent
-	t.delUp(grandParent, mNode, dNode, path)
+	t.delUp(grandParent, mNode, dNode, path, ls)
 
 	return
 } //end: func (t *tree) delUp(...)
@@ -1,6 +1,8 @@
 package bptree
 
 import (
+	"context"
+	"fmt"
 	"github.com/lleo/util"
 	"math"
 	"math/rand"
@@ -547,6 +549,222 @@ func TestBuildUpTreeThenDelAllEntriesOrder32(t *testing.T) {
 	}
 }
 
+func TestClear(t *testing.T) {
+	bpt := NewBpTree(4)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	bpt.Clear()
+
+	if bpt.NumberOfEntries() != 0 {
+		t.Logf("bpt.NumberOfEntries(),%d != 0", bpt.NumberOfEntries())
+		t.Fail()
+	}
+	if _, found := bpt.Get(largeNumEnts[0].key); found {
+		t.Logf("found ent.key=%q after Clear()", largeNumEnts[0].key)
+		t.Fail()
+	}
+	if !_validTree(t, bpt) {
+		t.Logf("!_validTree(t, bpt)")
+		t.Fail()
+	}
+
+	//the tree must be usable after Clear()
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	if bpt.NumberOfEntries() != len(largeNumEnts) {
+		t.Logf("bpt.NumberOfEntries(),%d != len(largeNumEnts),%d", bpt.NumberOfEntries(), len(largeNumEnts))
+		t.Fail()
+	}
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	bpt := NewBpTree(3)
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	cpy := bpt.CloneWith(func(v interface{}) interface{} {
+		return v.(int) * 10
+	})
+	if !_validTree(t, cpy) {
+		t.Logf("!_validTree(t, cpy)")
+		t.Fail()
+	}
+
+	//delete everything from the original; the clone must be untouched
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Del(ent.key)
+	}
+
+	if cpy.NumberOfEntries() != len(largeNumEnts) {
+		t.Logf("cpy.NumberOfEntries(),%d != len(largeNumEnts),%d", cpy.NumberOfEntries(), len(largeNumEnts))
+		t.Fail()
+	}
+	for _, ent := range largeNumEnts {
+		val, found := cpy.Get(ent.key)
+		if !found {
+			t.Logf("did NOT find entry for ent.key=%q in clone", ent.key)
+			t.FailNow()
+		}
+		if val.(int) != ent.val*10 {
+			t.Logf("clone val,%d != ent.val*10,%d", val.(int), ent.val*10)
+			t.Fail()
+		}
+	}
+}
+
+func _leaf(order int, keys ...int) *leafNodeS {
+	leaf := mkLeaf(order)
+	for _, k := range keys {
+		leaf.insert(intKey(k), k)
+	}
+	return leaf
+}
+
+func _keys(keys []BptKey) []int {
+	ks := make([]int, len(keys))
+	for i, k := range keys {
+		ks[i] = int(k.(intKey))
+	}
+	return ks
+}
+
+//TestStealAndMergeSeparators checks that the steals and merges of interior
+//nodes move the separator they are given down from the parent, and return
+//the one that replaces it, rather than look for the least key of a subtree;
+//a separator need only be greater than the keys to its left and no greater
+//than those to its right. Here sep=30 while the least key to its right is
+//40, as after Del(30).
+func TestStealAndMergeSeparators(t *testing.T) {
+	const order = 4
+	sep := intKey(30)
+	nodes := func() (*interiorNodeS, *interiorNodeS) {
+		l, r := mkNode(order), mkNode(order)
+		l.keys = append(l.keys, intKey(20))
+		l.vals = append(l.vals, _leaf(order, 10), _leaf(order, 20, 25))
+		r.keys = append(r.keys, intKey(50))
+		r.vals = append(r.vals, _leaf(order, 40), _leaf(order, 50))
+		return l, r
+	}
+
+	l, r := nodes()
+	moved := l.vals[1]
+	if newSep := r.stealLeft(l, sep); newSep != intKey(20) {
+		t.Errorf("stealLeft() returned %v; expected 20", newSep)
+	}
+	if fmt.Sprint(_keys(l.keys), _keys(r.keys)) != "[] [30 50]" || r.vals[0] != moved {
+		t.Errorf("stealLeft() left keys %v and %v; expected [] and [30 50]", _keys(l.keys), _keys(r.keys))
+	}
+
+	l, r = nodes()
+	moved = r.vals[0]
+	if newSep := l.stealRight(r, sep); newSep != intKey(50) {
+		t.Errorf("stealRight() returned %v; expected 50", newSep)
+	}
+	if fmt.Sprint(_keys(l.keys), _keys(r.keys)) != "[20 30] []" || l.vals[2] != moved {
+		t.Errorf("stealRight() left keys %v and %v; expected [20 30] and []", _keys(l.keys), _keys(r.keys))
+	}
+
+	l, r = nodes()
+	l.mergeRight(r, sep)
+	if fmt.Sprint(_keys(l.keys)) != "[20 30 50]" || len(l.vals) != 4 {
+		t.Errorf("mergeRight() left keys %v and %d children; expected [20 30 50] and 4", _keys(l.keys), len(l.vals))
+	}
+
+	//a leaf holds its own first key, so the new separator is that key
+	ll, rl := _leaf(order, 10, 20), _leaf(order, 40)
+	if newSep := rl.stealLeft(ll, sep); newSep != intKey(20) || rl.keys[0] != intKey(20) {
+		t.Errorf("leaf stealLeft() returned %v; expected 20", newSep)
+	}
+	ll, rl = _leaf(order, 10), _leaf(order, 40, 50)
+	if newSep := ll.stealRight(rl, sep); newSep != intKey(50) || rl.keys[0] != intKey(50) {
+		t.Errorf("leaf stealRight() returned %v; expected 50", newSep)
+	}
+}
+
+//Every BpTree is Encodable; only those that support them are Transactional
+//or Undoable, rather than panicking.
+func TestOptionalInterfaces(t *testing.T) {
+	trees := []struct {
+		name      string
+		bpt       BpTree
+		txn, undo bool
+	}{
+		{"plain", NewBpTree(3), true, true},
+		{"mvcc", NewMVCCBpTree(3), true, true},
+		{"concurrent", NewConcurrentBpTree(3), true, true},
+		{"latched", NewLatchedBpTree(3), true, true},
+		{"optimistic", NewOptimisticBpTree(3), true, true},
+		{"blink", NewBLinkBpTree(3), false, true},
+		{"sharded", NewShardedBpTree(3, shardSplits(3)), false, false},
+	}
+	for _, c := range trees {
+		if _, ok := c.bpt.(Encodable); !ok {
+			t.Errorf("%s: not Encodable", c.name)
+		}
+		if _, ok := c.bpt.(Transactional); ok != c.txn {
+			t.Errorf("%s: Transactional is %v; expected %v", c.name, ok, c.txn)
+		}
+		if _, ok := c.bpt.(Undoable); ok != c.undo {
+			t.Errorf("%s: Undoable is %v; expected %v", c.name, ok, c.undo)
+		}
+	}
+}
+
+func TestRangeContextCancel(t *testing.T) {
+	trees := map[string]BpTree{
+		"plain":      NewBpTree(3),
+		"mvcc":       NewMVCCBpTree(3),
+		"concurrent": NewConcurrentBpTree(3),
+		"latched":    NewLatchedBpTree(3),
+		"blink":      NewBLinkBpTree(3),
+		"optimistic": NewOptimisticBpTree(3),
+		"sharded":    NewShardedBpTree(3, []BptKey{largeNumEnts[len(largeNumEnts)/2].key}),
+	}
+	for name, bpt := range trees {
+		for _, ent := range largeNumEnts {
+			bpt.Put(ent.key, ent.val)
+		}
+
+		var n int
+		err := bpt.RangeContext(context.Background(), nil, nil, func(k BptKey, v interface{}) bool {
+			n++
+			return true
+		})
+		if err != nil || n != len(largeNumEnts) {
+			t.Fatalf("%s: RangeContext() = %v after %d entries; expected nil after %d", name, err, n, len(largeNumEnts))
+		}
+
+		//ctx is checked at leaf boundaries, so at most the rest of the
+		//first leaf is scanned after cancel()
+		ctx, cancel := context.WithCancel(context.Background())
+		n = 0
+		err = bpt.RangeContext(ctx, nil, nil, func(k BptKey, v interface{}) bool {
+			n++
+			cancel()
+			return true
+		})
+		if err != context.Canceled {
+			t.Fatalf("%s: RangeContext() = %v; expected context.Canceled", name, err)
+		}
+		if n == 0 || n >= bpt.Order() {
+			t.Fatalf("%s: RangeContext() called fn %d times after cancel(); expected 1 to %d", name, n, bpt.Order()-1)
+		}
+
+		n = 0
+		err = bpt.RangeContext(ctx, nil, nil, func(k BptKey, v interface{}) bool {
+			n++
+			return true
+		})
+		if err != context.Canceled || n != 0 {
+			t.Fatalf("%s: RangeContext(cancelled ctx) = %v after %d entries; expected context.Canceled after 0", name, err, n)
+		}
+	}
+}
+
 func _validTree(test *testing.T, t_ BpTree) bool {
 	t, ok := t_.(*tree)
 	if !ok {
@@ -617,7 +835,7 @@ func _validRootNode(t *testing.T, n nodeI, order int) bool {
 func _validInteriorNode(t *testing.T, node_ nodeI, order int) bool {
 	node, ok := node_.(*interiorNodeS)
 	if !ok {
-		lgr.Printf("The nodeI passed in is not castable to *interiorNodeS")
+		t.Logf("The nodeI passed in is not castable to *interiorNodeS")
 		return false
 	}
 
@@ -640,7 +858,7 @@ func _validInteriorNode(t *testing.T, node_ nodeI, order int) bool {
 func _validLeafNode(t *testing.T, node_ nodeI, order int) bool {
 	node, ok := node_.(*leafNodeS)
 	if !ok {
-		lgr.Printf("The nodeI passed in is not castable to *leafNodeS")
+		t.Logf("The nodeI passed in is not castable to *leafNodeS")
 		return false
 	}
 
@@ -0,0 +1,353 @@
+package bptree
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+//EvictionPolicy chooses which unpinned page the buffer pool of a
+//DiskBpTree writes back and drops when it is full; see DiskEviction().
+type EvictionPolicy int
+
+const (
+	//EvictLRU evicts the least recently used page.
+	EvictLRU EvictionPolicy = iota
+	//EvictCLOCK sweeps a clock hand over the pages, evicting the first one
+	//not used since the hand last passed it. It approximates LRU without
+	//reordering a list on every hit.
+	EvictCLOCK
+)
+
+func (ep EvictionPolicy) String() string {
+	switch ep {
+	case EvictLRU:
+		return "LRU"
+	case EvictCLOCK:
+		return "CLOCK"
+	}
+	return fmt.Sprintf("EvictionPolicy(%d)", int(ep))
+}
+
+//frame is a page held by the buffer pool. The page bytes are never modified
+//in place; write() replaces them. So a node decoded from a page may keep
+//referring to its bytes after the frame is unpinned, or evicted.
+type frame struct {
+	id    pageID
+	page  []byte
+	pins  int
+	dirty bool //page differs from the file
+
+	lsn     int64 //of the last log record holding page; 0 if none
+	pending bool  //written since the last commit(); pinned until then
+
+	//the page, and whether it was dirty, before it became pending; prior
+	//is nil if the page was not in the pool. See rollback().
+	prior      []byte
+	priorDirty bool
+
+	ref  bool          //CLOCK reference bit
+	slot int           //index in clock
+	elem *list.Element //in lru
+}
+
+//bufferPool is a bounded cache of the pages of a file. Pages are pinned
+//while in use, and a pinned page is never evicted. Written pages are only
+//marked dirty; they are written back to the file when evicted or flushed.
+//
+//If every page is pinned, the pool grows past its capacity rather than
+//fail, and shrinks back as pages are unpinned and evicted.
+type bufferPool struct {
+	mu       sync.Mutex
+	f        pageFile
+	pageSize int
+	capacity int //in pages
+	policy   EvictionPolicy
+	frames   map[pageID]*frame
+	lru      *list.List //of *frame; the front is the most recently used
+	clock    []*frame   //nil slots are free
+	hand     int
+
+	//With a write-ahead log, the pages written between commit()s are
+	//pending, and no page is written back before walSync(lsn) makes the
+	//record holding it durable; see wal.go.
+	logging bool
+	pending []*frame
+	walSync func(lsn int64) error
+
+	//verify(id, page), if set, checks each page read from the file; a page
+	//that fails is not cached
+	verify func(id pageID, page []byte) error
+
+	hits, misses, evictions, writeBacks uint64
+}
+
+//minPoolPages is the fewest pages a bufferPool holds, whatever its capacity
+//in bytes; enough for the nodes a split or merge touches at once.
+const minPoolPages = 8
+
+func newBufferPool(f pageFile, pageSize, capacityBytes int, policy EvictionPolicy) *bufferPool {
+	var bp = new(bufferPool)
+	bp.f = f
+	bp.pageSize = pageSize
+	bp.capacity = capacityBytes / pageSize
+	if bp.capacity < minPoolPages {
+		bp.capacity = minPoolPages
+	}
+	bp.policy = policy
+	bp.frames = make(map[pageID]*frame, bp.capacity)
+	bp.lru = list.New()
+	return bp
+}
+
+//pin(id) returns page id, reading it from the file if it is not in the
+//pool, and pins it until unpin(id).
+func (bp *bufferPool) pin(id pageID) ([]byte, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if fr, ok := bp.frames[id]; ok {
+		bp.hits++
+		bp.touch(fr)
+		fr.pins++
+		return fr.page, nil
+	}
+
+	bp.misses++
+	if err := bp.makeRoom(); err != nil {
+		return nil, err
+	}
+	page := make([]byte, bp.pageSize)
+	if _, err := bp.f.ReadAt(page, int64(id)*int64(bp.pageSize)); err != nil {
+		return nil, err
+	}
+	if bp.verify != nil {
+		if err := bp.verify(id, page); err != nil {
+			return nil, err
+		}
+	}
+	fr := bp.insert(id, page)
+	fr.pins++
+	return page, nil
+}
+
+func (bp *bufferPool) unpin(id pageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	fr, ok := bp.frames[id]
+	if !ok || fr.pins == 0 {
+		panic(fmt.Sprintf("unpin: page %d is not pinned", id))
+	}
+	fr.pins--
+}
+
+//write(id, page) replaces the contents of page id with page, which must
+//not be modified afterwards, and marks it dirty. With logging, it is also
+//pending, and so pinned, until commit() or rollback().
+func (bp *bufferPool) write(id pageID, page []byte) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	fr, ok := bp.frames[id]
+	if !ok {
+		if err := bp.makeRoom(); err != nil {
+			return err
+		}
+		fr = bp.insert(id, nil)
+	}
+	bp.touch(fr)
+	if bp.logging && !fr.pending {
+		fr.pending = true
+		fr.pins++
+		fr.prior, fr.priorDirty = fr.page, fr.dirty
+		bp.pending = append(bp.pending, fr)
+	}
+	fr.page = page
+	fr.dirty = true
+	return nil
+}
+
+//commit(log) passes the pending pages to log, which returns the LSN of the
+//record holding them, and unpins them. If log fails, they stay pending.
+func (bp *bufferPool) commit(log func(ids []pageID, pages [][]byte) (int64, error)) (int64, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if len(bp.pending) == 0 {
+		return 0, nil
+	}
+	ids := make([]pageID, len(bp.pending))
+	pages := make([][]byte, len(bp.pending))
+	for i, fr := range bp.pending {
+		ids[i], pages[i] = fr.id, fr.page
+	}
+	lsn, err := log(ids, pages)
+	if err != nil {
+		return 0, err
+	}
+	for _, fr := range bp.pending {
+		fr.lsn = lsn
+		fr.pending = false
+		fr.prior = nil
+		fr.pins--
+	}
+	bp.pending = bp.pending[:0]
+	return lsn, nil
+}
+
+//rollback() puts back the pages written since the last commit() as they
+//were before, and unpins them; a page that was not in the pool is dropped
+//from it, so it is read from the file again. The pages of a failed
+//operation are never logged.
+func (bp *bufferPool) rollback() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for _, fr := range bp.pending {
+		fr.pending = false
+		fr.pins--
+		if fr.prior == nil {
+			bp.remove(fr)
+			continue
+		}
+		fr.page, fr.dirty = fr.prior, fr.priorDirty
+		fr.prior = nil
+	}
+	bp.pending = bp.pending[:0]
+}
+
+//flush() writes every dirty page back to the file.
+func (bp *bufferPool) flush() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for _, fr := range bp.frames {
+		if err := bp.writeBack(fr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bp *bufferPool) writeBack(fr *frame) error {
+	if !fr.dirty {
+		return nil
+	}
+	if fr.lsn > 0 && bp.walSync != nil {
+		if err := bp.walSync(fr.lsn); err != nil {
+			return err
+		}
+	}
+	if _, err := bp.f.WriteAt(fr.page, int64(fr.id)*int64(bp.pageSize)); err != nil {
+		return err
+	}
+	fr.dirty = false
+	bp.writeBacks++
+	return nil
+}
+
+//touch(fr) records a use of fr for the eviction policy.
+func (bp *bufferPool) touch(fr *frame) {
+	switch bp.policy {
+	case EvictCLOCK:
+		fr.ref = true
+	default:
+		bp.lru.MoveToFront(fr.elem)
+	}
+}
+
+func (bp *bufferPool) insert(id pageID, page []byte) *frame {
+	var fr = &frame{id: id, page: page, ref: true}
+	bp.frames[id] = fr
+	switch bp.policy {
+	case EvictCLOCK:
+		fr.slot = -1
+		for i, slot := range bp.clock {
+			if slot == nil {
+				fr.slot = i
+				bp.clock[i] = fr
+				break
+			}
+		}
+		if fr.slot < 0 {
+			fr.slot = len(bp.clock)
+			bp.clock = append(bp.clock, fr)
+		}
+	default:
+		fr.elem = bp.lru.PushFront(fr)
+	}
+	return fr
+}
+
+//makeRoom() evicts pages until there is room for one more, or every page
+//left is pinned.
+func (bp *bufferPool) makeRoom() error {
+	for len(bp.frames) >= bp.capacity {
+		fr := bp.victim()
+		if fr == nil {
+			return nil
+		}
+		if err := bp.writeBack(fr); err != nil {
+			return err
+		}
+		bp.remove(fr)
+		bp.evictions++
+	}
+	return nil
+}
+
+func (bp *bufferPool) remove(fr *frame) {
+	delete(bp.frames, fr.id)
+	switch bp.policy {
+	case EvictCLOCK:
+		bp.clock[fr.slot] = nil
+	default:
+		bp.lru.Remove(fr.elem)
+	}
+}
+
+//victim() returns the unpinned page to evict, or nil if there is none.
+func (bp *bufferPool) victim() *frame {
+	if bp.policy != EvictCLOCK {
+		for e := bp.lru.Back(); e != nil; e = e.Prev() {
+			if fr := e.Value.(*frame); fr.pins == 0 {
+				return fr
+			}
+		}
+		return nil
+	}
+
+	//two full sweeps clear every reference bit on the way
+	for i := 0; i < 2*len(bp.clock); i++ {
+		fr := bp.clock[bp.hand]
+		bp.hand = (bp.hand + 1) % len(bp.clock)
+		switch {
+		case fr == nil || fr.pins > 0:
+		case fr.ref:
+			fr.ref = false
+		default:
+			return fr
+		}
+	}
+	return nil
+}
+
+//stats(ds) fills in the part of *ds kept by the bufferPool.
+func (bp *bufferPool) stats(ds *DiskStats) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	ds.CachedPages = len(bp.frames)
+	for _, fr := range bp.frames {
+		if fr.dirty {
+			ds.DirtyPages++
+		}
+		if fr.pins > 0 {
+			ds.PinnedPages++
+		}
+	}
+	ds.Hits = bp.hits
+	ds.Misses = bp.misses
+	ds.Evictions = bp.evictions
+	ds.WriteBacks = bp.writeBacks
+}
+
+func (bp *bufferPool) resetStats() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.hits, bp.misses, bp.evictions, bp.writeBacks = 0, 0, 0, 0
+}
@@ -0,0 +1,111 @@
+package bptree
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskBufferPool(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictCLOCK} {
+		path := filepath.Join(t.TempDir(), "tree")
+		opts := []DiskOption{DiskOrder(5), DiskPageSize(minPageSize), DiskCacheSize(10 * minPageSize), DiskEviction(policy)}
+		dt, err := OpenDiskBpTree(path, opts...)
+		if err != nil {
+			t.Fatalf("%v: OpenDiskBpTree() = %v", policy, err)
+		}
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			if _, err := dt.PutE(ent.key, ent.val); err != nil {
+				t.Fatalf("%v: Put(%q) = %v", policy, ent.key, err)
+			}
+		}
+		_diskCheck(t, dt)
+		ds := dt.Stats()
+		if ds.CachedPages > 10 || ds.PinnedPages != 0 || ds.Evictions == 0 || ds.WriteBacks == 0 {
+			t.Fatalf("%v: Stats() = %+v; expected at most 10 unpinned pages cached and some evicted", policy, ds)
+		}
+		if err := dt.Close(); err != nil {
+			t.Fatalf("%v: Close() = %v", policy, err)
+		}
+
+		if dt, err = OpenDiskBpTree(path, opts...); err != nil {
+			t.Fatalf("%v: reopening: %v", policy, err)
+		}
+		for _, ent := range largeNumEnts {
+			if val, found, err := dt.GetE(ent.key); err != nil || !found || val != ent.val {
+				t.Fatalf("%v: Get(%q) = %v, %v, %v after reopening", policy, ent.key, val, found, err)
+			}
+		}
+		dt.Get(largeNumEnts[0].key)
+		dt.ResetStats()
+		dt.Get(largeNumEnts[0].key)
+		dt.Get(largeNumEnts[0].key)
+		//CLOCK may evict a page of the path it just read
+		if ds := dt.Stats(); ds.Hits+ds.Misses != uint64(2*ds.Height) || ds.Hits < uint64(ds.Height) || policy == EvictLRU && ds.Misses != 0 {
+			t.Fatalf("%v: two Get()s of a cached path made %d hits and %d misses; height=%d", policy, ds.Hits, ds.Misses, ds.Height)
+		}
+		dt.Close()
+	}
+}
+
+func TestBufferPoolPins(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	const pageSize = 16
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictCLOCK} {
+		bp := newBufferPool(f, pageSize, 0, policy)
+		for id := pageID(1); id <= 2*minPoolPages; id++ {
+			if err := bp.write(id, bytes.Repeat([]byte{byte(id)}, pageSize)); err != nil {
+				t.Fatalf("%v: write(%d) = %v", policy, id, err)
+			}
+		}
+		if len(bp.frames) != minPoolPages || bp.writeBacks != minPoolPages {
+			t.Fatalf("%v: %d pages cached and %d written back; expected %d of each", policy, len(bp.frames), bp.writeBacks, minPoolPages)
+		}
+
+		//pinned pages are never evicted; the pool grows instead
+		for id := pageID(1); id <= minPoolPages+2; id++ {
+			page, err := bp.pin(id)
+			if err != nil || page[0] != byte(id) {
+				t.Fatalf("%v: pin(%d) = %v, %v", policy, id, page[0], err)
+			}
+		}
+		if len(bp.frames) != minPoolPages+2 {
+			t.Fatalf("%v: %d pages cached with %d pinned", policy, len(bp.frames), minPoolPages+2)
+		}
+		for id := pageID(1); id <= minPoolPages+2; id++ {
+			bp.unpin(id)
+		}
+		if _, err := bp.pin(2 * minPoolPages); err != nil {
+			t.Fatal(err)
+		}
+		if len(bp.frames) != minPoolPages {
+			t.Fatalf("%v: %d pages cached once unpinned; expected %d", policy, len(bp.frames), minPoolPages)
+		}
+		bp.unpin(2 * minPoolPages)
+		if err := bp.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//LRU evicts the least recently used page
+	bp := newBufferPool(f, pageSize, 0, EvictLRU)
+	for id := pageID(1); id <= minPoolPages; id++ {
+		bp.pin(id)
+		bp.unpin(id)
+	}
+	bp.pin(1)
+	bp.unpin(1)
+	bp.pin(minPoolPages + 1)
+	if _, ok := bp.frames[1]; !ok {
+		t.Fatal("LRU evicted the most recently used page")
+	}
+	if _, ok := bp.frames[2]; ok {
+		t.Fatal("LRU did not evict the least recently used page")
+	}
+}
@@ -0,0 +1,93 @@
+package bptree
+
+import (
+	"reflect"
+)
+
+//t.bulkLoad(keys, vals) replaces the contents of the *tree with the entries
+//keys[i],vals[i]; the keys must be in strictly ascending order. Rather than
+//Put() each entry, it builds the tree bottom up, spreading the entries as
+//evenly as possible over as few leaves as will hold them, and those leaves
+//over as few interior nodes, and so on up to the root. A B-link tree gets
+//its right-links and high keys.
+func (t *tree) bulkLoad(keys []BptKey, vals []interface{}) {
+	if t.undo != nil {
+		t.undo.recordRoot(t.root, t.numEnts)
+	}
+	t.numEnts = len(keys)
+	if len(keys) == 0 {
+		t.root = t.newLeaf()
+		return
+	}
+	t.keyType = reflect.TypeOf(keys[0])
+
+	//lows[i] is the lowest key in or below level[i]
+	var level []nodeI
+	var lows []BptKey
+	bounds := spread(len(keys), t.order-1)
+	for i := 1; i < len(bounds); i++ {
+		lo, hi := bounds[i-1], bounds[i]
+		leaf := t.newLeaf()
+		leaf.keys = append(leaf.keys, keys[lo:hi]...)
+		leaf.vals = append(leaf.vals, vals[lo:hi]...)
+		level = append(level, leaf)
+		lows = append(lows, keys[lo])
+	}
+	t.linkLevel(level, lows)
+
+	for len(level) > 1 {
+		var up []nodeI
+		var upLows []BptKey
+		bounds := spread(len(level), t.order)
+		for i := 1; i < len(bounds); i++ {
+			lo, hi := bounds[i-1], bounds[i]
+			node := mkNode(t.order)
+			node.gen = t.gen
+			node.sync = t.newSync()
+			node.keys = append(node.keys, lows[lo+1:hi]...)
+			node.vals = append(node.vals, level[lo:hi]...)
+			up = append(up, node)
+			upLows = append(upLows, lows[lo])
+		}
+		t.linkLevel(up, upLows)
+		level, lows = up, upLows
+	}
+	t.root = level[0]
+}
+
+//t.linkLevel(level, lows) sets the right-links and high keys of the nodes of
+//one level of a B-link tree; it does nothing for any other tree.
+func (t *tree) linkLevel(level []nodeI, lows []BptKey) {
+	if !t.blink {
+		return
+	}
+	for i := 0; i+1 < len(level); i++ {
+		var s *nodeSync
+		switch n := level[i].(type) {
+		case *leafNodeS:
+			s = n.sync
+		case *interiorNodeS:
+			s = n.sync
+		}
+		s.next, s.highKey = level[i+1], lows[i+1]
+	}
+}
+
+//spread(n, max) divides n items into as few groups of at most max items as
+//possible, whose sizes differ by at most one. It returns the boundaries of
+//the groups; group i is [bounds[i], bounds[i+1]).
+//
+//Any group of a split into more than one holds more than max/2 items, which
+//is what makes the leaves and interior nodes of bulkLoad() at least half
+//full.
+func spread(n, max int) []int {
+	groups := (n + max - 1) / max
+	bounds := make([]int, groups+1)
+	for i := 1; i <= groups; i++ {
+		bounds[i] = bounds[i-1] + n/groups
+		if i <= n%groups {
+			bounds[i]++
+		}
+	}
+	return bounds
+}
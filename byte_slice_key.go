@@ -5,7 +5,6 @@ type ByteSliceKey []byte
 func (k0 ByteSliceKey) Equals(K1 BptKey) bool {
 	k1, ok := K1.(ByteSliceKey)
 	if !ok {
-		lgr.Printf("incompatable BptKey = %v\n", K1)
 		return false
 	}
 	if len(k0) != len(k1) {
@@ -22,7 +21,6 @@ func (k0 ByteSliceKey) Equals(K1 BptKey) bool {
 func (k0 ByteSliceKey) LessThan(K1 BptKey) bool {
 	k1, ok := K1.(ByteSliceKey)
 	if !ok {
-		lgr.Printf("incompatable BptKey = %v\n", K1)
 		return false
 	}
 	if len(k0) < len(k1) {
@@ -0,0 +1,244 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+//ErrNoCodec is matched, via errors.Is(), by the error returned when a key
+//type has no KeyCodec registered, or a value can not be encoded by the
+//ValueCodec of the tree.
+var ErrNoCodec = errors.New("bptree: no codec")
+
+//KeyCodec encodes and decodes one type of BptKey; see RegisterKeyCodec().
+type KeyCodec struct {
+	Encode func(BptKey) ([]byte, error)
+	Decode func([]byte) (BptKey, error)
+}
+
+var keyCodecs = struct {
+	sync.RWMutex
+	byName map[string]KeyCodec
+	byType map[reflect.Type]string
+}{
+	byName: make(map[string]KeyCodec),
+	byType: make(map[reflect.Type]string),
+}
+
+//RegisterKeyCodec(name, example, codec) registers the codec for keys of the
+//same type as example under name. The name is written by MarshalBinary(),
+//and used by UnmarshalBinary() to find the codec again, so it must be the
+//same in every program that reads the encoding. StringKey and ByteSliceKey
+//are registered as "StringKey" and "ByteSliceKey".
+//
+//RegisterKeyCodec panics if name is already registered for another type,
+//or the type under another name.
+func RegisterKeyCodec(name string, example BptKey, codec KeyCodec) {
+	typ := reflect.TypeOf(example)
+
+	keyCodecs.Lock()
+	defer keyCodecs.Unlock()
+	if old, ok := keyCodecs.byType[typ]; ok && old != name {
+		panic(fmt.Sprintf("RegisterKeyCodec: %v is already registered as %q", typ, old))
+	}
+	for otherTyp, otherName := range keyCodecs.byType {
+		if otherTyp != typ && otherName == name {
+			panic(fmt.Sprintf("RegisterKeyCodec: %q is already registered for %v", name, otherTyp))
+		}
+	}
+	keyCodecs.byName[name] = codec
+	keyCodecs.byType[typ] = name
+}
+
+//keyCodecFor(typ) returns the name and KeyCodec registered for typ.
+func keyCodecFor(typ reflect.Type) (string, KeyCodec, error) {
+	keyCodecs.RLock()
+	defer keyCodecs.RUnlock()
+	name, ok := keyCodecs.byType[typ]
+	if !ok {
+		return "", KeyCodec{}, fmt.Errorf("%w: no KeyCodec registered for %v", ErrNoCodec, typ)
+	}
+	return name, keyCodecs.byName[name], nil
+}
+
+//keyTypeNamed(name) returns the key type registered as name, or nil.
+func keyTypeNamed(name string) reflect.Type {
+	keyCodecs.RLock()
+	defer keyCodecs.RUnlock()
+	for typ, n := range keyCodecs.byType {
+		if n == name {
+			return typ
+		}
+	}
+	return nil
+}
+
+//keyCodecNamed(name) returns the KeyCodec registered as name.
+func keyCodecNamed(name string) (KeyCodec, error) {
+	keyCodecs.RLock()
+	defer keyCodecs.RUnlock()
+	codec, ok := keyCodecs.byName[name]
+	if !ok {
+		return KeyCodec{}, fmt.Errorf("%w: no KeyCodec registered as %q", ErrNoCodec, name)
+	}
+	return codec, nil
+}
+
+func init() {
+	RegisterKeyCodec("StringKey", StringKey(""), KeyCodec{
+		Encode: func(k BptKey) ([]byte, error) { return []byte(k.(StringKey)), nil },
+		Decode: func(b []byte) (BptKey, error) { return StringKey(b), nil },
+	})
+	RegisterKeyCodec("ByteSliceKey", ByteSliceKey(nil), KeyCodec{
+		Encode: func(k BptKey) ([]byte, error) { return []byte(k.(ByteSliceKey)), nil },
+		Decode: func(b []byte) (BptKey, error) { return ByteSliceKey(append([]byte(nil), b...)), nil },
+	})
+}
+
+//ValueCodec encodes and decodes the values of a tree for MarshalBinary()
+//and UnmarshalBinary(); see Encodable.SetValueCodec().
+type ValueCodec struct {
+	Encode func(interface{}) ([]byte, error)
+	Decode func([]byte) (interface{}, error)
+}
+
+//DefaultValueCodec is the ValueCodec of every tree until SetValueCodec() is
+//called. It encodes nil, bool, string, []byte and the sized and unsized int,
+//uint and float types, and decodes each to the type it was encoded from.
+var DefaultValueCodec = ValueCodec{Encode: encodeValue, Decode: decodeValue}
+
+//the type tags of DefaultValueCodec
+const (
+	valNil byte = iota
+	valBool
+	valInt
+	valInt8
+	valInt16
+	valInt32
+	valInt64
+	valUint
+	valUint8
+	valUint16
+	valUint32
+	valUint64
+	valFloat32
+	valFloat64
+	valString
+	valBytes
+)
+
+func encodeValue(v interface{}) ([]byte, error) {
+	var n [8]byte
+	u64 := func(tag byte, u uint64) []byte {
+		binary.LittleEndian.PutUint64(n[:], u)
+		return append([]byte{tag}, n[:]...)
+	}
+	switch v := v.(type) {
+	case nil:
+		return []byte{valNil}, nil
+	case bool:
+		if v {
+			return []byte{valBool, 1}, nil
+		}
+		return []byte{valBool, 0}, nil
+	case int:
+		return u64(valInt, uint64(v)), nil
+	case int8:
+		return u64(valInt8, uint64(v)), nil
+	case int16:
+		return u64(valInt16, uint64(v)), nil
+	case int32:
+		return u64(valInt32, uint64(v)), nil
+	case int64:
+		return u64(valInt64, uint64(v)), nil
+	case uint:
+		return u64(valUint, uint64(v)), nil
+	case uint8:
+		return u64(valUint8, uint64(v)), nil
+	case uint16:
+		return u64(valUint16, uint64(v)), nil
+	case uint32:
+		return u64(valUint32, uint64(v)), nil
+	case uint64:
+		return u64(valUint64, v), nil
+	case float32:
+		return u64(valFloat32, math.Float64bits(float64(v))), nil
+	case float64:
+		return u64(valFloat64, math.Float64bits(v)), nil
+	case string:
+		return append([]byte{valString}, v...), nil
+	case []byte:
+		return append([]byte{valBytes}, v...), nil
+	}
+	return nil, fmt.Errorf("%w: DefaultValueCodec can not encode a %T", ErrNoCodec, v)
+}
+
+func decodeValue(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty value", ErrBadEncoding)
+	}
+	tag, b := b[0], b[1:]
+	switch tag {
+	case valNil:
+		return nil, nil
+	case valBool:
+		if len(b) != 1 {
+			break
+		}
+		return b[0] != 0, nil
+	case valString:
+		return string(b), nil
+	case valBytes:
+		return append([]byte(nil), b...), nil
+	}
+
+	if tag > valBytes || len(b) != 8 {
+		return nil, fmt.Errorf("%w: bad value tag=%d len=%d", ErrBadEncoding, tag, len(b))
+	}
+	u := binary.LittleEndian.Uint64(b)
+	switch tag {
+	case valInt:
+		return int(u), nil
+	case valInt8:
+		return int8(u), nil
+	case valInt16:
+		return int16(u), nil
+	case valInt32:
+		return int32(u), nil
+	case valInt64:
+		return int64(u), nil
+	case valUint:
+		return uint(u), nil
+	case valUint8:
+		return uint8(u), nil
+	case valUint16:
+		return uint16(u), nil
+	case valUint32:
+		return uint32(u), nil
+	case valUint64:
+		return u, nil
+	case valFloat32:
+		return float32(math.Float64frombits(u)), nil
+	}
+	return math.Float64frombits(u), nil
+}
+
+//SetValueCodec(vc) makes MarshalBinary(), WriteTo(), UnmarshalBinary() and
+//ReadFrom() use vc for the values of the *tree instead of
+//DefaultValueCodec.
+//
+func (t *tree) SetValueCodec(vc ValueCodec) {
+	t.vcodec = &vc
+}
+
+//valueCodec() returns the ValueCodec of the *tree.
+func (t *tree) valueCodec() ValueCodec {
+	if t.vcodec == nil {
+		return DefaultValueCodec
+	}
+	return *t.vcodec
+}
@@ -0,0 +1,263 @@
+package bptree
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+//concurrentTree wraps a *tree with a sync.RWMutex. Readers share the read
+//lock; Put(), Del() and every other modifying op take the write lock.
+type concurrentTree struct {
+	mu sync.RWMutex
+	t  *tree
+}
+
+//NewConcurrentBpTree instantiates a new B+Tree, for a given order, that is
+//safe for concurrent use by multiple goroutines; see NewBpTree() for the
+//meaning of order.
+//
+//Get() calls run in parallel with each other. Put(), Del() and the other
+//modifying operations are serialized, and exclude readers while they run.
+//
+//Range() iterates over a Snapshot() of the tree, so fn is called without
+//any lock held; fn may freely call Put() or Del() on the same tree, and it
+//never sees their effects.
+//
+//NewConcurrentBpTree panics if order is less than 3; see
+//NewConcurrentBpTreeE().
+func NewConcurrentBpTree(order int) BpTree {
+	ct, err := NewConcurrentBpTreeE(order)
+	if err != nil {
+		panic(err)
+	}
+	return ct
+}
+
+//NewConcurrentBpTreeE is NewConcurrentBpTree() that returns ErrInvalidOrder
+//instead of panicking.
+func NewConcurrentBpTreeE(order int) (BpTree, error) {
+	if order < 3 {
+		return nil, ErrInvalidOrder
+	}
+	var ct = new(concurrentTree)
+	ct.t = mkTree(order)
+	return ct, nil
+}
+
+func (ct *concurrentTree) Order() int {
+	//the order never changes
+	return ct.t.order
+}
+
+func (ct *concurrentTree) Get(key BptKey, opts ...ReadOption) (interface{}, bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.t.Get(key, opts...)
+}
+
+func (ct *concurrentTree) Put(key BptKey, val interface{}) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.t.Put(key, val)
+}
+
+func (ct *concurrentTree) Del(key BptKey) (interface{}, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.t.Del(key)
+}
+
+func (ct *concurrentTree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) {
+	//Snapshot() moves the tree to a new generation, so it needs the write
+	//lock, but only for as long as it takes to copy the root pointer.
+	snap := ct.Snapshot()
+	snap.Range(lo, hi, fn, opts...)
+}
+
+func (ct *concurrentTree) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error {
+	snap := ct.Snapshot()
+	return snap.RangeContext(ctx, lo, hi, fn, opts...)
+}
+
+func (ct *concurrentTree) String() string {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.t.String()
+}
+
+func (ct *concurrentTree) Validate() error {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.t.Validate()
+}
+
+func (ct *concurrentTree) Graph(opts ...GraphOption) string {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.t.Graph(opts...)
+}
+
+//DumpJSON(w, opts...) encodes the tree with the lock held, and writes it to w
+//without.
+func (ct *concurrentTree) DumpJSON(w io.Writer, opts ...JSONOption) error {
+	ct.mu.RLock()
+	doc, err := ct.t.jsonTree(jsonOpts(opts))
+	ct.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, doc)
+}
+
+//MarshalBinary() encodes a Snapshot() of the tree; see WriteTo().
+func (ct *concurrentTree) MarshalBinary() ([]byte, error) {
+	return ct.Snapshot().(*tree).MarshalBinary()
+}
+
+//WriteTo(w) writes a Snapshot() of the tree to w, without the lock held.
+func (ct *concurrentTree) WriteTo(w io.Writer) (int64, error) {
+	return ct.Snapshot().(*tree).WriteTo(w)
+}
+
+func (ct *concurrentTree) UnmarshalBinary(data []byte) error {
+	_, err := ct.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+//ReadFrom(r) decodes the entries without the lock held, and then replaces
+//the entries of the tree with them.
+func (ct *concurrentTree) ReadFrom(r io.Reader) (int64, error) {
+	ct.mu.Lock()
+	vc := ct.t.valueCodec()
+	ct.mu.Unlock()
+
+	keys, vals, n, err := readBinary(r, vc)
+	if err != nil {
+		return n, err
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	err = ct.t.loadEntries(keys, vals)
+	return n, err
+}
+
+func (ct *concurrentTree) SetValueCodec(vc ValueCodec) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.t.SetValueCodec(vc)
+}
+
+//MarshalJSON() encodes a Snapshot() of the tree.
+func (ct *concurrentTree) MarshalJSON() ([]byte, error) {
+	return ct.Snapshot().(*tree).MarshalJSON()
+}
+
+func (ct *concurrentTree) UnmarshalJSON(data []byte) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.t.UnmarshalJSON(data)
+}
+
+//GobEncode() encodes a Snapshot() of the tree.
+func (ct *concurrentTree) GobEncode() ([]byte, error) {
+	return ct.Snapshot().(*tree).GobEncode()
+}
+
+func (ct *concurrentTree) GobDecode(data []byte) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.t.GobDecode(data)
+}
+
+func (ct *concurrentTree) SetKeyFactory(f KeyFactory) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.t.SetKeyFactory(f)
+}
+
+func (ct *concurrentTree) Stats() Stats {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.t.Stats()
+}
+
+func (ct *concurrentTree) ResetStats() {
+	//the counters are atomic
+	ct.t.ResetStats()
+}
+
+func (ct *concurrentTree) NumberOfEntries() int {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.t.NumberOfEntries()
+}
+
+func (ct *concurrentTree) Clear() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.t.Clear()
+}
+
+//Clone() returns a plain, not concurrency safe, copy of the tree.
+func (ct *concurrentTree) Clone() BpTree {
+	return ct.CloneWith(nil)
+}
+
+//CloneWith(copyVal) returns a plain, not concurrency safe, copy of the tree.
+func (ct *concurrentTree) CloneWith(copyVal func(interface{}) interface{}) BpTree {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.t.CloneWith(copyVal)
+}
+
+//Snapshot() returns a read-only Snapshot which, since it never changes, is
+//safe for concurrent use without any locking.
+func (ct *concurrentTree) Snapshot() BpTree {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.t.Snapshot()
+}
+
+//Begin() starts a Txn whose Commit() takes the write lock while it installs
+//the Txn's writes.
+func (ct *concurrentTree) Begin() *Txn {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	txn := ct.t.Begin()
+	txn.lock = &ct.mu
+	return txn
+}
+
+func (ct *concurrentTree) EnableUndo(maxEntries int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.t.EnableUndo(maxEntries)
+}
+
+func (ct *concurrentTree) Savepoint() Savepoint {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.t.Savepoint()
+}
+
+func (ct *concurrentTree) RollbackTo(sp Savepoint) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.t.RollbackTo(sp)
+}
+
+func (ct *concurrentTree) SetLogger(l *slog.Logger) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.t.SetLogger(l)
+}
+
+func (ct *concurrentTree) SetCheckLevel(level CheckLevel) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.t.SetCheckLevel(level)
+}
@@ -0,0 +1,98 @@
+package bptree
+
+import (
+	"sync"
+	"testing"
+)
+
+//These tests are meant to be run with the race detector, go test -race.
+
+func TestConcurrentPutGetDel(t *testing.T) {
+	bpt := NewConcurrentBpTree(4)
+
+	nWorkers := 8
+	var wg sync.WaitGroup
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			//each worker owns every nWorkers'th entry
+			for i := w; i < len(largeNumEnts); i += nWorkers {
+				ent := largeNumEnts[i]
+				bpt.Put(ent.key, ent.val)
+				val, found := bpt.Get(ent.key)
+				if !found || val.(int) != ent.val {
+					t.Errorf("Get(%q) = %v, %v; expected %d", ent.key, val, found, ent.val)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if bpt.NumberOfEntries() != len(largeNumEnts) {
+		t.Fatalf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts))
+	}
+
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(largeNumEnts); i += nWorkers {
+				if _, found := bpt.Del(largeNumEnts[i].key); !found {
+					t.Errorf("Del(%q) did not find it", largeNumEnts[i].key)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for _, ent := range largeNumEnts {
+				bpt.Get(ent.key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if bpt.NumberOfEntries() != 0 {
+		t.Fatalf("bpt.NumberOfEntries(),%d != 0", bpt.NumberOfEntries())
+	}
+}
+
+func TestConcurrentRangeWhileWriting(t *testing.T) {
+	bpt := NewConcurrentBpTree(3)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for _, ent := range genRandomizedEntries(largeNumEnts) {
+				bpt.Put(ent.key, -ent.val)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var prev BptKey
+			var n int
+			bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+				if prev != nil && !prev.LessThan(k) {
+					t.Errorf("Range out of order: %q then %q", prev, k)
+					return false
+				}
+				//fn may modify the tree it is iterating
+				bpt.Put(k, v)
+				prev = k
+				n++
+				return true
+			})
+			if n != len(largeNumEnts) {
+				t.Errorf("Range visited %d entries; expected %d", n, len(largeNumEnts))
+			}
+		}()
+	}
+	wg.Wait()
+}
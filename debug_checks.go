@@ -0,0 +1,142 @@
+package bptree
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//checkHistory is the number of operations, and the structural changes they
+//made, remembered for the message of a failed check.
+const checkHistory = 32
+
+//checker holds the CheckLevel of a tree and the recent history of its
+//operations. It is shared by the writers of the latched and B-link trees, so
+//the history has its own lock.
+type checker struct {
+	level CheckLevel
+	mu    sync.Mutex
+	hist  [checkHistory]string
+	next  int //total number of entries ever recorded
+}
+
+func newChecker(level CheckLevel) *checker {
+	if level == CheckOff {
+		return nil
+	}
+	return &checker{level: level}
+}
+
+//c.record(format, args...) adds an entry to the history; the oldest entry is
+//forgotten once there are checkHistory of them.
+func (c *checker) record(format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...)
+	c.mu.Lock()
+	c.hist[c.next%checkHistory] = s
+	c.next++
+	c.mu.Unlock()
+}
+
+//c.history() returns the history, oldest first, one entry per line.
+func (c *checker) history() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	first := 0
+	if c.next > checkHistory {
+		first = c.next - checkHistory
+	}
+	var s string
+	for i := first; i < c.next; i++ {
+		s += "\n  " + c.hist[i%checkHistory]
+	}
+	return s
+}
+
+//c.fail(op, event, violations) panics with the violations and the history.
+func (c *checker) fail(op, event string, violations []Violation) {
+	vs := make([]string, len(violations))
+	for i, v := range violations {
+		vs[i] = v.String()
+	}
+	panic(fmt.Sprintf("ASSERT: %s: %s: %s\nhistory, oldest first:%s", op, event, strings.Join(vs, "; "), c.history()))
+}
+
+//SetCheckLevel(level) sets how much of its invariants the *tree checks as
+//it is modified; the default is DefaultCheckLevel. A failed check panics
+//with every broken invariant and the recent history of Put(), Del() and the
+//structural changes they made, so the corruption is caught by the operation
+//that causes it.
+//
+func (t *tree) SetCheckLevel(level CheckLevel) {
+	t.check = newChecker(level)
+}
+
+//t.checkOp(op, key) records the start of op on key in the history.
+func (t *tree) checkOp(op string, key BptKey) {
+	if t.check == nil {
+		return
+	}
+	t.check.record("%s %q", op, key)
+}
+
+//t.checkNodes(op, event, mayBeRoot, nodes...) records event in the history
+//and checks each of nodes on its own; see validator.shape(). The nodes must
+//be latched, or otherwise owned, by the caller. If mayBeRoot is true the
+//nodes are allowed the sizes of a root.
+func (t *tree) checkNodes(op, event string, mayBeRoot bool, nodes ...nodeI) {
+	if t.check == nil {
+		return
+	}
+	t.check.record("  %s %s", event, nodesString(nodes))
+	v := validator{order: t.order, leafDepth: -1}
+	for i, node := range nodes {
+		v.shape(node, fmt.Sprintf("nodes[%d]", i), mayBeRoot)
+	}
+	if len(v.violations) > 0 {
+		t.check.fail(op, event, v.violations)
+	}
+}
+
+//t.checkSep(op, event, left, sep, right) checks that sep separates left
+//from its right peer; every key of left is less than sep and no key of right
+//is.
+func (t *tree) checkSep(op, event string, left nodeI, sep BptKey, right nodeI) {
+	if t.check == nil {
+		return
+	}
+	v := validator{order: t.order, leafDepth: -1}
+	if keys := nodeKeys(left); len(keys) > 0 && !keys[len(keys)-1].LessThan(sep) {
+		v.fail("left", left, "separator bound", "last key %q is not less than the separator %q", keys[len(keys)-1], sep)
+	}
+	if keys := nodeKeys(right); len(keys) > 0 && keys[0].LessThan(sep) {
+		v.fail("right", right, "separator bound", "first key %q is less than the separator %q", keys[0], sep)
+	}
+	if len(v.violations) > 0 {
+		t.check.fail(op, event, v.violations)
+	}
+}
+
+//t.checkTree(op) runs Validate() if the CheckLevel is CheckTree. The caller
+//must exclude every other writer.
+func (t *tree) checkTree(op string) {
+	if t.check == nil || t.check.level < CheckTree {
+		return
+	}
+	if err := t.Validate(); err != nil {
+		t.check.fail(op, "validate", err.(*ValidationError).Violations)
+	}
+}
+
+//t.checkingTree() is true if every Put() and Del() must run Validate(); the
+//latched and B-link trees then serialize their writers.
+func (t *tree) checkingTree() bool {
+	return t.check != nil && t.check.level >= CheckTree
+}
+
+func nodesString(nodes []nodeI) string {
+	s := make([]string, len(nodes))
+	for i, node := range nodes {
+		s[i] = fmt.Sprintf("%p", node)
+	}
+	return strings.Join(s, " ")
+}
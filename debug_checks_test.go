@@ -0,0 +1,87 @@
+package bptree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//_panicMsg(fn) returns the message fn panics with, or "" if it does not.
+func _panicMsg(fn func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = fmt.Sprint(r)
+		}
+	}()
+	fn()
+	return ""
+}
+
+func TestCheckTreeAllTrees(t *testing.T) {
+	trees := map[string]BpTree{
+		"plain":      NewBpTree(3),
+		"mvcc":       NewMVCCBpTree(4),
+		"latched":    NewLatchedBpTree(3),
+		"blink":      NewBLinkBpTree(3),
+		"optimistic": NewOptimisticBpTree(4),
+		"sharded":    NewShardedBpTree(3, shardSplits(3)),
+	}
+	for name, bpt := range trees {
+		bpt.SetCheckLevel(CheckTree)
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Put(ent.key, ent.val)
+		}
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Del(ent.key)
+		}
+		if bpt.NumberOfEntries() != 0 {
+			t.Fatalf("%s: NumberOfEntries(),%d != 0", name, bpt.NumberOfEntries())
+		}
+	}
+}
+
+func TestCheckNodesCatchesCorruption(t *testing.T) {
+	bpt := NewBpTree(5)
+	bpt.SetCheckLevel(CheckNodes)
+	bpt.Put(StringKey("a"), 1)
+	bpt.Put(StringKey("c"), 2)
+
+	leaf := bpt.(*tree).root.(*leafNodeS)
+	leaf.keys[0], leaf.keys[1] = leaf.keys[1], leaf.keys[0]
+
+	msg := _panicMsg(func() { bpt.Put(StringKey("e"), 3) })
+	for _, want := range []string{"ASSERT: put: insert:", "key order", `put "a"`, `put "c"`, `put "e"`} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("panic message %q does not contain %q", msg, want)
+		}
+	}
+
+	//CheckOff does not notice
+	bpt.SetCheckLevel(CheckOff)
+	if msg := _panicMsg(func() { bpt.Put(StringKey("g"), 4) }); msg != "" {
+		t.Fatalf("Put() with CheckOff panicked: %s", msg)
+	}
+}
+
+func TestCheckTreeCatchesCorruption(t *testing.T) {
+	bpt := NewBpTree(3)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	//CheckNodes only looks at the nodes that are changed
+	bpt.SetCheckLevel(CheckNodes)
+	bpt.(*tree).numEnts++
+	ent := largeNumEnts[0]
+	if msg := _panicMsg(func() { bpt.Del(ent.key) }); msg != "" {
+		t.Fatalf("Del() with CheckNodes panicked: %s", msg)
+	}
+
+	bpt.SetCheckLevel(CheckTree)
+	msg := _panicMsg(func() { bpt.Put(ent.key, ent.val) })
+	for _, want := range []string{"ASSERT: put: validate:", "entry count", fmt.Sprintf("put %q", ent.key)} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("panic message %q does not contain %q", msg, want)
+		}
+	}
+}
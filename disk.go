@@ -0,0 +1,1116 @@
+package bptree
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+//ErrEntryTooLarge is matched, via errors.Is(), by the error returned when an
+//encoded key and value can not be guaranteed to fit in the pages of a
+//DiskBpTree.
+var ErrEntryTooLarge = errors.New("bptree: entry is too large for a page")
+
+//ErrClosed is returned by the methods of a DiskBpTree once it is closed.
+var ErrClosed = errors.New("bptree: tree is closed")
+
+//PageError is returned when a page of the file of a DiskBpTree, or a node
+//of the file of a FrozenBpTree, is damaged: its checksum does not match, or
+//it can not be decoded. Err matches ErrChecksum or ErrBadEncoding, via
+//errors.Is(), and so does the *PageError. See DiskBpTree.Salvage() and
+//FrozenBpTree.Salvage().
+type PageError struct {
+	Offset int64 //of the page, or node, in the file; 0 for the header
+	Err    error
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("%v; page at offset %d", e.Err, e.Offset)
+}
+
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
+
+//DiskOption sets a parameter of a DiskBpTree; see OpenDiskBpTree().
+type DiskOption func(*diskOptions)
+
+type diskOptions struct {
+	pageSize  int
+	order     int
+	vcodec    ValueCodec
+	cacheSize int
+	eviction  EvictionPolicy
+
+	wal            bool
+	fsync          FsyncPolicy
+	fsyncInterval  time.Duration
+	checkpointSize int64
+	openFile       func(name string) (pageFile, error)
+}
+
+//DiskPageSize(n) sets the page size, in bytes, of a new file; the default
+//is 4096. It is ignored for an existing file.
+func DiskPageSize(n int) DiskOption {
+	return func(do *diskOptions) {
+		do.pageSize = n
+	}
+}
+
+//DiskOrder(order) sets the order of a new file; the default is 16. It is
+//ignored for an existing file.
+func DiskOrder(order int) DiskOption {
+	return func(do *diskOptions) {
+		do.order = order
+	}
+}
+
+//DiskCacheSize(n) bounds the buffer pool of the DiskBpTree to n bytes of
+//pages; the default is 4MiB. It always holds at least 8 pages.
+func DiskCacheSize(n int) DiskOption {
+	return func(do *diskOptions) {
+		do.cacheSize = n
+	}
+}
+
+//DiskEviction(policy) sets how the buffer pool of the DiskBpTree chooses the
+//page to evict; the default is EvictLRU.
+func DiskEviction(policy EvictionPolicy) DiskOption {
+	return func(do *diskOptions) {
+		do.eviction = policy
+	}
+}
+
+//DiskValueCodec(vc) makes the DiskBpTree encode its values with vc instead
+//of DefaultValueCodec. It must be the same every time the file is opened.
+func DiskValueCodec(vc ValueCodec) DiskOption {
+	return func(do *diskOptions) {
+		do.vcodec = vc
+	}
+}
+
+//DiskBpTree is a B+Tree kept in a single file of fixed-size pages, rather
+//than in memory. Each leafNodeS or interiorNodeS is a page, and a node
+//refers to its children by pageID instead of by pointer; see pager.go for
+//the layout. Pages freed by merges are reused before the file grows. Every
+//page carries a checksum, verified as it is read from the file, so a
+//damaged file is reported as a *PageError rather than misread.
+//
+//The pages in use are cached in a buffer pool of bounded size; see
+//DiskCacheSize() and DiskEviction(). Put() and Del() only change the pages
+//in the pool, which are written back to the file as they are evicted, so
+//the tree is only durable, and only consistent on disk, once Sync() or
+//Close() writes back the rest and the header; unless it has a write-ahead
+//log, see DiskWAL().
+//
+//The keys are encoded by the KeyCodec registered for their type, and the
+//values by the ValueCodec given with DiskValueCodec(). A DiskBpTree is safe
+//for concurrent use by multiple goroutines.
+//
+//Get(), Put(), Del(), Range() and RangeContext() have the signatures of
+//BpTree's, and GetE(), PutE() and DelE() those of BpTreeE's, which return
+//the errors, such as a failed read of the file, that the others panic with.
+//A DiskBpTree is not a BpTree all the same: Snapshot(), Clone(), Graph()
+//and the like need the whole tree in memory, and Stats() returns DiskStats.
+type DiskBpTree struct {
+	mu       sync.RWMutex //shared by Get() and Range(); exclusive otherwise
+	p        *pager
+	kc       KeyCodec
+	keyType  reflect.Type //nil until the first key is Put()
+	vc       ValueCodec
+	maxEntry int //most bytes an encoded entry, with its lengths, may take
+	closed   bool
+
+	wal            *wal //nil without DiskWAL()
+	fsync          FsyncPolicy
+	checkpointSize int64
+}
+
+//OpenDiskBpTree(path, opts...) opens the DiskBpTree in the file at path,
+//creating the file, with an empty tree, if it does not exist. A write-ahead
+//log left at path+"-wal" is replayed, and removed unless DiskWAL() is
+//given.
+func OpenDiskBpTree(path string, opts ...DiskOption) (*DiskBpTree, error) {
+	var do = diskOptions{
+		pageSize:       4096,
+		order:          16,
+		vcodec:         DefaultValueCodec,
+		cacheSize:      4 << 20,
+		fsyncInterval:  100 * time.Millisecond,
+		checkpointSize: 16 << 20,
+		openFile:       openPageFile,
+	}
+	for _, opt := range opts {
+		opt(&do)
+	}
+
+	f, err := do.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var wf pageFile
+	walPath := path + "-wal"
+	if _, err := os.Stat(walPath); do.wal || err == nil {
+		if wf, err = do.openFile(walPath); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	dt, err := openDisk(f, wf, do)
+	if err != nil {
+		f.Close()
+		if wf != nil {
+			wf.Close()
+		}
+		return nil, err
+	}
+	if wf != nil && !do.wal {
+		wf.Close()
+		if err := os.Remove(walPath); err != nil {
+			dt.Close()
+			return nil, err
+		}
+	}
+	return dt, nil
+}
+
+func openDisk(f, wf pageFile, do diskOptions) (*DiskBpTree, error) {
+	var walEnd int64
+	if wf != nil {
+		var err error
+		if walEnd, err = replayWAL(f, wf); err != nil {
+			return nil, err
+		}
+		//a torn record must not be read back as part of the records
+		//written after it
+		if err := wf.Truncate(walEnd); err != nil {
+			return nil, err
+		}
+		if err := wf.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	p, err := openPager(f, do)
+	if err != nil {
+		return nil, err
+	}
+
+	var dt = &DiskBpTree{p: p, vc: do.vcodec}
+	dt.maxEntry = maxEntrySize(p.hdr.pageSize, p.hdr.order)
+	if name := p.hdr.keyCodec; name != "" {
+		if dt.kc, err = keyCodecNamed(name); err != nil {
+			return nil, err
+		}
+		dt.keyType = keyTypeNamed(name)
+	}
+	if do.wal {
+		dt.wal = newWAL(wf, walEnd, do.fsync, do.fsyncInterval)
+		dt.fsync = do.fsync
+		dt.checkpointSize = do.checkpointSize
+		p.pool.logging = true
+		p.pool.walSync = dt.wal.sync
+	}
+	return dt, nil
+}
+
+//maxEntrySize(pageSize, order) returns the most bytes one entry may take
+//such that a full leaf, or a full interior node of keys no larger, fits in
+//a page.
+func maxEntrySize(pageSize, order int) int {
+	return (pageSize - nodeHdr - 8*order) / (order - 1)
+}
+
+//diskNode is a page of the tree: the leafNodeS or interiorNodeS it holds,
+//so that Put() and Del() split, steal and merge with the same code as the
+//trees kept in memory. The children of an interior node are pageRefs, and
+//the values of a leaf are kept encoded, as []byte, so writing the node back
+//only has to encode its keys again.
+type diskNode struct {
+	id   pageID
+	node nodeI
+	next pageID //leaf to the right; 0 for the last
+}
+
+//pageRef is a child of the interiorNodeS of a diskNode; the page holding
+//it. The split, steal and merge code of interiorNodeS only moves children
+//from node to node, so it moves pageRefs just as well. No method of nodeI is
+//implemented; calling one panics.
+type pageRef struct {
+	nodeI
+	id pageID
+}
+
+func (n *diskNode) isLeaf() bool {
+	return n.node.isLeaf()
+}
+
+func (n *diskNode) leaf() *leafNodeS {
+	return n.node.(*leafNodeS)
+}
+
+func (n *diskNode) interior() *interiorNodeS {
+	return n.node.(*interiorNodeS)
+}
+
+//n.kid(i) returns the page of the i'th child of the interior node n.
+func (n *diskNode) kid(i int) pageID {
+	return n.interior().vals[i].(pageRef).id
+}
+
+//n.numKeys() returns the number of keys in n.
+func (n *diskNode) numKeys() int {
+	if n.isLeaf() {
+		return len(n.leaf().keys)
+	}
+	return len(n.interior().keys)
+}
+
+//encodeNode(n, pageSize, kc) returns the page holding n, its keys encoded
+//with kc. A node that does not fit means maxEntry was not enforced; the
+//tree is corrupt.
+func encodeNode(n *diskNode, pageSize int, kc KeyCodec) ([]byte, error) {
+	le := binary.LittleEndian
+	page := make([]byte, pageSize)
+	page[0] = pageInterior
+	if n.isLeaf() {
+		page[0] = pageLeaf
+	}
+	le.PutUint16(page[2:], uint16(n.numKeys()))
+	le.PutUint64(page[8:], uint64(n.next))
+
+	off := nodeHdr
+	bytes32 := func(b []byte) {
+		if off+4+len(b) > pageSize {
+			corrupt("page %d overflows %d bytes", n.id, pageSize)
+		}
+		le.PutUint32(page[off:], uint32(len(b)))
+		off += 4 + copy(page[off+4:], b)
+	}
+	key := func(k BptKey) error {
+		b, err := kc.Encode(k)
+		if err != nil {
+			return fmt.Errorf("bptree: encoding key %q: %w", k, err)
+		}
+		bytes32(b)
+		return nil
+	}
+
+	if n.isLeaf() {
+		leaf := n.leaf()
+		for i, k := range leaf.keys {
+			if err := key(k); err != nil {
+				return nil, err
+			}
+			bytes32(leaf.vals[i].([]byte))
+		}
+	} else {
+		node := n.interior()
+		if nodeHdr+8*len(node.vals) > pageSize {
+			corrupt("page %d overflows %d bytes", n.id, pageSize)
+		}
+		for i := range node.vals {
+			le.PutUint64(page[off:], uint64(n.kid(i)))
+			off += 8
+		}
+		for _, k := range node.keys {
+			if err := key(k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sealPage(page)
+	return page, nil
+}
+
+//decodeNode(id, page, kc, order) decodes page id, of a tree of the given
+//order; the keys with kc. A page that can not be decoded is a *PageError.
+func decodeNode(id pageID, page []byte, kc KeyCodec, order int) (*diskNode, error) {
+	le := binary.LittleEndian
+	bad := func(format string, args ...interface{}) (*diskNode, error) {
+		return nil, &PageError{int64(id) * int64(len(page)), fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))}
+	}
+	if page[0] != pageLeaf && page[0] != pageInterior {
+		return bad("type %d is not a node", page[0])
+	}
+
+	var n = &diskNode{id: id}
+	count := int(le.Uint16(page[2:]))
+	n.next = pageID(le.Uint64(page[8:]))
+	if count > order-1 {
+		return bad("%d keys; at most %d fit in a node of order %d", count, order-1, order)
+	}
+	if count > 0 && kc.Decode == nil {
+		return bad("holds keys, but the tree has no key codec")
+	}
+
+	off := nodeHdr
+	bytes32 := func() ([]byte, bool) {
+		if off+4 > len(page) {
+			return nil, false
+		}
+		l := int(le.Uint32(page[off:]))
+		if l > len(page)-off-4 {
+			return nil, false
+		}
+		b := page[off+4 : off+4+l]
+		off += 4 + l
+		return b, true
+	}
+	key := func(i int) (BptKey, error) {
+		b, ok := bytes32()
+		if !ok {
+			_, err := bad("key %d overflows the page", i)
+			return nil, err
+		}
+		k, err := kc.Decode(b)
+		if err != nil {
+			_, err = bad("key %d: %v", i, err)
+			return nil, err
+		}
+		return k, nil
+	}
+
+	if page[0] == pageLeaf {
+		leaf := mkLeaf(order)
+		for i := 0; i < count; i++ {
+			k, err := key(i)
+			if err != nil {
+				return nil, err
+			}
+			b, ok := bytes32()
+			if !ok {
+				return bad("value %d overflows the page", i)
+			}
+			leaf.keys = append(leaf.keys, k)
+			leaf.vals = append(leaf.vals, b)
+		}
+		n.node = leaf
+		return n, nil
+	}
+
+	if count == 0 || off+8*(count+1) > len(page) {
+		return bad("interior node has %d keys", count)
+	}
+	node := mkNode(order)
+	for i := 0; i <= count; i++ {
+		node.vals = append(node.vals, pageRef{id: pageID(le.Uint64(page[off:]))})
+		off += 8
+	}
+	for i := 0; i < count; i++ {
+		k, err := key(i)
+		if err != nil {
+			return nil, err
+		}
+		node.keys = append(node.keys, k)
+	}
+	n.node = node
+	return n, nil
+}
+
+//childIndex(key) returns the index of the child of the interior node n
+//whose subtree holds key; child i holds the keys k with
+//n.keys[i-1] <= k < n.keys[i].
+func (n *diskNode) childIndex(key BptKey) int {
+	keys := n.interior().keys
+	return sort.Search(len(keys), func(i int) bool {
+		return key.LessThan(keys[i])
+	})
+}
+
+//find(key) returns the index of key in the leaf n, and whether it was
+//found.
+func (n *diskNode) find(key BptKey) (int, bool) {
+	keys := n.leaf().keys
+	i := sort.Search(len(keys), func(i int) bool {
+		return !keys[i].LessThan(key)
+	})
+	return i, i < len(keys) && keys[i].Equals(key)
+}
+
+func (dt *DiskBpTree) load(id pageID) (*diskNode, error) {
+	page, err := dt.p.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+	defer dt.p.unpin(id)
+	return decodeNode(id, page, dt.kc, dt.p.hdr.order)
+}
+
+func (dt *DiskBpTree) store(n *diskNode) error {
+	page, err := encodeNode(n, dt.p.hdr.pageSize, dt.kc)
+	if err != nil {
+		return err
+	}
+	return dt.p.writePage(n.id, page)
+}
+
+//keyCodec(key) returns the name and KeyCodec for key; a *KeyTypeError if
+//key is nil or of a different type than the keys already Put() in the tree,
+//and ErrNoCodec if no KeyCodec is registered for its type.
+func (dt *DiskBpTree) keyCodec(key BptKey) (string, KeyCodec, error) {
+	if key == nil || dt.keyType != nil && reflect.TypeOf(key) != dt.keyType {
+		return "", KeyCodec{}, &KeyTypeError{key, dt.keyType}
+	}
+	if dt.keyType != nil {
+		return dt.p.hdr.keyCodec, dt.kc, nil
+	}
+	return keyCodecFor(reflect.TypeOf(key))
+}
+
+//Order() returns the order of the tree.
+func (dt *DiskBpTree) Order() int {
+	//the order never changes
+	return dt.p.hdr.order
+}
+
+//NumberOfEntries() returns the number of entries in the tree.
+func (dt *DiskBpTree) NumberOfEntries() int {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+	return dt.p.hdr.entries
+}
+
+//Get(key) returns the value of key and whether it was found. A key of the
+//wrong type is not found, as for BpTree.Get(); any other error, such as a
+//page that can not be read, panics. See GetE().
+func (dt *DiskBpTree) Get(key BptKey, opts ...ReadOption) (interface{}, bool) {
+	val, found, err := dt.GetE(key, opts...)
+	panicUnlessKeyErr(err)
+	return val, found
+}
+
+//GetE(key) is Get(key) that returns an error instead of panicking; a
+//*KeyTypeError for a bad key, ErrAsOfUnsupported if given AsOf(), a
+//*PageError for a damaged page, or the error reading the file.
+func (dt *DiskBpTree) GetE(key BptKey, opts ...ReadOption) (interface{}, bool, error) {
+	if readOpts(opts).asOfSet {
+		return nil, false, ErrAsOfUnsupported
+	}
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+	if dt.closed {
+		return nil, false, ErrClosed
+	}
+	if key == nil || dt.keyType != nil && reflect.TypeOf(key) != dt.keyType {
+		return nil, false, &KeyTypeError{key, dt.keyType}
+	}
+	if dt.keyType == nil {
+		return nil, false, nil
+	}
+
+	leaf, err := dt.findLeaf(key)
+	if err != nil {
+		return nil, false, err
+	}
+	i, found := leaf.find(key)
+	if !found {
+		return nil, false, nil
+	}
+	val, err := dt.vc.Decode(leaf.leaf().vals[i].([]byte))
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: page %d: value of key %q: %v", ErrBadEncoding, leaf.id, key, err)
+	}
+	return val, true, nil
+}
+
+//findLeaf(key) returns the leaf that would hold key; the leftmost leaf if
+//key is nil. A node out of place for the height of the tree is a
+//*PageError, so a damaged page can not lead it astray for long.
+func (dt *DiskBpTree) findLeaf(key BptKey) (*diskNode, error) {
+	n, err := dt.load(dt.p.hdr.root)
+	for depth := 1; err == nil; depth++ {
+		if n.isLeaf() != (depth == dt.p.hdr.height) {
+			return nil, &PageError{int64(n.id) * int64(dt.p.hdr.pageSize), fmt.Errorf("%w: node at depth %d of %d", ErrBadEncoding, depth, dt.p.hdr.height)}
+		}
+		if n.isLeaf() {
+			return n, nil
+		}
+		i := 0
+		if key != nil {
+			i = n.childIndex(key)
+		}
+		n, err = dt.load(n.kid(i))
+	}
+	return nil, err
+}
+
+//Range(lo, hi, fn) calls fn(key, val) for every entry with lo <= key < hi in
+//ascending key order; see BpTree.Range(). Errors panic, as for Get(); see
+//RangeContext().
+//
+//fn must not modify the tree.
+func (dt *DiskBpTree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) {
+	panicUnlessKeyErr(dt.RangeContext(context.Background(), lo, hi, fn, opts...))
+}
+
+//RangeContext(ctx, lo, hi, fn) is Range(lo, hi, fn) that returns an error
+//instead of panicking, and stops, returning ctx.Err(), once ctx is
+//cancelled; see BpTree.RangeContext(). It follows the right-links of the
+//leaves, so only the first leaf is found from the root. A lo or hi of the
+//wrong type is a *KeyTypeError, as for GetE().
+func (dt *DiskBpTree) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error {
+	if readOpts(opts).asOfSet {
+		panic("Range: AsOf() requires an MVCC tree")
+	}
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+	if dt.closed {
+		return ErrClosed
+	}
+	for _, k := range []BptKey{lo, hi} {
+		if k != nil && dt.keyType != nil && reflect.TypeOf(k) != dt.keyType {
+			return &KeyTypeError{k, dt.keyType}
+		}
+	}
+	if dt.keyType == nil {
+		return nil
+	}
+
+	n, err := dt.findLeaf(lo)
+	for err == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		leaf := n.leaf()
+		for i, k := range leaf.keys {
+			if lo != nil && k.LessThan(lo) {
+				continue
+			}
+			if hi != nil && !k.LessThan(hi) {
+				return nil
+			}
+			val, err := dt.vc.Decode(leaf.vals[i].([]byte))
+			if err != nil {
+				return fmt.Errorf("%w: page %d: value of key %q: %v", ErrBadEncoding, n.id, k, err)
+			}
+			if !fn(k, val) {
+				return nil
+			}
+		}
+		if n.next == 0 {
+			return nil
+		}
+		n, err = dt.load(n.next)
+	}
+	return err
+}
+
+//Salvage(fn) calls fn(key, val), in ascending key order, for every entry
+//before the first damaged page of a tree, and returns the number of entries
+//passed to fn and the *PageError of that page; nil if there was none, or fn
+//returned false. It is Range(nil, nil, fn) for a tree that may be damaged:
+//each leaf is checked to hold keys greater than those before it, and values
+//that can be decoded, before any of its entries is passed to fn; and a
+//cycle of leaves is found. So the entries passed to fn are the intact
+//prefix of the tree; copying them to a new tree recovers it.
+//
+//fn must not modify the tree.
+func (dt *DiskBpTree) Salvage(fn func(BptKey, interface{}) bool) (int, error) {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+	if dt.closed {
+		return 0, ErrClosed
+	}
+	if dt.keyType == nil {
+		return 0, nil
+	}
+
+	var last BptKey
+	n := 0
+	dn, err := dt.findLeaf(nil)
+	for leaves := pageID(1); err == nil; leaves++ {
+		bad := func(format string, args ...interface{}) error {
+			return &PageError{int64(dn.id) * int64(dt.p.hdr.pageSize), fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))}
+		}
+		if leaves >= dt.p.hdr.pages {
+			return n, bad("the leaves link in a cycle")
+		}
+		leaf := dn.leaf()
+		vals := make([]interface{}, len(leaf.keys))
+		for i, k := range leaf.keys {
+			if last != nil && !last.LessThan(k) {
+				return n, bad("key %q is not greater than %q", k, last)
+			}
+			if vals[i], err = dt.vc.Decode(leaf.vals[i].([]byte)); err != nil {
+				return n, bad("value of key %q: %v", k, err)
+			}
+			last = k
+		}
+		for i, k := range leaf.keys {
+			n++
+			if !fn(k, vals[i]) {
+				return n, nil
+			}
+		}
+		if dn.next == 0 {
+			return n, nil
+		}
+		dn, err = dt.load(dn.next)
+	}
+	return n, err
+}
+
+//Validate() checks every invariant of the tree and returns a
+//*ValidationError describing each one that is broken, or nil. The pages are
+//loaded into a tree of leafNodeS and interiorNodeS, which is checked by
+//tree.Validate(), the same as every other BpTree. Then the depth of the
+//leaves, their right-links, and that every page is either in the tree or
+//free, are checked. A page that can not be read is returned as a *PageError.
+//
+//Every page is loaded, and every value decoded, so the whole tree is held in
+//memory while it runs.
+func (dt *DiskBpTree) Validate() error {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+	if dt.closed {
+		return ErrClosed
+	}
+
+	var violations []Violation
+	fail := func(id pageID, rule, format string, args ...interface{}) {
+		page := fmt.Sprintf("page %d", id)
+		violations = append(violations, Violation{page, page, rule, fmt.Sprintf(format, args...)})
+	}
+
+	t := mkTree(dt.p.hdr.order)
+	t.numEnts = dt.p.hdr.entries
+	var leaves []*diskNode
+	seen := make(map[pageID]bool)
+	var load func(id pageID, depth int) (nodeI, error)
+	load = func(id pageID, depth int) (nodeI, error) {
+		if seen[id] {
+			//validated as a nil child
+			fail(id, "page reuse", "the page is in the tree more than once")
+			return nil, nil
+		}
+		seen[id] = true
+		n, err := dt.load(id)
+		if err != nil {
+			return nil, err
+		}
+		if n.isLeaf() != (depth == dt.p.hdr.height) {
+			fail(id, "height", "node at depth %d; height=%d", depth, dt.p.hdr.height)
+		}
+
+		//n is a copy of the page, so its values and children are replaced
+		//in place
+		if n.isLeaf() {
+			leaf := n.leaf()
+			for i, k := range leaf.keys {
+				val, err := dt.vc.Decode(leaf.vals[i].([]byte))
+				if err != nil {
+					return nil, &PageError{int64(id) * int64(dt.p.hdr.pageSize), fmt.Errorf("%w: value of key %q: %v", ErrBadEncoding, k, err)}
+				}
+				leaf.vals[i] = val
+			}
+			leaves = append(leaves, n)
+			return leaf, nil
+		}
+
+		node := n.interior()
+		for i := range node.vals {
+			child, err := load(n.kid(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			node.vals[i] = child
+		}
+		return node, nil
+	}
+	root, err := load(dt.p.hdr.root, 1)
+	if err != nil {
+		return err
+	}
+	t.root = root
+
+	for i, leaf := range leaves {
+		var next pageID
+		if i+1 < len(leaves) {
+			next = leaves[i+1].id
+		}
+		if leaf.next != next {
+			fail(leaf.id, "leaf link", "links to page %d; expected %d", leaf.next, next)
+		}
+	}
+	if len(seen)+dt.p.hdr.free+1 != int(dt.p.hdr.pages) {
+		fail(dt.p.hdr.root, "page count", "%d pages in the tree + %d free + the header != %d pages", len(seen), dt.p.hdr.free, dt.p.hdr.pages)
+	}
+
+	if err, ok := t.Validate().(*ValidationError); ok {
+		violations = append(err.Violations, violations...)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ValidationError{violations}
+}
+
+//Put(key, val) inserts or replaces the value of key, and returns true iff
+//it was inserted. A key of the wrong type is not inserted, as for
+//BpTree.Put(); any other error panics. See PutE().
+func (dt *DiskBpTree) Put(key BptKey, val interface{}) bool {
+	added, err := dt.PutE(key, val)
+	panicUnlessKeyErr(err)
+	return added
+}
+
+//PutE(key, val) is Put(key, val) that returns an error instead of
+//panicking. With a write-ahead log, a PutE() that fails before it is logged
+//changes nothing; see apply().
+func (dt *DiskBpTree) PutE(key BptKey, val interface{}) (bool, error) {
+	var added bool
+	dt.mu.Lock()
+	lsn, err := dt.apply(func() (err error) {
+		added, err = dt.put(key, val)
+		return err
+	})
+	dt.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return added, dt.durable(lsn)
+}
+
+//dt.apply(op) runs op, the body of a Put() or Del(), then logs the pages it
+//changed; see logOp(). If op fails part way, say a page can not be read or
+//written back in the middle of a split, the pages it changed so far are
+//rolled back, along with the header, rather than logged; otherwise they
+//would be replayed after a crash as if the operation were complete.
+//Without a log, the pages may already be written back, so they are left
+//as they are.
+func (dt *DiskBpTree) apply(op func() error) (int64, error) {
+	hdr, kc, keyType := dt.p.hdr, dt.kc, dt.keyType
+	if err := op(); err != nil {
+		if dt.wal != nil {
+			dt.p.pool.rollback()
+			dt.p.hdr, dt.kc, dt.keyType = hdr, kc, keyType
+		}
+		return 0, err
+	}
+	return dt.logOp()
+}
+
+func (dt *DiskBpTree) put(key BptKey, val interface{}) (bool, error) {
+	if dt.closed {
+		return false, ErrClosed
+	}
+	name, kc, err := dt.keyCodec(key)
+	if err != nil {
+		return false, err
+	}
+	kb, err := kc.Encode(key)
+	if err != nil {
+		return false, fmt.Errorf("bptree: encoding key %q: %w", key, err)
+	}
+	vb, err := dt.vc.Encode(val)
+	if err != nil {
+		return false, fmt.Errorf("bptree: encoding value of key %q: %w", key, err)
+	}
+	if size := 8 + len(kb) + len(vb); size > dt.maxEntry {
+		return false, fmt.Errorf("%w: key %q takes %d bytes; at most %d fit", ErrEntryTooLarge, key, size, dt.maxEntry)
+	}
+	if dt.keyType == nil {
+		dt.p.hdr.keyCodec, dt.kc, dt.keyType = name, kc, reflect.TypeOf(key)
+	}
+
+	root, err := dt.load(dt.p.hdr.root)
+	if err != nil {
+		return false, err
+	}
+	added, sep, right, err := dt.insert(root, key, vb)
+	if err != nil {
+		return false, err
+	}
+	if right != nil {
+		node := mkNode(dt.p.hdr.order)
+		node.keys = append(node.keys, sep)
+		node.vals = append(node.vals, pageRef{id: root.id}, pageRef{id: right.id})
+		newRoot := &diskNode{id: dt.p.alloc(), node: node}
+		if err := dt.store(newRoot); err != nil {
+			return false, err
+		}
+		dt.p.hdr.root = newRoot.id
+		dt.p.hdr.height++
+	}
+	if added {
+		dt.p.hdr.entries++
+	}
+	return added, nil
+}
+
+//insert(n, key, val) inserts key into the subtree rooted at n. If n is
+//split, it returns the new right node and the separator key for the parent.
+func (dt *DiskBpTree) insert(n *diskNode, key BptKey, val []byte) (added bool, sep BptKey, right *diskNode, err error) {
+	if n.isLeaf() {
+		added = n.node.insert(key, val)
+	} else {
+		child, err := dt.load(n.kid(n.childIndex(key)))
+		if err != nil {
+			return false, nil, nil, err
+		}
+		var cright *diskNode
+		added, sep, cright, err = dt.insert(child, key, val)
+		if err != nil || cright == nil {
+			return added, nil, nil, err
+		}
+		n.node.insert(sep, pageRef{id: cright.id})
+	}
+
+	if n.node.isToBig() {
+		sep, right = dt.split(n)
+		if err := dt.store(right); err != nil {
+			return false, nil, nil, err
+		}
+	}
+	return added, sep, right, dt.store(n)
+}
+
+//split(n) moves the upper half of n into a new node to its right, and
+//returns that node with the separator key for the parent.
+func (dt *DiskBpTree) split(n *diskNode) (BptKey, *diskNode) {
+	node, sep := n.node.split()
+	right := &diskNode{id: dt.p.alloc(), node: node}
+	if n.isLeaf() {
+		right.next, n.next = n.next, right.id
+	}
+	return sep, right
+}
+
+//Del(key) removes key from the tree and returns its value, if it was found.
+//A key of the wrong type is not found, as for BpTree.Del(); any other error
+//panics. See DelE().
+func (dt *DiskBpTree) Del(key BptKey) (interface{}, bool) {
+	val, found, err := dt.DelE(key)
+	panicUnlessKeyErr(err)
+	return val, found
+}
+
+//DelE(key) is Del(key) that returns an error instead of panicking. With a
+//write-ahead log, a DelE() that fails before it is logged changes nothing;
+//see apply().
+func (dt *DiskBpTree) DelE(key BptKey) (interface{}, bool, error) {
+	var vb []byte
+	var found bool
+	dt.mu.Lock()
+	lsn, err := dt.apply(func() (err error) {
+		vb, found, err = dt.del(key)
+		return err
+	})
+	dt.mu.Unlock()
+	if err != nil || !found {
+		return nil, false, err
+	}
+	err = dt.durable(lsn)
+
+	//a value that can not be decoded is deleted all the same
+	val, derr := dt.vc.Decode(vb)
+	if derr != nil {
+		return nil, true, fmt.Errorf("%w: value of key %q: %v", ErrBadEncoding, key, derr)
+	}
+	return val, true, err
+}
+
+//del(key) removes key and returns its encoded value, if it was found.
+func (dt *DiskBpTree) del(key BptKey) ([]byte, bool, error) {
+	if dt.closed {
+		return nil, false, ErrClosed
+	}
+	if key == nil || dt.keyType != nil && reflect.TypeOf(key) != dt.keyType {
+		return nil, false, &KeyTypeError{key, dt.keyType}
+	}
+	if dt.keyType == nil {
+		return nil, false, nil
+	}
+
+	root, err := dt.load(dt.p.hdr.root)
+	if err != nil {
+		return nil, false, err
+	}
+	vb, found, err := dt.remove(root, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	dt.p.hdr.entries--
+	if !root.isLeaf() && root.numKeys() == 0 {
+		dt.p.hdr.root = root.kid(0)
+		dt.p.hdr.height--
+		if err := dt.p.free(root.id); err != nil {
+			return nil, false, err
+		}
+	}
+	return vb, true, nil
+}
+
+//remove(n, key) removes key from the subtree rooted at n, leaving it to the
+//caller to fix n if it is left less than half full.
+func (dt *DiskBpTree) remove(n *diskNode, key BptKey) ([]byte, bool, error) {
+	if n.isLeaf() {
+		i, found := n.find(key)
+		if !found {
+			return nil, false, nil
+		}
+		leaf := n.leaf()
+		vb := leaf.vals[i].([]byte)
+		leaf.keys = append(leaf.keys[:i], leaf.keys[i+1:]...)
+		leaf.vals = append(leaf.vals[:i], leaf.vals[i+1:]...)
+		return vb, true, dt.store(n)
+	}
+
+	i := n.childIndex(key)
+	child, err := dt.load(n.kid(i))
+	if err != nil {
+		return nil, false, err
+	}
+	vb, found, err := dt.remove(child, key)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	if child.node.size() < child.node.halfFullSize() {
+		err = dt.rebalance(n, i, child)
+	}
+	return vb, true, err
+}
+
+//rebalance(parent, i, child) refills child, the i'th child of parent, by
+//stealing from a peer that can spare an entry, or else by merging it with
+//a peer, the same as tree.Del() does. parent is written, but may be left
+//less than half full.
+func (dt *DiskBpTree) rebalance(parent *diskNode, i int, child *diskNode) error {
+	p := parent.interior()
+	var left, right *diskNode
+	var err error
+	if i > 0 {
+		if left, err = dt.load(parent.kid(i - 1)); err != nil {
+			return err
+		}
+		if left.node.size() > left.node.halfFullSize() {
+			p.keys[i-1] = child.node.stealLeft(left.node, p.keys[i-1])
+			return dt.storeAll(left, child, parent)
+		}
+	}
+	if i+1 < len(p.vals) {
+		if right, err = dt.load(parent.kid(i + 1)); err != nil {
+			return err
+		}
+		if right.node.size() > right.node.halfFullSize() {
+			p.keys[i] = child.node.stealRight(right.node, p.keys[i])
+			return dt.storeAll(child, right, parent)
+		}
+	}
+
+	if left != nil {
+		dt.merge(parent, i-1, left, child)
+		if err := dt.storeAll(left, parent); err != nil {
+			return err
+		}
+		return dt.p.free(child.id)
+	}
+	dt.merge(parent, i, child, right)
+	if err := dt.storeAll(child, parent); err != nil {
+		return err
+	}
+	return dt.p.free(right.id)
+}
+
+func (dt *DiskBpTree) storeAll(nodes ...*diskNode) error {
+	for _, n := range nodes {
+		if err := dt.store(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//merge(parent, i, left, right) moves everything in right, the i+1'th child
+//of parent, into left, the i'th, and removes right from parent. The page of
+//right is left to the caller to free.
+func (dt *DiskBpTree) merge(parent *diskNode, i int, left, right *diskNode) {
+	p := parent.interior()
+	left.node.mergeRight(right.node, p.keys[i])
+	if left.isLeaf() {
+		left.next = right.next
+	}
+	p.keys = append(p.keys[:i], p.keys[i+1:]...)
+	p.vals = append(p.vals[:i+1], p.vals[i+2:]...)
+}
+
+//DiskStats describes the shape of a DiskBpTree, its file and the use of
+//its buffer pool; see DiskBpTree.Stats().
+type DiskStats struct {
+	Height    int //levels of nodes; 1 is just a root leaf
+	Entries   int
+	Pages     int //in the file, the header included
+	FreePages int //on the free list
+
+	CachedPages int //in the buffer pool
+	DirtyPages  int //in the pool, but not yet written back
+	PinnedPages int
+
+	LogBytes int64 //in the write-ahead log since the last checkpoint
+
+	//counted since the tree was opened, or ResetStats()
+	Hits       uint64 //page reads found in the pool
+	Misses     uint64 //page reads from the file
+	Evictions  uint64
+	WriteBacks uint64 //dirty pages written to the file
+}
+
+//Stats() returns the DiskStats of the tree.
+func (dt *DiskBpTree) Stats() DiskStats {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+	var ds DiskStats
+	ds.Height = dt.p.hdr.height
+	ds.Entries = dt.p.hdr.entries
+	ds.Pages = int(dt.p.hdr.pages)
+	ds.FreePages = dt.p.hdr.free
+	dt.p.pool.stats(&ds)
+	if dt.wal != nil {
+		ds.LogBytes = dt.wal.size()
+	}
+	return ds
+}
+
+//ResetStats() zeroes the counters of the buffer pool.
+func (dt *DiskBpTree) ResetStats() {
+	dt.p.pool.resetStats()
+}
+
+//Sync() writes back every dirty page, then the header, and flushes the
+//file, making every change so far durable. With a write-ahead log, it is a
+//checkpoint.
+func (dt *DiskBpTree) Sync() error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.closed {
+		return ErrClosed
+	}
+	return dt.checkpoint()
+}
+
+//Close() calls Sync() and closes the file.
+func (dt *DiskBpTree) Close() error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.closed {
+		return ErrClosed
+	}
+	dt.closed = true
+	err := dt.checkpoint()
+	if dt.wal != nil {
+		if cerr := dt.wal.close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := dt.p.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
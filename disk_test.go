@@ -0,0 +1,360 @@
+package bptree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//_diskCheck(t, dt) checks dt with Validate() and returns the number of pages
+//in use.
+func _diskCheck(t *testing.T, dt *DiskBpTree) int {
+	t.Helper()
+	if err := dt.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	return int(dt.p.hdr.pages) - dt.p.hdr.free - 1
+}
+
+func TestDiskBpTree(t *testing.T) {
+	for _, order := range []int{3, 4, 7} {
+		path := filepath.Join(t.TempDir(), "tree")
+		dt, err := OpenDiskBpTree(path, DiskOrder(order), DiskPageSize(minPageSize))
+		if err != nil {
+			t.Fatalf("OpenDiskBpTree() = %v", err)
+		}
+
+		want := make(map[string]int)
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			added, err := dt.PutE(ent.key, ent.val)
+			if err != nil || !added {
+				t.Fatalf("order=%d: Put(%q) = %v, %v", order, ent.key, added, err)
+			}
+			want[string(ent.key.(StringKey))] = ent.val
+		}
+		_diskCheck(t, dt)
+
+		for i, ent := range genRandomizedEntries(largeNumEnts) {
+			if i%3 == 0 {
+				continue
+			}
+			val, found, err := dt.DelE(ent.key)
+			if err != nil || !found || val != ent.val {
+				t.Fatalf("order=%d: Del(%q) = %v, %v, %v", order, ent.key, val, found, err)
+			}
+			delete(want, string(ent.key.(StringKey)))
+			if i%97 == 0 {
+				_diskCheck(t, dt)
+			}
+		}
+		_diskCheck(t, dt)
+		if err := dt.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+
+		//reopened with other options, even ones too big for its pages, the
+		//file keeps its own
+		if dt, err = OpenDiskBpTree(path, DiskOrder(300), DiskPageSize(minPageSize)); err != nil {
+			t.Fatalf("reopening: %v", err)
+		}
+		if dt.Order() != order || dt.NumberOfEntries() != len(want) {
+			t.Fatalf("reopened with order=%d and %d entries; expected %d and %d", dt.Order(), dt.NumberOfEntries(), order, len(want))
+		}
+		_diskCheck(t, dt)
+		for _, ent := range largeNumEnts {
+			val, found, err := dt.GetE(ent.key)
+			if w, ok := want[string(ent.key.(StringKey))]; err != nil || found != ok || ok && val != w {
+				t.Fatalf("Get(%q) = %v, %v, %v; expected %v, %v", ent.key, val, found, err, w, ok)
+			}
+		}
+
+		var got []string
+		lo, hi := StringKey("ba"), StringKey("ca")
+		err = dt.RangeContext(context.Background(), lo, hi, func(k BptKey, v interface{}) bool {
+			got = append(got, string(k.(StringKey)))
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Range() = %v", err)
+		}
+		var expected []string
+		for _, ent := range largeNumEnts {
+			if k := ent.key; !k.LessThan(lo) && k.LessThan(hi) && want[string(k.(StringKey))] != 0 {
+				expected = append(expected, string(k.(StringKey)))
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Range(%q, %q) = %v; expected %v", lo, hi, got, expected)
+		}
+		dt.Close()
+	}
+}
+
+func TestDiskFreeList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	dt, err := OpenDiskBpTree(path, DiskOrder(4), DiskPageSize(minPageSize))
+	if err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	defer dt.Close()
+
+	for _, ent := range largeNumEnts {
+		dt.Put(ent.key, ent.val)
+	}
+	pages := dt.p.hdr.pages
+	for _, ent := range largeNumEnts {
+		dt.Del(ent.key)
+	}
+	if n := _diskCheck(t, dt); n != 1 || dt.p.hdr.free != int(pages)-2 {
+		t.Fatalf("an empty tree uses %d pages with %d free; expected 1 and %d", n, dt.p.hdr.free, pages-2)
+	}
+
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		dt.Put(ent.key, ent.val)
+	}
+	_diskCheck(t, dt)
+	if dt.p.hdr.pages > pages+pages/2 {
+		t.Fatalf("the file grew from %d to %d pages despite the free list", pages, dt.p.hdr.pages)
+	}
+}
+
+type unregisteredKey struct{ StringKey }
+
+func TestDiskErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := OpenDiskBpTree(filepath.Join(dir, "small"), DiskOrder(32), DiskPageSize(minPageSize)); err == nil {
+		t.Fatal("OpenDiskBpTree() with pages too small for the order did not fail")
+	}
+
+	path := filepath.Join(dir, "tree")
+	dt, err := OpenDiskBpTree(path, DiskPageSize(minPageSize), DiskOrder(4))
+	if err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	if _, err := dt.PutE(StringKey(strings.Repeat("x", 200)), 1); !errors.Is(err, ErrEntryTooLarge) {
+		t.Fatalf("Put() of a large key = %v; expected ErrEntryTooLarge", err)
+	}
+	if _, err := dt.PutE(unregisteredKey{"a"}, 1); !errors.Is(err, ErrNoCodec) {
+		t.Fatalf("Put() of a key without a KeyCodec = %v; expected ErrNoCodec", err)
+	}
+	dt.Put(StringKey("a"), 1)
+	if _, err := dt.PutE(ByteSliceKey("b"), 2); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("Put() of a ByteSliceKey = %v; expected ErrKeyTypeMismatch", err)
+	}
+	var ke *KeyTypeError
+	noop := func(BptKey, interface{}) bool { return true }
+	if err := dt.RangeContext(context.Background(), nil, ByteSliceKey("z"), noop); !errors.As(err, &ke) || ke.Key == nil {
+		t.Fatalf("Range() to a ByteSliceKey = %v; expected a *KeyTypeError", err)
+	}
+	if err := dt.RangeContext(context.Background(), ByteSliceKey("a"), nil, noop); !errors.As(err, &ke) {
+		t.Fatalf("Range() from a ByteSliceKey = %v; expected a *KeyTypeError", err)
+	}
+	//as for a BpTree, a key of the wrong type is not found, or not added
+	if _, found := dt.Get(ByteSliceKey("a")); found {
+		t.Fatal("Get() of a ByteSliceKey found it")
+	}
+	if dt.Put(ByteSliceKey("b"), 2) || dt.NumberOfEntries() != 1 {
+		t.Fatal("Put() of a ByteSliceKey added it")
+	}
+	dt.Close()
+	if _, _, err := dt.GetE(StringKey("a")); err != ErrClosed {
+		t.Fatalf("Get() after Close() = %v; expected ErrClosed", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrClosed {
+				t.Fatalf("Get() after Close() panicked with %v; expected ErrClosed", r)
+			}
+		}()
+		dt.Get(StringKey("a"))
+	}()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'X'
+	os.WriteFile(path, data, 0644)
+	if _, err := OpenDiskBpTree(path); !errors.Is(err, ErrBadEncoding) {
+		t.Fatalf("OpenDiskBpTree() of a bad header = %v; expected ErrBadEncoding", err)
+	}
+
+	//a page that is not a node, with a good checksum
+	data[0] = 'B'
+	data[minPageSize] = 0x7f
+	sealPage(data[minPageSize : 2*minPageSize])
+	os.WriteFile(path, data, 0644)
+	dt, err = OpenDiskBpTree(path)
+	if err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	defer dt.Close()
+	var pe *PageError
+	if _, _, err := dt.GetE(StringKey(string(rune('a' + rand.Intn(26))))); !errors.Is(err, ErrBadEncoding) || !errors.As(err, &pe) || pe.Offset != minPageSize {
+		t.Fatalf("Get() from a bad page = %v; expected a *PageError at %d of ErrBadEncoding", err, minPageSize)
+	}
+}
+
+func TestDiskChecksums(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	dt, err := OpenDiskBpTree(path, DiskOrder(4), DiskPageSize(minPageSize))
+	if err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		dt.Put(ent.key, ent.val)
+	}
+	//the leaves in order, and the entries before each
+	var leaves []pageID
+	var before []int
+	n := 0
+	for leaf, _ := dt.findLeaf(nil); leaf != nil; {
+		leaves = append(leaves, leaf.id)
+		before = append(before, n)
+		n += leaf.numKeys()
+		if leaf.next == 0 {
+			break
+		}
+		leaf, _ = dt.load(leaf.next)
+	}
+	if err := dt.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a flipped bit in the header
+	bad := append([]byte(nil), data...)
+	bad[20] ^= 1
+	os.WriteFile(path, bad, 0644)
+	var pe *PageError
+	if _, err := OpenDiskBpTree(path); !errors.Is(err, ErrChecksum) || !errors.As(err, &pe) || pe.Offset != 0 {
+		t.Fatalf("OpenDiskBpTree() of a damaged header = %v; expected a *PageError at 0 of ErrChecksum", err)
+	}
+
+	//a flipped bit in a leaf halfway along
+	l := len(leaves) / 2
+	off := int64(leaves[l]) * minPageSize
+	bad = append([]byte(nil), data...)
+	bad[off+nodeHdr+2] ^= 0x10
+	os.WriteFile(path, bad, 0644)
+	if dt, err = OpenDiskBpTree(path); err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	if _, _, err := dt.GetE(largeNumEnts[before[l]].key); !errors.Is(err, ErrChecksum) || !errors.As(err, &pe) || pe.Offset != off {
+		t.Fatalf("Get() from a damaged leaf = %v; expected a *PageError at %d of ErrChecksum", err, off)
+	}
+	if val, found, err := dt.GetE(largeNumEnts[0].key); err != nil || !found || val != largeNumEnts[0].val {
+		t.Fatalf("Get() from an intact leaf = %v, %v, %v", val, found, err)
+	}
+
+	//the entries before the damaged leaf are recovered
+	into, err := OpenDiskBpTree(filepath.Join(t.TempDir(), "recovered"))
+	if err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	defer into.Close()
+	saved, err := dt.Salvage(func(k BptKey, v interface{}) bool {
+		if _, err := into.PutE(k, v); err != nil {
+			t.Fatalf("Put() = %v", err)
+		}
+		return true
+	})
+	if !errors.As(err, &pe) || pe.Offset != off {
+		t.Fatalf("Salvage() = %v; expected a *PageError at %d", err, off)
+	}
+	if saved != before[l] || !_sameEntries(_diskEntries(t, into), _entryMap(largeNumEnts[:saved])) {
+		t.Fatalf("Salvage() recovered %d entries; expected the first %d", saved, before[l])
+	}
+	dt.Close()
+
+	//an intact tree is salvaged whole
+	os.WriteFile(path, data, 0644)
+	if dt, err = OpenDiskBpTree(path); err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	defer dt.Close()
+	if saved, err := dt.Salvage(func(BptKey, interface{}) bool { return true }); err != nil || saved != len(largeNumEnts) {
+		t.Fatalf("Salvage() of an intact tree = %d, %v; expected %d, nil", saved, err, len(largeNumEnts))
+	}
+}
+
+//The DiskBpTree splits, steals and merges as the in-memory tree does, so
+//the same Put()s and Del()s give both trees the same shape.
+func TestDiskMatchesBpTree(t *testing.T) {
+	for _, order := range []int{3, 4, 5, 8, 32} {
+		dt, err := OpenDiskBpTree(filepath.Join(t.TempDir(), "tree"), DiskOrder(order))
+		if err != nil {
+			t.Fatalf("OpenDiskBpTree() = %v", err)
+		}
+		bpt := NewBpTree(order)
+
+		same := func(when string) {
+			t.Helper()
+			pages := _diskCheck(t, dt)
+			s, ds := bpt.Stats(), dt.Stats()
+			if ds.Height != s.Height || pages != s.LeafNodes+s.InteriorNodes || ds.Entries != s.Entries {
+				t.Fatalf("order=%d: after %s the DiskBpTree has height %d, %d nodes and %d entries; the BpTree has %d, %d and %d",
+					order, when, ds.Height, pages, ds.Entries, s.Height, s.LeafNodes+s.InteriorNodes, s.Entries)
+			}
+			var got, expected []string
+			dt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+				got = append(got, fmt.Sprintf("%s=%v", k, v))
+				return true
+			})
+			bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+				expected = append(expected, fmt.Sprintf("%s=%v", k, v))
+				return true
+			})
+			if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Fatalf("order=%d: after %s the entries differ", order, when)
+			}
+		}
+
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			dt.Put(ent.key, ent.val)
+			bpt.Put(ent.key, ent.val)
+		}
+		same("Put()")
+		for i, ent := range genRandomizedEntries(largeNumEnts) {
+			if i%4 == 0 {
+				continue
+			}
+			dt.Del(ent.key)
+			bpt.Del(ent.key)
+			if i%61 == 0 {
+				same("Del()")
+			}
+		}
+		same("Del()")
+		dt.Close()
+	}
+}
+
+func TestDiskValidate(t *testing.T) {
+	dt, err := OpenDiskBpTree(filepath.Join(t.TempDir(), "tree"), DiskOrder(3), DiskPageSize(minPageSize))
+	if err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	defer dt.Close()
+	for _, ent := range largeNumEnts[:50] {
+		dt.Put(ent.key, ent.val)
+	}
+
+	//unlink the first leaf from the rest
+	leaf, _ := dt.findLeaf(nil)
+	leaf.next = 0
+	dt.store(leaf)
+
+	var ve *ValidationError
+	if err := dt.Validate(); !errors.Is(err, ErrCorrupt) || !errors.As(err, &ve) || ve.Violations[0].Rule != "leaf link" {
+		t.Fatalf("Validate() = %v; expected a leaf link violation", err)
+	}
+}
@@ -0,0 +1,373 @@
+package bptree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+//ErrBadDump is matched, via errors.Is(), by the error LoadJSON() returns
+//for a document that is not a tree written by DumpJSON().
+var ErrBadDump = errors.New("bptree: invalid JSON tree dump")
+
+//JSONOption modifies how DumpJSON() encodes, or LoadJSON() decodes, the keys
+//and values of a tree.
+type JSONOption func(*jsonOptions)
+
+type jsonOptions struct {
+	encKey func(BptKey) ([]byte, error)
+	decKey func([]byte) (BptKey, error)
+	encVal func(interface{}) ([]byte, error)
+	decVal func([]byte) (interface{}, error)
+}
+
+func jsonOpts(opts []JSONOption) jsonOptions {
+	var jo = jsonOptions{
+		encKey: func(k BptKey) ([]byte, error) { return json.Marshal(k) },
+		encVal: json.Marshal,
+		decVal: func(b []byte) (interface{}, error) {
+			var v interface{}
+			err := json.Unmarshal(b, &v)
+			return v, err
+		},
+	}
+	for _, opt := range opts {
+		opt(&jo)
+	}
+	return jo
+}
+
+//JSONKeyEncoder(enc) makes DumpJSON() encode each key with enc instead of
+//json.Marshal().
+func JSONKeyEncoder(enc func(BptKey) ([]byte, error)) JSONOption {
+	return func(jo *jsonOptions) {
+		jo.encKey = enc
+	}
+}
+
+//JSONKeyDecoder(dec) makes LoadJSON() decode each key with dec. It is
+//required for any key type but StringKey and ByteSliceKey.
+func JSONKeyDecoder(dec func([]byte) (BptKey, error)) JSONOption {
+	return func(jo *jsonOptions) {
+		jo.decKey = dec
+	}
+}
+
+//JSONValueEncoder(enc) makes DumpJSON() encode each value with enc instead
+//of json.Marshal().
+func JSONValueEncoder(enc func(interface{}) ([]byte, error)) JSONOption {
+	return func(jo *jsonOptions) {
+		jo.encVal = enc
+	}
+}
+
+//JSONValueDecoder(dec) makes LoadJSON() decode each value with dec instead
+//of json.Unmarshal() into an interface{}.
+func JSONValueDecoder(dec func([]byte) (interface{}, error)) JSONOption {
+	return func(jo *jsonOptions) {
+		jo.decVal = dec
+	}
+}
+
+//jsonTree is the document written by DumpJSON(). A sharded tree has Splits
+//and Shards instead of a Root.
+type jsonTree struct {
+	Order   int               `json:"order"`
+	KeyType string            `json:"keyType,omitempty"`
+	Height  int               `json:"height,omitempty"`
+	Entries int               `json:"entries"`
+	Root    *jsonNode         `json:"root,omitempty"`
+	Splits  []json.RawMessage `json:"splits,omitempty"`
+	Shards  []*jsonTree       `json:"shards,omitempty"`
+}
+
+//jsonNode is a leaf if it has Values, an interior node if it has Children.
+type jsonNode struct {
+	Keys     []json.RawMessage `json:"keys"`
+	Values   []json.RawMessage `json:"values,omitempty"`
+	Children []*jsonNode       `json:"children,omitempty"`
+}
+
+//DumpJSON(w, opts...) writes the exact structure of the *tree to w as an
+//indented JSON document; each node with its keys, in order, and either its
+//children or, for a leaf, its values. LoadJSON() reads it back into an
+//identical tree.
+//
+func (t *tree) DumpJSON(w io.Writer, opts ...JSONOption) error {
+	doc, err := t.jsonTree(jsonOpts(opts))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, doc)
+}
+
+func writeJSON(w io.Writer, doc *jsonTree) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func (t *tree) jsonTree(jo jsonOptions) (*jsonTree, error) {
+	var doc = new(jsonTree)
+	doc.Order = t.order
+	doc.Entries = t.numEnts
+	if t.keyType != nil {
+		doc.KeyType = t.keyType.String()
+	} else if keys := nodeKeys(t.root); len(keys) > 0 {
+		//the B-link tree's own Put() does not record the key type
+		doc.KeyType = reflect.TypeOf(keys[0]).String()
+	}
+	root, err := t.jsonNode(t.root, jo)
+	if err != nil {
+		return nil, err
+	}
+	doc.Root = root
+	doc.Height = 1
+	for n := t.root; !n.isLeaf(); n = n.(*interiorNodeS).vals[0] {
+		doc.Height++
+	}
+	return doc, nil
+}
+
+func (t *tree) jsonNode(node nodeI, jo jsonOptions) (*jsonNode, error) {
+	var jn = new(jsonNode)
+	var err error
+	if jn.Keys, err = jsonKeys(nodeKeys(node), jo); err != nil {
+		return nil, err
+	}
+
+	if node.isLeaf() {
+		leaf := node.(*leafNodeS)
+		jn.Values = make([]json.RawMessage, len(leaf.vals))
+		for i, v := range leaf.vals {
+			if jn.Values[i], err = jo.encVal(v); err != nil {
+				return nil, fmt.Errorf("bptree: DumpJSON: value of key %q: %w", leaf.keys[i], err)
+			}
+		}
+		return jn, nil
+	}
+
+	curNode := node.(*interiorNodeS)
+	jn.Children = make([]*jsonNode, len(curNode.vals))
+	for i, child := range curNode.vals {
+		if jn.Children[i], err = t.jsonNode(child, jo); err != nil {
+			return nil, err
+		}
+	}
+	return jn, nil
+}
+
+func jsonKeys(keys []BptKey, jo jsonOptions) ([]json.RawMessage, error) {
+	raw := make([]json.RawMessage, len(keys))
+	for i, k := range keys {
+		var err error
+		if raw[i], err = jo.encKey(k); err != nil {
+			return nil, fmt.Errorf("bptree: DumpJSON: key %q: %w", k, err)
+		}
+	}
+	return raw, nil
+}
+
+//LoadJSON(r, opts...) reads a document written by DumpJSON() and returns a
+//tree with exactly the same structure, keys and values. A dump of a plain,
+//MVCC, latched, B-link or optimistic tree is loaded as a plain NewBpTree();
+//a dump of a sharded tree as a NewShardedBpTree().
+//
+//The loaded tree is checked with Validate(); a *ValidationError is returned
+//if the dump does not describe a valid tree. An order too big for the keys
+//in the dump, see maxLeafJSONOrder, or a node less than half full other than
+//the root is an ErrBadDump, found before the nodes are made.
+func LoadJSON(r io.Reader, opts ...JSONOption) (BpTree, error) {
+	var doc jsonTree
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadDump, err)
+	}
+	jo := jsonOpts(opts)
+
+	if doc.Shards == nil {
+		t, err := loadJSONTree(&doc, jo)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	if doc.Order < 3 || len(doc.Shards) != len(doc.Splits)+1 {
+		return nil, fmt.Errorf("%w: %d shards for %d splits of order %d", ErrBadDump, len(doc.Shards), len(doc.Splits), doc.Order)
+	}
+	splits := make([]BptKey, len(doc.Splits))
+	for i, raw := range doc.Splits {
+		k, err := decodeJSONKey(raw, doc.KeyType, jo)
+		if err != nil {
+			return nil, err
+		}
+		splits[i] = k
+	}
+	for i := 1; i < len(splits); i++ {
+		if !splits[i-1].LessThan(splits[i]) {
+			return nil, fmt.Errorf("%w: splits[%d]=%q is not less than splits[%d]=%q", ErrBadDump, i-1, splits[i-1], i, splits[i])
+		}
+	}
+
+	//the shards are loaded first, as they bound the order
+	trees := make([]*tree, len(doc.Shards))
+	for i, sdoc := range doc.Shards {
+		t, err := loadJSONTree(sdoc, jo)
+		if err != nil {
+			return nil, err
+		}
+		if t.order != doc.Order {
+			return nil, fmt.Errorf("%w: shard %d has order %d; expected %d", ErrBadDump, i, t.order, doc.Order)
+		}
+		trees[i] = t
+	}
+	st := NewShardedBpTree(doc.Order, splits).(*shardedTree)
+	for i, t := range trees {
+		st.shards[i].(*concurrentTree).t = t
+	}
+	if err := st.Validate(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func loadJSONTree(doc *jsonTree, jo jsonOptions) (*tree, error) {
+	if doc == nil || doc.Root == nil {
+		return nil, fmt.Errorf("%w: no root", ErrBadDump)
+	}
+	if doc.Order < 3 {
+		return nil, fmt.Errorf("%w: order=%d", ErrBadDump, doc.Order)
+	}
+	//every node is made with room for order keys
+	if n := jsonKeyCount(doc.Root); doc.Order > n+1 && doc.Order > maxLeafJSONOrder {
+		return nil, fmt.Errorf("%w: order=%d for %d keys", ErrBadDump, doc.Order, n)
+	}
+
+	t := mkTree(doc.Order)
+	root, err := t.loadJSONNode(doc.Root, doc.KeyType, jo, true)
+	if err != nil {
+		return nil, err
+	}
+	t.root = root
+	t.numEnts = doc.Entries
+	if keys := nodeKeys(root); len(keys) > 0 {
+		//only an empty tree has a root without keys
+		t.keyType = reflect.TypeOf(keys[0])
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+//maxLeafJSONOrder is the largest order LoadJSON() accepts for a tree that is
+//a single leaf. The order of a bigger tree is bounded by its keys, as a valid
+//tree of more than one node has at least order keys; see jsonKeyCount().
+const maxLeafJSONOrder = 1024
+
+//jsonKeyCount(jn) returns the number of keys in jn and the nodes below it.
+func jsonKeyCount(jn *jsonNode) int {
+	if jn == nil {
+		return 0
+	}
+	n := len(jn.Keys)
+	for _, jc := range jn.Children {
+		n += jsonKeyCount(jc)
+	}
+	return n
+}
+
+//loadJSONNode(jn, keyType, jo, isRoot) decodes jn and the nodes below it. A
+//node that is not the root must be at least half full, as Validate() would
+//require, so the room made for order keys in each node is bounded by the
+//keys in the dump.
+func (t *tree) loadJSONNode(jn *jsonNode, keyType string, jo jsonOptions, isRoot bool) (nodeI, error) {
+	if jn == nil {
+		return nil, fmt.Errorf("%w: null node", ErrBadDump)
+	}
+	//keys and vals must never outgrow their capacity; see mkLeaf()
+	if len(jn.Keys) > t.order-1 {
+		return nil, fmt.Errorf("%w: node has %d keys; order=%d", ErrBadDump, len(jn.Keys), t.order)
+	}
+	if !isRoot {
+		min := intCeil(t.order-1, 2)
+		if jn.Children != nil {
+			min = intCeil(t.order, 2) - 1
+		}
+		if len(jn.Keys) < min {
+			return nil, fmt.Errorf("%w: node has %d keys; order=%d", ErrBadDump, len(jn.Keys), t.order)
+		}
+	}
+
+	keys := make([]BptKey, len(jn.Keys))
+	for i, raw := range jn.Keys {
+		k, err := decodeJSONKey(raw, keyType, jo)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = k
+	}
+
+	if jn.Children == nil {
+		if len(jn.Values) != len(jn.Keys) {
+			return nil, fmt.Errorf("%w: leaf has %d keys and %d values", ErrBadDump, len(jn.Keys), len(jn.Values))
+		}
+		leaf := t.newLeaf()
+		leaf.keys = append(leaf.keys, keys...)
+		for _, raw := range jn.Values {
+			v, err := jo.decVal(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%w: value: %v", ErrBadDump, err)
+			}
+			leaf.vals = append(leaf.vals, v)
+		}
+		return leaf, nil
+	}
+
+	if len(jn.Children) != len(jn.Keys)+1 {
+		return nil, fmt.Errorf("%w: node has %d keys and %d children", ErrBadDump, len(jn.Keys), len(jn.Children))
+	}
+	node := mkNode(t.order)
+	node.gen = t.gen
+	node.sync = t.newSync()
+	node.keys = append(node.keys, keys...)
+	for _, jc := range jn.Children {
+		child, err := t.loadJSONNode(jc, keyType, jo, false)
+		if err != nil {
+			return nil, err
+		}
+		node.vals = append(node.vals, child)
+	}
+	return node, nil
+}
+
+//decodeJSONKey(raw, keyType, jo) decodes a key with the JSONKeyDecoder(), or
+//else as the built-in key type named keyType.
+func decodeJSONKey(raw json.RawMessage, keyType string, jo jsonOptions) (BptKey, error) {
+	if jo.decKey != nil {
+		k, err := jo.decKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key: %v", ErrBadDump, err)
+		}
+		return k, nil
+	}
+
+	switch keyType {
+	case reflect.TypeOf(StringKey("")).String():
+		var k StringKey
+		if err := json.Unmarshal(raw, &k); err != nil {
+			return nil, fmt.Errorf("%w: key: %v", ErrBadDump, err)
+		}
+		return k, nil
+	case reflect.TypeOf(ByteSliceKey(nil)).String():
+		var k ByteSliceKey
+		if err := json.Unmarshal(raw, &k); err != nil {
+			return nil, fmt.Errorf("%w: key: %v", ErrBadDump, err)
+		}
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: no JSONKeyDecoder() for keys of type %q", ErrBadDump, keyType)
+}
@@ -0,0 +1,78 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+//_decodeInt is a JSONValueDecoder() for the int values of the test entries.
+func _decodeInt(b []byte) (interface{}, error) {
+	var i int
+	err := json.Unmarshal(b, &i)
+	return i, err
+}
+
+func TestDumpLoadJSON(t *testing.T) {
+	trees := map[string]BpTree{
+		"empty":   NewBpTree(3),
+		"plain":   NewBpTree(3),
+		"blink":   NewBLinkBpTree(4),
+		"sharded": NewShardedBpTree(3, shardSplits(3)),
+	}
+	for name, bpt := range trees {
+		if name != "empty" {
+			for _, ent := range genRandomizedEntries(largeNumEnts) {
+				bpt.Put(ent.key, ent.val)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := bpt.DumpJSON(&buf); err != nil {
+			t.Fatalf("%s: DumpJSON() = %v", name, err)
+		}
+		dump := buf.String()
+
+		loaded, err := LoadJSON(&buf, JSONValueDecoder(_decodeInt))
+		if err != nil {
+			t.Fatalf("%s: LoadJSON() = %v", name, err)
+		}
+		if loaded.Graph(GraphValues()) != bpt.Graph(GraphValues()) && name != "blink" {
+			t.Fatalf("%s: LoadJSON() did not load an identical tree", name)
+		}
+		if loaded.NumberOfEntries() != bpt.NumberOfEntries() {
+			t.Fatalf("%s: loaded.NumberOfEntries(),%d != %d", name, loaded.NumberOfEntries(), bpt.NumberOfEntries())
+		}
+
+		buf.Reset()
+		loaded.DumpJSON(&buf)
+		if buf.String() != dump {
+			t.Fatalf("%s: the dump of the loaded tree differs:\n%s\nexpected:\n%s", name, buf.String(), dump)
+		}
+	}
+}
+
+func TestLoadJSONErrors(t *testing.T) {
+	bad := []struct {
+		doc string
+		err error
+	}{
+		{`{"order":3`, ErrBadDump},
+		{`{"order":2,"root":{"keys":[]}}`, ErrBadDump},
+		{`{"order":3,"keyType":"bptree.StringKey","root":{"keys":["a","b","c"],"values":[1,2,3]}}`, ErrBadDump},
+		{`{"order":3,"keyType":"bptree.StringKey","root":{"keys":["a"],"values":[]}}`, ErrBadDump},
+		{`{"order":3,"keyType":"main.Key","root":{"keys":["a"],"values":[1]}}`, ErrBadDump},
+		{`{"order":3,"keyType":"bptree.StringKey","entries":2,"root":{"keys":["b","a"],"values":[1,2]}}`, ErrCorrupt},
+		{`{"order":1000000000000,"keyType":"bptree.StringKey","root":{"keys":["a"],"values":[1]}}`, ErrBadDump},
+		{`{"order":1000000000000,"keyType":"bptree.StringKey","splits":[],"shards":[{"order":3,"root":{"keys":[]}}]}`, ErrBadDump},
+		{`{"order":5,"keyType":"bptree.StringKey","root":{"keys":["b"],"children":[{"keys":["a"],"values":[1]},{"keys":["b","c"],"values":[2,3]}]}}`, ErrBadDump},
+	}
+	for _, b := range bad {
+		_, err := LoadJSON(strings.NewReader(b.doc))
+		if !errors.Is(err, b.err) {
+			t.Fatalf("LoadJSON(%s) = %v; expected %v", b.doc, err, b.err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package bptree
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+//ErrInvalidOrder is returned by NewBpTreeE(), and the other constructors
+//ending in E, for an order less than 3.
+var ErrInvalidOrder = errors.New("bptree: order must be at least 3")
+
+//ErrAsOfUnsupported is returned by GetE() given AsOf() on a tree that was not
+//made with NewMVCCBpTree().
+var ErrAsOfUnsupported = errors.New("bptree: AsOf() requires an MVCC tree")
+
+//ErrKeyTypeMismatch is matched, via errors.Is(), by the *KeyTypeError
+//returned when a key is nil or not of the same type as the keys already in
+//the tree.
+var ErrKeyTypeMismatch = errors.New("bptree: key type mismatch")
+
+//ErrCorrupt is matched, via errors.Is(), by the *CorruptError returned when
+//the tree is found to be internally inconsistent.
+var ErrCorrupt = errors.New("bptree: tree is corrupt")
+
+//ErrReadOnly is returned when a read-only Snapshot would be modified.
+var ErrReadOnly = errors.New("bptree: tree is a read-only Snapshot")
+
+//KeyTypeError is returned for a key whose type is not the type, Want, of the
+//keys already in the tree.
+type KeyTypeError struct {
+	Key  BptKey
+	Want reflect.Type
+}
+
+func (e *KeyTypeError) Error() string {
+	if e.Key == nil {
+		return "bptree: key type mismatch: key is nil"
+	}
+	return fmt.Sprintf("bptree: key type mismatch: key %q is a %v; expected a %v", e.Key.String(), reflect.TypeOf(e.Key), e.Want)
+}
+
+//Is(target) makes errors.Is(err, ErrKeyTypeMismatch) true.
+func (e *KeyTypeError) Is(target error) bool {
+	return target == ErrKeyTypeMismatch
+}
+
+//CorruptError describes an internal inconsistency found in the tree.
+type CorruptError struct {
+	Msg string
+}
+
+func (e *CorruptError) Error() string {
+	return "bptree: tree is corrupt: " + e.Msg
+}
+
+//Is(target) makes errors.Is(err, ErrCorrupt) true.
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+//corrupt(format, args...) panics with a *CorruptError. The error returning
+//methods turn it back into an error with t.recoverCorrupt(); everywhere else
+//it is a panic, just as panic() was.
+func corrupt(format string, args ...interface{}) {
+	panic(&CorruptError{fmt.Sprintf(format, args...)})
+}
+
+//t.recoverCorrupt(op, key, errp) stores, and logs, a *CorruptError panic in
+//*errp; any other panic is passed on. It must be deferred.
+func (t *tree) recoverCorrupt(op string, key BptKey, errp *error) {
+	if r := recover(); r != nil {
+		if err, ok := r.(*CorruptError); ok {
+			t.logErr(op, key, err)
+			*errp = err
+			return
+		}
+		panic(r)
+	}
+}
+
+//BpTreeE is a BpTree with methods that return an error, instead of
+//panicking or misbehaving, when given a bad key or when the tree turns out
+//to be corrupt. The methods without the E are thin wrappers; they log a bad
+//key and treat it as not found, as they always have, and panic on any other
+//error.
+type BpTreeE interface {
+	BpTree
+	GetE(key BptKey, opts ...ReadOption) (interface{}, bool, error)
+	PutE(key BptKey, val interface{}) (bool, error)
+	DelE(key BptKey) (interface{}, bool, error)
+}
+
+//NewBpTreeE is NewBpTree() that returns ErrInvalidOrder instead of panicking.
+func NewBpTreeE(order int) (BpTreeE, error) {
+	if order < 3 {
+		return nil, ErrInvalidOrder
+	}
+	return mkTree(order), nil
+}
+
+//panicUnlessKeyErr(err) is how the methods without the E handle the error of
+//their E method. A *KeyTypeError was logged, and the key reads as not found;
+//any other error is a panic.
+func panicUnlessKeyErr(err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(*KeyTypeError); !ok {
+		panic(err)
+	}
+}
+
+//checkKey(key) returns a *KeyTypeError if key is nil or of a different type
+//than the keys already Put() in the *tree.
+func (t *tree) checkKey(key BptKey) error {
+	if key == nil {
+		return &KeyTypeError{key, t.keyType}
+	}
+	if t.keyType != nil && reflect.TypeOf(key) != t.keyType {
+		return &KeyTypeError{key, t.keyType}
+	}
+	return nil
+}
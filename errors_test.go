@@ -0,0 +1,162 @@
+package bptree
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewBpTreeEInvalidOrder(t *testing.T) {
+	bpt, err := NewBpTreeE(2)
+	if err != ErrInvalidOrder || bpt != nil {
+		t.Fatalf("NewBpTreeE(2) = %v, %v; expected nil, ErrInvalidOrder", bpt, err)
+	}
+	if _, err := NewBpTreeE(3); err != nil {
+		t.Fatalf("NewBpTreeE(3) = %v", err)
+	}
+}
+
+func TestKeyTypeMismatch(t *testing.T) {
+	bpt, _ := NewBpTreeE(3)
+	for _, ent := range largeNumEnts {
+		if _, err := bpt.PutE(ent.key, ent.val); err != nil {
+			t.Fatalf("PutE(%q) = %v", ent.key, err)
+		}
+	}
+
+	bad := ByteSliceKey("bad")
+	if _, err := bpt.PutE(bad, 0); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("PutE(ByteSliceKey) = %v; expected ErrKeyTypeMismatch", err)
+	}
+	if _, _, err := bpt.GetE(bad); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("GetE(ByteSliceKey) = %v; expected ErrKeyTypeMismatch", err)
+	}
+	if _, _, err := bpt.DelE(nil); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("DelE(nil) = %v; expected ErrKeyTypeMismatch", err)
+	}
+	if bpt.NumberOfEntries() != len(largeNumEnts) {
+		t.Fatalf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts))
+	}
+
+	snap := bpt.Snapshot().(BpTreeE)
+	if _, err := snap.PutE(largeNumEnts[0].key, 0); err != ErrReadOnly {
+		t.Fatalf("snap.PutE() = %v; expected ErrReadOnly", err)
+	}
+	if _, _, err := snap.GetE(bad); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("snap.GetE(ByteSliceKey) = %v; expected ErrKeyTypeMismatch", err)
+	}
+
+	m := NewMVCCBpTree(3).(BpTreeE)
+	m.Put(StringKey("a"), 1)
+	if _, err := m.PutE(bad, 0); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("mvcc PutE(ByteSliceKey) = %v; expected ErrKeyTypeMismatch", err)
+	}
+	if m.(MVCCBpTree).Version() != 1 {
+		t.Fatalf("mvcc Version(),%d != 1; a failed PutE() must not stamp a version", m.(MVCCBpTree).Version())
+	}
+}
+
+func TestDelECorrupt(t *testing.T) {
+	bpt, _ := NewBpTreeE(3)
+	bpt.Put(StringKey("a"), 1)
+
+	//an interior root with a single child; the leaf has no peers to
+	//steal from or merge with when it underflows.
+	tr := bpt.(*tree)
+	root := mkNode(tr.order)
+	root.gen = tr.gen
+	root.vals = append(root.vals, tr.root)
+	tr.root = root
+
+	_, _, err := bpt.DelE(StringKey("a"))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("DelE() = %v; expected ErrCorrupt", err)
+	}
+	if _, ok := err.(*CorruptError); !ok {
+		t.Fatalf("DelE() error is a %T; expected *CorruptError", err)
+	}
+}
+
+func TestNewEInvalidOrder(t *testing.T) {
+	news := map[string]func(int) (BpTree, error){
+		"concurrent": NewConcurrentBpTreeE,
+		"latched":    NewLatchedBpTreeE,
+		"blink":      NewBLinkBpTreeE,
+		"optimistic": NewOptimisticBpTreeE,
+		"mvcc": func(order int) (BpTree, error) {
+			m, err := NewMVCCBpTreeE(order)
+			if m == nil {
+				return nil, err
+			}
+			return m, err
+		},
+		"sharded": func(order int) (BpTree, error) {
+			st, err := NewShardedBpTreeE(order, shardSplits(3))
+			if st == nil {
+				return nil, err
+			}
+			return st, err
+		},
+	}
+	for name, newE := range news {
+		if bpt, err := newE(2); err != ErrInvalidOrder || bpt != nil {
+			t.Fatalf("%s: new(2) = %v, %v; expected nil, ErrInvalidOrder", name, bpt, err)
+		}
+		if _, err := newE(3); err != nil {
+			t.Fatalf("%s: new(3) = %v", name, err)
+		}
+	}
+
+	splits := shardSplits(3)
+	splits[0], splits[1] = splits[1], splits[0]
+	if _, err := NewShardedBpTreeE(3, splits); err == nil {
+		t.Fatalf("NewShardedBpTreeE() with unordered splits did not fail")
+	}
+}
+
+//Get(), Put() and Del() given a key of the wrong type log it and treat it as
+//not found; they do not panic.
+func TestKeyTypeMismatchWrappers(t *testing.T) {
+	news := map[string]func(int) BpTree{
+		"tree":       NewBpTree,
+		"mvcc":       func(order int) BpTree { return NewMVCCBpTree(order) },
+		"concurrent": NewConcurrentBpTree,
+		"latched":    NewLatchedBpTree,
+		"blink":      NewBLinkBpTree,
+		"optimistic": NewOptimisticBpTree,
+		"sharded":    func(order int) BpTree { return NewShardedBpTree(order, shardSplits(3)) },
+	}
+	bad := ByteSliceKey("bad")
+	for name, newTree := range news {
+		bpt := newTree(3)
+		for _, ent := range largeNumEnts {
+			bpt.Put(ent.key, ent.val)
+		}
+
+		if bpt.Put(bad, 0) {
+			t.Fatalf("%s: Put(ByteSliceKey) = true; expected false", name)
+		}
+		if _, found := bpt.Get(bad); found {
+			t.Fatalf("%s: Get(ByteSliceKey) found it", name)
+		}
+		if _, found := bpt.Del(bad); found {
+			t.Fatalf("%s: Del(ByteSliceKey) found it", name)
+		}
+		if _, found := bpt.Get(nil); found {
+			t.Fatalf("%s: Get(nil) found it", name)
+		}
+		if bpt.NumberOfEntries() != len(largeNumEnts) {
+			t.Fatalf("%s: NumberOfEntries(),%d != %d", name, bpt.NumberOfEntries(), len(largeNumEnts))
+		}
+		if err := bpt.Validate(); err != nil {
+			t.Fatalf("%s: Validate() = %v", name, err)
+		}
+	}
+}
+
+func TestGetEAsOfUnsupported(t *testing.T) {
+	bpt, _ := NewBpTreeE(3)
+	bpt.Put(StringKey("a"), 1)
+	if _, _, err := bpt.GetE(StringKey("a"), AsOf(0)); err != ErrAsOfUnsupported {
+		t.Fatalf("GetE(AsOf(0)) = %v; expected ErrAsOfUnsupported", err)
+	}
+}
@@ -0,0 +1,652 @@
+package bptree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"reflect"
+)
+
+//A frozen tree file is, with every integer little endian:
+//
+//    magic    [4]byte  "BPTF"
+//    version  uint8    frozenVersion
+//    _        [3]byte
+//    order    uint32   of the tree it was frozen from
+//    height   uint32   1 is just a root leaf
+//    entries  uint64
+//    root     uint64   offset of the root node
+//    leaves   uint64   offset of the first leaf
+//    leafEnd  uint64   offset just past the last leaf
+//    nameLen  uint16   length of the name
+//    checksum uint32   CRC-32C of the header, but for these 4 bytes, and the
+//                      name
+//    name     the name the KeyCodec is registered as
+//
+//then the nodes, each at an offset that is a multiple of 8:
+//
+//    type     uint8    pageLeaf or pageInterior
+//    _        uint8
+//    count    uint16   number of keys
+//    size     uint32   of the node, in bytes, these 16 included
+//    checksum uint32   CRC-32C of the node, but for these 4 bytes
+//    _        uint32
+//    leaf     count times: uint32 offset, from the node, of entry i; then
+//             count times: uint32 length, then the encoded key;
+//                          uint32 length, then the encoded value
+//    interior count+1 times: uint64 offset of child i; then
+//             count times: uint32 offset, from the node, of key i; then
+//             count times: uint32 length, then the encoded key
+//
+//The leaves come first, in key order and back to back, so a range scan
+//walks from one to the next; then each level of interior nodes, up to the
+//root. The offset tables let Get() and Range() binary search a node in
+//place, decoding only the keys they compare; the checksum of each node is
+//checked as it is visited, so a damaged node is reported as a *PageError
+//rather than misread. See Salvage().
+const (
+	frozenMagic   = "BPTF"
+	frozenVersion = 2
+	frozenHdrLen  = 4 + 1 + 3 + 4 + 4 + 8 + 8 + 8 + 8 + 2 + 4
+	frozenNodeLen = 16 //of the header of a node
+)
+
+//frozenChecksum(b, at) returns the CRC-32C of b but for the 4 bytes at at,
+//where it is kept.
+func frozenChecksum(b []byte, at int) uint32 {
+	crc := crc32.Update(0, castagnoli, b[:at])
+	return crc32.Update(crc, castagnoli, b[at+4:])
+}
+
+//FrozenOption sets a parameter of Freeze() or OpenFrozen().
+type FrozenOption func(*frozenOptions)
+
+type frozenOptions struct {
+	vcodec ValueCodec
+}
+
+func frozenOpts(opts []FrozenOption) frozenOptions {
+	var fo = frozenOptions{vcodec: DefaultValueCodec}
+	for _, opt := range opts {
+		opt(&fo)
+	}
+	return fo
+}
+
+//FrozenValueCodec(vc) makes Freeze() encode, and OpenFrozen() decode, the
+//values with vc instead of DefaultValueCodec.
+func FrozenValueCodec(vc ValueCodec) FrozenOption {
+	return func(fo *frozenOptions) {
+		fo.vcodec = vc
+	}
+}
+
+//frozenWriter writes the nodes of a frozen tree, keeping the offset.
+type frozenWriter struct {
+	w   *bufio.Writer
+	off uint64
+	err error
+}
+
+func (fw *frozenWriter) write(p []byte) {
+	if fw.err != nil {
+		return
+	}
+	var n int
+	n, fw.err = fw.w.Write(p)
+	fw.off += uint64(n)
+}
+
+func (fw *frozenWriter) align() {
+	var zero [8]byte
+	fw.write(zero[:(8-fw.off%8)%8])
+}
+
+//node(typ, kids, keys, vals) writes one node and returns its offset. The
+//kids are only for an interior node, the vals only for a leaf.
+func (fw *frozenWriter) node(typ byte, kids []uint64, keys, vals [][]byte) uint64 {
+	le := binary.LittleEndian
+	fw.align()
+	off := fw.off
+
+	size := frozenNodeLen + 4*len(keys) + 8*len(kids)
+	for i, k := range keys {
+		size += 4 + len(k)
+		if vals != nil {
+			size += 4 + len(vals[i])
+		}
+	}
+	b := make([]byte, size)
+	b[0] = typ
+	le.PutUint16(b[2:], uint16(len(keys)))
+	le.PutUint32(b[4:], uint32(size))
+	p := frozenNodeLen
+	for _, kid := range kids {
+		le.PutUint64(b[p:], kid)
+		p += 8
+	}
+	table, p := p, p+4*len(keys)
+	for i, k := range keys {
+		le.PutUint32(b[table+4*i:], uint32(p))
+		le.PutUint32(b[p:], uint32(len(k)))
+		p += 4 + copy(b[p+4:], k)
+		if vals != nil {
+			le.PutUint32(b[p:], uint32(len(vals[i])))
+			p += 4 + copy(b[p+4:], vals[i])
+		}
+	}
+	le.PutUint32(b[8:], frozenChecksum(b, 8))
+	fw.write(b)
+	return off
+}
+
+//Freeze(bpt, path, opts...) writes a Snapshot() of bpt to a new frozen tree
+//file at path, replacing any file there only once it is complete; see
+//OpenFrozen(). The nodes are packed as full as spread() allows. The keys are
+//encoded by the KeyCodec registered for their type, and the values by
+//FrozenValueCodec() or DefaultValueCodec.
+func Freeze(bpt BpTree, path string, opts ...FrozenOption) error {
+	fo := frozenOpts(opts)
+	snap := bpt.Snapshot()
+	order := snap.Order()
+	count := snap.NumberOfEntries()
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	fw := &frozenWriter{w: bufio.NewWriter(f)}
+	fw.write(make([]byte, frozenHdrLen)) //written last
+
+	//the leaves; lows[i] is the lowest key of offs[i]
+	var offs []uint64
+	var lows [][]byte
+	var name string
+	var kc KeyCodec
+	var keys, vals [][]byte
+	bounds := spread(count, order-1)
+	n := 0
+	snap.Range(nil, nil, func(k BptKey, v interface{}) bool {
+		if n == 0 {
+			if name, kc, err = keyCodecFor(reflect.TypeOf(k)); err != nil {
+				return false
+			}
+			fw.write([]byte(name))
+		}
+		var kb, vb []byte
+		if kb, err = kc.Encode(k); err != nil {
+			err = fmt.Errorf("bptree: encoding key %q: %w", k, err)
+			return false
+		}
+		if vb, err = fo.vcodec.Encode(v); err != nil {
+			err = fmt.Errorf("bptree: encoding value of key %q: %w", k, err)
+			return false
+		}
+		keys, vals = append(keys, kb), append(vals, vb)
+		n++
+		if n == bounds[len(offs)+1] {
+			offs = append(offs, fw.node(pageLeaf, nil, keys, vals))
+			lows = append(lows, keys[0])
+			keys, vals = keys[:0:0], vals[:0:0]
+		}
+		return fw.err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if n != count {
+		return fmt.Errorf("bptree: Freeze: %d entries were found; expected %d", n, count)
+	}
+	if count == 0 {
+		offs = append(offs, fw.node(pageLeaf, nil, nil, [][]byte{}))
+		lows = append(lows, nil)
+	}
+	leaves, leafEnd := offs[0], fw.off
+
+	height := 1
+	for len(offs) > 1 {
+		var up []uint64
+		var upLows [][]byte
+		bounds := spread(len(offs), order)
+		for i := 1; i < len(bounds); i++ {
+			lo, hi := bounds[i-1], bounds[i]
+			up = append(up, fw.node(pageInterior, offs[lo:hi], lows[lo+1:hi], nil))
+			upLows = append(upLows, lows[lo])
+		}
+		offs, lows = up, upLows
+		height++
+	}
+	if fw.err == nil {
+		fw.err = fw.w.Flush()
+	}
+	if fw.err != nil {
+		return fw.err
+	}
+
+	le := binary.LittleEndian
+	hdr := make([]byte, frozenHdrLen)
+	copy(hdr, frozenMagic)
+	hdr[4] = frozenVersion
+	le.PutUint32(hdr[8:], uint32(order))
+	le.PutUint32(hdr[12:], uint32(height))
+	le.PutUint64(hdr[16:], uint64(count))
+	le.PutUint64(hdr[24:], offs[0])
+	le.PutUint64(hdr[32:], leaves)
+	le.PutUint64(hdr[40:], leafEnd)
+	le.PutUint16(hdr[48:], uint16(len(name)))
+	le.PutUint32(hdr[50:], frozenChecksum(append(hdr, name...), 50))
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//FrozenBpTree is a read-only B+Tree in a file written by Freeze(). The file
+//is mapped into memory, and Get() and Range() work on the mapped bytes,
+//decoding only the keys they compare and the values they return; opening
+//even a huge tree reads nothing but the header. A damaged node is reported
+//as a *PageError; see Salvage().
+//
+//A FrozenBpTree is safe for concurrent use by multiple goroutines, but
+//Close() must not be called while any other method is running.
+type FrozenBpTree struct {
+	data    []byte
+	kc      KeyCodec
+	keyType reflect.Type
+	vc      ValueCodec
+	order   int
+	height  int
+	entries int
+	root    uint64
+	leaves  uint64
+	leafEnd uint64
+}
+
+//OpenFrozen(path, opts...) maps the frozen tree file at path; see Freeze().
+func OpenFrozen(path string, opts ...FrozenOption) (*FrozenBpTree, error) {
+	fo := frozenOpts(opts)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //the mapping outlives the file
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < frozenHdrLen || fi.Size() != int64(int(fi.Size())) {
+		return nil, fmt.Errorf("%w: a frozen tree of %d bytes", ErrBadEncoding, fi.Size())
+	}
+	data, err := mmapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+	ft, err := openFrozen(data, fo)
+	if err != nil {
+		munmapFile(data)
+		return nil, err
+	}
+	return ft, nil
+}
+
+func openFrozen(data []byte, fo frozenOptions) (*FrozenBpTree, error) {
+	le := binary.LittleEndian
+	if string(data[:4]) != frozenMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrBadEncoding, data[:4])
+	}
+	if data[4] != frozenVersion {
+		return nil, fmt.Errorf("%w: unsupported frozen version %d", ErrBadEncoding, data[4])
+	}
+	var ft = &FrozenBpTree{data: data, vc: fo.vcodec}
+	ft.order = int(le.Uint32(data[8:]))
+	ft.height = int(le.Uint32(data[12:]))
+	ft.entries = int(le.Uint64(data[16:]))
+	ft.root = le.Uint64(data[24:])
+	ft.leaves = le.Uint64(data[32:])
+	ft.leafEnd = le.Uint64(data[40:])
+	nameLen := int(le.Uint16(data[48:]))
+	size := uint64(len(data))
+	if frozenHdrLen+nameLen > len(data) {
+		return nil, &PageError{0, fmt.Errorf("%w: bad frozen header", ErrBadEncoding)}
+	}
+	hdr := data[:frozenHdrLen+nameLen]
+	if stored, sum := le.Uint32(hdr[50:]), frozenChecksum(hdr, 50); stored != sum {
+		return nil, &PageError{0, fmt.Errorf("%w: stored %08x; computed %08x", ErrChecksum, stored, sum)}
+	}
+	if ft.height < 1 || ft.root >= size || ft.leaves > ft.leafEnd || ft.leafEnd > size {
+		return nil, &PageError{0, fmt.Errorf("%w: bad frozen header", ErrBadEncoding)}
+	}
+	if name := string(hdr[frozenHdrLen:]); name != "" {
+		var err error
+		if ft.kc, err = keyCodecNamed(name); err != nil {
+			return nil, err
+		}
+		ft.keyType = keyTypeNamed(name)
+	}
+	return ft, nil
+}
+
+//frozenNode is a node of a FrozenBpTree; b holds its bytes, in the mapping.
+type frozenNode struct {
+	off   uint64
+	b     []byte
+	leaf  bool
+	count int
+}
+
+//bad(format, args...) returns the *PageError of n for a decoding error.
+func (n frozenNode) bad(format string, args ...interface{}) error {
+	return &PageError{int64(n.off), fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))}
+}
+
+//node(off) returns the node at off, once its checksum is checked.
+func (ft *FrozenBpTree) node(off uint64) (frozenNode, error) {
+	le := binary.LittleEndian
+	var n = frozenNode{off: off}
+	if off%8 != 0 || off+frozenNodeLen > uint64(len(ft.data)) {
+		return frozenNode{}, n.bad("node offset is out of range")
+	}
+	b := ft.data[off:]
+	size := uint64(le.Uint32(b[4:]))
+	n.leaf, n.count = b[0] == pageLeaf, int(le.Uint16(b[2:]))
+	tables := uint64(frozenNodeLen + 4*n.count)
+	if !n.leaf {
+		tables += uint64(8 * (n.count + 1))
+	}
+	if b[0] != pageLeaf && b[0] != pageInterior || size < tables || size > uint64(len(b)) {
+		return frozenNode{}, n.bad("bad node")
+	}
+	n.b = b[:size]
+	if stored, sum := le.Uint32(n.b[8:]), frozenChecksum(n.b, 8); stored != sum {
+		return frozenNode{}, &PageError{int64(off), fmt.Errorf("%w: stored %08x; computed %08x", ErrChecksum, stored, sum)}
+	}
+	return n, nil
+}
+
+//bytes32(p) returns the length prefixed bytes at p, and the offset past
+//them.
+func (n frozenNode) bytes32(p int) ([]byte, int, error) {
+	if p < 0 || p+4 > len(n.b) {
+		return nil, 0, n.bad("node overflows")
+	}
+	l := int(binary.LittleEndian.Uint32(n.b[p:]))
+	if l > len(n.b)-p-4 {
+		return nil, 0, n.bad("node overflows")
+	}
+	return n.b[p+4 : p+4+l], p + 4 + l, nil
+}
+
+func (n frozenNode) tableAt() int {
+	if n.leaf {
+		return frozenNodeLen
+	}
+	return frozenNodeLen + 8*(n.count+1)
+}
+
+func (n frozenNode) child(i int) uint64 {
+	return binary.LittleEndian.Uint64(n.b[frozenNodeLen+8*i:])
+}
+
+func (ft *FrozenBpTree) key(n frozenNode, i int) (BptKey, error) {
+	p := int(binary.LittleEndian.Uint32(n.b[n.tableAt()+4*i:]))
+	kb, _, err := n.bytes32(p)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ft.kc.Decode(kb)
+	if err != nil {
+		return nil, n.bad("key %d: %v", i, err)
+	}
+	return k, nil
+}
+
+func (ft *FrozenBpTree) value(n frozenNode, i int) (interface{}, error) {
+	p := int(binary.LittleEndian.Uint32(n.b[n.tableAt()+4*i:]))
+	_, p, err := n.bytes32(p)
+	if err != nil {
+		return nil, err
+	}
+	vb, _, err := n.bytes32(p)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ft.vc.Decode(vb)
+	if err != nil {
+		return nil, n.bad("value %d: %v", i, err)
+	}
+	return v, nil
+}
+
+//search(n, key, upper) returns the index of the first key of n greater
+//than key, if upper, or else not less than key.
+func (ft *FrozenBpTree) search(n frozenNode, key BptKey, upper bool) (int, error) {
+	lo, hi := 0, n.count
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		k, err := ft.key(n, mid)
+		if err != nil {
+			return 0, err
+		}
+		var below bool //k sorts before the index searched for
+		if upper {
+			below = !key.LessThan(k)
+		} else {
+			below = k.LessThan(key)
+		}
+		if below {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+//findLeaf(key) returns the leaf that would hold key.
+func (ft *FrozenBpTree) findLeaf(key BptKey) (frozenNode, error) {
+	n, err := ft.node(ft.root)
+	for depth := 1; err == nil && depth < ft.height; depth++ {
+		if n.leaf {
+			return n, n.bad("leaf above the bottom")
+		}
+		var i int
+		if i, err = ft.search(n, key, true); err == nil {
+			n, err = ft.node(n.child(i))
+		}
+	}
+	if err == nil && !n.leaf {
+		err = n.bad("interior node at the bottom")
+	}
+	return n, err
+}
+
+func (ft *FrozenBpTree) checkKey(key BptKey) error {
+	if ft.data == nil {
+		return ErrClosed
+	}
+	if key == nil || ft.keyType != nil && reflect.TypeOf(key) != ft.keyType {
+		return &KeyTypeError{key, ft.keyType}
+	}
+	return nil
+}
+
+//Get(key) returns the value of key and whether it was found.
+func (ft *FrozenBpTree) Get(key BptKey) (interface{}, bool, error) {
+	if err := ft.checkKey(key); err != nil {
+		return nil, false, err
+	}
+	if ft.entries == 0 {
+		return nil, false, nil
+	}
+	leaf, err := ft.findLeaf(key)
+	if err != nil {
+		return nil, false, err
+	}
+	i, err := ft.search(leaf, key, false)
+	if err != nil || i == leaf.count {
+		return nil, false, err
+	}
+	k, err := ft.key(leaf, i)
+	if err != nil || !k.Equals(key) {
+		return nil, false, err
+	}
+	v, err := ft.value(leaf, i)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+//Range(lo, hi, fn) calls fn(key, val) for every entry with lo <= key < hi in
+//ascending key order; see BpTree.Range(). A lo or hi of the wrong type is a
+//*KeyTypeError, as for Get().
+func (ft *FrozenBpTree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool) error {
+	if ft.data == nil {
+		return ErrClosed
+	}
+	for _, k := range []BptKey{lo, hi} {
+		if k == nil {
+			continue
+		}
+		if err := ft.checkKey(k); err != nil {
+			return err
+		}
+	}
+	if ft.entries == 0 {
+		return nil
+	}
+
+	var leaf frozenNode
+	var i int
+	var err error
+	if lo != nil {
+		if leaf, err = ft.findLeaf(lo); err != nil {
+			return err
+		}
+		if i, err = ft.search(leaf, lo, false); err != nil {
+			return err
+		}
+	} else if leaf, err = ft.node(ft.leaves); err != nil {
+		return err
+	}
+
+	for {
+		for ; i < leaf.count; i++ {
+			k, err := ft.key(leaf, i)
+			if err != nil {
+				return err
+			}
+			if hi != nil && !k.LessThan(hi) {
+				return nil
+			}
+			v, err := ft.value(leaf, i)
+			if err != nil {
+				return err
+			}
+			if !fn(k, v) {
+				return nil
+			}
+		}
+		if leaf, err = ft.nextLeaf(leaf); err != nil || leaf.b == nil {
+			return err
+		}
+		i = 0
+	}
+}
+
+//nextLeaf(leaf) returns the leaf after leaf; one without bytes if leaf is
+//the last.
+func (ft *FrozenBpTree) nextLeaf(leaf frozenNode) (frozenNode, error) {
+	next := leaf.off + uint64(len(leaf.b))
+	next += (8 - next%8) % 8
+	if next >= ft.leafEnd {
+		return frozenNode{}, nil
+	}
+	leaf, err := ft.node(next)
+	if err == nil && !leaf.leaf {
+		err = leaf.bad("interior node among the leaves")
+	}
+	return leaf, err
+}
+
+//Salvage(fn) calls fn(key, val), in ascending key order, for every entry
+//before the first damaged leaf of the tree, and returns the number of
+//entries passed to fn and the *PageError of that leaf; nil if there was
+//none, or fn returned false. It is Range(nil, nil, fn) for a tree that may
+//be damaged: the interior nodes are not visited, and each leaf is checked
+//to hold keys greater than those before it, and keys and values that can
+//be decoded, before any of its entries is passed to fn. So the entries
+//passed to fn are the intact prefix of the tree; copying them to a new tree
+//recovers it.
+func (ft *FrozenBpTree) Salvage(fn func(BptKey, interface{}) bool) (int, error) {
+	if ft.data == nil {
+		return 0, ErrClosed
+	}
+	if ft.entries == 0 {
+		return 0, nil
+	}
+
+	var last BptKey
+	n := 0
+	leaf, err := ft.node(ft.leaves)
+	if err == nil && !leaf.leaf {
+		err = leaf.bad("interior node among the leaves")
+	}
+	for err == nil && leaf.b != nil {
+		keys := make([]BptKey, leaf.count)
+		vals := make([]interface{}, leaf.count)
+		for i := range keys {
+			if keys[i], err = ft.key(leaf, i); err != nil {
+				return n, err
+			}
+			if last != nil && !last.LessThan(keys[i]) {
+				return n, leaf.bad("key %q is not greater than %q", keys[i], last)
+			}
+			if vals[i], err = ft.value(leaf, i); err != nil {
+				return n, err
+			}
+			last = keys[i]
+		}
+		for i, k := range keys {
+			n++
+			if !fn(k, vals[i]) {
+				return n, nil
+			}
+		}
+		leaf, err = ft.nextLeaf(leaf)
+	}
+	return n, err
+}
+
+//Order() returns the order of the tree it was frozen from.
+func (ft *FrozenBpTree) Order() int {
+	return ft.order
+}
+
+//NumberOfEntries() returns the number of entries in the tree.
+func (ft *FrozenBpTree) NumberOfEntries() int {
+	return ft.entries
+}
+
+//Close() unmaps the file.
+func (ft *FrozenBpTree) Close() error {
+	if ft.data == nil {
+		return ErrClosed
+	}
+	data := ft.data
+	ft.data = nil
+	return munmapFile(data)
+}
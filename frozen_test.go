@@ -0,0 +1,213 @@
+package bptree
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	trees := map[string]BpTree{
+		"plain":   NewBpTree(3),
+		"mvcc":    NewMVCCBpTree(4),
+		"blink":   NewBLinkBpTree(7),
+		"sharded": NewShardedBpTree(5, shardSplits(3)),
+	}
+	for name, bpt := range trees {
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Put(ent.key, ent.val)
+		}
+		path := filepath.Join(t.TempDir(), "frozen")
+		if err := Freeze(bpt, path); err != nil {
+			t.Fatalf("%s: Freeze() = %v", name, err)
+		}
+		ft, err := OpenFrozen(path)
+		if err != nil {
+			t.Fatalf("%s: OpenFrozen() = %v", name, err)
+		}
+		if ft.NumberOfEntries() != len(largeNumEnts) || ft.Order() != bpt.Order() {
+			t.Fatalf("%s: %d entries of order %d; expected %d of order %d", name, ft.NumberOfEntries(), ft.Order(), len(largeNumEnts), bpt.Order())
+		}
+
+		for _, ent := range largeNumEnts {
+			if val, found, err := ft.Get(ent.key); err != nil || !found || val != ent.val {
+				t.Fatalf("%s: Get(%q) = %v, %v, %v", name, ent.key, val, found, err)
+			}
+		}
+		if _, found, err := ft.Get(StringKey("missing")); err != nil || found {
+			t.Fatalf("%s: Get() of a missing key = %v, %v", name, found, err)
+		}
+		if _, _, err := ft.Get(ByteSliceKey("a")); !errors.Is(err, ErrKeyTypeMismatch) {
+			t.Fatalf("%s: Get() of a ByteSliceKey = %v; expected ErrKeyTypeMismatch", name, err)
+		}
+		var ke *KeyTypeError
+		noop := func(BptKey, interface{}) bool { return true }
+		if err := ft.Range(StringKey("a"), ByteSliceKey("z"), noop); !errors.As(err, &ke) || ke.Key == nil {
+			t.Fatalf("%s: Range() to a ByteSliceKey = %v; expected a *KeyTypeError", name, err)
+		}
+
+		for _, bounds := range [][2]BptKey{{nil, nil}, {StringKey("ba"), StringKey("ca")}, {StringKey("b"), nil}, {nil, StringKey("c")}} {
+			lo, hi := bounds[0], bounds[1]
+			var got, expected []string
+			err := ft.Range(lo, hi, func(k BptKey, v interface{}) bool {
+				got = append(got, string(k.(StringKey)))
+				return true
+			})
+			if err != nil {
+				t.Fatalf("%s: Range() = %v", name, err)
+			}
+			bpt.Range(lo, hi, func(k BptKey, v interface{}) bool {
+				expected = append(expected, string(k.(StringKey)))
+				return true
+			})
+			if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Fatalf("%s: Range(%v, %v) = %v; expected %v", name, lo, hi, got, expected)
+			}
+		}
+		n := 0
+		ft.Range(nil, nil, func(k BptKey, v interface{}) bool {
+			n++
+			return n < 10
+		})
+		if n != 10 {
+			t.Fatalf("%s: Range() went on for %d entries after fn returned false", name, n)
+		}
+
+		if err := ft.Close(); err != nil {
+			t.Fatalf("%s: Close() = %v", name, err)
+		}
+		if _, _, err := ft.Get(largeNumEnts[0].key); err != ErrClosed {
+			t.Fatalf("%s: Get() after Close() = %v; expected ErrClosed", name, err)
+		}
+	}
+}
+
+func TestFreezeEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frozen")
+	if err := Freeze(NewBpTree(3), path); err != nil {
+		t.Fatalf("Freeze() = %v", err)
+	}
+	ft, err := OpenFrozen(path)
+	if err != nil {
+		t.Fatalf("OpenFrozen() = %v", err)
+	}
+	defer ft.Close()
+	if _, found, err := ft.Get(StringKey("a")); err != nil || found {
+		t.Fatalf("Get() = %v, %v on an empty tree", found, err)
+	}
+	err = ft.Range(nil, nil, func(k BptKey, v interface{}) bool {
+		t.Fatalf("Range() found %q in an empty tree", k)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Range() = %v", err)
+	}
+}
+
+func TestFrozenCorrupt(t *testing.T) {
+	bpt := NewBpTree(4)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	path := filepath.Join(t.TempDir(), "frozen")
+	if err := Freeze(bpt, path); err != nil {
+		t.Fatalf("Freeze() = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := append([]byte("XXXX"), data[4:]...)
+	os.WriteFile(path, bad, 0644)
+	if _, err := OpenFrozen(path); !errors.Is(err, ErrBadEncoding) {
+		t.Fatalf("OpenFrozen() of a bad magic = %v; expected ErrBadEncoding", err)
+	}
+
+	//a truncated file has a root beyond its end
+	os.WriteFile(path, data[:len(data)/2], 0644)
+	if _, err := OpenFrozen(path); !errors.Is(err, ErrBadEncoding) {
+		t.Fatalf("OpenFrozen() of a truncated file = %v; expected ErrBadEncoding", err)
+	}
+
+	//a garbled node is found, not followed
+	bad = append([]byte(nil), data...)
+	for i := len(bad) / 4; i < len(bad)/2; i++ {
+		bad[i] = 0xff
+	}
+	os.WriteFile(path, bad, 0644)
+	ft, err := OpenFrozen(path)
+	if err != nil {
+		t.Fatalf("OpenFrozen() = %v", err)
+	}
+	defer ft.Close()
+	err = ft.Range(nil, nil, func(BptKey, interface{}) bool { return true })
+	var pe *PageError
+	if !errors.As(err, &pe) || pe.Offset >= int64(len(bad)/2) {
+		t.Fatalf("Range() over garbled leaves = %v; expected a *PageError of a garbled node", err)
+	}
+
+	//so is a damaged header
+	bad = append([]byte(nil), data...)
+	bad[8] ^= 0x01
+	os.WriteFile(path, bad, 0644)
+	if _, err := OpenFrozen(path); !errors.As(err, &pe) || pe.Offset != 0 || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("OpenFrozen() of a damaged header = %v; expected a *PageError at 0", err)
+	}
+}
+
+func TestFrozenSalvage(t *testing.T) {
+	bpt := NewBpTree(4)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	want := _entries(bpt)
+	path := filepath.Join(t.TempDir(), "frozen")
+	if err := Freeze(bpt, path); err != nil {
+		t.Fatalf("Freeze() = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []entry
+	collect := func(k BptKey, v interface{}) bool {
+		got = append(got, entry{k, v.(int)})
+		return true
+	}
+	ft, err := OpenFrozen(path)
+	if err != nil {
+		t.Fatalf("OpenFrozen() = %v", err)
+	}
+	n, err := ft.Salvage(collect)
+	ft.Close()
+	if err != nil || n != len(want) || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Salvage() of an intact tree = %d, %v; expected %d, nil", n, err, len(want))
+	}
+
+	//one flipped bit, in a leaf, is caught by its checksum
+	bad := append([]byte(nil), data...)
+	at := len(bad) / 3
+	bad[at] ^= 0x10
+	os.WriteFile(path, bad, 0644)
+	if ft, err = OpenFrozen(path); err != nil {
+		t.Fatalf("OpenFrozen() = %v", err)
+	}
+	defer ft.Close()
+	got = nil
+	n, err = ft.Salvage(collect)
+	var pe *PageError
+	if !errors.As(err, &pe) || !errors.Is(err, ErrChecksum) || pe.Offset > int64(at) {
+		t.Fatalf("Salvage() of a damaged leaf = %v; expected a *PageError at or before %d", err, at)
+	}
+	if n == 0 || n >= len(want) || !reflect.DeepEqual(got, want[:n]) {
+		t.Fatalf("Salvage() passed %d entries; expected the %d before the damage of %d", len(got), n, len(want))
+	}
+	if err := ft.Range(nil, nil, func(BptKey, interface{}) bool { return true }); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Range() over a damaged leaf = %v; expected ErrChecksum", err)
+	}
+}
@@ -0,0 +1,150 @@
+package bptree
+
+import (
+	"fmt"
+	"strings"
+)
+
+//GraphOption modifies the Graphviz DOT document made by Graph().
+type GraphOption func(*graphOptions)
+
+type graphOptions struct {
+	values   bool
+	maxDepth int //0 is unlimited
+}
+
+func graphOpts(opts []GraphOption) graphOptions {
+	var gro graphOptions
+	for _, opt := range opts {
+		opt(&gro)
+	}
+	return gro
+}
+
+//GraphValues() makes Graph() show the value of each entry, formatted with
+//%v, under its key.
+func GraphValues() GraphOption {
+	return func(gro *graphOptions) {
+		gro.values = true
+	}
+}
+
+//GraphMaxDepth(depth) makes Graph() show only the nodes less than depth
+//levels below the root; GraphMaxDepth(1) shows just the root. The children
+//of the deepest nodes shown are replaced by a single "..." node. A depth of
+//0 or less shows the whole tree.
+func GraphMaxDepth(depth int) GraphOption {
+	return func(gro *graphOptions) {
+		gro.maxDepth = depth
+	}
+}
+
+//Graph(opts...) returns the tree as a Graphviz DOT document. Each node is a
+//record listing its keys; an interior node has a port between its keys for
+//each child, with an edge to that child. The right-links of a B-link tree
+//are dashed edges.
+//
+//    bpt.Graph(GraphMaxDepth(3))
+//
+//renders, with "dot -Tsvg", the top three levels of a big tree.
+//
+func (t *tree) Graph(opts ...GraphOption) string {
+	var b strings.Builder
+	b.WriteString("digraph bptree {\n")
+	b.WriteString("\tnode [shape=record];\n")
+	t.graph(&b, "n", "\t", graphOpts(opts))
+	b.WriteString("}\n")
+	return b.String()
+}
+
+//graphWriter writes the statements of one tree in a DOT document.
+type graphWriter struct {
+	b      *strings.Builder
+	prefix string //of every node id, so several trees fit in one document
+	indent string
+	opts   graphOptions
+	ids    map[nodeI]string
+	links  []nodeI //nodes with a right-link, in the order they were written
+}
+
+//t.graph(b, prefix, indent, opts) writes the nodes and edges of the tree to
+//b. The node ids all start with prefix.
+func (t *tree) graph(b *strings.Builder, prefix, indent string, opts graphOptions) {
+	g := graphWriter{b: b, prefix: prefix, indent: indent, opts: opts, ids: make(map[nodeI]string)}
+	g.node(t.root, 1)
+
+	//a right-link is only drawn if both ends are shown
+	for _, node := range g.links {
+		next, _ := node.link()
+		if id, ok := g.ids[next]; ok {
+			fmt.Fprintf(g.b, "%s%s -> %s [style=dashed, constraint=false];\n", g.indent, g.ids[node], id)
+		}
+	}
+}
+
+//g.node(node, depth) writes node, and its subtree down to the maximum
+//depth, and returns the id of node.
+func (g *graphWriter) node(node nodeI, depth int) string {
+	id := fmt.Sprintf("%s%d", g.prefix, len(g.ids))
+	g.ids[node] = id
+	if next, _ := node.link(); next != nil {
+		g.links = append(g.links, node)
+	}
+
+	if node.isLeaf() {
+		leaf := node.(*leafNodeS)
+		fields := make([]string, len(leaf.keys))
+		for i, k := range leaf.keys {
+			fields[i] = dotEscape(k.String())
+			if g.opts.values {
+				fields[i] = fmt.Sprintf("{%s|%s}", fields[i], dotEscape(fmt.Sprintf("%v", leaf.vals[i])))
+			}
+		}
+		fmt.Fprintf(g.b, "%s%s [label=\"%s\"];\n", g.indent, id, strings.Join(fields, "|"))
+		return id
+	}
+
+	curNode := node.(*interiorNodeS)
+	fields := make([]string, 0, len(curNode.keys)+len(curNode.vals))
+	for i := range curNode.vals {
+		if i > 0 {
+			fields = append(fields, dotEscape(curNode.keys[i-1].String()))
+		}
+		fields = append(fields, fmt.Sprintf("<c%d>", i))
+	}
+	fmt.Fprintf(g.b, "%s%s [label=\"%s\"];\n", g.indent, id, strings.Join(fields, "|"))
+
+	if g.opts.maxDepth > 0 && depth >= g.opts.maxDepth {
+		more := id + "_more"
+		fmt.Fprintf(g.b, "%s%s [shape=plaintext, label=\"...\"];\n", g.indent, more)
+		fmt.Fprintf(g.b, "%s%s -> %s;\n", g.indent, id, more)
+		return id
+	}
+
+	for i, child := range curNode.vals {
+		childID := g.node(child, depth+1)
+		fmt.Fprintf(g.b, "%s%s:c%d -> %s;\n", g.indent, id, i, childID)
+	}
+	return id
+}
+
+//dotQuote(s) escapes the characters that are special in a quoted DOT string.
+func dotQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+//dotEscape(s) escapes the characters that are special in a DOT record label.
+func dotEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '"', '{', '}', '|', '<', '>', ' ':
+			b.WriteByte('\\')
+		case '\n':
+			b.WriteString(`\n`)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
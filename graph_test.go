@@ -0,0 +1,53 @@
+package bptree
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	bpt := NewBpTree(3)
+	for i, k := range []string{"a", "b", "c", "d", "e"} {
+		bpt.Put(StringKey(k), i)
+	}
+
+	//order 3 holds 5 keys in a root, 2 interior nodes and 4 leaves
+	dot := bpt.Graph()
+	if !strings.HasPrefix(dot, "digraph bptree {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Fatalf("Graph() is not a digraph:\n%s", dot)
+	}
+	if n := strings.Count(dot, "[label="); n != 7 {
+		t.Fatalf("Graph() has %d nodes; expected 7:\n%s", n, dot)
+	}
+	if n := strings.Count(dot, " -> "); n != 6 {
+		t.Fatalf("Graph() has %d edges; expected 6:\n%s", n, dot)
+	}
+	if strings.Contains(dot, "style=dashed") {
+		t.Fatalf("Graph() of a plain tree has right-links:\n%s", dot)
+	}
+
+	dot = bpt.Graph(GraphMaxDepth(1))
+	if n := strings.Count(dot, "[label="); n != 1 || !strings.Contains(dot, `label="..."`) {
+		t.Fatalf("Graph(GraphMaxDepth(1)) is not just the root:\n%s", dot)
+	}
+
+	dot = bpt.Graph(GraphValues())
+	if !strings.Contains(dot, `{d|3}|{e|4}`) {
+		t.Fatalf("Graph(GraphValues()) does not show the values:\n%s", dot)
+	}
+
+	blink := NewBLinkBpTree(3)
+	for i, k := range []string{"a", "b", "c", "d", "e"} {
+		blink.Put(StringKey(k), i)
+	}
+	if n := strings.Count(blink.Graph(), "style=dashed"); n == 0 {
+		t.Fatalf("Graph() of a B-link tree has no right-links:\n%s", blink.Graph())
+	}
+
+	st := NewShardedBpTree(3, []BptKey{StringKey("c")})
+	st.Put(StringKey("a b"), 0)
+	dot = st.Graph()
+	if !strings.Contains(dot, "cluster_1") || !strings.Contains(dot, `a\ b`) {
+		t.Fatalf("Graph() of a sharded tree:\n%s", dot)
+	}
+}
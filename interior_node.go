@@ -2,11 +2,14 @@ package bptree
 
 import (
 	"fmt"
+	"sync"
 )
 
 type interiorNodeS struct {
 	keys []BptKey
 	vals []nodeI
+	gen  uint64    //generation of the *tree that may modify this node in place
+	sync *nodeSync //nil unless the tree is latched; see latch.go
 }
 
 func mkNode(order int) *interiorNodeS {
@@ -25,7 +28,7 @@ func (node *interiorNodeS) swapKeys(oldKey, newKey BptKey) {
 			return
 		}
 	}
-	lgr.Panicf("swapKeys: did not find oldKey=%q to swap for newKey=%q; node=\n%v", oldKey, newKey, node)
+	corrupt("swapKeys: did not find oldKey=%q to swap for newKey=%q; node=\n%v", oldKey, newKey, node)
 }
 
 func (node *interiorNodeS) String() string {
@@ -120,6 +123,8 @@ func (node *interiorNodeS) isToBig() bool {
 func (lNode *interiorNodeS) split() (nodeI, BptKey) {
 	order := lNode.order()
 	rNode := mkNode(order)
+	rNode.gen = lNode.gen
+	rNode.sync = lNode.sync.fresh()
 
 	keySplitIdx := len(lNode.keys) / 2
 	valSplitIdx := len(lNode.vals) / 2
@@ -160,6 +165,13 @@ func (lNode *interiorNodeS) split() (nodeI, BptKey) {
 	//  newKey must come from the left node.keys cuz it has more
 	//  the MIDDLE key is lNode.keys[keySplitIdx-1]
 
+	//publish rNode to the right of lNode for B-link readers
+	if ls := lNode.sync; ls.isBLink() {
+		rs := rNode.sync
+		rs.next, rs.highKey = ls.next, ls.highKey
+		ls.next, ls.highKey = rNode, newKey
+	}
+
 	return rNode, newKey
 }
 
@@ -178,7 +190,7 @@ func (rNode *interiorNodeS) findPeerLeft(parent *interiorNodeS) (nodeI, BptKey)
 			return leftPeerNode, leftPeerKey
 		}
 	}
-	lgr.Panic("findPeerLeft: didn't find rNode(receiver) in parent")
+	corrupt("findPeerLeft: didn't find rNode(receiver) in parent")
 	return nil, nil
 }
 
@@ -197,24 +209,26 @@ func (lNode *interiorNodeS) findPeerRight(parent *interiorNodeS) (nodeI, BptKey)
 			return rightPeerNode, rightPeerKey
 		}
 	}
-	lgr.Panic("findPeerRight: didn't find lNode(receiver) in parent")
+	corrupt("findPeerRight: didn't find lNode(receiver) in parent")
 	return nil, nil
 }
 
-func (rNode *interiorNodeS) stealLeft(lNode_ nodeI) {
+//rNode.stealLeft(lNode, sep) moves the last child of lNode, the left peer of
+//rNode, to the front of rNode. sep is the key separating lNode and rNode in
+//their parent; it becomes the first key of rNode. The new separator, which
+//the caller must swap for sep in the parent, is returned.
+func (rNode *interiorNodeS) stealLeft(lNode_ nodeI, sep BptKey) BptKey {
 	lNode := lNode_.(*interiorNodeS)
 
-	//stolenKey := lNode.keys[len(lNode.keys)-1]
+	stolenKey := lNode.keys[len(lNode.keys)-1]
 	stolenVal := lNode.vals[len(lNode.vals)-1]
 	//this preserves cap(lNode.keys) and cap(lNode.vals)
 	lNode.keys = append(lNode.keys[:0], lNode.keys[:len(lNode.keys)-1]...)
 	lNode.vals = append(lNode.vals[:0], lNode.vals[:len(lNode.vals)-1]...)
 
-	//Before modifying rNode what was its leastKey
-	leastKey := rNode.findLeftMostKey()
-
-	//Now we will insert leastKey as the first key in rNode, because
-	//it is guaranteed to be greater-than anything in the stolen val/node.
+	//Everything in the stolen val/node is less than sep and everything
+	//already in rNode is greater-than-or-equal to sep, so sep is the
+	//first key of rNode.
 
 	//unshift operation that preserves cap(rNode.vals)
 	rNode.vals = append(rNode.vals[:0],
@@ -222,44 +236,100 @@ func (rNode *interiorNodeS) stealLeft(lNode_ nodeI) {
 
 	//unshift operation that preserves cap(rNode.keys)
 	rNode.keys = append(rNode.keys[:0],
-		append([]BptKey{leastKey}, rNode.keys...)...)
-
-	return
+		append([]BptKey{sep}, rNode.keys...)...)
 
+	//stolenKey separated what is left of lNode from the stolen val/node.
+	if ls := lNode.sync; ls.isBLink() {
+		ls.highKey = stolenKey
+	}
+	return stolenKey
 }
 
-func (lNode *interiorNodeS) stealRight(rNode_ nodeI) {
+//lNode.stealRight(rNode, sep) moves the first child of rNode, the right peer
+//of lNode, to the end of lNode. sep is the key separating lNode and rNode in
+//their parent; it becomes the last key of lNode. The new separator, which
+//the caller must swap for sep in the parent, is returned.
+func (lNode *interiorNodeS) stealRight(rNode_ nodeI, sep BptKey) BptKey {
 	rNode := rNode_.(*interiorNodeS)
-	//stolenKey := rNode.keys[0]
+	stolenKey := rNode.keys[0]
 	stolenNode := rNode.vals[0]
 
 	//this preserves cap(rNode.keys) and cap(rNode.vals)
 	rNode.keys = append(rNode.keys[:0], rNode.keys[1:]...)
 	rNode.vals = append(rNode.vals[:0], rNode.vals[1:]...)
 
-	leastKey := stolenNode.findLeftMostKey()
-
-	lNode.keys = append(lNode.keys, leastKey)
+	lNode.keys = append(lNode.keys, sep)
 	lNode.vals = append(lNode.vals, stolenNode)
 
-	return
+	//stolenKey separated the stolen node from what is left of rNode.
+	if ls := lNode.sync; ls.isBLink() {
+		ls.highKey = stolenKey
+	}
+	return stolenKey
 }
 
-func (lNode *interiorNodeS) mergeRight(rNode_ nodeI) {
+//lNode.mergeRight(rNode, sep) appends all of rNode, the right peer of lNode,
+//to lNode. sep is the key separating lNode and rNode in their parent.
+func (lNode *interiorNodeS) mergeRight(rNode_ nodeI, sep BptKey) {
 	rNode := rNode_.(*interiorNodeS)
 
-	leastKey := rNode.findLeftMostKey()
-
 	//For some reason you can't do the following append(...)
-	//   lNode.keys = append(lNode.keys, leastKey, rNode.keys...)
+	//   lNode.keys = append(lNode.keys, sep, rNode.keys...)
 	//you get "too many arguments to append"
-	lNode.keys = append(lNode.keys, leastKey)
+	lNode.keys = append(lNode.keys, sep)
 	lNode.keys = append(lNode.keys, rNode.keys...)
 	lNode.vals = append(lNode.vals, rNode.vals...)
 
+	if ls := lNode.sync; ls.isBLink() {
+		ls.next, ls.highKey = rNode.sync.next, rNode.sync.highKey
+	}
+
 	return
 }
 
+//node.clone(gen, copyVal) recursively copies node and every node below it.
+//The copies have the same cap(keys) and cap(vals), hence the same order, and
+//belong to generation gen.
+func (node *interiorNodeS) clone(gen uint64, copyVal func(interface{}) interface{}) nodeI {
+	nNode := mkNode(node.order())
+	nNode.gen = gen
+	nNode.keys = append(nNode.keys, node.keys...)
+	for _, v := range node.vals {
+		nNode.vals = append(nNode.vals, v.clone(gen, copyVal))
+	}
+	return nNode
+}
+
+//node.copyNode(gen) copies just this node for path-copying. The children are
+//shared with the original node, and the copy keeps a latch if it has one.
+func (node *interiorNodeS) copyNode(gen uint64) nodeI {
+	nNode := mkNode(node.order())
+	nNode.gen = gen
+	nNode.sync = node.sync.fresh()
+	nNode.keys = append(nNode.keys, node.keys...)
+	nNode.vals = append(nNode.vals, node.vals...)
+	return nNode
+}
+
+func (node *interiorNodeS) nodeLatch() *sync.RWMutex {
+	return &node.sync.latch
+}
+
+func (node *interiorNodeS) syncState() *nodeSync {
+	return node.sync
+}
+
+func (node *interiorNodeS) link() (nodeI, BptKey) {
+	if node.sync == nil {
+		return nil, nil
+	}
+	return node.sync.next, node.sync.highKey
+}
+
+func (node *interiorNodeS) generation() uint64 {
+	return node.gen
+}
+
 func (node *interiorNodeS) isLeaf() bool {
 	return false
 	//return cap(node.keys) == cap(node.vals)
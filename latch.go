@@ -0,0 +1,537 @@
+package bptree
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+//nodeSync is what the latched, B-link and optimistic trees keep for a node
+//besides its keys and values: its latch and, for the B-link tree, its
+//right-link and high key, or for the optimistic tree, its version and
+//read-only view. The nodes of every other tree have none; see
+//tree.newSync().
+type nodeSync struct {
+	latch sync.RWMutex
+
+	//The optimistic lock coupling version, odd while a writer has the node
+	//locked, and the copy of the node readers read instead of the node; see
+	//olc.go.
+	version atomic.Uint64
+	view    atomic.Pointer[olcView]
+
+	//The B-link right-link and high key, only maintained if blink is set;
+	//see blink.go. Every key in or below the node is less than highKey, and
+	//next is the node at the same level holding the keys starting at
+	//highKey. A nil highKey is +infinity.
+	blink   bool
+	next    nodeI
+	highKey BptKey
+}
+
+//t.newSync() returns the nodeSync of a new node of the tree; nil unless the
+//tree is latched.
+func (t *tree) newSync() *nodeSync {
+	if !t.latched {
+		return nil
+	}
+	return &nodeSync{blink: t.blink}
+}
+
+//s.fresh() returns the nodeSync of a node split off, or copied from, the
+//node of s; unlatched, not yet linked and with no view. It is nil if s is.
+func (s *nodeSync) fresh() *nodeSync {
+	if s == nil {
+		return nil
+	}
+	return &nodeSync{blink: s.blink}
+}
+
+func (s *nodeSync) isBLink() bool {
+	return s != nil && s.blink
+}
+
+//latchSet is the set of node latches held by one Put() or Del() of the
+//latched tree. A nil *latchSet is valid and does nothing; that is what the
+//plain *tree passes to delLeaf().
+//
+//If olc is set the latches are the optimistic lock coupling versions of the
+//nodes instead of their RWMutex; see olc.go.
+type latchSet struct {
+	root  *sync.RWMutex //non-nil while the latch guarding t.root is held
+	nodes []nodeI       //write latched nodes, in the order they were latched
+	olc   bool
+}
+
+//ls.lock(node) write latches node and remembers to release it.
+func (ls *latchSet) lock(node nodeI) {
+	if ls == nil {
+		return
+	}
+	if ls.olc {
+		olcWriteLock(node)
+	} else {
+		node.nodeLatch().Lock()
+	}
+	ls.nodes = append(ls.nodes, node)
+}
+
+//ls.unlock(node) releases the latch ls.lock(node) took.
+func (ls *latchSet) unlock(node nodeI) {
+	if ls.olc {
+		olcWriteUnlock(node)
+	} else {
+		node.nodeLatch().Unlock()
+	}
+}
+
+//ls.releaseAbove() releases the root latch and every node latch, except the
+//one latched last. This is done once the last node is known to be "safe".
+func (ls *latchSet) releaseAbove() {
+	if ls.root != nil {
+		ls.root.Unlock()
+		ls.root = nil
+	}
+	last := len(ls.nodes) - 1
+	for _, node := range ls.nodes[:last] {
+		ls.unlock(node)
+	}
+	ls.nodes = append(ls.nodes[:0], ls.nodes[last])
+}
+
+//ls.releaseAll() releases every latch in the latchSet.
+func (ls *latchSet) releaseAll() {
+	if ls.root != nil {
+		ls.root.Unlock()
+		ls.root = nil
+	}
+	for _, node := range ls.nodes {
+		ls.unlock(node)
+	}
+	ls.nodes = ls.nodes[:0]
+}
+
+//putSafe(node, isRoot) is true if inserting one more entry (key,val pair or
+//child) into node can not split it.
+func putSafe(node nodeI, isRoot bool) bool {
+	if node.isLeaf() {
+		leaf := node.(*leafNodeS)
+		return len(leaf.keys) < leaf.order()-1
+	}
+	curNode := node.(*interiorNodeS)
+	return len(curNode.keys) < curNode.order()-1
+}
+
+//delSafe(node, isRoot) is true if removing one entry (key,val pair or child)
+//from node can not underflow it, or in the case of the root, collapse it.
+func delSafe(node nodeI, isRoot bool) bool {
+	if isRoot {
+		if node.isLeaf() {
+			return true
+		}
+		return len(node.(*interiorNodeS).keys) > 1
+	}
+	return node.size() > node.halfFullSize()
+}
+
+//latchedTree is a BpTree where writers use latch crabbing, aka lock coupling,
+//on the individual interiorNodeS and leafNodeS latches. A writer holds the
+//latches of the ancestors of a node only until it reaches a node that is
+//safe; one that will not split in Put() or underflow in Del(). So writers
+//touching different leaves proceed in parallel.
+//
+//Operations on the whole tree (Clear, Clone, Snapshot, Begin, the undo
+//journal and String) exclude Get, Put and Del by taking mu exclusively.
+type latchedTree struct {
+	mu        sync.RWMutex //shared by Get/Put/Del; exclusive for the rest
+	rootLatch sync.RWMutex //guards t.root
+	cntMu     sync.Mutex   //guards t.numEnts
+	t         *tree
+}
+
+//NewLatchedBpTree instantiates a new B+Tree, for a given order, that is safe
+//for concurrent use by multiple goroutines; see NewBpTree() for the meaning
+//of order.
+//
+//Unlike NewConcurrentBpTree(), writers are not serialized by one lock.
+//Every node has its own latch and writers use latch crabbing, so Put() and
+//Del() calls that touch different leaves run in parallel.
+//
+//While the undo journal is enabled, see EnableUndo(), Put() and Del() are
+//serialized so the journal records them in the order they happen.
+//
+//NewLatchedBpTree panics if order is less than 3; see NewLatchedBpTreeE().
+func NewLatchedBpTree(order int) BpTree {
+	lt, err := NewLatchedBpTreeE(order)
+	if err != nil {
+		panic(err)
+	}
+	return lt
+}
+
+//NewLatchedBpTreeE is NewLatchedBpTree() that returns ErrInvalidOrder
+//instead of panicking.
+func NewLatchedBpTreeE(order int) (BpTree, error) {
+	if order < 3 {
+		return nil, ErrInvalidOrder
+	}
+	var lt = new(latchedTree)
+	lt.t = mkTree(order)
+	lt.t.latched = true
+	lt.t.root = lt.t.newLeaf()
+	return lt, nil
+}
+
+//findLeafLatched(key, path, ls, safe) descends from the root to the leaf
+//for key, write latching each node before it is looked at. Whenever a node
+//is safe, the latches on its ancestors are released and they are dropped
+//from path. Every node left on path, and the returned leaf, are latched in
+//ls and owned by the current generation of the tree.
+func (lt *latchedTree) findLeafLatched(key BptKey, path *pathT, ls *latchSet, safe func(nodeI, bool) bool) *leafNodeS {
+	t := lt.t
+
+	lt.rootLatch.Lock()
+	ls.root = &lt.rootLatch
+
+	t.root = t.owned(t.root)
+
+	node := t.root
+	ls.lock(node)
+	if safe(node, true) {
+		ls.releaseAbove()
+	}
+
+	for !node.isLeaf() {
+		curNode := node.(*interiorNodeS)
+
+		path.push(curNode)
+		var i int
+		for i = 0; i < len(curNode.keys); i++ {
+			if key.LessThan(curNode.keys[i]) {
+				break
+			}
+		}
+
+		//curNode is latched, so no one else can be copying this child
+		child := t.ownChild(curNode, curNode.vals[i])
+		ls.lock(child)
+		if safe(child, false) {
+			ls.releaseAbove()
+			*path = (*path)[:0]
+		}
+
+		node = child
+	}
+	return node.(*leafNodeS)
+}
+
+func (lt *latchedTree) Order() int {
+	//the order never changes
+	return lt.t.order
+}
+
+//Get(key) crabs down the tree with read latches; at most two are held at
+//any one time.
+func (lt *latchedTree) Get(key BptKey, opts ...ReadOption) (interface{}, bool) {
+	if readOpts(opts).asOfSet {
+		panic("Get: AsOf() requires an MVCC tree")
+	}
+
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+
+	if err := lt.t.checkKey(key); err != nil {
+		lt.t.logErr("get", key, err)
+		return nil, false
+	}
+
+	lt.rootLatch.RLock()
+	node := lt.t.root
+	node.nodeLatch().RLock()
+	lt.rootLatch.RUnlock()
+
+	for !node.isLeaf() {
+		curNode := node.(*interiorNodeS)
+		var i int
+		for i = 0; i < len(curNode.keys); i++ {
+			if key.LessThan(curNode.keys[i]) {
+				break
+			}
+		}
+		child := curNode.vals[i]
+		child.nodeLatch().RLock()
+		curNode.nodeLatch().RUnlock()
+		node = child
+	}
+
+	leaf := node.(*leafNodeS)
+	defer leaf.nodeLatch().RUnlock()
+
+	for i, k := range leaf.keys {
+		if key.Equals(k) {
+			return leaf.vals[i], true
+		}
+	}
+	return nil, false
+}
+
+//Put(key, val) is exclusive for the first key, which sets the key type of
+//the tree; see checkKey().
+func (lt *latchedTree) Put(key BptKey, val interface{}) bool {
+	lt.mu.RLock()
+	if lt.t.undo != nil || lt.t.checkingTree() || lt.t.keyType == nil {
+		lt.mu.RUnlock()
+		lt.mu.Lock()
+		defer lt.mu.Unlock()
+		return lt.t.Put(key, val)
+	}
+	defer lt.mu.RUnlock()
+
+	if err := lt.t.checkKey(key); err != nil {
+		lt.t.logErr("put", key, err)
+		return false
+	}
+
+	ls := new(latchSet)
+	path := newPathT()
+
+	lt.t.checkOp("put", key)
+	leaf := lt.findLeafLatched(key, &path, ls, putSafe)
+	added := lt.t.putLeaf(leaf, key, val, &path)
+	ls.releaseAll()
+
+	if added {
+		lt.cntMu.Lock()
+		lt.t.numEnts++
+		lt.cntMu.Unlock()
+	}
+	return added
+}
+
+func (lt *latchedTree) Del(key BptKey) (interface{}, bool) {
+	lt.mu.RLock()
+	if lt.t.undo != nil || lt.t.checkingTree() {
+		lt.mu.RUnlock()
+		lt.mu.Lock()
+		defer lt.mu.Unlock()
+		return lt.t.Del(key)
+	}
+	defer lt.mu.RUnlock()
+
+	if err := lt.t.checkKey(key); err != nil {
+		lt.t.logErr("del", key, err)
+		return nil, false
+	}
+
+	ls := new(latchSet)
+	path := newPathT()
+
+	lt.t.checkOp("del", key)
+	leaf := lt.findLeafLatched(key, &path, ls, delSafe)
+	val, found := lt.t.delLeaf(leaf, key, &path, ls)
+	ls.releaseAll()
+
+	if found {
+		lt.cntMu.Lock()
+		lt.t.numEnts--
+		lt.cntMu.Unlock()
+	}
+	return val, found
+}
+
+//Range() iterates over a Snapshot() of the tree, so fn is called without
+//any latch held.
+func (lt *latchedTree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) {
+	snap := lt.Snapshot()
+	snap.Range(lo, hi, fn, opts...)
+}
+
+func (lt *latchedTree) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error {
+	snap := lt.Snapshot()
+	return snap.RangeContext(ctx, lo, hi, fn, opts...)
+}
+
+func (lt *latchedTree) String() string {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.String()
+}
+
+func (lt *latchedTree) Validate() error {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.Validate()
+}
+
+func (lt *latchedTree) Graph(opts ...GraphOption) string {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.Graph(opts...)
+}
+
+//DumpJSON(w, opts...) encodes the tree with the lock held, and writes it to w
+//without.
+func (lt *latchedTree) DumpJSON(w io.Writer, opts ...JSONOption) error {
+	lt.mu.Lock()
+	doc, err := lt.t.jsonTree(jsonOpts(opts))
+	lt.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, doc)
+}
+
+//MarshalBinary() encodes a Snapshot() of the tree; see WriteTo().
+func (lt *latchedTree) MarshalBinary() ([]byte, error) {
+	return lt.Snapshot().(*tree).MarshalBinary()
+}
+
+//WriteTo(w) writes a Snapshot() of the tree to w, without the lock held.
+func (lt *latchedTree) WriteTo(w io.Writer) (int64, error) {
+	return lt.Snapshot().(*tree).WriteTo(w)
+}
+
+func (lt *latchedTree) UnmarshalBinary(data []byte) error {
+	_, err := lt.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+//ReadFrom(r) decodes the entries without the lock held, and then replaces
+//the entries of the tree with them.
+func (lt *latchedTree) ReadFrom(r io.Reader) (int64, error) {
+	lt.mu.Lock()
+	vc := lt.t.valueCodec()
+	lt.mu.Unlock()
+
+	keys, vals, n, err := readBinary(r, vc)
+	if err != nil {
+		return n, err
+	}
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	err = lt.t.loadEntries(keys, vals)
+	return n, err
+}
+
+func (lt *latchedTree) SetValueCodec(vc ValueCodec) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.t.SetValueCodec(vc)
+}
+
+//MarshalJSON() encodes a Snapshot() of the tree.
+func (lt *latchedTree) MarshalJSON() ([]byte, error) {
+	return lt.Snapshot().(*tree).MarshalJSON()
+}
+
+func (lt *latchedTree) UnmarshalJSON(data []byte) error {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.UnmarshalJSON(data)
+}
+
+//GobEncode() encodes a Snapshot() of the tree.
+func (lt *latchedTree) GobEncode() ([]byte, error) {
+	return lt.Snapshot().(*tree).GobEncode()
+}
+
+func (lt *latchedTree) GobDecode(data []byte) error {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.GobDecode(data)
+}
+
+func (lt *latchedTree) SetKeyFactory(f KeyFactory) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.t.SetKeyFactory(f)
+}
+
+func (lt *latchedTree) Stats() Stats {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.Stats()
+}
+
+func (lt *latchedTree) ResetStats() {
+	//the counters are atomic
+	lt.t.ResetStats()
+}
+
+func (lt *latchedTree) NumberOfEntries() int {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+	lt.cntMu.Lock()
+	defer lt.cntMu.Unlock()
+	return lt.t.numEnts
+}
+
+func (lt *latchedTree) Clear() {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.t.Clear()
+}
+
+//Clone() returns a plain, not concurrency safe, copy of the tree.
+func (lt *latchedTree) Clone() BpTree {
+	return lt.CloneWith(nil)
+}
+
+//CloneWith(copyVal) returns a plain, not concurrency safe, copy of the tree.
+func (lt *latchedTree) CloneWith(copyVal func(interface{}) interface{}) BpTree {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.CloneWith(copyVal)
+}
+
+//Snapshot() returns a read-only Snapshot which, since it never changes, is
+//safe for concurrent use without any locking.
+func (lt *latchedTree) Snapshot() BpTree {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.Snapshot()
+}
+
+//Begin() starts a Txn whose Commit() excludes Get, Put and Del while it
+//installs the Txn's writes.
+func (lt *latchedTree) Begin() *Txn {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	txn := lt.t.Begin()
+	txn.lock = &lt.mu
+	return txn
+}
+
+func (lt *latchedTree) EnableUndo(maxEntries int) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.t.EnableUndo(maxEntries)
+}
+
+func (lt *latchedTree) Savepoint() Savepoint {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.Savepoint()
+}
+
+func (lt *latchedTree) RollbackTo(sp Savepoint) error {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t.RollbackTo(sp)
+}
+
+func (lt *latchedTree) SetLogger(l *slog.Logger) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.t.SetLogger(l)
+}
+
+func (lt *latchedTree) SetCheckLevel(level CheckLevel) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.t.SetCheckLevel(level)
+}
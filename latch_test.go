@@ -0,0 +1,205 @@
+package bptree
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestLatchedParallelWriters(t *testing.T) {
+	for _, order := range []int{3, 4, 7} {
+		bpt := NewLatchedBpTree(order)
+
+		nWorkers := 8
+		var wg sync.WaitGroup
+		for w := 0; w < nWorkers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(largeNumEnts); i += nWorkers {
+					ent := largeNumEnts[i]
+					if !bpt.Put(ent.key, ent.val) {
+						t.Errorf("Put(%q) did not insert", ent.key)
+						return
+					}
+					val, found := bpt.Get(ent.key)
+					if !found || val.(int) != ent.val {
+						t.Errorf("Get(%q) = %v, %v; expected %d", ent.key, val, found, ent.val)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		lt := bpt.(*latchedTree)
+		if !_validTree(t, lt.t) {
+			t.Fatalf("order=%d; !_validTree(t, lt.t) after parallel Put()", order)
+		}
+		if bpt.NumberOfEntries() != len(largeNumEnts) {
+			t.Fatalf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts))
+		}
+
+		delEnts := genRandomizedEntries(largeNumEnts)
+		for w := 0; w < nWorkers; w++ {
+			wg.Add(2)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(delEnts); i += nWorkers {
+					val, found := bpt.Del(delEnts[i].key)
+					if !found || val.(int) != delEnts[i].val {
+						t.Errorf("Del(%q) = %v, %v; expected %d", delEnts[i].key, val, found, delEnts[i].val)
+						return
+					}
+				}
+			}(w)
+			go func() {
+				defer wg.Done()
+				for _, ent := range largeNumEnts {
+					bpt.Get(ent.key)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if !_validTree(t, lt.t) {
+			t.Fatalf("order=%d; !_validTree(t, lt.t) after parallel Del()", order)
+		}
+		if bpt.NumberOfEntries() != 0 {
+			t.Fatalf("bpt.NumberOfEntries(),%d != 0", bpt.NumberOfEntries())
+		}
+	}
+}
+
+func TestLatchedWritersWithSnapshots(t *testing.T) {
+	bpt := NewLatchedBpTree(4)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(largeNumEnts); i += 4 {
+				bpt.Del(largeNumEnts[i].key)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				snap := bpt.Snapshot()
+				if !_validTree(t, snap) {
+					t.Errorf("!_validTree(t, snap)")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if bpt.NumberOfEntries() != 0 {
+		t.Fatalf("bpt.NumberOfEntries(),%d != 0", bpt.NumberOfEntries())
+	}
+}
+
+//_nodeSyncs(node) returns how many nodes, in and below node, have a
+//nodeSync and how many do not.
+func _nodeSyncs(node nodeI) (with, without int) {
+	count := func(s *nodeSync) {
+		if s != nil {
+			with++
+		} else {
+			without++
+		}
+	}
+	switch n := node.(type) {
+	case *leafNodeS:
+		count(n.sync)
+	case *interiorNodeS:
+		count(n.sync)
+		for _, child := range n.vals {
+			w, wo := _nodeSyncs(child)
+			with, without = with+w, without+wo
+		}
+	}
+	return with, without
+}
+
+//Only the nodes of the latched and B-link trees carry a latch, but every
+//one of their nodes does; whichever way it was made.
+func TestLatchedNodeSyncs(t *testing.T) {
+	plain := NewBpTree(3)
+	for _, ent := range largeNumEnts {
+		plain.Put(ent.key, ent.val)
+	}
+	if with, _ := _nodeSyncs(plain.(*tree).root); with != 0 {
+		t.Fatalf("%d nodes of a plain tree have a nodeSync", with)
+	}
+	data, _ := plain.(Encodable).MarshalBinary()
+	js, _ := plain.(Encodable).MarshalJSON()
+
+	for name, bpt := range map[string]BpTree{"latched": NewLatchedBpTree(3), "blink": NewBLinkBpTree(3)} {
+		var tr *tree
+		switch b := bpt.(type) {
+		case *latchedTree:
+			tr = b.t
+		case *blinkTree:
+			tr = b.t
+		}
+		check := func(what string) {
+			if _, without := _nodeSyncs(tr.root); without != 0 {
+				t.Fatalf("%s: %d nodes have no nodeSync after %s", name, without, what)
+			}
+		}
+
+		bpt.(Undoable).EnableUndo(0)
+		sp := bpt.(Undoable).Savepoint()
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Put(ent.key, ent.val)
+		}
+		check("Put")
+		bpt.Snapshot()
+		for _, ent := range largeNumEnts[:len(largeNumEnts)/2] {
+			bpt.Del(ent.key)
+		}
+		check("Del after a Snapshot")
+		bpt.(Undoable).RollbackTo(sp)
+		check("RollbackTo")
+
+		if txnTree, ok := bpt.(Transactional); ok {
+			txn := txnTree.Begin()
+			for _, ent := range largeNumEnts {
+				txn.Put(ent.key, ent.val)
+			}
+			txn.Commit()
+			check("a Txn")
+			//another writer, in the last leaf, makes Commit() replay the
+			//Txn
+			for i, del := range []bool{true, false} {
+				txn = txnTree.Begin()
+				bpt.Put(StringKey("~"+strconv.Itoa(i)), i)
+				for _, ent := range largeNumEnts[:len(largeNumEnts)/2] {
+					if del {
+						txn.Del(ent.key)
+					} else {
+						txn.Put(ent.key, ent.val)
+					}
+				}
+				if err := txn.Commit(); err != nil {
+					t.Fatalf("%s: Commit() = %v", name, err)
+				}
+				check("a replayed Txn")
+			}
+		}
+
+		bpt.(Encodable).UnmarshalBinary(data)
+		check("UnmarshalBinary")
+		bpt.(Encodable).UnmarshalJSON(js)
+		check("UnmarshalJSON")
+		if err := bpt.Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
@@ -2,11 +2,14 @@ package bptree
 
 import (
 	"fmt"
+	"sync"
 )
 
 type leafNodeS struct {
 	keys []BptKey
 	vals []interface{}
+	gen  uint64    //generation of the *tree that may modify this leaf in place
+	sync *nodeSync //nil unless the tree is latched; see latch.go
 }
 
 func mkLeaf(order int) *leafNodeS {
@@ -84,6 +87,8 @@ func (n *leafNodeS) isToBig() bool {
 func (lNode *leafNodeS) split() (nodeI, BptKey) {
 	order := lNode.order()
 	rNode := mkLeaf(order)
+	rNode.gen = lNode.gen
+	rNode.sync = lNode.sync.fresh()
 
 	//leafSplit for ODD orders makes the right node the larger node.
 	//hence the MIDDLE KEY is rNode.keys[0], for ODD and EVEN orders.
@@ -96,6 +101,13 @@ func (lNode *leafNodeS) split() (nodeI, BptKey) {
 	lNode.keys = append(lNode.keys[:0], lNode.keys[:keySplitIdx]...)
 	lNode.vals = append(lNode.vals[:0], lNode.vals[:valSplitIdx]...)
 
+	//publish rNode to the right of lNode for B-link readers
+	if ls := lNode.sync; ls.isBLink() {
+		rs := rNode.sync
+		rs.next, rs.highKey = ls.next, ls.highKey
+		ls.next, ls.highKey = rNode, rNode.keys[0]
+	}
+
 	return rNode, rNode.keys[0]
 }
 
@@ -114,7 +126,7 @@ func (rNode *leafNodeS) findPeerLeft(parent *interiorNodeS) (nodeI, BptKey) {
 			return leftPeerNode, leftPeerKey
 		}
 	}
-	lgr.Panic("findPeerLeft: didn't find rNode(receiver) in parent")
+	corrupt("findPeerLeft: didn't find rNode(receiver) in parent")
 	return nil, nil
 }
 
@@ -133,12 +145,13 @@ func (lNode *leafNodeS) findPeerRight(parent *interiorNodeS) (nodeI, BptKey) {
 			return rightPeerNode, rightPeerKey
 		}
 	}
-	lgr.Panic("findPeerRight: didn't find lNode(receiver) in parent")
+	corrupt("findPeerRight: didn't find lNode(receiver) in parent")
 	return nil, nil
 }
 
-//Given left peer, steal its right most
-func (rLeaf *leafNodeS) stealLeft(lLeaf_ nodeI) {
+//Given left peer, steal its right most entry. The new first key of rLeaf is
+//returned; it replaces sep as the separator of lLeaf and rLeaf in the parent.
+func (rLeaf *leafNodeS) stealLeft(lLeaf_ nodeI, sep BptKey) BptKey {
 	lLeaf := lLeaf_.(*leafNodeS)
 
 	stolenKey := lLeaf.keys[len(lLeaf.keys)-1]
@@ -154,11 +167,15 @@ func (rLeaf *leafNodeS) stealLeft(lLeaf_ nodeI) {
 	rLeaf.vals = append(rLeaf.vals[:0],
 		append([]interface{}{stolenVal}, rLeaf.vals...)...)
 
-	return
+	if ls := lLeaf.sync; ls.isBLink() {
+		ls.highKey = stolenKey
+	}
+	return stolenKey
 }
 
-//Given right peer, steal its left most entry.
-func (lLeaf *leafNodeS) stealRight(rLeaf_ nodeI) {
+//Given right peer, steal its left most entry. The new first key of rLeaf is
+//returned; it replaces sep as the separator of lLeaf and rLeaf in the parent.
+func (lLeaf *leafNodeS) stealRight(rLeaf_ nodeI, sep BptKey) BptKey {
 	rLeaf := rLeaf_.(*leafNodeS)
 
 	stolenKey := rLeaf.keys[0]
@@ -171,18 +188,71 @@ func (lLeaf *leafNodeS) stealRight(rLeaf_ nodeI) {
 	lLeaf.keys = append(lLeaf.keys, stolenKey)
 	lLeaf.vals = append(lLeaf.vals, stolenVal)
 
-	return
+	if ls := lLeaf.sync; ls.isBLink() {
+		ls.highKey = rLeaf.keys[0]
+	}
+	return rLeaf.keys[0]
 }
 
-func (lLeaf *leafNodeS) mergeRight(rLeaf_ nodeI) {
+//Given right peer, append all its entries. Leaves do not need sep; it is
+//only there to match interiorNodeS.mergeRight().
+func (lLeaf *leafNodeS) mergeRight(rLeaf_ nodeI, sep BptKey) {
 	rLeaf := rLeaf_.(*leafNodeS)
 
 	lLeaf.keys = append(lLeaf.keys, rLeaf.keys...)
 	lLeaf.vals = append(lLeaf.vals, rLeaf.vals...)
 
+	if ls := lLeaf.sync; ls.isBLink() {
+		ls.next, ls.highKey = rLeaf.sync.next, rLeaf.sync.highKey
+	}
+
 	return
 }
 
+//leaf.clone(gen, copyVal) copies the leaf keeping the same cap(keys) and
+//cap(vals). The keys are shared; the values are shared unless copyVal is
+//non-nil, in which case copyVal(val) is stored instead.
+func (leaf *leafNodeS) clone(gen uint64, copyVal func(interface{}) interface{}) nodeI {
+	nLeaf := mkLeaf(leaf.order())
+	nLeaf.gen = gen
+	nLeaf.keys = append(nLeaf.keys, leaf.keys...)
+	if copyVal == nil {
+		nLeaf.vals = append(nLeaf.vals, leaf.vals...)
+	} else {
+		for _, v := range leaf.vals {
+			nLeaf.vals = append(nLeaf.vals, copyVal(v))
+		}
+	}
+	return nLeaf
+}
+
+//leaf.copyNode(gen) copies the leaf for path-copying; it is the same as
+//leaf.clone(gen, nil), but the copy keeps a latch if the leaf has one.
+func (leaf *leafNodeS) copyNode(gen uint64) nodeI {
+	nLeaf := leaf.clone(gen, nil).(*leafNodeS)
+	nLeaf.sync = leaf.sync.fresh()
+	return nLeaf
+}
+
+func (leaf *leafNodeS) nodeLatch() *sync.RWMutex {
+	return &leaf.sync.latch
+}
+
+func (leaf *leafNodeS) syncState() *nodeSync {
+	return leaf.sync
+}
+
+func (leaf *leafNodeS) link() (nodeI, BptKey) {
+	if leaf.sync == nil {
+		return nil, nil
+	}
+	return leaf.sync.next, leaf.sync.highKey
+}
+
+func (leaf *leafNodeS) generation() uint64 {
+	return leaf.gen
+}
+
 func (n *leafNodeS) isLeaf() bool {
 	return true
 	//return cap(n.keys) == cap(n.vals)
@@ -0,0 +1,68 @@
+package bptree
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+//discardHandler is a slog.Handler that is never enabled; it is the default
+//for every tree, so the package is silent unless SetLogger() is called.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var silentLogger = slog.New(discardHandler{})
+
+//SetLogger(l) makes the *tree log to l. Structural changes (splits, steals,
+//merges and changes of the root) are logged at slog.LevelDebug with the
+//addresses of the nodes involved; bad keys at slog.LevelWarn and corruption
+//at slog.LevelError. A nil l makes the *tree silent again, which is the
+//default.
+//
+func (t *tree) SetLogger(l *slog.Logger) {
+	t.log = l
+}
+
+//logger() returns the logger of the *tree, or silentLogger if there is
+//none. Trees made with new(tree), like Snapshots, inherit the logger of
+//their *tree, or are silent.
+func (t *tree) logger() *slog.Logger {
+	if t.log == nil {
+		return silentLogger
+	}
+	return t.log
+}
+
+//nodeAttr(name, node) formats node's address as a structured field.
+func nodeAttr(name string, node nodeI) slog.Attr {
+	return slog.String(name, fmt.Sprintf("%p", node))
+}
+
+//debugNode(op, msg, node, args...) logs a structural change to node at
+//slog.LevelDebug. The fields are only built if debug logging is enabled.
+func (t *tree) debugNode(op, msg string, node nodeI, args ...interface{}) {
+	l := t.logger()
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	args = append([]interface{}{slog.String("op", op), nodeAttr("node", node)}, args...)
+	l.Debug(msg, args...)
+}
+
+//logErr(op, key, err) logs an error returned by GetE(), PutE() or DelE();
+//corruption at slog.LevelError, anything else at slog.LevelWarn.
+func (t *tree) logErr(op string, key BptKey, err error) {
+	level := slog.LevelWarn
+	if _, ok := err.(*CorruptError); ok {
+		level = slog.LevelError
+	}
+	var k string
+	if key != nil {
+		k = key.String()
+	}
+	t.logger().Log(context.Background(), level, err.Error(), slog.String("op", op), slog.String("key", k))
+}
@@ -0,0 +1,60 @@
+package bptree
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	bpt, _ := NewBpTreeE(3)
+	bpt.SetLogger(l)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	for _, ent := range largeNumEnts {
+		bpt.Del(ent.key)
+	}
+	bpt.PutE(ByteSliceKey("bad"), 0)
+
+	out := buf.String()
+	for _, want := range []string{
+		`msg="split leaf" op=put node=0x`,
+		`msg="new root" op=put`,
+		`msg="merge leaves" op=del`,
+		`msg="collapse root" op=del`,
+		`level=WARN msg="bptree: key type mismatch`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("log output does not contain %s; output=\n%s", want, out)
+		}
+	}
+
+	//a nil logger is silent again
+	buf.Reset()
+	bpt.SetLogger(nil)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("SetLogger(nil) still logged:\n%s", buf.String())
+	}
+}
+
+func TestSetLoggerSharded(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	bpt := NewShardedBpTree(3, shardSplits(2))
+	bpt.SetLogger(l)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	if !strings.Contains(buf.String(), `msg="split leaf"`) {
+		t.Fatalf("sharded tree did not log its splits; output=\n%s", buf.String())
+	}
+}
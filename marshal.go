@@ -0,0 +1,217 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+//KeyFactory returns a zero key of the type UnmarshalJSON() and GobDecode()
+//decode the keys of a tree into; see Encodable.SetKeyFactory().
+type KeyFactory func() BptKey
+
+//SetKeyFactory(f) makes UnmarshalJSON() and GobDecode() decode each key into
+//a new key of the type f returns. Without a KeyFactory the keys are decoded
+//as the type of the keys already in the *tree, or else as StringKeys.
+//
+func (t *tree) SetKeyFactory(f KeyFactory) {
+	t.keyFactory = f
+}
+
+//decodeKeyType(f, keyType) returns the type keys are decoded into.
+func decodeKeyType(f KeyFactory, keyType reflect.Type) reflect.Type {
+	switch {
+	case f != nil:
+		return reflect.TypeOf(f())
+	case keyType != nil:
+		return keyType
+	}
+	return reflect.TypeOf(StringKey(""))
+}
+
+//jsonEntry is one element of the array MarshalJSON() makes.
+type jsonEntry struct {
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+//MarshalJSON() encodes the entries of the *tree as an array of
+//{"key": ..., "value": ...} objects in ascending key order. The keys and
+//values are encoded with json.Marshal().
+//
+func (t *tree) MarshalJSON() ([]byte, error) {
+	return marshalEntriesJSON(t.numEnts, func(fn func(BptKey, interface{}) bool) {
+		t.Range(nil, nil, fn)
+	})
+}
+
+//marshalEntriesJSON(count, scan) encodes the count entries scan calls its fn
+//with; see MarshalJSON().
+func marshalEntriesJSON(count int, scan func(fn func(BptKey, interface{}) bool)) ([]byte, error) {
+	ents := make([]jsonEntry, 0, count)
+	var err error
+	scan(func(k BptKey, v interface{}) bool {
+		var ent jsonEntry
+		if ent.Key, err = json.Marshal(k); err != nil {
+			err = fmt.Errorf("bptree: MarshalJSON: key %q: %w", k, err)
+			return false
+		}
+		if ent.Value, err = json.Marshal(v); err != nil {
+			err = fmt.Errorf("bptree: MarshalJSON: value of key %q: %w", k, err)
+			return false
+		}
+		ents = append(ents, ent)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ents)
+}
+
+//UnmarshalJSON(data) replaces the entries of the *tree with those of an
+//array made by MarshalJSON(). The values are decoded into interface{}, as
+//json.Unmarshal() does. The entries need not be in order; the last of any
+//duplicate keys wins. The *tree is rebuilt bottom up, not by Put()ting each
+//entry, and is left unchanged if any error is returned.
+//
+func (t *tree) UnmarshalJSON(data []byte) error {
+	keys, vals, err := decodeEntriesJSON(data, decodeKeyType(t.keyFactory, t.keyType))
+	if err != nil {
+		return err
+	}
+	return t.loadEntries(keys, vals)
+}
+
+func decodeEntriesJSON(data []byte, keyType reflect.Type) ([]BptKey, []interface{}, error) {
+	var ents []jsonEntry
+	if err := json.Unmarshal(data, &ents); err != nil {
+		return nil, nil, fmt.Errorf("bptree: UnmarshalJSON: %w", err)
+	}
+	keys := make([]BptKey, len(ents))
+	vals := make([]interface{}, len(ents))
+	for i, ent := range ents {
+		kp := reflect.New(keyType)
+		if err := json.Unmarshal(ent.Key, kp.Interface()); err != nil {
+			return nil, nil, fmt.Errorf("bptree: UnmarshalJSON: key %s: %w", ent.Key, err)
+		}
+		keys[i] = kp.Elem().Interface().(BptKey)
+		if err := json.Unmarshal(ent.Value, &vals[i]); err != nil {
+			return nil, nil, fmt.Errorf("bptree: UnmarshalJSON: value of key %s: %w", ent.Key, err)
+		}
+	}
+	keys, vals = sortEntries(keys, vals)
+	return keys, vals, nil
+}
+
+//gobValue boxes a value so gob encodes its concrete type; any type other
+//than the basic ones must be gob.Register()ed.
+type gobValue struct {
+	V interface{}
+}
+
+//GobEncode() encodes the number of entries of the *tree, then each key and
+//value in ascending key order.
+//
+func (t *tree) GobEncode() ([]byte, error) {
+	return gobEncodeEntries(t.numEnts, func(fn func(BptKey, interface{}) bool) {
+		t.Range(nil, nil, fn)
+	})
+}
+
+//gobEncodeEntries(count, scan) encodes the count entries scan calls its fn
+//with; see GobEncode().
+func gobEncodeEntries(count int, scan func(fn func(BptKey, interface{}) bool)) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(count)
+	scan(func(k BptKey, v interface{}) bool {
+		if err == nil {
+			err = enc.Encode(k)
+		}
+		if err == nil {
+			err = enc.Encode(gobValue{v})
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bptree: GobEncode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+//GobDecode(data) replaces the entries of the *tree with those encoded by
+//GobEncode(); see UnmarshalJSON().
+//
+func (t *tree) GobDecode(data []byte) error {
+	keys, vals, err := decodeEntriesGob(data, decodeKeyType(t.keyFactory, t.keyType))
+	if err != nil {
+		return err
+	}
+	return t.loadEntries(keys, vals)
+}
+
+func decodeEntriesGob(data []byte, keyType reflect.Type) ([]BptKey, []interface{}, error) {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		return nil, nil, fmt.Errorf("bptree: GobDecode: %w", err)
+	}
+	if n < 0 || n > len(data) {
+		return nil, nil, fmt.Errorf("bptree: GobDecode: bad number of entries %d", n)
+	}
+	keys := make([]BptKey, n)
+	vals := make([]interface{}, n)
+	for i := range keys {
+		kp := reflect.New(keyType)
+		if err := dec.Decode(kp.Interface()); err != nil {
+			return nil, nil, fmt.Errorf("bptree: GobDecode: key: %w", err)
+		}
+		keys[i] = kp.Elem().Interface().(BptKey)
+		var v gobValue
+		if err := dec.Decode(&v); err != nil {
+			return nil, nil, fmt.Errorf("bptree: GobDecode: value of key %q: %w", keys[i], err)
+		}
+		vals[i] = v.V
+	}
+	keys, vals = sortEntries(keys, vals)
+	return keys, vals, nil
+}
+
+//sortEntries(keys, vals) sorts the entries by key, unless they already are
+//in strictly ascending order, and drops all but the last of any duplicate
+//keys.
+func sortEntries(keys []BptKey, vals []interface{}) ([]BptKey, []interface{}) {
+	sorted := true
+	for i := 1; i < len(keys); i++ {
+		if !keys[i-1].LessThan(keys[i]) {
+			sorted = false
+			break
+		}
+	}
+	if sorted {
+		return keys, vals
+	}
+
+	idx := make([]int, len(keys))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return keys[idx[a]].LessThan(keys[idx[b]])
+	})
+	sk := make([]BptKey, 0, len(keys))
+	sv := make([]interface{}, 0, len(vals))
+	for _, i := range idx {
+		if n := len(sk); n > 0 && sk[n-1].Equals(keys[i]) {
+			sv[n-1] = vals[i] //stable, so this is the later one
+			continue
+		}
+		sk = append(sk, keys[i])
+		sv = append(sv, vals[i])
+	}
+	return sk, sv
+}
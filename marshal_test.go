@@ -0,0 +1,144 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	trees := map[string]BpTree{
+		"plain":      NewBpTree(3),
+		"mvcc":       NewMVCCBpTree(4),
+		"concurrent": NewConcurrentBpTree(5),
+		"latched":    NewLatchedBpTree(3),
+		"blink":      NewBLinkBpTree(3),
+		"optimistic": NewOptimisticBpTree(4),
+		"sharded":    NewShardedBpTree(3, shardSplits(3)),
+	}
+	for name, bpt := range trees {
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Put(ent.key, ent.val)
+		}
+		data, err := json.Marshal(bpt)
+		if err != nil {
+			t.Fatalf("%s: json.Marshal() = %v", name, err)
+		}
+		var ents []struct {
+			Key   string
+			Value int
+		}
+		if err := json.Unmarshal(data, &ents); err != nil {
+			t.Fatalf("%s: json.Marshal() made %s: %v", name, data, err)
+		}
+		if len(ents) != len(largeNumEnts) || ents[0].Key != string(largeNumEnts[0].key.(StringKey)) {
+			t.Fatalf("%s: json.Marshal() did not make an ordered array of entries", name)
+		}
+
+		for _, into := range []BpTree{NewBpTree(7), NewBLinkBpTree(3), NewShardedBpTree(4, shardSplits(5)), NewMVCCBpTree(3)} {
+			into.Put(StringKey("gone"), 0)
+			if err := json.Unmarshal(data, into); err != nil {
+				t.Fatalf("%s: json.Unmarshal() = %v", name, err)
+			}
+			if err := into.Validate(); err != nil {
+				t.Fatalf("%s: json.Unmarshal() made an invalid tree: %v", name, err)
+			}
+			i := 0
+			into.Range(nil, nil, func(k BptKey, v interface{}) bool {
+				if !k.Equals(largeNumEnts[i].key) || v != float64(largeNumEnts[i].val) {
+					t.Fatalf("%s: entry %d = %q:%v; expected %q:%d", name, i, k, v, largeNumEnts[i].key, largeNumEnts[i].val)
+				}
+				i++
+				return true
+			})
+			if i != len(largeNumEnts) {
+				t.Fatalf("%s: json.Unmarshal() restored %d entries; expected %d", name, i, len(largeNumEnts))
+			}
+		}
+	}
+}
+
+func TestUnmarshalJSONUnsorted(t *testing.T) {
+	var data = []byte(`[{"key":"c","value":3},{"key":"a","value":1},{"key":"b","value":2},{"key":"a","value":4}]`)
+	bpt := NewBpTree(3)
+	if err := json.Unmarshal(data, bpt); err != nil {
+		t.Fatalf("json.Unmarshal() = %v", err)
+	}
+	var got []interface{}
+	bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+		got = append(got, string(k.(StringKey)), v)
+		return true
+	})
+	if expected := []interface{}{"a", 4.0, "b", 2.0, "c", 3.0}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("json.Unmarshal() of unsorted entries = %v; expected %v", got, expected)
+	}
+
+	if err := json.Unmarshal([]byte(`{"key":"a"}`), bpt); err == nil {
+		t.Fatal("json.Unmarshal() of an object did not fail")
+	}
+	if bpt.NumberOfEntries() != 3 {
+		t.Fatal("a failed json.Unmarshal() modified the tree")
+	}
+}
+
+func TestGobEncode(t *testing.T) {
+	for _, bpt := range []BpTree{NewBpTree(4), NewLatchedBpTree(3), NewShardedBpTree(3, shardSplits(4))} {
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Put(ent.key, ent.val)
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(bpt); err != nil {
+			t.Fatalf("gob Encode() = %v", err)
+		}
+
+		into := NewOptimisticBpTree(5)
+		if err := gob.NewDecoder(&buf).Decode(into); err != nil {
+			t.Fatalf("gob Decode() = %v", err)
+		}
+		if err := into.Validate(); err != nil {
+			t.Fatalf("gob Decode() made an invalid tree: %v", err)
+		}
+		if !reflect.DeepEqual(_entries(into), largeNumEnts) {
+			t.Fatal("gob Decode() did not restore the entries")
+		}
+	}
+}
+
+func TestKeyFactory(t *testing.T) {
+	bpt := NewBpTree(3).(Encodable)
+	for i := 0; i < 30; i++ {
+		bpt.Put(intKey(i), i)
+	}
+	data, err := json.Marshal(bpt)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+	gobData, err := bpt.GobEncode()
+	if err != nil {
+		t.Fatalf("GobEncode() = %v", err)
+	}
+
+	//without a KeyFactory an empty tree decodes StringKeys
+	if err := json.Unmarshal(data, NewBpTree(3)); err == nil {
+		t.Fatal("json.Unmarshal() of int keys into StringKeys did not fail")
+	}
+
+	factory := func() BptKey { return intKey(0) }
+	for _, into := range []Encodable{NewBpTree(4).(Encodable), NewConcurrentBpTree(3).(Encodable), NewShardedBpTree(3, []BptKey{intKey(10), intKey(20)}).(Encodable)} {
+		into.SetKeyFactory(factory)
+		if err := json.Unmarshal(data, into); err != nil {
+			t.Fatalf("json.Unmarshal() = %v", err)
+		}
+		if v, ok := into.Get(intKey(17)); !ok || v != 17.0 {
+			t.Fatalf("Get(17) = %v, %v after json.Unmarshal()", v, ok)
+		}
+		if err := into.GobDecode(gobData); err != nil {
+			t.Fatalf("GobDecode() = %v", err)
+		}
+		if v, ok := into.Get(intKey(29)); !ok || v != 29 || into.NumberOfEntries() != 30 {
+			t.Fatalf("Get(29) = %v, %v after GobDecode()", v, ok)
+		}
+	}
+}
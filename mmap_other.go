@@ -0,0 +1,21 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package bptree
+
+import (
+	"io"
+	"os"
+)
+
+//mmapFile(f, size) reads the first size bytes of f into memory, where there
+//is no mmap.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	b := make([]byte, size)
+	_, err := io.ReadFull(io.NewSectionReader(f, 0, int64(size)), b)
+	return b, err
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
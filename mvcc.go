@@ -0,0 +1,328 @@
+package bptree
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+)
+
+//ReadOption modifies how Get() and Range() read a BpTree.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	asOf    uint64
+	asOfSet bool
+}
+
+func readOpts(opts []ReadOption) readOptions {
+	var ro readOptions
+	for _, opt := range opts {
+		opt(&ro)
+	}
+	return ro
+}
+
+//AsOf(version) makes Get() or Range() read the tree as it was right after
+//the Put() or Del() stamped with version. It is only supported by
+//MVCCBpTree; the plain BpTree panics when given AsOf().
+func AsOf(version uint64) ReadOption {
+	return func(ro *readOptions) {
+		ro.asOf = version
+		ro.asOfSet = true
+	}
+}
+
+//MVCCBpTree is a BpTree that keeps every version of itself. Each Put() or
+//Del() that changes the tree is stamped with the next version number;
+//Get() and Range() given AsOf(version) see the tree exactly as it was at that
+//version, no matter what has been written since.
+//
+//Old versions share all their unmodified nodes with newer versions (see
+//Snapshot()), so a version costs about one root-to-leaf path of nodes.
+//
+//Get(), Range(), RangeContext(), Version() and GC() are safe to call from
+//any number of goroutines while one other goroutine writes: they read a
+//recorded version, whose nodes are never modified again. The writes, Put(),
+//Del(), Clear(), Txn.Commit(), RollbackTo() and the Unmarshal methods, are
+//serialized with each other. The remaining methods must not be called while
+//the tree is written.
+type MVCCBpTree interface {
+	BpTree
+	//Version() returns the version of the latest Put() or Del().
+	Version() uint64
+	//GC(minVersion) forgets the versions no reader of minVersion, or any
+	//later version, can see.
+	GC(minVersion uint64)
+}
+
+type versionT struct {
+	version uint64
+	root    nodeI
+	numEnts int
+}
+
+type mvccTree struct {
+	*tree
+	mu      sync.RWMutex //guards version and history; exclusive for writes
+	version uint64
+	history []versionT //ascending by version
+}
+
+//NewMVCCBpTree instantiates a new multi-version B+Tree for a given order; see
+//NewBpTree() for the meaning of order. The empty tree is version 0.
+//
+//NewMVCCBpTree panics if order is less than 3; see NewMVCCBpTreeE().
+func NewMVCCBpTree(order int) MVCCBpTree {
+	m, err := NewMVCCBpTreeE(order)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+//NewMVCCBpTreeE is NewMVCCBpTree() that returns ErrInvalidOrder instead of
+//panicking.
+func NewMVCCBpTreeE(order int) (MVCCBpTree, error) {
+	if order < 3 {
+		return nil, ErrInvalidOrder
+	}
+	var m = new(mvccTree)
+	m.tree = mkTree(order)
+	m.stamp()
+	return m, nil
+}
+
+//stamp() records the current root as m.version and moves the live tree to a
+//new generation so the recorded nodes are never modified again. m.mu must be
+//held exclusively, but by the constructor.
+func (m *mvccTree) stamp() {
+	m.history = append(m.history, versionT{m.version, m.root, m.numEnts})
+	m.tree.gen = nextGen()
+}
+
+//Version() returns the version of the latest Put() or Del().
+//
+func (m *mvccTree) Version() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.version
+}
+
+//Put(k, v) stamps a new version; see tree.Put() for the return value.
+//
+func (m *mvccTree) Put(key BptKey, val interface{}) bool {
+	added, err := m.PutE(key, val)
+	panicUnlessKeyErr(err)
+	return added
+}
+
+//PutE(k, v) is Put(k, v) that returns an error instead of panicking; no
+//version is stamped if it does.
+//
+func (m *mvccTree) PutE(key BptKey, val interface{}) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	added, err := m.tree.PutE(key, val)
+	if err != nil {
+		return false, err
+	}
+	m.version++
+	m.stamp()
+	return added, nil
+}
+
+//Del(k) stamps a new version iff key was found; see tree.Del() for the
+//return values.
+//
+func (m *mvccTree) Del(key BptKey) (interface{}, bool) {
+	val, found, err := m.DelE(key)
+	panicUnlessKeyErr(err)
+	return val, found
+}
+
+//DelE(k) is Del(k) that returns an error instead of panicking; no version
+//is stamped if it does.
+//
+func (m *mvccTree) DelE(key BptKey) (interface{}, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	val, found, err := m.tree.DelE(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if found {
+		m.version++
+		m.stamp()
+	}
+	return val, found, nil
+}
+
+//Clear() empties the tree as a new version; older versions are unchanged.
+//
+func (m *mvccTree) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tree.Clear()
+	m.version++
+	m.stamp()
+}
+
+//Begin() starts a Txn; its Commit() is stamped as a single new version.
+//
+func (m *mvccTree) Begin() *Txn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txn := m.tree.Begin()
+	txn.lock = &m.mu
+	txn.commit = func() {
+		m.version++
+		m.stamp()
+	}
+	return txn
+}
+
+//RollbackTo(sp) is stamped as a single new version; older versions are
+//unchanged.
+//
+func (m *mvccTree) RollbackTo(sp Savepoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.tree.RollbackTo(sp); err != nil {
+		return err
+	}
+	m.version++
+	m.stamp()
+	return nil
+}
+
+//Get(key, AsOf(version)) returns the value for key as of version. Without
+//AsOf() the latest version is read.
+//
+func (m *mvccTree) Get(key BptKey, opts ...ReadOption) (interface{}, bool) {
+	val, found, err := m.GetE(key, opts...)
+	panicUnlessKeyErr(err)
+	return val, found
+}
+
+//GetE(key, AsOf(version)) is Get(key, AsOf(version)) that returns a
+//*KeyTypeError for a bad key.
+//
+func (m *mvccTree) GetE(key BptKey, opts ...ReadOption) (interface{}, bool, error) {
+	return m.view(readOpts(opts)).GetE(key)
+}
+
+//Range(lo, hi, fn, AsOf(version)) is tree.Range() as of version. Without
+//AsOf() the latest version is read.
+//
+func (m *mvccTree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) {
+	m.RangeContext(context.Background(), lo, hi, fn, opts...)
+}
+
+//RangeContext(ctx, lo, hi, fn, AsOf(version)) is tree.RangeContext() as of
+//version. Without AsOf() the latest version is read.
+//
+func (m *mvccTree) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error {
+	return m.view(readOpts(opts)).RangeContext(ctx, lo, hi, fn)
+}
+
+//UnmarshalBinary(data) stamps a new version; see tree.UnmarshalBinary().
+//
+func (m *mvccTree) UnmarshalBinary(data []byte) error {
+	_, err := m.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+//ReadFrom(r) stamps a new version iff the entries are replaced; see
+//tree.ReadFrom().
+//
+func (m *mvccTree) ReadFrom(r io.Reader) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.tree.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+	m.version++
+	m.stamp()
+	return n, nil
+}
+
+//UnmarshalJSON(data) stamps a new version iff the entries are replaced; see
+//tree.UnmarshalJSON().
+//
+func (m *mvccTree) UnmarshalJSON(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.tree.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	m.version++
+	m.stamp()
+	return nil
+}
+
+//GobDecode(data) stamps a new version iff the entries are replaced; see
+//tree.GobDecode().
+//
+func (m *mvccTree) GobDecode(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.tree.GobDecode(data); err != nil {
+		return err
+	}
+	m.version++
+	m.stamp()
+	return nil
+}
+
+//view(ro) returns a read-only *tree of the newest recorded version that is
+//<= the AsOf() version of ro, or of the latest version without AsOf(). A
+//version reclaimed by GC() reads as an empty tree. The nodes of a recorded
+//version are never modified again, so the *tree is read without m.mu.
+func (m *mvccTree) view(ro readOptions) *tree {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var at = new(tree)
+	at.order = m.order
+	at.keyType = m.keyType
+	at.log = m.log
+	at.readOnly = true
+
+	version := m.version
+	if ro.asOfSet {
+		version = ro.asOf
+	}
+	//i is the index of the first recorded version > version
+	i := sort.Search(len(m.history), func(i int) bool {
+		return m.history[i].version > version
+	})
+	if i == 0 {
+		at.root = mkLeaf(m.order)
+		return at
+	}
+	v := m.history[i-1]
+	at.root = v.root
+	at.numEnts = v.numEnts
+	return at
+}
+
+//GC(minVersion) drops every recorded version that is not visible to a read
+//AsOf(minVersion) or later. Nodes only reachable from dropped versions are
+//reclaimed by the go garbage collector. After GC(minVersion), reads AsOf a
+//version < minVersion may not find anything.
+//
+func (m *mvccTree) GC(minVersion uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := sort.Search(len(m.history), func(i int) bool {
+		return m.history[i].version > minVersion
+	})
+	if i <= 1 {
+		return //the version minVersion reads is the oldest we have
+	}
+	//keep m.history[i-1], the version minVersion reads, and everything after
+	m.history = append([]versionT(nil), m.history[i-1:]...)
+}
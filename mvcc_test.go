@@ -0,0 +1,165 @@
+package bptree
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRangeInOrder(t *testing.T) {
+	bpt := NewBpTree(3)
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	//largeNumEnts is in ascending StringKey order
+	var i int
+	bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+		if !k.Equals(largeNumEnts[i].key) || v.(int) != largeNumEnts[i].val {
+			t.Logf("Range entry %d = {%q %v}; expected {%q %d}", i, k, v, largeNumEnts[i].key, largeNumEnts[i].val)
+			t.FailNow()
+		}
+		i++
+		return true
+	})
+	if i != len(largeNumEnts) {
+		t.Logf("Range visited %d entries; expected %d", i, len(largeNumEnts))
+		t.Fail()
+	}
+
+	lo, hi := 100, 200
+	i = lo
+	bpt.Range(largeNumEnts[lo].key, largeNumEnts[hi].key, func(k BptKey, v interface{}) bool {
+		if !k.Equals(largeNumEnts[i].key) {
+			t.Logf("Range entry = %q; expected %q", k, largeNumEnts[i].key)
+			t.FailNow()
+		}
+		i++
+		return true
+	})
+	if i != hi {
+		t.Logf("Range(lo, hi) stopped at %d; expected %d", i, hi)
+		t.Fail()
+	}
+}
+
+func TestMVCCAsOf(t *testing.T) {
+	bpt := NewMVCCBpTree(3)
+
+	versions := make([]uint64, len(largeNumEnts))
+	for i, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+		versions[i] = bpt.Version()
+	}
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Del(ent.key)
+	}
+
+	if bpt.NumberOfEntries() != 0 {
+		t.Logf("bpt.NumberOfEntries(),%d != 0", bpt.NumberOfEntries())
+		t.Fail()
+	}
+
+	//as of versions[i] exactly the first i+1 entries were in the tree
+	for _, i := range []int{0, 1, 99, 450, len(largeNumEnts) - 1} {
+		var n int
+		bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+			n++
+			return true
+		}, AsOf(versions[i]))
+		if n != i+1 {
+			t.Logf("AsOf(%d) Range found %d entries; expected %d", versions[i], n, i+1)
+			t.Fail()
+		}
+
+		val, found := bpt.Get(largeNumEnts[i].key, AsOf(versions[i]))
+		if !found || val.(int) != largeNumEnts[i].val {
+			t.Logf("AsOf(%d) Get(%q) = %v, %v", versions[i], largeNumEnts[i].key, val, found)
+			t.Fail()
+		}
+		if i+1 < len(largeNumEnts) {
+			if _, found := bpt.Get(largeNumEnts[i+1].key, AsOf(versions[i])); found {
+				t.Logf("AsOf(%d) found %q put in a later version", versions[i], largeNumEnts[i+1].key)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestMVCCGC(t *testing.T) {
+	bpt := NewMVCCBpTree(4)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	minVersion := uint64(500)
+	bpt.GC(minVersion)
+
+	if _, found := bpt.Get(largeNumEnts[0].key, AsOf(minVersion-1)); found {
+		t.Logf("found an entry AsOf(%d) after GC(%d)", minVersion-1, minVersion)
+		t.Fail()
+	}
+	for _, v := range []uint64{minVersion, minVersion + 1, bpt.Version()} {
+		if _, found := bpt.Get(largeNumEnts[v-1].key, AsOf(v)); !found {
+			t.Logf("did not find %q AsOf(%d) after GC(%d)", largeNumEnts[v-1].key, v, minVersion)
+			t.Fail()
+		}
+	}
+}
+
+func TestMVCCConcurrentAsOf(t *testing.T) {
+	bpt := NewMVCCBpTree(4)
+	keep := uint64(len(largeNumEnts) / 4)
+
+	var wg, started sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan string, 8)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				//version v holds exactly the first v entries; the writer
+				//only reclaims the versions before keep
+				v := bpt.Version()
+				var n uint64
+				bpt.Range(nil, nil, func(BptKey, interface{}) bool {
+					n++
+					return true
+				}, AsOf(v))
+				if v >= keep && n != v {
+					errs <- fmt.Sprintf("AsOf(%d) Range found %d entries", v, n)
+					return
+				}
+				if v > 0 {
+					if _, found := bpt.Get(largeNumEnts[v-1].key, AsOf(v)); !found && v >= keep {
+						errs <- fmt.Sprintf("AsOf(%d) did not find %q", v, largeNumEnts[v-1].key)
+						return
+					}
+				}
+				bpt.Get(largeNumEnts[0].key)
+			}
+		}()
+	}
+
+	started.Wait()
+	for i, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+		if i == len(largeNumEnts)/2 {
+			bpt.GC(keep)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,681 @@
+package bptree
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+//olcTree is a BpTree using optimistic lock coupling (Leis et al., "The ART
+//of Practical Synchronization", 2016). Every node has a version counter, see
+//nodeSync, that is odd while a writer has the node locked and is bumped again
+//when the writer is done with it.
+//
+//Readers take no locks and write nothing shared. They remember the version
+//of each node before reading it and check it is unchanged afterwards, and
+//after reading the version of its child; if it is not, what they read may be
+//out of date and they restart from the root.
+//
+//A Go program may not read memory while another goroutine writes it, so
+//readers do not read the keys and vals of a node, which the writers modify
+//in place. They read its view, an olcView the writer publishes with an
+//atomic store before unlocking the node, and which is never modified.
+//
+//Writers are serialized by mu. Each Put() or Del() version locks the nodes
+//the split/steal/merge code of the plain *tree is going to change, the same
+//nodes the latched tree would latch, runs that code, publishes the new views
+//of those nodes and unlocks them. Operations on the whole tree do not modify
+//any node a reader can reach; they copy-on-write, see Snapshot(), and publish
+//the new root.
+type olcTree struct {
+	mu       sync.Mutex              //serializes writers and every op on the whole tree
+	root     atomic.Pointer[olcRoot] //the published t.root; see publish()
+	count    atomic.Int64            //the published t.numEnts
+	restarts atomic.Uint64           //number of times a reader restarted
+	t        *tree
+}
+
+//olcRoot is the root readers start from, and a read-only tree holding the
+//key type and logger Get() checks keys with.
+type olcRoot struct {
+	node nodeI
+	meta *tree
+}
+
+//olcView is the read-only copy of a node that readers read instead of the
+//node. Its slices are never modified.
+type olcView struct {
+	keys []BptKey
+	vals []interface{} //the values of a leaf
+	kids []nodeI       //the children of an interior node
+}
+
+//NewOptimisticBpTree instantiates a new B+Tree, for a given order, that is
+//safe for concurrent use by multiple goroutines; see NewBpTree() for the
+//meaning of order.
+//
+//It is meant for read mostly workloads. Get() and Range() take no locks and
+//are never blocked; they retry when a Put() or Del() changes a node while
+//they read it. Put(), Del() and the other modifying operations are
+//serialized.
+//
+//Range() does not see a consistent snapshot; it sees every entry that was in
+//the tree for the whole Range() call exactly once, and may or may not see
+//entries changed while it runs. fn is called with no lock held, so it may
+//call any method of the tree.
+//
+//NewOptimisticBpTree panics if order is less than 3; see
+//NewOptimisticBpTreeE().
+func NewOptimisticBpTree(order int) BpTree {
+	o, err := NewOptimisticBpTreeE(order)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+//NewOptimisticBpTreeE is NewOptimisticBpTree() that returns ErrInvalidOrder
+//instead of panicking.
+func NewOptimisticBpTreeE(order int) (BpTree, error) {
+	if order < 3 {
+		return nil, ErrInvalidOrder
+	}
+	var o = new(olcTree)
+	o.t = mkTree(order)
+	o.t.latched = true
+	o.t.root = o.t.newLeaf()
+	o.publish()
+	return o, nil
+}
+
+//olcReadLock(node) returns the version of node, and false if node is
+//write locked.
+func olcReadLock(node nodeI) (uint64, bool) {
+	v := node.syncState().version.Load()
+	return v, v&1 == 0
+}
+
+//olcValidate(node, v) is true if node is still at version v; i.e. no writer
+//has locked node since olcReadLock() returned v.
+func olcValidate(node nodeI, v uint64) bool {
+	return node.syncState().version.Load() == v
+}
+
+//olcWriteLock(node) makes the version of node odd. Writers are serialized,
+//so node can not already be write locked.
+func olcWriteLock(node nodeI) {
+	if node.syncState().version.Add(1)&1 == 0 {
+		corrupt("olcWriteLock: node was already write locked")
+	}
+}
+
+//olcWriteUnlock(node) makes the version of node even again, and different
+//from any version a reader could have seen before olcWriteLock().
+func olcWriteUnlock(node nodeI) {
+	node.syncState().version.Add(1)
+}
+
+//olcLoad(node) returns the published view of node.
+func olcLoad(node nodeI) *olcView {
+	return node.syncState().view.Load()
+}
+
+//olcReadView(node, v) returns the view of node at version v, and false if
+//node has changed since; then the caller must restart.
+func olcReadView(node nodeI, v uint64) (*olcView, bool) {
+	view := olcLoad(node)
+	return view, olcValidate(node, v)
+}
+
+//olcPublish(node) publishes a view of node as it is now. The children of an
+//interior node that have no view yet, the nodes a writer made, are published
+//first; a reader must never reach a node with no view.
+func olcPublish(node nodeI) {
+	view := new(olcView)
+	if node.isLeaf() {
+		leaf := node.(*leafNodeS)
+		view.keys = append([]BptKey(nil), leaf.keys...)
+		view.vals = append([]interface{}(nil), leaf.vals...)
+	} else {
+		curNode := node.(*interiorNodeS)
+		for _, child := range curNode.vals {
+			if olcLoad(child) == nil {
+				olcPublish(child)
+			}
+		}
+		view.keys = append([]BptKey(nil), curNode.keys...)
+		view.kids = append([]nodeI(nil), curNode.vals...)
+	}
+	node.syncState().view.Store(view)
+}
+
+//o.publish() makes t.root, and t.numEnts, visible to readers. It must be
+//called with o.mu held after every change to t, and before the nodes the
+//change locked are unlocked. Every node reachable from t.root has a view,
+//except the nodes the change made, which get one now.
+func (o *olcTree) publish() {
+	t := o.t
+	if olcLoad(t.root) == nil {
+		olcPublish(t.root)
+	}
+	r := o.root.Load()
+	if r == nil || r.node != t.root || r.meta.keyType != t.keyType || r.meta.log != t.log {
+		meta := &tree{readOnly: true, keyType: t.keyType, log: t.log}
+		o.root.Store(&olcRoot{node: t.root, meta: meta})
+	}
+	o.count.Store(int64(t.numEnts))
+}
+
+//o.release(ls) publishes the views of the nodes locked in ls, and of the
+//nodes made by the Put() or Del() that locked them, then the root, and only
+//then unlocks them.
+func (o *olcTree) release(ls *latchSet) {
+	for _, node := range ls.nodes {
+		olcPublish(node)
+	}
+	o.publish()
+	ls.releaseAll()
+}
+
+//o.readRoot() returns the root and its version, and false if the caller
+//must restart.
+func (o *olcTree) readRoot() (nodeI, uint64, bool) {
+	r := o.root.Load()
+	v, ok := olcReadLock(r.node)
+	if !ok {
+		return nil, 0, false
+	}
+	//a writer changes the root while holding the old root locked
+	if o.root.Load() != r {
+		return nil, 0, false
+	}
+	return r.node, v, true
+}
+
+//o.descend(key) optimistically walks from the root to the leaf key belongs
+//in. It returns the leaf, its version and the least key known to be in a
+//leaf to the right of it, or nil if there is none. ok is false if the caller
+//must restart.
+func (o *olcTree) descend(key BptKey) (leaf nodeI, v uint64, upper BptKey, ok bool) {
+	node, v, ok := o.readRoot()
+	if !ok {
+		return nil, 0, nil, false
+	}
+
+	for !node.isLeaf() {
+		view := olcLoad(node)
+		var i int
+		for i = 0; i < len(view.keys); i++ {
+			if key.LessThan(view.keys[i]) {
+				break
+			}
+		}
+		if i < len(view.keys) {
+			upper = view.keys[i]
+		}
+		child := view.kids[i]
+
+		cv, ok := olcReadLock(child)
+		//child may have been split or merged away before its version was
+		//read
+		if !ok || !olcValidate(node, v) {
+			return nil, 0, nil, false
+		}
+		node, v = child, cv
+	}
+	return node, v, upper, true
+}
+
+//o.descendLeftMost() is descend() for the left most leaf.
+func (o *olcTree) descendLeftMost() (nodeI, uint64, BptKey, bool) {
+	node, v, ok := o.readRoot()
+	if !ok {
+		return nil, 0, nil, false
+	}
+
+	var upper BptKey
+	for !node.isLeaf() {
+		view := olcLoad(node)
+		if len(view.keys) > 0 {
+			upper = view.keys[0]
+		}
+		child := view.kids[0]
+
+		cv, ok := olcReadLock(child)
+		if !ok || !olcValidate(node, v) {
+			return nil, 0, nil, false
+		}
+		node, v = child, cv
+	}
+	return node, v, upper, true
+}
+
+//o.retry(fn) calls fn until it returns true, yielding the processor in
+//between.
+func (o *olcTree) retry(fn func() bool) {
+	for !fn() {
+		o.restarts.Add(1)
+		runtime.Gosched()
+	}
+}
+
+func (o *olcTree) Order() int {
+	//the order never changes
+	return o.t.order
+}
+
+func (o *olcTree) Get(key BptKey, opts ...ReadOption) (interface{}, bool) {
+	if readOpts(opts).asOfSet {
+		panic("Get: AsOf() requires an MVCC tree")
+	}
+
+	meta := o.root.Load().meta
+	if err := meta.checkKey(key); err != nil {
+		meta.logErr("get", key, err)
+		return nil, false
+	}
+
+	var val interface{}
+	var found bool
+	o.retry(func() bool {
+		val, found = nil, false
+
+		leaf, v, _, ok := o.descend(key)
+		if !ok {
+			return false
+		}
+		view, ok := olcReadView(leaf, v)
+		if !ok {
+			return false
+		}
+
+		for i, k := range view.keys {
+			if key.Equals(k) {
+				val, found = view.vals[i], true
+				break
+			}
+		}
+		return true
+	})
+	return val, found
+}
+
+func (o *olcTree) Put(key BptKey, val interface{}) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	t := o.t
+	if err := t.checkKey(key); err != nil {
+		t.logErr("put", key, err)
+		return false
+	}
+	t.checkOp("put", key)
+
+	ls := &latchSet{olc: true}
+	defer o.release(ls)
+
+	path := newPathT()
+	leaf := o.lockPath(key, &path, ls, putSafe)
+
+	var inverse undoEntry
+	if t.undo != nil {
+		inverse = putInverse(leaf, key)
+	}
+
+	added := t.putLeaf(leaf, key, val, &path)
+	if added {
+		t.numEnts++
+	}
+	if t.undo != nil {
+		t.undo.record(inverse)
+	}
+	if t.keyType == nil {
+		t.keyType = reflect.TypeOf(key)
+	}
+
+	t.checkTree("put")
+	return added
+}
+
+func (o *olcTree) Del(key BptKey) (interface{}, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	t := o.t
+	if err := t.checkKey(key); err != nil {
+		t.logErr("del", key, err)
+		return nil, false
+	}
+	t.checkOp("del", key)
+
+	ls := &latchSet{olc: true}
+	defer o.release(ls)
+
+	path := newPathT()
+	leaf := o.lockPath(key, &path, ls, delSafe)
+
+	val, found := t.delLeaf(leaf, key, &path, ls)
+	if found {
+		if t.undo != nil {
+			t.undo.recordDel(key, val)
+		}
+		t.numEnts--
+	}
+
+	t.checkTree("del")
+	return val, found
+}
+
+//o.lockPath(key, path, ls, safe) finds the leaf for key and version locks,
+//in ls, the nodes a Put() or Del() of key may change: the leaf and its
+//ancestors up to the lowest one that is safe, or the root. Only those
+//ancestors are left on path, the same as findLeafLatched() of the latched
+//tree. Peers are locked by delLeaf() as it reaches them.
+//
+//If a node on the way to the leaf is shared with a Snapshot, every node on
+//the way is locked instead, and the leaf and path returned are the copies
+//findLeafMut() makes of them.
+func (o *olcTree) lockPath(key BptKey, path *pathT, ls *latchSet, safe func(nodeI, bool) bool) *leafNodeS {
+	t := o.t
+
+	leaf := t.findLeaf(key, path)
+
+	nodes := make([]nodeI, 0, len(*path)+1)
+	owned := true
+	for _, node := range *path {
+		nodes = append(nodes, node)
+		owned = owned && node.generation() == t.gen
+	}
+	nodes = append(nodes, leaf)
+	owned = owned && leaf.generation() == t.gen
+
+	if !owned {
+		for _, node := range nodes {
+			ls.lock(node)
+		}
+		*path = (*path)[:0]
+		return t.findLeafMut(key, path)
+	}
+
+	var top int
+	for i := len(nodes) - 1; i > 0; i-- {
+		if safe(nodes[i], false) {
+			top = i
+			break
+		}
+	}
+	for _, node := range nodes[top:] {
+		ls.lock(node)
+	}
+	*path = append((*path)[:0], (*path)[top:]...)
+	return leaf
+}
+
+//Range(lo, hi, fn) reads one leaf at a time optimistically and calls fn with
+//its entries once the leaf has been validated. The next leaf is found from
+//the root again, starting at the least key known to be to the right of the
+//leaf just read.
+func (o *olcTree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) {
+	o.RangeContext(context.Background(), lo, hi, fn, opts...)
+}
+
+//RangeContext(ctx, lo, hi, fn) is Range(lo, hi, fn) that checks ctx before
+//reading each leaf.
+func (o *olcTree) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error {
+	if readOpts(opts).asOfSet {
+		panic("Range: AsOf() requires an MVCC tree")
+	}
+
+	var keys []BptKey
+	var vals []interface{}
+	start := lo
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var upper BptKey
+		o.retry(func() bool {
+			keys, vals = keys[:0], vals[:0]
+
+			var leaf nodeI
+			var v uint64
+			var ok bool
+			if start != nil {
+				leaf, v, upper, ok = o.descend(start)
+			} else {
+				leaf, v, upper, ok = o.descendLeftMost()
+			}
+			if !ok {
+				return false
+			}
+			view, ok := olcReadView(leaf, v)
+			if !ok {
+				return false
+			}
+
+			for i, k := range view.keys {
+				if start != nil && k.LessThan(start) {
+					continue
+				}
+				keys = append(keys, k)
+				vals = append(vals, view.vals[i])
+			}
+			return true
+		})
+
+		for i, k := range keys {
+			if hi != nil && !k.LessThan(hi) {
+				return nil
+			}
+			if !fn(k, vals[i]) {
+				return nil
+			}
+		}
+
+		if upper == nil || (hi != nil && !upper.LessThan(hi)) {
+			return nil
+		}
+		start = upper
+	}
+}
+
+func (o *olcTree) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.t.String()
+}
+
+func (o *olcTree) Validate() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.t.Validate()
+}
+
+func (o *olcTree) Graph(opts ...GraphOption) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.t.Graph(opts...)
+}
+
+//DumpJSON(w, opts...) encodes the tree with the lock held, and writes it to w
+//without.
+func (o *olcTree) DumpJSON(w io.Writer, opts ...JSONOption) error {
+	o.mu.Lock()
+	doc, err := o.t.jsonTree(jsonOpts(opts))
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, doc)
+}
+
+//MarshalBinary() encodes a Snapshot() of the tree; see WriteTo().
+func (o *olcTree) MarshalBinary() ([]byte, error) {
+	return o.Snapshot().(*tree).MarshalBinary()
+}
+
+//WriteTo(w) writes a Snapshot() of the tree to w, without the lock held.
+func (o *olcTree) WriteTo(w io.Writer) (int64, error) {
+	return o.Snapshot().(*tree).WriteTo(w)
+}
+
+func (o *olcTree) UnmarshalBinary(data []byte) error {
+	_, err := o.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+//ReadFrom(r) decodes the entries without the lock held, and then replaces
+//the entries of the tree with them.
+func (o *olcTree) ReadFrom(r io.Reader) (int64, error) {
+	o.mu.Lock()
+	vc := o.t.valueCodec()
+	o.mu.Unlock()
+
+	keys, vals, n, err := readBinary(r, vc)
+	if err != nil {
+		return n, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err = o.t.loadEntries(keys, vals)
+	o.publish()
+	return n, err
+}
+
+func (o *olcTree) SetValueCodec(vc ValueCodec) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.t.SetValueCodec(vc)
+}
+
+//MarshalJSON() encodes a Snapshot() of the tree.
+func (o *olcTree) MarshalJSON() ([]byte, error) {
+	return o.Snapshot().(*tree).MarshalJSON()
+}
+
+func (o *olcTree) UnmarshalJSON(data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.t.UnmarshalJSON(data)
+	o.publish()
+	return err
+}
+
+//GobEncode() encodes a Snapshot() of the tree.
+func (o *olcTree) GobEncode() ([]byte, error) {
+	return o.Snapshot().(*tree).GobEncode()
+}
+
+func (o *olcTree) GobDecode(data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.t.GobDecode(data)
+	o.publish()
+	return err
+}
+
+func (o *olcTree) SetKeyFactory(f KeyFactory) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.t.SetKeyFactory(f)
+}
+
+func (o *olcTree) Stats() Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.t.Stats()
+}
+
+func (o *olcTree) ResetStats() {
+	//the counters are atomic
+	o.t.ResetStats()
+}
+
+func (o *olcTree) NumberOfEntries() int {
+	return int(o.count.Load())
+}
+
+//Clear() installs a new empty root; readers still in the old tree finish
+//reading it undisturbed.
+func (o *olcTree) Clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.t.Clear()
+	o.publish()
+}
+
+//Clone() returns a plain, not concurrency safe, copy of the tree.
+func (o *olcTree) Clone() BpTree {
+	return o.CloneWith(nil)
+}
+
+//CloneWith(copyVal) returns a plain, not concurrency safe, copy of the tree.
+func (o *olcTree) CloneWith(copyVal func(interface{}) interface{}) BpTree {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.t.CloneWith(copyVal)
+}
+
+//Snapshot() returns a read-only Snapshot which, since it never changes, is
+//safe for concurrent use without any locking.
+func (o *olcTree) Snapshot() BpTree {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.t.Snapshot()
+}
+
+//Begin() starts a Txn whose Commit() excludes Put and Del while it installs
+//the Txn's writes, and publishes the new root. Commit() copies-on-write
+//every node it changes, so no reader sees a partially installed Txn.
+func (o *olcTree) Begin() *Txn {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	txn := o.t.Begin()
+	txn.lock = &o.mu
+	txn.commit = o.publish
+	return txn
+}
+
+func (o *olcTree) EnableUndo(maxEntries int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.t.EnableUndo(maxEntries)
+}
+
+func (o *olcTree) Savepoint() Savepoint {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.t.Savepoint()
+}
+
+//RollbackTo(sp) replays the journal on a new generation of the tree, so
+//every node it changes is a copy no reader can see until the new root is
+//published.
+func (o *olcTree) RollbackTo(sp Savepoint) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.t.gen = nextGen()
+	err := o.t.RollbackTo(sp)
+	o.publish()
+	return err
+}
+
+func (o *olcTree) SetLogger(l *slog.Logger) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.t.SetLogger(l)
+	o.publish()
+}
+
+func (o *olcTree) SetCheckLevel(level CheckLevel) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.t.SetCheckLevel(level)
+}
@@ -0,0 +1,240 @@
+package bptree
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestOptimisticPutGetRangeDel(t *testing.T) {
+	for _, order := range []int{3, 4, 7} {
+		bpt := NewOptimisticBpTree(order)
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			if !bpt.Put(ent.key, ent.val) {
+				t.Fatalf("Put(%q) did not insert", ent.key)
+			}
+		}
+
+		ot := bpt.(*olcTree)
+		if !_validTree(t, ot.t) {
+			t.Fatalf("order=%d; !_validTree(t, ot.t) after Put()", order)
+		}
+
+		for _, ent := range largeNumEnts {
+			val, found := bpt.Get(ent.key)
+			if !found || val.(int) != ent.val {
+				t.Fatalf("Get(%q) = %v, %v; expected %d", ent.key, val, found, ent.val)
+			}
+		}
+
+		//Range() must find the next leaf from its upper bound
+		var n int
+		bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+			if !k.Equals(largeNumEnts[n].key) {
+				t.Fatalf("Range entry %d = %q; expected %q", n, k, largeNumEnts[n].key)
+			}
+			n++
+			return true
+		})
+		if n != len(largeNumEnts) {
+			t.Fatalf("Range visited %d entries; expected %d", n, len(largeNumEnts))
+		}
+
+		lo, hi := largeNumEnts[3].key, largeNumEnts[len(largeNumEnts)-3].key
+		n = 3
+		bpt.Range(lo, hi, func(k BptKey, v interface{}) bool {
+			if !k.Equals(largeNumEnts[n].key) {
+				t.Fatalf("Range(lo,hi) entry = %q; expected %q", k, largeNumEnts[n].key)
+			}
+			n++
+			return true
+		})
+		if n != len(largeNumEnts)-3 {
+			t.Fatalf("Range(lo,hi) stopped at %d; expected %d", n, len(largeNumEnts)-3)
+		}
+
+		//the second half of the Del()s path-copy around the Snapshot
+		delEnts := genRandomizedEntries(largeNumEnts)
+		half := len(delEnts) / 2
+		var snap BpTree
+		for i, ent := range delEnts {
+			if i == half {
+				snap = bpt.Snapshot()
+			}
+			val, found := bpt.Del(ent.key)
+			if !found || val.(int) != ent.val {
+				t.Fatalf("Del(%q) = %v, %v; expected %d", ent.key, val, found, ent.val)
+			}
+		}
+
+		if !_validTree(t, ot.t) {
+			t.Fatalf("order=%d; !_validTree(t, ot.t) after Del()", order)
+		}
+		if bpt.NumberOfEntries() != 0 {
+			t.Fatalf("bpt.NumberOfEntries(),%d != 0", bpt.NumberOfEntries())
+		}
+		if snap.NumberOfEntries() != len(delEnts)-half {
+			t.Fatalf("snap.NumberOfEntries(),%d != %d", snap.NumberOfEntries(), len(delEnts)-half)
+		}
+		for _, ent := range delEnts[half:] {
+			if _, found := snap.Get(ent.key); !found {
+				t.Fatalf("snap.Get(%q) not found", ent.key)
+			}
+		}
+	}
+}
+
+//TestOptimisticRestarts checks that readers restart, instead of reading a
+//node, while a writer has it locked, and then see what the writer published.
+func TestOptimisticRestarts(t *testing.T) {
+	bpt := NewOptimisticBpTree(3)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	o := bpt.(*olcTree)
+	ent := largeNumEnts[len(largeNumEnts)/2]
+
+	//replace the value of ent as Put() does, but keep its leaf locked
+	o.mu.Lock()
+	ls := &latchSet{olc: true}
+	path := newPathT()
+	leaf := o.lockPath(ent.key, &path, ls, putSafe)
+	o.t.putLeaf(leaf, ent.key, -1, &path)
+
+	got := make(chan interface{}, 2)
+	go func() {
+		val, _ := bpt.Get(ent.key)
+		got <- val
+		bpt.Range(ent.key, nil, func(k BptKey, v interface{}) bool {
+			got <- v
+			return false
+		})
+	}()
+
+	for o.restarts.Load() < 10 {
+		select {
+		case val := <-got:
+			t.Fatalf("Get(%q) = %v while its leaf was locked", ent.key, val)
+		default:
+			runtime.Gosched()
+		}
+	}
+
+	o.release(ls)
+	o.mu.Unlock()
+
+	if val := <-got; val != -1 {
+		t.Fatalf("Get(%q) = %v; expected -1", ent.key, val)
+	}
+	if val := <-got; val != -1 {
+		t.Fatalf("Range(%q, nil) started with %v; expected -1", ent.key, val)
+	}
+
+	//a reader that found the leaf before a writer changed it must restart
+	node, v, _, ok := o.descend(ent.key)
+	if !ok {
+		t.Fatalf("descend(%q) restarted with no writer", ent.key)
+	}
+	bpt.Del(ent.key)
+	if _, ok := olcReadView(node, v); ok {
+		t.Fatalf("olcReadView() of the leaf of %q validated after Del(%q)", ent.key, ent.key)
+	}
+}
+
+func TestOptimisticRollbackAndTxn(t *testing.T) {
+	bpt := NewOptimisticBpTree(4).(Undoable)
+	bpt.EnableUndo(0)
+	sp := bpt.Savepoint()
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+	if err := bpt.RollbackTo(sp); err != nil {
+		t.Fatalf("RollbackTo(sp) = %v", err)
+	}
+	if bpt.NumberOfEntries() != 0 {
+		t.Fatalf("bpt.NumberOfEntries(),%d != 0 after RollbackTo", bpt.NumberOfEntries())
+	}
+	if _, found := bpt.Get(largeNumEnts[0].key); found {
+		t.Fatalf("Get(%q) found after RollbackTo", largeNumEnts[0].key)
+	}
+
+	txn := bpt.(Transactional).Begin()
+	for _, ent := range largeNumEnts {
+		txn.Put(ent.key, ent.val)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("txn.Commit() = %v", err)
+	}
+	if bpt.NumberOfEntries() != len(largeNumEnts) {
+		t.Fatalf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts))
+	}
+	for _, ent := range largeNumEnts {
+		if _, found := bpt.Get(ent.key); !found {
+			t.Fatalf("Get(%q) not found after Commit", ent.key)
+		}
+	}
+}
+
+//TestOptimisticReadersWithWriters runs under the race detector too; the
+//readers only read the views of nodes, which no writer modifies.
+func TestOptimisticReadersWithWriters(t *testing.T) {
+	for _, order := range []int{3, 4, 7} {
+		bpt := NewOptimisticBpTree(order)
+
+		//the even entries are always in the tree; the odd ones come and go
+		for i := 0; i < len(largeNumEnts); i += 2 {
+			bpt.Put(largeNumEnts[i].key, largeNumEnts[i].val)
+		}
+
+		nWorkers := 4
+		var wg sync.WaitGroup
+		for w := 0; w < nWorkers; w++ {
+			wg.Add(2)
+			go func(w int) {
+				defer wg.Done()
+				for i := 2*w + 1; i < len(largeNumEnts); i += 2 * nWorkers {
+					bpt.Put(largeNumEnts[i].key, largeNumEnts[i].val)
+				}
+				for i := 2*w + 1; i < len(largeNumEnts); i += 2 * nWorkers {
+					bpt.Del(largeNumEnts[i].key)
+				}
+			}(w)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < len(largeNumEnts); i += 2 {
+					val, found := bpt.Get(largeNumEnts[i].key)
+					if !found || val.(int) != largeNumEnts[i].val {
+						t.Errorf("Get(%q) = %v, %v; expected %d", largeNumEnts[i].key, val, found, largeNumEnts[i].val)
+						return
+					}
+				}
+
+				var prev BptKey
+				var n int
+				bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+					if prev != nil && !prev.LessThan(k) {
+						t.Errorf("Range out of order: %q then %q", prev, k)
+						return false
+					}
+					prev = k
+					if v.(int)%2 == 1 {
+						n++
+					}
+					return true
+				})
+				if n != (len(largeNumEnts)+1)/2 {
+					t.Errorf("Range saw %d of the %d permanent entries", n, (len(largeNumEnts)+1)/2)
+				}
+			}()
+		}
+		wg.Wait()
+
+		ot := bpt.(*olcTree)
+		if !_validTree(t, ot.t) {
+			t.Fatalf("order=%d; !_validTree(t, ot.t)", order)
+		}
+		if bpt.NumberOfEntries() != (len(largeNumEnts)+1)/2 {
+			t.Fatalf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), (len(largeNumEnts)+1)/2)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+//pageID is the index of a page in the file of a DiskBpTree; the page is at
+//byte offset pageID*pageSize. Page 0 is the header, so 0 is also the nil
+//pageID.
+type pageID uint64
+
+//The header page of the file of a DiskBpTree is, with every integer little
+//endian:
+//
+//    magic    [4]byte  "BPTD"
+//    version  uint8    pageVersion
+//    _        [3]byte
+//    pageSize uint32
+//    order    uint32
+//    root     uint64   pageID of the root node
+//    height   uint32   of the tree; 1 is just a root leaf
+//    entries  uint64
+//    pages    uint64   number of pages in the file, the header included
+//    freeHead uint64   pageID of the first free page; 0 if there is none
+//    free     uint64   number of free pages
+//    keyCodec uint16 length, then the name the KeyCodec is registered as;
+//                      empty for a tree that never held a key
+//    ...
+//    checksum uint32   at byte headerSum; CRC-32C of every byte before it
+//
+//Every other page is a node or a free page:
+//
+//    type     uint8    pageLeaf, pageInterior or pageFree
+//    _        uint8
+//    count    uint16   number of keys
+//    checksum uint32   CRC-32C of every other byte of the page
+//    next     uint64   leaf: pageID of the leaf to the right, 0 for the last;
+//                      free page: pageID of the next free page
+//    leaf     count times: uint32 length, then the encoded key;
+//                          uint32 length, then the encoded value
+//    interior count+1 times: uint64 pageID of a child; then
+//             count times: uint32 length, then the encoded key
+//
+//The rest of a page is zero. A page whose checksum does not match is never
+//decoded; see checkPage().
+const (
+	pageMagic   = "BPTD"
+	pageVersion = 2
+
+	headerLen = 4 + 1 + 3 + 4 + 4 + 8 + 4 + 8 + 8 + 8 + 8 + 2
+	headerSum = minPageSize - 4
+	nodeHdr   = 1 + 1 + 2 + 4 + 8
+
+	minPageSize = 512
+)
+
+//the page types
+const (
+	pageLeaf byte = 1 + iota
+	pageInterior
+	pageFree
+)
+
+//pageHeader is the decoded header page.
+type pageHeader struct {
+	pageSize int
+	order    int
+	root     pageID
+	height   int
+	entries  int
+	pages    pageID
+	freeHead pageID
+	free     int
+	keyCodec string
+}
+
+func (h *pageHeader) encode(page []byte) {
+	le := binary.LittleEndian
+	copy(page, pageMagic)
+	page[4] = pageVersion
+	le.PutUint32(page[8:], uint32(h.pageSize))
+	le.PutUint32(page[12:], uint32(h.order))
+	le.PutUint64(page[16:], uint64(h.root))
+	le.PutUint32(page[24:], uint32(h.height))
+	le.PutUint64(page[28:], uint64(h.entries))
+	le.PutUint64(page[36:], uint64(h.pages))
+	le.PutUint64(page[44:], uint64(h.freeHead))
+	le.PutUint64(page[52:], uint64(h.free))
+	le.PutUint16(page[60:], uint16(len(h.keyCodec)))
+	copy(page[headerLen:], h.keyCodec)
+	le.PutUint32(page[headerSum:], crc32.Checksum(page[:headerSum], castagnoli))
+}
+
+//decodePageHeader(b) decodes the header from the first bytes of a file; b
+//must hold at least minPageSize bytes.
+func decodePageHeader(b []byte) (*pageHeader, error) {
+	le := binary.LittleEndian
+	if string(b[:4]) != pageMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrBadEncoding, b[:4])
+	}
+	if b[4] != pageVersion {
+		return nil, fmt.Errorf("%w: unsupported page version %d", ErrBadEncoding, b[4])
+	}
+	if stored, sum := le.Uint32(b[headerSum:]), crc32.Checksum(b[:headerSum], castagnoli); stored != sum {
+		return nil, &PageError{0, fmt.Errorf("%w: header: stored %08x; computed %08x", ErrChecksum, stored, sum)}
+	}
+	var h = new(pageHeader)
+	h.pageSize = int(le.Uint32(b[8:]))
+	h.order = int(le.Uint32(b[12:]))
+	h.root = pageID(le.Uint64(b[16:]))
+	h.height = int(le.Uint32(b[24:]))
+	h.entries = int(le.Uint64(b[28:]))
+	h.pages = pageID(le.Uint64(b[36:]))
+	h.freeHead = pageID(le.Uint64(b[44:]))
+	h.free = int(le.Uint64(b[52:]))
+	n := int(le.Uint16(b[60:]))
+	if h.pageSize < minPageSize || h.order < 3 || maxEntrySize(h.pageSize, h.order) < 64 || headerLen+n > headerSum {
+		return nil, fmt.Errorf("%w: bad header pageSize=%d order=%d", ErrBadEncoding, h.pageSize, h.order)
+	}
+	if h.root == 0 || h.root >= h.pages || h.freeHead >= h.pages || h.height < 1 {
+		return nil, fmt.Errorf("%w: bad header root=%d height=%d pages=%d", ErrBadEncoding, h.root, h.height, h.pages)
+	}
+	h.keyCodec = string(b[headerLen : headerLen+n])
+	return h, nil
+}
+
+//pageSum(page) returns the checksum of a node or free page.
+func pageSum(page []byte) uint32 {
+	return crc32.Update(crc32.Checksum(page[:4], castagnoli), castagnoli, page[8:])
+}
+
+//sealPage(page) stores the checksum of a node or free page in it.
+func sealPage(page []byte) {
+	binary.LittleEndian.PutUint32(page[4:], pageSum(page))
+}
+
+//checkPage(id, page) returns a *PageError if the checksum of page id, as
+//read from the file, does not match.
+func checkPage(id pageID, page []byte) error {
+	if stored, sum := binary.LittleEndian.Uint32(page[4:]), pageSum(page); stored != sum {
+		return &PageError{int64(id) * int64(len(page)), fmt.Errorf("%w: stored %08x; computed %08x", ErrChecksum, stored, sum)}
+	}
+	return nil
+}
+
+//pager reads and writes the pages of a single file, through a bufferPool,
+//and allocates them. Freed pages are kept on a free list, threaded through
+//the pages themselves, and reused before the file is grown.
+//
+//The header is only written by sync().
+type pager struct {
+	f    pageFile
+	hdr  pageHeader
+	pool *bufferPool
+}
+
+//openPager(f, do) reads the header of f, or writes a new one for an empty
+//tree of the page size and order of do, if f is empty.
+func openPager(f pageFile, do diskOptions) (*pager, error) {
+	var p = &pager{f: f}
+	pageSize, order := do.pageSize, do.order
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		//the options only matter for a new file; see DiskOrder()
+		if order < 3 {
+			return nil, ErrInvalidOrder
+		}
+		if pageSize < minPageSize || maxEntrySize(pageSize, order) < 64 {
+			return nil, fmt.Errorf("bptree: a page size of %d is too small for order %d", pageSize, order)
+		}
+		p.hdr = pageHeader{pageSize: pageSize, order: order, height: 1, pages: 1}
+		p.pool = newBufferPool(f, pageSize, do.cacheSize, do.eviction)
+		p.pool.verify = checkPage
+		root := p.alloc()
+		p.hdr.root = root
+		page, err := encodeNode(&diskNode{id: root, node: mkLeaf(order)}, pageSize, KeyCodec{})
+		if err != nil {
+			return nil, err
+		}
+		if err := p.writePage(root, page); err != nil {
+			return nil, err
+		}
+		return p, p.sync()
+	}
+
+	b := make([]byte, minPageSize)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: truncated header", ErrBadEncoding)
+		}
+		return nil, err
+	}
+	hdr, err := decodePageHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < int64(hdr.pages)*int64(hdr.pageSize) {
+		return nil, fmt.Errorf("%w: file holds %d bytes; expected %d pages of %d", ErrBadEncoding, fi.Size(), hdr.pages, hdr.pageSize)
+	}
+	p.hdr = *hdr
+	p.pool = newBufferPool(f, hdr.pageSize, do.cacheSize, do.eviction)
+	p.pool.verify = checkPage
+	return p, nil
+}
+
+//readPage(id) returns page id pinned in the pool; the caller must unpin(id)
+//it once done with it.
+func (p *pager) readPage(id pageID) ([]byte, error) {
+	if id == 0 || id >= p.hdr.pages {
+		return nil, fmt.Errorf("%w: page %d is out of range", ErrBadEncoding, id)
+	}
+	return p.pool.pin(id)
+}
+
+func (p *pager) unpin(id pageID) {
+	p.pool.unpin(id)
+}
+
+//writePage(id, page) replaces page id, which is written to the file when
+//it is evicted from the pool or by sync(). page must not be modified
+//afterwards.
+func (p *pager) writePage(id pageID, page []byte) error {
+	return p.pool.write(id, page)
+}
+
+//alloc() returns the pageID of an unused page; the first free page, or else
+//a new page at the end of the file. The page is not written.
+func (p *pager) alloc() pageID {
+	if id := p.hdr.freeHead; id != 0 {
+		page, err := p.readPage(id)
+		if err == nil {
+			p.unpin(id)
+		}
+		if err == nil && page[0] == pageFree {
+			p.hdr.freeHead = pageID(binary.LittleEndian.Uint64(page[8:]))
+			p.hdr.free--
+			return id
+		}
+		//a broken free list is abandoned rather than trusted
+		p.hdr.freeHead, p.hdr.free = 0, 0
+	}
+	id := p.hdr.pages
+	p.hdr.pages++
+	return id
+}
+
+//free(id) puts page id on the free list.
+func (p *pager) free(id pageID) error {
+	page := make([]byte, p.hdr.pageSize)
+	page[0] = pageFree
+	binary.LittleEndian.PutUint64(page[8:], uint64(p.hdr.freeHead))
+	sealPage(page)
+	if err := p.writePage(id, page); err != nil {
+		return err
+	}
+	p.hdr.freeHead = id
+	p.hdr.free++
+	return nil
+}
+
+//sync() writes back every dirty page, then the header, and flushes the file
+//to stable storage.
+func (p *pager) sync() error {
+	if err := p.pool.flush(); err != nil {
+		return err
+	}
+	page := make([]byte, p.hdr.pageSize)
+	p.hdr.encode(page)
+	if _, err := p.f.WriteAt(page, 0); err != nil {
+		return err
+	}
+	return p.f.Sync()
+}
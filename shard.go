@@ -0,0 +1,618 @@
+package bptree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//ErrBadSplit is returned by Rebalance() when the shard does not exist, or
+//the new split point is nil or not strictly between its neighboring split
+//points. A split point of another type than the rest is a *KeyTypeError.
+var ErrBadSplit = errors.New("bptree: split point is out of range or out of order")
+
+//ShardedBpTree is a BpTree made of independent shards, each owning the keys
+//in one range. Shard i owns the keys k with SplitPoints()[i-1] <= k <
+//SplitPoints()[i]; the first shard has no lower bound and the last has no
+//upper bound.
+//
+//Get(), Put() and Del() only lock the shard that owns the key, so writes to
+//different shards run in parallel.
+type ShardedBpTree interface {
+	BpTree
+	//Shards() returns the number of shards.
+	Shards() int
+	//SplitPoints() returns a copy of the Shards()-1 split points.
+	SplitPoints() []BptKey
+	//Rebalance(i, split) moves the split point between shard i and shard
+	//i+1 to split, moving the entries in between to the shard that now
+	//owns them.
+	Rebalance(i int, split BptKey) error
+}
+
+type shardedTree struct {
+	mu     sync.RWMutex //shared by routed ops; exclusive for Rebalance()
+	order  int
+	splits []BptKey //ascending; len(splits) == len(shards)-1
+	shards []BpTree
+	vcodec ValueCodec //also set on every shard; see SetValueCodec()
+	keyFac KeyFactory //see SetKeyFactory()
+}
+
+//NewShardedBpTree instantiates a new B+Tree, for a given order, made of
+//len(splits)+1 shards; see NewBpTree() for the meaning of order and
+//ShardedBpTree for how splits divide the keys between the shards. The
+//splits must be in strictly ascending order.
+//
+//Each shard is a NewConcurrentBpTree(), so the ShardedBpTree is safe for
+//concurrent use by multiple goroutines.
+//
+//Range() iterates over a Snapshot() of the shards it covers, so fn may call
+//any method of the tree. It is neither Transactional nor Undoable.
+//
+//NewShardedBpTree panics if order is less than 3 or the splits are bad; see
+//NewShardedBpTreeE().
+func NewShardedBpTree(order int, splits []BptKey) ShardedBpTree {
+	st, err := NewShardedBpTreeE(order, splits)
+	if err != nil {
+		panic(err)
+	}
+	return st
+}
+
+//NewShardedBpTreeE is NewShardedBpTree() that returns ErrInvalidOrder,
+//ErrBadSplit for a nil split, a *KeyTypeError for splits of mixed types, or
+//an error naming the splits that are out of order, instead of panicking.
+func NewShardedBpTreeE(order int, splits []BptKey) (ShardedBpTree, error) {
+	if order < 3 {
+		return nil, ErrInvalidOrder
+	}
+	for _, split := range splits {
+		if err := checkSplit(split, splits[0]); err != nil {
+			return nil, err
+		}
+	}
+	for i := 1; i < len(splits); i++ {
+		if !splits[i-1].LessThan(splits[i]) {
+			return nil, fmt.Errorf("bptree: NewShardedBpTree: splits[%d]=%q is not less than splits[%d]=%q", i-1, splits[i-1], i, splits[i])
+		}
+	}
+
+	var st = new(shardedTree)
+	st.order = order
+	st.splits = append([]BptKey(nil), splits...)
+	st.vcodec = DefaultValueCodec
+	st.shards = make([]BpTree, len(splits)+1)
+	for i := range st.shards {
+		st.shards[i] = NewConcurrentBpTree(order)
+	}
+	return st, nil
+}
+
+//checkSplit(split, like) returns ErrBadSplit for a nil split, and a
+//*KeyTypeError for a split of another type than like.
+func checkSplit(split, like BptKey) error {
+	if split == nil || like == nil {
+		return ErrBadSplit
+	}
+	if want := reflect.TypeOf(like); reflect.TypeOf(split) != want {
+		return &KeyTypeError{split, want}
+	}
+	return nil
+}
+
+//shardFor(key) returns the index of the shard that owns key. A nil key goes
+//to the first shard, which rejects it; see checkKey().
+func (st *shardedTree) shardFor(key BptKey) int {
+	if key == nil {
+		return 0
+	}
+	return sort.Search(len(st.splits), func(i int) bool {
+		return key.LessThan(st.splits[i])
+	})
+}
+
+//shaped(shards) returns a shardedTree with the same split points as st made
+//of the given shards.
+func (st *shardedTree) shaped(shards []BpTree) *shardedTree {
+	var nst = new(shardedTree)
+	nst.order = st.order
+	nst.splits = append([]BptKey(nil), st.splits...)
+	nst.shards = shards
+	nst.vcodec = st.vcodec
+	nst.keyFac = st.keyFac
+	return nst
+}
+
+func (st *shardedTree) Order() int {
+	//the order never changes
+	return st.order
+}
+
+func (st *shardedTree) Shards() int {
+	//the number of shards never changes
+	return len(st.shards)
+}
+
+func (st *shardedTree) SplitPoints() []BptKey {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return append([]BptKey(nil), st.splits...)
+}
+
+func (st *shardedTree) Get(key BptKey, opts ...ReadOption) (interface{}, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.shards[st.shardFor(key)].Get(key, opts...)
+}
+
+func (st *shardedTree) Put(key BptKey, val interface{}) bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.shards[st.shardFor(key)].Put(key, val)
+}
+
+func (st *shardedTree) Del(key BptKey) (interface{}, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.shards[st.shardFor(key)].Del(key)
+}
+
+//Range(lo, hi, fn) takes a Snapshot() of every shard that owns keys in
+//[lo, hi), all at once, and then iterates over them in order.
+func (st *shardedTree) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) {
+	st.RangeContext(context.Background(), lo, hi, fn, opts...)
+}
+
+func (st *shardedTree) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool, opts ...ReadOption) error {
+	stopped := false
+	for _, snap := range st.rangeSnapshots(lo, hi) {
+		err := snap.RangeContext(ctx, lo, hi, func(k BptKey, v interface{}) bool {
+			if !fn(k, v) {
+				stopped = true
+				return false
+			}
+			return true
+		}, opts...)
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+//rangeSnapshots(lo, hi) returns a Snapshot() of every shard that owns keys
+//in [lo, hi), in order, all taken at once; none if hi <= lo.
+func (st *shardedTree) rangeSnapshots(lo, hi BptKey) []BpTree {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	first, last := 0, len(st.shards)-1
+	if lo != nil {
+		first = st.shardFor(lo)
+	}
+	if hi != nil {
+		last = st.shardFor(hi)
+	}
+	if first > last {
+		return nil
+	}
+	snaps := make([]BpTree, 0, last-first+1)
+	for _, shard := range st.shards[first : last+1] {
+		snaps = append(snaps, shard.Snapshot())
+	}
+	return snaps
+}
+
+func (st *shardedTree) String() string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	s := fmt.Sprintf("SHARDED TREE: shards=%d; order=%d;\n", len(st.shards), st.order)
+	for i, shard := range st.shards {
+		s += fmt.Sprintf("SHARD %d:", i)
+		if i > 0 {
+			s += fmt.Sprintf(" from %q", st.splits[i-1])
+		}
+		if i < len(st.splits) {
+			s += fmt.Sprintf(" to %q", st.splits[i])
+		}
+		s += "\n"
+		s += shard.String()
+	}
+	return s
+}
+
+//Validate() validates every shard, and checks each shard only holds the
+//keys it owns. The Path of a Violation starts with the shard, eg
+//"shard[1].root".
+func (st *shardedTree) Validate() error {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var vs []Violation
+	for i, shard := range st.shards {
+		prefix := fmt.Sprintf("shard[%d].", i)
+		if err := shard.Validate(); err != nil {
+			vs = append(vs, prefixViolations(err, prefix)...)
+		}
+		shard.Range(nil, nil, func(k BptKey, v interface{}) bool {
+			if st.shardFor(k) != i {
+				vs = append(vs, Violation{
+					Path:   prefix + "root",
+					Node:   fmt.Sprintf("%p", shard),
+					Rule:   "shard bound",
+					Detail: fmt.Sprintf("key %q belongs in shard %d", k, st.shardFor(k)),
+				})
+			}
+			return true
+		})
+	}
+
+	if len(vs) == 0 {
+		return nil
+	}
+	return &ValidationError{vs}
+}
+
+//Graph(opts...) draws each shard, from a Snapshot(), as a cluster labeled
+//with the keys it owns.
+func (st *shardedTree) Graph(opts ...GraphOption) string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	gro := graphOpts(opts)
+	var b strings.Builder
+	b.WriteString("digraph bptree {\n")
+	b.WriteString("\tnode [shape=record];\n")
+	for i, shard := range st.shards {
+		lo, hi := "-inf", "+inf"
+		if i > 0 {
+			lo = st.splits[i-1].String()
+		}
+		if i < len(st.splits) {
+			hi = st.splits[i].String()
+		}
+		fmt.Fprintf(&b, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(&b, "\t\tlabel=\"shard %d [%s, %s)\";\n", i, dotQuote(lo), dotQuote(hi))
+		shard.Snapshot().(*tree).graph(&b, fmt.Sprintf("s%dn", i), "\t\t", gro)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+//Stats() adds up the Stats of every shard. The levels of LevelNodes are
+//counted from the root of each shard, and Height is that of the tallest
+//shard.
+func (st *shardedTree) Stats() Stats {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var s Stats
+	for _, shard := range st.shards {
+		ss := shard.Stats()
+		if ss.Height > s.Height {
+			s.Height = ss.Height
+		}
+		for i, n := range ss.LevelNodes {
+			if i == len(s.LevelNodes) {
+				s.LevelNodes = append(s.LevelNodes, 0)
+			}
+			s.LevelNodes[i] += n
+		}
+		s.LeafFill = mergeFill(s.LeafFill, s.LeafNodes, ss.LeafFill, ss.LeafNodes)
+		s.InteriorFill = mergeFill(s.InteriorFill, s.InteriorNodes, ss.InteriorFill, ss.InteriorNodes)
+		s.LeafNodes += ss.LeafNodes
+		s.InteriorNodes += ss.InteriorNodes
+		s.Entries += ss.Entries
+		s.Splits += ss.Splits
+		s.Steals += ss.Steals
+		s.Merges += ss.Merges
+	}
+	return s
+}
+
+func (st *shardedTree) ResetStats() {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	for _, shard := range st.shards {
+		shard.ResetStats()
+	}
+}
+
+//DumpJSON(w, opts...) dumps the split points and a Snapshot() of every
+//shard; LoadJSON() loads it back as a sharded tree.
+func (st *shardedTree) DumpJSON(w io.Writer, opts ...JSONOption) error {
+	jo := jsonOpts(opts)
+	st.mu.RLock()
+	var doc = new(jsonTree)
+	doc.Order = st.order
+	splits, err := jsonKeys(st.splits, jo)
+	if err == nil && len(st.splits) > 0 {
+		doc.Splits = splits
+		doc.KeyType = reflect.TypeOf(st.splits[0]).String()
+	}
+	snaps := make([]*tree, len(st.shards))
+	for i, shard := range st.shards {
+		snaps[i] = shard.Snapshot().(*tree)
+	}
+	st.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snaps {
+		sdoc, err := snap.jsonTree(jo)
+		if err != nil {
+			return err
+		}
+		doc.Shards = append(doc.Shards, sdoc)
+		doc.Entries += sdoc.Entries
+	}
+	return writeJSON(w, doc)
+}
+
+//MarshalBinary() encodes a Snapshot() of every shard; see WriteTo().
+func (st *shardedTree) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := st.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//WriteTo(w) writes the entries of a Snapshot() of every shard to w, in the
+//same format as any other BpTree, so it may be read back into any BpTree.
+func (st *shardedTree) WriteTo(w io.Writer) (int64, error) {
+	snap := st.Snapshot().(*shardedTree)
+	return writeBinary(w, snap.order, snap.NumberOfEntries(), snap.vcodec, func(fn func(BptKey, interface{}) bool) {
+		snap.Range(nil, nil, fn)
+	})
+}
+
+func (st *shardedTree) UnmarshalBinary(data []byte) error {
+	_, err := st.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+//ReadFrom(r) decodes the entries and then, excluding every other operation,
+//replaces the entries of each shard with those it owns.
+func (st *shardedTree) ReadFrom(r io.Reader) (int64, error) {
+	st.mu.RLock()
+	vc := st.vcodec
+	st.mu.RUnlock()
+
+	keys, vals, n, err := readBinary(r, vc)
+	if err != nil {
+		return n, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return n, st.loadEntries(keys, vals)
+}
+
+//st.loadEntries(keys, vals) replaces the entries of each shard with those of
+//keys[i],vals[i] it owns; the keys must be in strictly ascending order. The
+//caller must hold st.mu exclusively.
+func (st *shardedTree) loadEntries(keys []BptKey, vals []interface{}) error {
+	//bounds[i] is the index of the first key shard i owns
+	bounds := make([]int, len(st.shards)+1)
+	bounds[len(st.shards)] = len(keys)
+	for i, split := range st.splits {
+		lo := bounds[i]
+		bounds[i+1] = lo + sort.Search(len(keys)-lo, func(j int) bool {
+			return !keys[lo+j].LessThan(split)
+		})
+	}
+
+	//check every shard before any is changed
+	for i, shard := range st.shards {
+		t, unlock := lockShard(shard)
+		err := t.checkLoad(keys[bounds[i]:bounds[i+1]])
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	for i, shard := range st.shards {
+		t, unlock := lockShard(shard)
+		t.bulkLoad(keys[bounds[i]:bounds[i+1]], vals[bounds[i]:bounds[i+1]])
+		unlock()
+	}
+	return nil
+}
+
+//lockShard(shard) returns the *tree of shard, exclusively locked if shard is
+//a NewConcurrentBpTree(), and the func that unlocks it. The shards of a
+//Clone() or Snapshot() are plain *trees.
+func lockShard(shard BpTree) (*tree, func()) {
+	if ct, ok := shard.(*concurrentTree); ok {
+		ct.mu.Lock()
+		return ct.t, ct.mu.Unlock
+	}
+	return shard.(*tree), func() {}
+}
+
+func (st *shardedTree) SetValueCodec(vc ValueCodec) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.vcodec = vc
+	for _, shard := range st.shards {
+		shard.(Encodable).SetValueCodec(vc)
+	}
+}
+
+//MarshalJSON() encodes the entries of a Snapshot() of every shard, in the
+//same format as any other BpTree.
+func (st *shardedTree) MarshalJSON() ([]byte, error) {
+	snap := st.Snapshot().(*shardedTree)
+	return marshalEntriesJSON(snap.NumberOfEntries(), func(fn func(BptKey, interface{}) bool) {
+		snap.Range(nil, nil, fn)
+	})
+}
+
+//UnmarshalJSON(data) replaces the entries of each shard with those it owns;
+//see tree.UnmarshalJSON().
+func (st *shardedTree) UnmarshalJSON(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	keys, vals, err := decodeEntriesJSON(data, st.decodeKeyType())
+	if err != nil {
+		return err
+	}
+	return st.loadEntries(keys, vals)
+}
+
+//GobEncode() encodes the entries of a Snapshot() of every shard, in the
+//same format as any other BpTree.
+func (st *shardedTree) GobEncode() ([]byte, error) {
+	snap := st.Snapshot().(*shardedTree)
+	return gobEncodeEntries(snap.NumberOfEntries(), func(fn func(BptKey, interface{}) bool) {
+		snap.Range(nil, nil, fn)
+	})
+}
+
+//GobDecode(data) replaces the entries of each shard with those it owns; see
+//tree.GobDecode().
+func (st *shardedTree) GobDecode(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	keys, vals, err := decodeEntriesGob(data, st.decodeKeyType())
+	if err != nil {
+		return err
+	}
+	return st.loadEntries(keys, vals)
+}
+
+//decodeKeyType() returns the type keys are decoded into; without a
+//KeyFactory, that of the split points.
+func (st *shardedTree) decodeKeyType() reflect.Type {
+	var keyType reflect.Type
+	if len(st.splits) > 0 {
+		keyType = reflect.TypeOf(st.splits[0])
+	}
+	return decodeKeyType(st.keyFac, keyType)
+}
+
+func (st *shardedTree) SetKeyFactory(f KeyFactory) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.keyFac = f
+}
+
+func (st *shardedTree) NumberOfEntries() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	var n int
+	for _, shard := range st.shards {
+		n += shard.NumberOfEntries()
+	}
+	return n
+}
+
+func (st *shardedTree) Clear() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, shard := range st.shards {
+		shard.Clear()
+	}
+}
+
+//Clone() returns a not concurrency safe copy of the tree; the shards are
+//plain copies.
+func (st *shardedTree) Clone() BpTree {
+	return st.CloneWith(nil)
+}
+
+//CloneWith(copyVal) returns a not concurrency safe copy of the tree; the
+//shards are plain copies.
+func (st *shardedTree) CloneWith(copyVal func(interface{}) interface{}) BpTree {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	shards := make([]BpTree, len(st.shards))
+	for i, shard := range st.shards {
+		shards[i] = shard.CloneWith(copyVal)
+	}
+	return st.shaped(shards)
+}
+
+//Snapshot() returns a read-only Snapshot of every shard, taken while no
+//Rebalance() is running.
+func (st *shardedTree) Snapshot() BpTree {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	shards := make([]BpTree, len(st.shards))
+	for i, shard := range st.shards {
+		shards[i] = shard.Snapshot()
+	}
+	return st.shaped(shards)
+}
+
+func (st *shardedTree) SetLogger(l *slog.Logger) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, shard := range st.shards {
+		shard.SetLogger(l)
+	}
+}
+
+func (st *shardedTree) SetCheckLevel(level CheckLevel) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, shard := range st.shards {
+		shard.SetCheckLevel(level)
+	}
+}
+
+//Rebalance(i, split) moves the split point between shard i and shard i+1. It
+//excludes every other operation while it moves the entries.
+func (st *shardedTree) Rebalance(i int, split BptKey) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if i < 0 || i >= len(st.splits) {
+		return ErrBadSplit
+	}
+	if err := checkSplit(split, st.splits[i]); err != nil {
+		return err
+	}
+	if i > 0 && !st.splits[i-1].LessThan(split) {
+		return ErrBadSplit
+	}
+	if i+1 < len(st.splits) && !split.LessThan(st.splits[i+1]) {
+		return ErrBadSplit
+	}
+
+	old := st.splits[i]
+	switch {
+	case split.LessThan(old):
+		moveRange(st.shards[i], st.shards[i+1], split, old)
+	case old.LessThan(split):
+		moveRange(st.shards[i+1], st.shards[i], old, split)
+	}
+	st.splits[i] = split
+	return nil
+}
+
+//moveRange(from, to, lo, hi) moves the entries with keys in [lo, hi) from
+//one BpTree to another.
+func moveRange(from, to BpTree, lo, hi BptKey) {
+	var keys []BptKey
+	var vals []interface{}
+	from.Range(lo, hi, func(k BptKey, v interface{}) bool {
+		keys = append(keys, k)
+		vals = append(vals, v)
+		return true
+	})
+	for i, k := range keys {
+		from.Del(k)
+		to.Put(k, vals[i])
+	}
+}
@@ -0,0 +1,185 @@
+package bptree
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+//shardSplits() picks n-1 evenly spaced keys of largeNumEnts as split points.
+func shardSplits(n int) []BptKey {
+	var splits []BptKey
+	for i := 1; i < n; i++ {
+		splits = append(splits, largeNumEnts[i*len(largeNumEnts)/n].key)
+	}
+	return splits
+}
+
+func _checkShards(t *testing.T, bpt ShardedBpTree) {
+	st := bpt.(*shardedTree)
+	for i, shard := range st.shards {
+		shard.Range(nil, nil, func(k BptKey, v interface{}) bool {
+			if st.shardFor(k) != i {
+				t.Fatalf("key %q is in shard %d; expected shard %d", k, i, st.shardFor(k))
+			}
+			return true
+		})
+	}
+}
+
+func TestShardedParallelPutGetDel(t *testing.T) {
+	bpt := NewShardedBpTree(4, shardSplits(4))
+	if bpt.Shards() != 4 {
+		t.Fatalf("bpt.Shards(),%d != 4", bpt.Shards())
+	}
+
+	nWorkers := 8
+	var wg sync.WaitGroup
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(largeNumEnts); i += nWorkers {
+				ent := largeNumEnts[i]
+				if !bpt.Put(ent.key, ent.val) {
+					t.Errorf("Put(%q) did not insert", ent.key)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if bpt.NumberOfEntries() != len(largeNumEnts) {
+		t.Fatalf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts))
+	}
+	_checkShards(t, bpt)
+
+	for _, ent := range largeNumEnts {
+		val, found := bpt.Get(ent.key)
+		if !found || val.(int) != ent.val {
+			t.Fatalf("Get(%q) = %v, %v; expected %d", ent.key, val, found, ent.val)
+		}
+	}
+
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		val, found := bpt.Del(ent.key)
+		if !found || val.(int) != ent.val {
+			t.Fatalf("Del(%q) = %v, %v; expected %d", ent.key, val, found, ent.val)
+		}
+	}
+	if bpt.NumberOfEntries() != 0 {
+		t.Fatalf("bpt.NumberOfEntries(),%d != 0", bpt.NumberOfEntries())
+	}
+}
+
+func TestShardedRangeCrossesShards(t *testing.T) {
+	bpt := NewShardedBpTree(3, shardSplits(5))
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	var n int
+	bpt.Range(nil, nil, func(k BptKey, v interface{}) bool {
+		if !k.Equals(largeNumEnts[n].key) {
+			t.Fatalf("Range entry %d = %q; expected %q", n, k, largeNumEnts[n].key)
+		}
+		n++
+		return true
+	})
+	if n != len(largeNumEnts) {
+		t.Fatalf("Range visited %d entries; expected %d", n, len(largeNumEnts))
+	}
+
+	//stop part way thru the third shard
+	lo, hi := largeNumEnts[1].key, largeNumEnts[len(largeNumEnts)-2].key
+	stop := len(largeNumEnts) / 2
+	n = 1
+	bpt.Range(lo, hi, func(k BptKey, v interface{}) bool {
+		if !k.Equals(largeNumEnts[n].key) {
+			t.Fatalf("Range(lo,hi) entry = %q; expected %q", k, largeNumEnts[n].key)
+		}
+		n++
+		return n < stop
+	})
+	if n != stop {
+		t.Fatalf("Range(lo,hi) stopped at %d; expected %d", n, stop)
+	}
+
+	//lo > hi in different shards is an empty range, not a panic
+	lo, hi = hi, lo
+	n = 0
+	bpt.Range(lo, hi, func(k BptKey, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != 0 {
+		t.Fatalf("Range(hi,lo) visited %d entries; expected 0", n)
+	}
+
+	//and the shard lock was released
+	bpt.Put(largeNumEnts[0].key, largeNumEnts[0].val)
+}
+
+func TestShardedRebalance(t *testing.T) {
+	splits := shardSplits(3)
+	bpt := NewShardedBpTree(4, splits)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	//move the first split left, then the second split right
+	if err := bpt.Rebalance(0, largeNumEnts[2].key); err != nil {
+		t.Fatalf("Rebalance(0, ...) = %v", err)
+	}
+	if err := bpt.Rebalance(1, largeNumEnts[len(largeNumEnts)-2].key); err != nil {
+		t.Fatalf("Rebalance(1, ...) = %v", err)
+	}
+	_checkShards(t, bpt)
+
+	st := bpt.(*shardedTree)
+	if st.shards[0].NumberOfEntries() != 2 {
+		t.Fatalf("shard 0 has %d entries; expected 2", st.shards[0].NumberOfEntries())
+	}
+	if st.shards[2].NumberOfEntries() != 2 {
+		t.Fatalf("shard 2 has %d entries; expected 2", st.shards[2].NumberOfEntries())
+	}
+	if bpt.NumberOfEntries() != len(largeNumEnts) {
+		t.Fatalf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts))
+	}
+
+	//and back again
+	if err := bpt.Rebalance(0, splits[0]); err != nil {
+		t.Fatalf("Rebalance(0, splits[0]) = %v", err)
+	}
+	_checkShards(t, bpt)
+
+	if err := bpt.Rebalance(2, splits[0]); err != ErrBadSplit {
+		t.Fatalf("Rebalance(2, ...) = %v; expected ErrBadSplit", err)
+	}
+	if err := bpt.Rebalance(1, largeNumEnts[0].key); err != ErrBadSplit {
+		t.Fatalf("Rebalance(1, <split 0) = %v; expected ErrBadSplit", err)
+	}
+
+	//a bad split point changes no shard
+	before := bpt.SplitPoints()
+	if err := bpt.Rebalance(0, nil); err != ErrBadSplit {
+		t.Fatalf("Rebalance(0, nil) = %v; expected ErrBadSplit", err)
+	}
+	err := bpt.Rebalance(0, ByteSliceKey("a"))
+	if kte, ok := err.(*KeyTypeError); !ok || kte.Want != reflect.TypeOf(splits[0]) {
+		t.Fatalf("Rebalance(0, ByteSliceKey) = %v; expected a *KeyTypeError", err)
+	}
+	if !reflect.DeepEqual(bpt.SplitPoints(), before) {
+		t.Fatalf("SplitPoints() = %v after a bad Rebalance(); expected %v", bpt.SplitPoints(), before)
+	}
+	_checkShards(t, bpt)
+
+	if _, err := NewShardedBpTreeE(4, []BptKey{splits[0], nil}); err != ErrBadSplit {
+		t.Fatalf("NewShardedBpTreeE() with a nil split = %v; expected ErrBadSplit", err)
+	}
+	if _, err := NewShardedBpTreeE(4, []BptKey{splits[0], ByteSliceKey("z")}); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("NewShardedBpTreeE() with mixed splits = %v; expected ErrKeyTypeMismatch", err)
+	}
+}
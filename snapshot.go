@@ -0,0 +1,92 @@
+package bptree
+
+import (
+	"sync/atomic"
+)
+
+//Every *tree has a generation number. A node whose gen equals the *tree's gen
+//is owned by that *tree and may be modified in place. Any other node may be
+//shared with a Snapshot (or an older generation of the same tree) and must be
+//copied before it is modified; this is path-copying, aka copy-on-write.
+var lastGen uint64
+
+//nextGen() returns a generation number that has never been handed out before.
+func nextGen() uint64 {
+	return atomic.AddUint64(&lastGen, 1)
+}
+
+//Snapshot() returns a read-only BpTree frozen at the current state of the
+//*tree. The Snapshot shares all its nodes with the *tree; later Put() and
+//Del() calls on the *tree copy the nodes on the path from the root to the
+//leaf they modify, so the Snapshot is never effected by them.
+//
+//Calling Put(), Del() or Clear() on the Snapshot panics.
+//
+func (t *tree) Snapshot() BpTree {
+	var snap = new(tree)
+	snap.root = t.root
+	snap.order = t.order
+	snap.numEnts = t.numEnts
+	snap.gen = t.gen
+	snap.readOnly = true
+	snap.keyType = t.keyType
+	snap.log = t.log
+	snap.vcodec = t.vcodec
+
+	//Every node currently reachable from t.root now belongs to the snapshot
+	//as well, so the live tree moves on to a new generation.
+	t.gen = nextGen()
+
+	return snap
+}
+
+//owned(node) returns node if it belongs to the current generation of the
+//*tree, otherwise it returns a copy of node that does.
+func (t *tree) owned(node nodeI) nodeI {
+	if node.generation() == t.gen {
+		return node
+	}
+	return node.copyNode(t.gen)
+}
+
+//ownChild(parent, child) makes sure child, which must be one of parent.vals,
+//can be modified in place. If it can not then child is copied and the copy
+//replaces child in parent.vals. The parent must already be owned by the
+//current generation.
+func (t *tree) ownChild(parent *interiorNodeS, child nodeI) nodeI {
+	if child.generation() == t.gen {
+		return child
+	}
+	for i, v := range parent.vals {
+		if v == child {
+			child = child.copyNode(t.gen)
+			parent.vals[i] = child
+			return child
+		}
+	}
+	corrupt("ownChild: didn't find child in parent")
+	return nil
+}
+
+//findLeafMut(key, path) is findLeaf(key, path) for the modifying ops
+//Put()/Del(). The root, every node pushed on the path, and the returned leaf
+//are owned by the current generation of the *tree.
+func (t *tree) findLeafMut(key BptKey, path *pathT) *leafNodeS {
+	t.root = t.owned(t.root)
+
+	nextNode := t.root
+	for !nextNode.isLeaf() {
+		curNode := nextNode.(*interiorNodeS)
+
+		path.push(curNode)
+		var i int
+		for i = 0; i < len(curNode.keys); i++ {
+			if key.LessThan(curNode.keys[i]) {
+				break
+			}
+		}
+		nextNode = t.ownChild(curNode, curNode.vals[i])
+	}
+	leafNode := nextNode.(*leafNodeS)
+	return leafNode
+}
@@ -0,0 +1,108 @@
+package bptree
+
+import (
+	"testing"
+)
+
+func TestSnapshotUnaffectedByPut(t *testing.T) {
+	half := len(largeNumEnts) / 2
+
+	bpt := NewBpTree(3)
+	for _, ent := range largeNumEnts[:half] {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	snap := bpt.Snapshot()
+
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Put(ent.key, -ent.val)
+	}
+
+	if !_validTree(t, bpt) || !_validTree(t, snap) {
+		t.Logf("!_validTree(t, bpt) || !_validTree(t, snap)")
+		t.FailNow()
+	}
+
+	if snap.NumberOfEntries() != half {
+		t.Logf("snap.NumberOfEntries(),%d != half,%d", snap.NumberOfEntries(), half)
+		t.Fail()
+	}
+	for i, ent := range largeNumEnts {
+		val, found := snap.Get(ent.key)
+		if i >= half {
+			if found {
+				t.Logf("snapshot found ent.key=%q put after Snapshot()", ent.key)
+				t.Fail()
+			}
+			continue
+		}
+		if !found || val.(int) != ent.val {
+			t.Logf("snapshot lost or changed ent.key=%q; val=%v; found=%v", ent.key, val, found)
+			t.Fail()
+		}
+	}
+	for _, ent := range largeNumEnts {
+		val, found := bpt.Get(ent.key)
+		if !found || val.(int) != -ent.val {
+			t.Logf("live tree lost or did not change ent.key=%q; val=%v; found=%v", ent.key, val, found)
+			t.Fail()
+		}
+	}
+}
+
+func TestSnapshotUnaffectedByDel(t *testing.T) {
+	bpt := NewBpTree(4)
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	var snaps []BpTree
+	for i, ent := range genRandomizedEntries(largeNumEnts) {
+		if i%100 == 0 {
+			snaps = append(snaps, bpt.Snapshot())
+		}
+		bpt.Del(ent.key)
+		if !_validTree(t, bpt) {
+			t.Logf("!_validTree(t, bpt)")
+			t.FailNow()
+		}
+	}
+
+	if bpt.NumberOfEntries() != 0 {
+		t.Logf("bpt.NumberOfEntries(),%d != 0", bpt.NumberOfEntries())
+		t.Fail()
+	}
+
+	for i, snap := range snaps {
+		if snap.NumberOfEntries() != len(largeNumEnts)-i*100 {
+			t.Logf("snaps[%d].NumberOfEntries(),%d != %d", i, snap.NumberOfEntries(), len(largeNumEnts)-i*100)
+			t.Fail()
+		}
+		if !_validTree(t, snap) {
+			t.Logf("!_validTree(t, snaps[%d])", i)
+			t.Fail()
+		}
+	}
+
+	//the very first snapshot was taken before any Del()
+	for _, ent := range largeNumEnts {
+		val, found := snaps[0].Get(ent.key)
+		if !found || val.(int) != ent.val {
+			t.Logf("snaps[0] lost or changed ent.key=%q; val=%v; found=%v", ent.key, val, found)
+			t.Fail()
+		}
+	}
+}
+
+func TestSnapshotIsReadOnly(t *testing.T) {
+	bpt := NewBpTree(3)
+	snap := bpt.Snapshot()
+
+	defer func() {
+		if recover() == nil {
+			t.Logf("Put() on a Snapshot did not panic")
+			t.Fail()
+		}
+	}()
+	snap.Put(StringKey("a"), 1)
+}
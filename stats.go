@@ -0,0 +1,160 @@
+package bptree
+
+import (
+	"sync/atomic"
+)
+
+//Stats describes the shape of a tree, and counts the structural changes
+//Put() and Del() have made to it; see BpTree.Stats().
+type Stats struct {
+	Height        int   //number of levels; 1 for a tree that is just a leaf
+	InteriorNodes int   //number of interior nodes
+	LeafNodes     int   //number of leaves
+	LevelNodes    []int //number of nodes at each level, the root first
+	Entries       int   //number of entries in the leaves
+
+	//The fill ratio of a leaf is its number of entries over order-1; of an
+	//interior node its number of children over order.
+	LeafFill     FillStats
+	InteriorFill FillStats //zero if there are no interior nodes
+
+	//Counted since the tree was made or ResetStats() was last called.
+	Splits uint64 //leaves and interior nodes split by Put()
+	Steals uint64 //entries or children moved between peers by Del()
+	Merges uint64 //leaves and interior nodes merged by Del()
+}
+
+//FillStats summarizes the fill ratios of a kind of node.
+type FillStats struct {
+	Min, Avg, Max float64
+}
+
+//opCounters are the cumulative counters of Stats. They are shared by the
+//writers of the latched and B-link trees, so they are updated atomically.
+//A nil *opCounters counts nothing; it belongs to a read-only Snapshot.
+type opCounters struct {
+	splits uint64
+	steals uint64
+	merges uint64
+}
+
+func (c *opCounters) split() {
+	if c != nil {
+		atomic.AddUint64(&c.splits, 1)
+	}
+}
+
+func (c *opCounters) steal() {
+	if c != nil {
+		atomic.AddUint64(&c.steals, 1)
+	}
+}
+
+func (c *opCounters) merge() {
+	if c != nil {
+		atomic.AddUint64(&c.merges, 1)
+	}
+}
+
+//c.add(o) adds the counts of o to c.
+func (c *opCounters) add(o *opCounters) {
+	if c != nil && o != nil {
+		atomic.AddUint64(&c.splits, atomic.LoadUint64(&o.splits))
+		atomic.AddUint64(&c.steals, atomic.LoadUint64(&o.steals))
+		atomic.AddUint64(&c.merges, atomic.LoadUint64(&o.merges))
+	}
+}
+
+//Stats() walks the whole *tree to measure its shape.
+//
+func (t *tree) Stats() Stats {
+	var s Stats
+	var leafFill, nodeFill fillAcc
+	t.statsNode(t.root, 0, &s, &leafFill, &nodeFill)
+	s.Height = len(s.LevelNodes)
+	s.LeafFill = leafFill.stats()
+	s.InteriorFill = nodeFill.stats()
+
+	if c := t.counters; c != nil {
+		s.Splits = atomic.LoadUint64(&c.splits)
+		s.Steals = atomic.LoadUint64(&c.steals)
+		s.Merges = atomic.LoadUint64(&c.merges)
+	}
+	return s
+}
+
+func (t *tree) statsNode(node nodeI, depth int, s *Stats, leafFill, nodeFill *fillAcc) {
+	if depth == len(s.LevelNodes) {
+		s.LevelNodes = append(s.LevelNodes, 0)
+	}
+	s.LevelNodes[depth]++
+
+	if node.isLeaf() {
+		leaf := node.(*leafNodeS)
+		s.LeafNodes++
+		s.Entries += len(leaf.keys)
+		leafFill.add(float64(len(leaf.keys)) / float64(t.order-1))
+		return
+	}
+
+	curNode := node.(*interiorNodeS)
+	s.InteriorNodes++
+	nodeFill.add(float64(len(curNode.vals)) / float64(t.order))
+	for _, child := range curNode.vals {
+		t.statsNode(child, depth+1, s, leafFill, nodeFill)
+	}
+}
+
+//ResetStats() zeroes the split, steal and merge counters of Stats().
+//
+func (t *tree) ResetStats() {
+	if c := t.counters; c != nil {
+		atomic.StoreUint64(&c.splits, 0)
+		atomic.StoreUint64(&c.steals, 0)
+		atomic.StoreUint64(&c.merges, 0)
+	}
+}
+
+//fillAcc accumulates fill ratios into a FillStats.
+type fillAcc struct {
+	n             int
+	min, sum, max float64
+}
+
+func (a *fillAcc) add(fill float64) {
+	if a.n == 0 || fill < a.min {
+		a.min = fill
+	}
+	if a.n == 0 || fill > a.max {
+		a.max = fill
+	}
+	a.sum += fill
+	a.n++
+}
+
+func (a *fillAcc) stats() FillStats {
+	if a.n == 0 {
+		return FillStats{}
+	}
+	return FillStats{Min: a.min, Avg: a.sum / float64(a.n), Max: a.max}
+}
+
+//mergeFill(a, na, b, nb) combines the FillStats of na nodes with those of nb
+//other nodes.
+func mergeFill(a FillStats, na int, b FillStats, nb int) FillStats {
+	switch {
+	case nb == 0:
+		return a
+	case na == 0:
+		return b
+	}
+	m := FillStats{Min: a.Min, Max: a.Max}
+	if b.Min < m.Min {
+		m.Min = b.Min
+	}
+	if b.Max > m.Max {
+		m.Max = b.Max
+	}
+	m.Avg = (a.Avg*float64(na) + b.Avg*float64(nb)) / float64(na+nb)
+	return m
+}
@@ -0,0 +1,72 @@
+package bptree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	bpt := NewBpTree(3)
+	for i, k := range []string{"a", "b", "c", "d", "e"} {
+		bpt.Put(StringKey(k), i)
+	}
+
+	//a root, 2 interior nodes and the leaves [a] [b] [c] [d e]
+	s := bpt.Stats()
+	expected := Stats{
+		Height:        3,
+		InteriorNodes: 3,
+		LeafNodes:     4,
+		LevelNodes:    []int{1, 2, 4},
+		Entries:       5,
+		LeafFill:      FillStats{Min: 0.5, Avg: 0.625, Max: 1},
+		InteriorFill:  FillStats{Min: 2.0 / 3, Avg: 2.0 / 3, Max: 2.0 / 3},
+		Splits:        4,
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Stats() = %+v; expected %+v", s, expected)
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		bpt.Del(StringKey(k))
+	}
+	s = bpt.Stats()
+	if s.Height != 1 || s.Entries != 0 || s.Merges == 0 || s.Splits != 4 {
+		t.Fatalf("Stats() after Del() = %+v", s)
+	}
+
+	bpt.ResetStats()
+	if s = bpt.Stats(); s.Splits != 0 || s.Steals != 0 || s.Merges != 0 {
+		t.Fatalf("Stats() after ResetStats() = %+v", s)
+	}
+}
+
+func TestStatsAllTrees(t *testing.T) {
+	trees := map[string]BpTree{
+		"mvcc":       NewMVCCBpTree(4),
+		"concurrent": NewConcurrentBpTree(5),
+		"latched":    NewLatchedBpTree(3),
+		"blink":      NewBLinkBpTree(3),
+		"optimistic": NewOptimisticBpTree(4),
+		"sharded":    NewShardedBpTree(3, shardSplits(3)),
+	}
+	for name, bpt := range trees {
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Put(ent.key, ent.val)
+		}
+		s := bpt.Stats()
+		if s.Entries != len(largeNumEnts) || s.Splits == 0 {
+			t.Fatalf("%s: Stats() = %+v", name, s)
+		}
+		var n int
+		for _, c := range s.LevelNodes {
+			n += c
+		}
+		if n != s.LeafNodes+s.InteriorNodes {
+			t.Fatalf("%s: Stats().LevelNodes %v do not add up to %d nodes", name, s.LevelNodes, s.LeafNodes+s.InteriorNodes)
+		}
+		if s.LeafFill.Min < 0.5 || s.LeafFill.Max > 1 {
+			t.Fatalf("%s: Stats().LeafFill = %+v", name, s.LeafFill)
+		}
+	}
+}
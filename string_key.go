@@ -9,7 +9,6 @@ type StringKey string
 func (k0 StringKey) Equals(K1 BptKey) bool {
 	k1, ok := K1.(StringKey)
 	if !ok {
-		lgr.Printf("incompatable BptKey = %v\n", K1)
 		return false
 	}
 	return string(k0) == string(k1)
@@ -24,7 +23,6 @@ func (k0 StringKey) Equals(K1 BptKey) bool {
 func (k0 StringKey) LessThan(K1 BptKey) bool {
 	k1, ok := K1.(StringKey)
 	if !ok {
-		lgr.Printf("incompatable BptKey = %v\n", K1)
 		return false
 	}
 	if len(k0) < len(k1) {
@@ -0,0 +1,334 @@
+package bptree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+//ErrTxnConflict is matched, via errors.Is(), by the *TxnConflictError
+//returned from Txn.Commit() when another writer changed what the Txn read or
+//wrote.
+var ErrTxnConflict = errors.New("bptree: transaction conflict")
+
+//ErrTxnDone is returned by Txn.Commit(), Txn.Rollback() and
+//Txn.RangeContext() once the Txn has already been committed or rolled back.
+//The other methods of the Txn panic with it.
+var ErrTxnDone = errors.New("bptree: transaction already committed or rolled back")
+
+//TxnConflictError is returned by Txn.Commit() when a key the Txn read or
+//wrote, or a range it scanned, was changed in the BpTree after Begin().
+type TxnConflictError struct {
+	Key BptKey //first conflicting key, or the lo key of a conflicting Range
+}
+
+func (e *TxnConflictError) Error() string {
+	if e.Key == nil {
+		return "bptree: transaction conflict"
+	}
+	return fmt.Sprintf("bptree: transaction conflict on key %q", e.Key.String())
+}
+
+//Is(target) makes errors.Is(err, ErrTxnConflict) true.
+func (e *TxnConflictError) Is(target error) bool {
+	return target == ErrTxnConflict
+}
+
+type txnWrite struct {
+	key BptKey
+	val interface{}
+	del bool
+}
+
+type keyRange struct {
+	lo, hi BptKey
+}
+
+//Txn is a set of Get/Put/Del/Range operations on a BpTree that is applied
+//all-or-nothing by Commit(). A Txn sees its own writes. Nothing it writes
+//is visible to other readers of the BpTree until Commit(), and then all of
+//it becomes visible at once.
+//
+//A Txn is not safe for use by multiple goroutines, but multiple Txns on the
+//same BpTree may be used concurrently.
+type Txn struct {
+	t      *tree
+	base   *tree //read-only Snapshot() of t at Begin()
+	work   *tree //private tree holding the Txn's writes
+	writes []txnWrite
+	reads  []BptKey
+	ranges []keyRange
+	commit func()      //called with t.txnMu held after the Txn is installed
+	lock   sync.Locker //if non-nil, held while the Txn is installed
+	done   bool
+}
+
+//Begin() starts a new Txn on the *tree.
+//
+func (t *tree) Begin() *Txn {
+	if t.readOnly {
+		panic("Begin: tree is a read-only Snapshot")
+	}
+
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+
+	var txn = new(Txn)
+	txn.t = t
+	txn.base = t.Snapshot().(*tree)
+	txn.work = new(tree)
+	txn.work.root = txn.base.root
+	txn.work.order = t.order
+	txn.work.numEnts = txn.base.numEnts
+	txn.work.gen = nextGen()
+	txn.work.keyType = t.keyType
+	txn.work.latched = t.latched
+	txn.work.log = t.log
+	txn.work.check = t.check
+	txn.work.vcodec = t.vcodec
+	txn.work.keyFactory = t.keyFactory
+	//the work tree counts on its own; only Commit() adds to t.counters
+	txn.work.counters = new(opCounters)
+	return txn
+}
+
+//checkDone() panics with ErrTxnDone once the Txn is committed or rolled
+//back; the work tree may then be shared with, or be, the live tree.
+func (txn *Txn) checkDone() {
+	if txn.done {
+		panic(ErrTxnDone)
+	}
+}
+
+//Get(key) returns the value for key as seen by the Txn. A key of the wrong
+//type is logged and not found, as by BpTree.Get().
+//
+func (txn *Txn) Get(key BptKey) (interface{}, bool) {
+	txn.checkDone()
+	val, found, err := txn.work.GetE(key)
+	if err != nil {
+		panicUnlessKeyErr(err)
+		return nil, false
+	}
+	txn.reads = append(txn.reads, key)
+	return val, found
+}
+
+//Put(key, val) stores val for key in the Txn; see BpTree.Put(). A key of the
+//wrong type is logged and not written, as by BpTree.Put().
+//
+func (txn *Txn) Put(key BptKey, val interface{}) bool {
+	txn.checkDone()
+	added, err := txn.work.PutE(key, val)
+	if err != nil {
+		panicUnlessKeyErr(err)
+		return false
+	}
+	txn.writes = append(txn.writes, txnWrite{key: key, val: val})
+	return added
+}
+
+//Del(key) deletes key in the Txn; see BpTree.Del(). A key of the wrong type
+//is logged and not found, as by BpTree.Del().
+//
+func (txn *Txn) Del(key BptKey) (interface{}, bool) {
+	txn.checkDone()
+	val, found, err := txn.work.DelE(key)
+	if err != nil {
+		panicUnlessKeyErr(err)
+		return nil, false
+	}
+	txn.writes = append(txn.writes, txnWrite{key: key, del: true})
+	return val, found
+}
+
+//Range(lo, hi, fn) is BpTree.Range() as seen by the Txn.
+//
+func (txn *Txn) Range(lo, hi BptKey, fn func(BptKey, interface{}) bool) {
+	txn.checkDone()
+	txn.ranges = append(txn.ranges, keyRange{lo, hi})
+	txn.work.Range(lo, hi, fn)
+}
+
+//RangeContext(ctx, lo, hi, fn) is BpTree.RangeContext() as seen by the Txn.
+//The whole range is checked for conflicts, even if ctx cancelled the scan.
+//
+func (txn *Txn) RangeContext(ctx context.Context, lo, hi BptKey, fn func(BptKey, interface{}) bool) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.ranges = append(txn.ranges, keyRange{lo, hi})
+	return txn.work.RangeContext(ctx, lo, hi, fn)
+}
+
+//Rollback() discards everything the Txn wrote.
+//
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	txn.work = nil
+	return nil
+}
+
+//Commit() atomically makes every write of the Txn visible in the BpTree.
+//If the BpTree was changed since Begin() in a way that effects a key the Txn
+//read or wrote, or a range it scanned, nothing is written and a
+//*TxnConflictError is returned.
+//
+//Conflicts are detected per leaf, so a change to a different key that shares
+//a leaf with a key of the Txn is also a conflict. If the BpTree was empty at
+//Begin() and has since been given keys of another type than the Txn read or
+//wrote, nothing is written and a *KeyTypeError is returned.
+//
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+
+	//txn.lock is taken before t.txnMu, the same order as the Begin() of
+	//a concurrent tree takes them.
+	if txn.lock != nil {
+		txn.lock.Lock()
+		defer txn.lock.Unlock()
+	}
+
+	t := txn.t
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+
+	if t.root == txn.base.root {
+		//nothing was written since Begin(); the nodes of the work tree
+		//become the new tree. A new gen keeps them from being changed in
+		//place, as they may be shared with a Snapshot() of the work tree.
+		if t.undo != nil {
+			t.undo.recordRoot(t.root, t.numEnts)
+		}
+		t.root = txn.work.root
+		t.numEnts = txn.work.numEnts
+		t.keyType = txn.work.keyType
+		t.gen = nextGen()
+		t.counters.add(txn.work.counters)
+	} else {
+		//the keys are checked first; conflict() compares them with the
+		//keys of the tree
+		if t.keyType != nil {
+			keys := append([]BptKey(nil), txn.reads...)
+			for _, w := range txn.writes {
+				keys = append(keys, w.key)
+			}
+			for _, key := range keys {
+				if reflect.TypeOf(key) != t.keyType {
+					return &KeyTypeError{key, t.keyType}
+				}
+			}
+		}
+		if err := txn.conflict(); err != nil {
+			return err
+		}
+
+		//replay the writes on a private copy of the current tree so
+		//readers never see a partially applied Txn.
+		var nt = new(tree)
+		nt.root = t.root
+		nt.order = t.order
+		nt.numEnts = t.numEnts
+		nt.gen = nextGen()
+		nt.keyType = t.keyType
+		nt.latched = t.latched
+		nt.log = t.log
+		nt.check = t.check
+		nt.counters = new(opCounters)
+		nt.vcodec = t.vcodec
+		nt.keyFactory = t.keyFactory
+		for _, w := range txn.writes {
+			if w.del {
+				nt.Del(w.key)
+			} else {
+				nt.Put(w.key, w.val)
+			}
+		}
+
+		if t.undo != nil {
+			t.undo.recordRoot(t.root, t.numEnts)
+		}
+		t.root = nt.root
+		t.numEnts = nt.numEnts
+		t.keyType = nt.keyType
+		t.gen = nt.gen
+		//only the replay is counted; the work tree is discarded
+		t.counters.add(nt.counters)
+	}
+
+	if txn.commit != nil {
+		txn.commit()
+	}
+	return nil
+}
+
+//conflict() returns a *TxnConflictError if any leaf the Txn depends on in
+//txn.base is not also in the current tree.
+func (txn *Txn) conflict() error {
+	t := txn.t
+
+	check := func(key BptKey) error {
+		bpath, cpath := newPathT(), newPathT()
+		if txn.base.findLeaf(key, &bpath) != t.findLeaf(key, &cpath) {
+			return &TxnConflictError{Key: key}
+		}
+		return nil
+	}
+
+	for _, key := range txn.reads {
+		if err := check(key); err != nil {
+			return err
+		}
+	}
+	for _, w := range txn.writes {
+		if err := check(w.key); err != nil {
+			return err
+		}
+	}
+	for _, r := range txn.ranges {
+		bLeaves := rangeLeaves(txn.base.root, r.lo, r.hi)
+		cLeaves := rangeLeaves(t.root, r.lo, r.hi)
+		if len(bLeaves) != len(cLeaves) {
+			return &TxnConflictError{Key: r.lo}
+		}
+		for i := range bLeaves {
+			if bLeaves[i] != cLeaves[i] {
+				return &TxnConflictError{Key: r.lo}
+			}
+		}
+	}
+	return nil
+}
+
+//rangeLeaves(node, lo, hi) returns every leaf, in order, that Range(lo, hi)
+//would look at in the subtree rooted at node.
+func rangeLeaves(node nodeI, lo, hi BptKey) []*leafNodeS {
+	var leaves []*leafNodeS
+	var walk func(nodeI)
+	walk = func(node nodeI) {
+		if node.isLeaf() {
+			leaves = append(leaves, node.(*leafNodeS))
+			return
+		}
+		curNode := node.(*interiorNodeS)
+		for i, v := range curNode.vals {
+			if lo != nil && i < len(curNode.keys) && !lo.LessThan(curNode.keys[i]) {
+				continue
+			}
+			if hi != nil && i > 0 && !curNode.keys[i-1].LessThan(hi) {
+				return
+			}
+			walk(v)
+		}
+	}
+	walk(node)
+	return leaves
+}
@@ -0,0 +1,292 @@
+package bptree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestTxnCommit(t *testing.T) {
+	bpt := NewBpTree(3).(Transactional)
+	half := len(largeNumEnts) / 2
+	for _, ent := range largeNumEnts[:half] {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	txn := bpt.Begin()
+	for _, ent := range largeNumEnts[half:] {
+		txn.Put(ent.key, ent.val)
+	}
+	for _, ent := range largeNumEnts[:10] {
+		txn.Del(ent.key)
+	}
+
+	//the txn sees its own writes; the tree does not
+	if _, found := txn.Get(largeNumEnts[half].key); !found {
+		t.Logf("txn did not see its own Put of %q", largeNumEnts[half].key)
+		t.Fail()
+	}
+	if _, found := txn.Get(largeNumEnts[0].key); found {
+		t.Logf("txn did not see its own Del of %q", largeNumEnts[0].key)
+		t.Fail()
+	}
+	if _, found := bpt.Get(largeNumEnts[half].key); found {
+		t.Logf("tree saw an uncommitted Put of %q", largeNumEnts[half].key)
+		t.Fail()
+	}
+	if bpt.NumberOfEntries() != half {
+		t.Logf("bpt.NumberOfEntries(),%d != half,%d", bpt.NumberOfEntries(), half)
+		t.Fail()
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Logf("txn.Commit() failed: %v", err)
+		t.FailNow()
+	}
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Logf("second txn.Commit() returned %v; expected ErrTxnDone", err)
+		t.Fail()
+	}
+
+	if bpt.NumberOfEntries() != len(largeNumEnts)-10 {
+		t.Logf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts)-10)
+		t.Fail()
+	}
+	if !_validTree(t, bpt) {
+		t.Logf("!_validTree(t, bpt)")
+		t.Fail()
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	bpt := NewBpTree(4).(Transactional)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	txn := bpt.Begin()
+	for _, ent := range largeNumEnts {
+		txn.Del(ent.key)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Logf("txn.Rollback() failed: %v", err)
+		t.Fail()
+	}
+
+	if bpt.NumberOfEntries() != len(largeNumEnts) {
+		t.Logf("bpt.NumberOfEntries(),%d != %d", bpt.NumberOfEntries(), len(largeNumEnts))
+		t.Fail()
+	}
+	for _, ent := range largeNumEnts {
+		if _, found := bpt.Get(ent.key); !found {
+			t.Logf("lost ent.key=%q after Rollback()", ent.key)
+			t.FailNow()
+		}
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	bpt := NewBpTree(4).(Transactional)
+	for _, ent := range largeNumEnts {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	first, last := largeNumEnts[0], largeNumEnts[len(largeNumEnts)-1]
+
+	txn1 := bpt.Begin()
+	txn2 := bpt.Begin()
+	txn3 := bpt.Begin()
+
+	txn1.Put(first.key, -1)
+	txn2.Get(first.key)
+	txn2.Put(first.key, -2)
+	txn3.Put(last.key, -3) //different leaf; no conflict
+
+	if err := txn1.Commit(); err != nil {
+		t.Logf("txn1.Commit() failed: %v", err)
+		t.FailNow()
+	}
+	err := txn2.Commit()
+	if !errors.Is(err, ErrTxnConflict) {
+		t.Logf("txn2.Commit() returned %v; expected ErrTxnConflict", err)
+		t.Fail()
+	}
+	if err := txn3.Commit(); err != nil {
+		t.Logf("txn3.Commit() failed: %v", err)
+		t.Fail()
+	}
+
+	if val, _ := bpt.Get(first.key); val.(int) != -1 {
+		t.Logf("Get(%q) = %v; expected -1", first.key, val)
+		t.Fail()
+	}
+	if val, _ := bpt.Get(last.key); val.(int) != -3 {
+		t.Logf("Get(%q) = %v; expected -3", last.key, val)
+		t.Fail()
+	}
+	if !_validTree(t, bpt) {
+		t.Logf("!_validTree(t, bpt)")
+		t.Fail()
+	}
+}
+
+//_txnDone(t, what, txn) checks that every method of the finished txn fails
+//with ErrTxnDone.
+func _txnDone(t *testing.T, what string, txn *Txn) {
+	t.Helper()
+	key := largeNumEnts[5].key
+	ops := map[string]func(){
+		"Get":   func() { txn.Get(key) },
+		"Put":   func() { txn.Put(key, "MUTATED") },
+		"Del":   func() { txn.Del(key) },
+		"Range": func() { txn.Range(nil, nil, func(BptKey, interface{}) bool { return true }) },
+	}
+	for name, op := range ops {
+		func() {
+			defer func() {
+				if r := recover(); r != ErrTxnDone {
+					t.Fatalf("%s after %s panicked with %v; expected ErrTxnDone", name, what, r)
+				}
+			}()
+			op()
+		}()
+	}
+	if err := txn.RangeContext(context.Background(), nil, nil, func(BptKey, interface{}) bool { return true }); err != ErrTxnDone {
+		t.Fatalf("RangeContext after %s = %v; expected ErrTxnDone", what, err)
+	}
+}
+
+func TestTxnDone(t *testing.T) {
+	bpt := NewBpTree(3).(Transactional)
+	for _, ent := range largeNumEnts[:20] {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	//nothing else writes, so Commit() installs the work tree
+	txn := bpt.Begin()
+	txn.Put(largeNumEnts[0].key, "committed")
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("txn.Commit() = %v", err)
+	}
+	snap := bpt.Snapshot()
+	_txnDone(t, "Commit()", txn)
+	for _, bt := range []BpTree{bpt, snap} {
+		if val, _ := bt.Get(largeNumEnts[5].key); val != largeNumEnts[5].val || bt.NumberOfEntries() != 20 {
+			t.Fatalf("a finished txn changed the tree: %v with %d entries", val, bt.NumberOfEntries())
+		}
+	}
+
+	//the live tree no longer shares the gen of the work tree
+	bpt.Put(largeNumEnts[5].key, "live")
+	if val, _ := snap.Get(largeNumEnts[5].key); val != largeNumEnts[5].val {
+		t.Fatalf("Put() after Commit() changed a Snapshot(): %v", val)
+	}
+
+	txn = bpt.Begin()
+	txn.Put(largeNumEnts[0].key, "rolled back")
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("txn.Rollback() = %v", err)
+	}
+	_txnDone(t, "Rollback()", txn)
+	if val, _ := bpt.Get(largeNumEnts[0].key); val != "committed" {
+		t.Fatalf("Get() after Rollback() = %v", val)
+	}
+}
+
+//The splits of a Txn count in Stats() only once it commits, and only those
+//of the tree that becomes live.
+func TestTxnStats(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e"}
+	bpt := NewBpTree(3).(Transactional)
+
+	txn := bpt.Begin()
+	for _, k := range keys {
+		txn.Put(StringKey(k), k)
+	}
+	if s := bpt.Stats(); s.Splits != 0 {
+		t.Fatalf("Stats().Splits,%d != 0 before Commit()", s.Splits)
+	}
+	txn.Rollback()
+	if s := bpt.Stats(); s.Splits != 0 {
+		t.Fatalf("Stats().Splits,%d != 0 after Rollback()", s.Splits)
+	}
+
+	//fast path; the work tree becomes live
+	txn = bpt.Begin()
+	for _, k := range keys {
+		txn.Put(StringKey(k), k)
+	}
+	txn.Commit()
+	if s := bpt.Stats(); s.Splits != 4 {
+		t.Fatalf("Stats().Splits,%d != 4 after Commit()", s.Splits)
+	}
+
+	//slow path; the writes are replayed on the changed tree. The new keys
+	//are longer, so they all go to the right of "a".
+	bpt.ResetStats()
+	txn = bpt.Begin()
+	for i := 0; i < 20; i++ {
+		txn.Put(StringKey(fmt.Sprintf("x%02d", i)), i)
+	}
+	bpt.Put(StringKey("a"), "A")
+
+	replay := bpt.Clone()
+	replay.ResetStats()
+	for i := 0; i < 20; i++ {
+		replay.Put(StringKey(fmt.Sprintf("x%02d", i)), i)
+	}
+	expected := replay.Stats().Splits
+
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("txn.Commit() = %v", err)
+	}
+	if s := bpt.Stats(); s.Splits != expected {
+		t.Fatalf("Stats().Splits,%d != %d after a replayed Commit()", s.Splits, expected)
+	}
+}
+
+//A Txn holds keys of the type of its tree, the same as the tree does.
+func TestTxnKeyType(t *testing.T) {
+	bad := ByteSliceKey("bad")
+
+	bpt, _ := NewBpTreeE(3)
+	bpt.Put(StringKey("a"), 1)
+	txn := bpt.(Transactional).Begin()
+	if txn.Put(bad, 2) {
+		t.Fatalf("txn.Put(ByteSliceKey) added to a tree of StringKey")
+	}
+	if _, found := txn.Get(bad); found {
+		t.Fatalf("txn.Get(ByteSliceKey) found a key")
+	}
+	bpt.Put(StringKey("b"), 3) //Commit() replays the writes
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("txn.Commit() = %v", err)
+	}
+	if bpt.NumberOfEntries() != 2 || !_validTree(t, bpt) {
+		t.Fatalf("Commit() installed a mistyped key; %d entries", bpt.NumberOfEntries())
+	}
+
+	//the key type of an empty tree is set by Commit()
+	bpt, _ = NewBpTreeE(3)
+	txn = bpt.(Transactional).Begin()
+	txn.Put(StringKey("a"), 1)
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("txn.Commit() = %v", err)
+	}
+	if _, err := bpt.PutE(bad, 2); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("PutE(ByteSliceKey) after Commit() = %v; expected ErrKeyTypeMismatch", err)
+	}
+
+	//or conflicts with the key type another writer gave it
+	bpt, _ = NewBpTreeE(3)
+	txn = bpt.(Transactional).Begin()
+	txn.Put(StringKey("a"), 1)
+	bpt.Put(bad, 2)
+	if err := txn.Commit(); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Fatalf("txn.Commit() of StringKey into a tree of ByteSliceKey = %v; expected ErrKeyTypeMismatch", err)
+	}
+	if bpt.NumberOfEntries() != 1 {
+		t.Fatalf("a failed Commit() changed the tree; %d entries", bpt.NumberOfEntries())
+	}
+}
@@ -0,0 +1,143 @@
+package bptree
+
+import (
+	"errors"
+)
+
+//ErrUndoDisabled is returned by RollbackTo() when EnableUndo() was never
+//called on the BpTree.
+var ErrUndoDisabled = errors.New("bptree: undo journal is not enabled")
+
+//ErrSavepointExpired is returned by RollbackTo() when entries needed to roll
+//back to the Savepoint were dropped because the journal reached its cap, or
+//when the Savepoint is from the future.
+var ErrSavepointExpired = errors.New("bptree: savepoint is no longer in the undo journal")
+
+//Savepoint marks a position in the undo journal of a BpTree; see
+//Undoable.Savepoint() and Undoable.RollbackTo().
+type Savepoint uint64
+
+type undoKind int
+
+const (
+	undoPut  undoKind = iota //inverse is Put(key, val)
+	undoDel                  //inverse is Del(key)
+	undoRoot                 //inverse is restoring root and numEnts
+)
+
+type undoEntry struct {
+	kind    undoKind
+	key     BptKey
+	val     interface{}
+	root    nodeI
+	numEnts int
+}
+
+//undoJournal records the inverse of every modification of a *tree. The
+//entries[i] was the (first+i)'th entry ever recorded.
+type undoJournal struct {
+	maxEntries int
+	first      uint64
+	entries    []undoEntry
+}
+
+func (j *undoJournal) record(e undoEntry) {
+	j.entries = append(j.entries, e)
+	if j.maxEntries > 0 && len(j.entries) > j.maxEntries {
+		drop := len(j.entries) - j.maxEntries
+		//copy so the dropped entries (and the nodes/vals they hold) are
+		//not kept alive by the backing array.
+		j.entries = append([]undoEntry(nil), j.entries[drop:]...)
+		j.first += uint64(drop)
+	}
+}
+
+//putInverse(leaf, key) returns the inverse of a Put(key, ...) about to be
+//done on leaf; leaf must be the leaf key belongs in. It is only recorded
+//once the Put is done, so a Put that fails leaves nothing to undo.
+func putInverse(leaf *leafNodeS, key BptKey) undoEntry {
+	for i, k := range leaf.keys {
+		if key.Equals(k) {
+			return undoEntry{kind: undoPut, key: key, val: leaf.vals[i]}
+		}
+	}
+	return undoEntry{kind: undoDel, key: key}
+}
+
+//recordDel(key, val) records the inverse of a Del(key) that removed val.
+func (j *undoJournal) recordDel(key BptKey, val interface{}) {
+	j.record(undoEntry{kind: undoPut, key: key, val: val})
+}
+
+//recordRoot(root, numEnts) records the inverse of replacing the whole tree,
+//as Clear() and Txn.Commit() do.
+func (j *undoJournal) recordRoot(root nodeI, numEnts int) {
+	j.record(undoEntry{kind: undoRoot, root: root, numEnts: numEnts})
+}
+
+func (j *undoJournal) next() Savepoint {
+	return Savepoint(j.first + uint64(len(j.entries)))
+}
+
+//EnableUndo(maxEntries) starts recording the inverse of every Put(), Del(),
+//Clear() and Txn.Commit() on the *tree. At most maxEntries inverses are kept,
+//the oldest are dropped first; maxEntries <= 0 means no limit.
+//
+//Calling EnableUndo() again keeps the existing journal but changes its cap.
+//
+func (t *tree) EnableUndo(maxEntries int) {
+	if t.undo == nil {
+		t.undo = new(undoJournal)
+	}
+	t.undo.maxEntries = maxEntries
+	if maxEntries > 0 && len(t.undo.entries) > maxEntries {
+		drop := len(t.undo.entries) - maxEntries
+		t.undo.entries = append([]undoEntry(nil), t.undo.entries[drop:]...)
+		t.undo.first += uint64(drop)
+	}
+}
+
+//Savepoint() returns the current position in the undo journal. It returns 0
+//if EnableUndo() was never called.
+//
+func (t *tree) Savepoint() Savepoint {
+	if t.undo == nil {
+		return 0
+	}
+	return t.undo.next()
+}
+
+//RollbackTo(sp) undoes, newest first, every modification made since
+//Savepoint() returned sp. The rolled back entries are removed from the
+//journal, so sp and any earlier Savepoint remain valid.
+//
+func (t *tree) RollbackTo(sp Savepoint) error {
+	if t.undo == nil {
+		return ErrUndoDisabled
+	}
+	j := t.undo
+	if uint64(sp) < j.first || sp > j.next() {
+		return ErrSavepointExpired
+	}
+
+	//replaying the inverses must not journal them
+	t.undo = nil
+	defer func() { t.undo = j }()
+
+	for i := len(j.entries) - 1; i >= int(uint64(sp)-j.first); i-- {
+		e := j.entries[i]
+		switch e.kind {
+		case undoPut:
+			t.Put(e.key, e.val)
+		case undoDel:
+			t.Del(e.key)
+		case undoRoot:
+			t.root = e.root
+			t.numEnts = e.numEnts
+		}
+		j.entries[i] = undoEntry{} //don't hold on to the node or val
+	}
+	j.entries = j.entries[:uint64(sp)-j.first]
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package bptree
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestUndoRollbackTo(t *testing.T) {
+	bpt := NewBpTree(3).(Undoable)
+	bpt.EnableUndo(0)
+
+	half := len(largeNumEnts) / 2
+	for _, ent := range largeNumEnts[:half] {
+		bpt.Put(ent.key, ent.val)
+	}
+
+	sp := bpt.Savepoint()
+
+	for _, ent := range genRandomizedEntries(largeNumEnts) {
+		bpt.Put(ent.key, -ent.val)
+	}
+	for _, ent := range genRandomizedEntries(largeNumEnts[:half/2]) {
+		bpt.Del(ent.key)
+	}
+	bpt.Clear()
+	bpt.Put(largeNumEnts[0].key, 0)
+
+	if err := bpt.RollbackTo(sp); err != nil {
+		t.Logf("bpt.RollbackTo(sp) failed: %v", err)
+		t.FailNow()
+	}
+
+	if !_validTree(t, bpt) {
+		t.Logf("!_validTree(t, bpt)")
+		t.Fail()
+	}
+	if bpt.NumberOfEntries() != half {
+		t.Logf("bpt.NumberOfEntries(),%d != half,%d", bpt.NumberOfEntries(), half)
+		t.Fail()
+	}
+	for i, ent := range largeNumEnts {
+		val, found := bpt.Get(ent.key)
+		if i >= half {
+			if found {
+				t.Logf("found ent.key=%q after RollbackTo()", ent.key)
+				t.Fail()
+			}
+			continue
+		}
+		if !found || val.(int) != ent.val {
+			t.Logf("Get(%q) = %v, %v after RollbackTo(); expected %d", ent.key, val, found, ent.val)
+			t.Fail()
+		}
+	}
+}
+
+func TestUndoCap(t *testing.T) {
+	bpt := NewBpTree(4).(Undoable)
+	bpt.EnableUndo(10)
+
+	sp := bpt.Savepoint()
+	for _, ent := range largeNumEnts[:20] {
+		bpt.Put(ent.key, ent.val)
+	}
+	if err := bpt.RollbackTo(sp); err != ErrSavepointExpired {
+		t.Logf("RollbackTo(expired savepoint) returned %v; expected ErrSavepointExpired", err)
+		t.Fail()
+	}
+
+	sp = bpt.Savepoint()
+	bpt.Del(largeNumEnts[0].key)
+	if err := bpt.RollbackTo(sp); err != nil {
+		t.Logf("bpt.RollbackTo(sp) failed: %v", err)
+		t.Fail()
+	}
+	if _, found := bpt.Get(largeNumEnts[0].key); !found {
+		t.Logf("RollbackTo() did not undo Del(%q)", largeNumEnts[0].key)
+		t.Fail()
+	}
+
+	if err := NewBpTree(3).(Undoable).RollbackTo(0); err != ErrUndoDisabled {
+		t.Logf("RollbackTo() without EnableUndo() returned %v; expected ErrUndoDisabled", err)
+		t.Fail()
+	}
+}
+
+//brittleKey reports the tree corrupt when compared to its poison value, as
+//a check of a damaged node would.
+type brittleKey int
+
+const poison brittleKey = 99
+
+func (k brittleKey) Equals(o BptKey) bool { return k == o.(brittleKey) }
+func (k brittleKey) LessThan(o BptKey) bool {
+	if k == poison || o.(brittleKey) == poison {
+		corrupt("compared the poison key")
+	}
+	return k < o.(brittleKey)
+}
+func (k brittleKey) String() string { return strconv.Itoa(int(k)) }
+
+func TestUndoFailedPut(t *testing.T) {
+	bpt, _ := NewBpTreeE(4)
+	undo := bpt.(Undoable)
+	undo.EnableUndo(0)
+	bpt.Put(brittleKey(1), 1)
+
+	sp := undo.Savepoint()
+	if _, err := bpt.PutE(poison, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("PutE(poison) = %v; expected ErrCorrupt", err)
+	}
+	if undo.Savepoint() != sp {
+		t.Fatalf("Savepoint(),%d != %d; a failed PutE() must not be journaled", undo.Savepoint(), sp)
+	}
+
+	bpt.Put(brittleKey(2), 2)
+	if err := undo.RollbackTo(sp); err != nil {
+		t.Fatalf("RollbackTo(sp) = %v", err)
+	}
+	if _, found := bpt.Get(brittleKey(2)); found || bpt.NumberOfEntries() != 1 {
+		t.Fatalf("RollbackTo(sp) left %d entries; expected 1", bpt.NumberOfEntries())
+	}
+}
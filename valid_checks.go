@@ -1,148 +1,250 @@
 package bptree
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
 	"math"
 )
 
-func validTree(t *tree) bool {
-	if !validRootNode(t.root, t.order) {
-		return false
+//Violation is one broken invariant found by Validate().
+type Violation struct {
+	Path   string //how the node is reached, eg "root.vals[2].vals[0]"
+	Node   string //address of the node
+	Rule   string //the invariant that is broken, eg "key order"
+	Detail string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s (%s): %s: %s", v.Path, v.Node, v.Rule, v.Detail)
+}
+
+//ValidationError is returned by Validate() with every Violation found, in the
+//order the nodes were visited.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	s := fmt.Sprintf("bptree: invalid tree: %d violation(s)", len(e.Violations))
+	for i, v := range e.Violations {
+		if i == 10 {
+			s += fmt.Sprintf("; and %d more", len(e.Violations)-i)
+			break
+		}
+		s += "; " + v.String()
 	}
-	if t.root.isLeaf() {
-		return true //else validRootNode(t.root) would have caught it
+	return s
+}
+
+//Is(target) makes errors.Is(err, ErrCorrupt) true.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+//validator walks a tree once, collecting every Violation.
+type validator struct {
+	order      int
+	leafDepth  int //-1 until the first leaf is found
+	numEnts    int //number of entries found in the leaves
+	violations []Violation
+}
+
+func (v *validator) fail(path string, node nodeI, rule, format string, args ...interface{}) {
+	v.violations = append(v.violations, Violation{
+		Path:   path,
+		Node:   fmt.Sprintf("%p", node),
+		Rule:   rule,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+//Validate() checks every invariant of the *tree and returns a
+//*ValidationError describing each one that is broken, or nil. It checks
+//
+//  - the number of keys, and children or values, of every node
+//  - that keys are strictly ascending within each node
+//  - that the separator keys of every interior node bound its subtrees;
+//    which also makes keys strictly ascending across nodes
+//  - that every leaf is at the same depth
+//  - that NumberOfEntries() is the number of entries in the leaves
+//  - the high key of every node of a B-link tree
+//
+func (t *tree) Validate() error {
+	v := validator{order: t.order, leafDepth: -1}
+	v.node(t.root, "root", 0, nil, nil, true)
+
+	if t.numEnts != v.numEnts {
+		v.fail("root", t.root, "entry count", "NumberOfEntries() is %d; the leaves hold %d entries", t.numEnts, v.numEnts)
+	}
+
+	if len(v.violations) == 0 {
+		return nil
+	}
+	return &ValidationError{v.violations}
+}
+
+//v.node(node, path, depth, lo, hi, isRoot) checks node and its subtree. Every
+//key in it must be >= lo and < hi; a nil lo or hi is unbounded.
+func (v *validator) node(node nodeI, path string, depth int, lo, hi BptKey, isRoot bool) {
+	if node == nil {
+		v.fail(path, node, "nil child", "the node is nil")
+		return
 	}
 
-	rootNode := t.root.(*interiorNodeS)
+	if node.isLeaf() {
+		v.numEnts += len(node.(*leafNodeS).keys)
 
-	nodes := make([]nodeI, 0, 2)
+		if v.leafDepth < 0 {
+			v.leafDepth = depth
+		} else if depth != v.leafDepth {
+			v.fail(path, node, "leaf depth", "leaf is at depth %d; the first leaf is at depth %d", depth, v.leafDepth)
+		}
+	}
 
-	//seed the nodes slice
-	for i := 0; i < len(rootNode.vals); i++ {
-		nodes = append(nodes, rootNode.vals[i])
+	if !v.shape(node, path, isRoot) {
+		return
 	}
 
-	for i := 0; i < len(nodes); i++ {
-		if nodes[i].isLeaf() {
-			node := nodes[i].(*leafNodeS)
-			if !validLeafNode(node, t.order) {
-				lgr.Printf("!validLeafNode(node, t.order) node=\n%v", node)
-				return false
-			}
-		} else {
-			node := nodes[i].(*interiorNodeS)
-			if !validInteriorNode(node, t.order) {
-				lgr.Printf("!validInteriorNode(node, t.order) node=\n%v", node)
-				return false
-			}
-			nodes = append(nodes, node.vals...)
+	keys := nodeKeys(node)
+	for i, k := range keys {
+		if lo != nil && k.LessThan(lo) {
+			v.fail(path, node, "separator bound", "keys[%d]=%q is less than the lower bound %q", i, k, lo)
+		}
+		if hi != nil && !k.LessThan(hi) {
+			v.fail(path, node, "separator bound", "keys[%d]=%q is not less than the upper bound %q", i, k, hi)
+		}
+	}
+
+	if nodeIsBLink(node) {
+		_, highKey := node.link()
+		if (highKey == nil) != (hi == nil) || (hi != nil && !highKey.Equals(hi)) {
+			v.fail(path, node, "high key", "high key is %v; expected %v", keyString(highKey), keyString(hi))
 		}
 	}
-	return true
-}
 
-func validRootNode(node nodeI, order int) bool {
 	if node.isLeaf() {
-		node := node.(*leafNodeS)
+		return
+	}
 
-		if !(len(node.keys) >= 0 && len(node.keys) <= order-1) {
-			lgr.Printf("!(len(node.keys),%d >= 0 && len(node.keys),%d <= order-1,%d) root=\n%v", len(node.keys), len(node.keys), cap(node.keys)-1, node)
-			return false
+	curNode := node.(*interiorNodeS)
+	for i, child := range curNode.vals {
+		//curNode.vals[i] holds the keys in [keys[i-1], keys[i])
+		clo, chi := lo, hi
+		if i > 0 && i-1 < len(keys) {
+			clo = keys[i-1]
 		}
-		if len(node.keys) != len(node.vals) {
-			lgr.Printf("len(node.keys),%d != len(node.vals),%d root=\n%v", len(node.keys), len(node.vals), node)
-			return false
+		if i < len(keys) {
+			chi = keys[i]
 		}
+		v.node(child, fmt.Sprintf("%s.vals[%d]", path, i), depth+1, clo, chi, false)
+	}
+}
+
+//v.shape(node, path, isRoot) checks node on its own; its size, its order
+//and that its keys are strictly ascending. It returns false if node has a nil
+//key, which makes any further check of its keys meaningless.
+func (v *validator) shape(node nodeI, path string, isRoot bool) bool {
+	if node.isLeaf() {
+		v.leafSize(node.(*leafNodeS), path, isRoot)
 	} else {
-		node := node.(*interiorNodeS)
+		v.interiorSize(node.(*interiorNodeS), path, isRoot)
+	}
+
+	if node.order() != v.order {
+		v.fail(path, node, "order", "node has order %d; the tree has order %d", node.order(), v.order)
+	}
 
-		if !(len(node.keys) >= 1 && len(node.keys) <= order-1) {
-			lgr.Printf("validRootNode: !(len(node.keys),%d >= 1 && len(node.keys),%d <= order-1,%d) root=\n%v", len(node.keys), len(node.keys), cap(node.keys)-1, node)
+	keys := nodeKeys(node)
+	for i, k := range keys {
+		if k == nil {
+			v.fail(path, node, "nil key", "keys[%d] is nil", i)
 			return false
 		}
-		if len(node.keys) != len(node.vals)-1 {
-			lgr.Printf("len(node.keys),%d != len(node.vals)-1,%d root=\n%v", len(node.keys), len(node.vals)-1, node)
-			return false
+		if i > 0 && !keys[i-1].LessThan(k) {
+			v.fail(path, node, "key order", "keys[%d]=%q is not less than keys[%d]=%q", i-1, keys[i-1], i, k)
 		}
 	}
 	return true
 }
 
-func validInteriorNode(n_ nodeI, order int) bool {
-	node, ok := n_.(*interiorNodeS)
-	if !ok {
-		lgr.Printf("The Node passed in is not castable to *interiorNodeS")
-		return false
+func (v *validator) leafSize(leaf *leafNodeS, path string, isRoot bool) {
+	min := intCeil(v.order-1, 2)
+	if isRoot {
+		min = 0
 	}
-
-	if !validNodeKeys(node.keys, order) {
-		lgr.Printf("!validNodeKeys(t, node.keys, order) node=\n%v", node)
-		return false
-	}
-	if !validNodeVals(node.vals, order) {
-		lgr.Printf("!validNodeVals(t, node.vals, order) node=\n%v", node)
-		return false
+	if len(leaf.keys) < min || len(leaf.keys) > v.order-1 {
+		v.fail(path, leaf, "leaf size", "leaf has %d keys; expected %d to %d", len(leaf.keys), min, v.order-1)
 	}
-	if len(node.keys) != len(node.vals)-1 {
-		lgr.Printf("len(node.keys),%d != len(node.vals)-1,%d node=\n%v", len(node.keys), len(node.vals)-1, node)
-		return false
+	if len(leaf.keys) != len(leaf.vals) {
+		v.fail(path, leaf, "leaf size", "len(keys),%d != len(vals),%d", len(leaf.keys), len(leaf.vals))
 	}
-	return true
 }
 
-func validLeafNode(node_ nodeI, order int) bool {
-	node, ok := node_.(*leafNodeS)
-	if !ok {
-		lgr.Printf("The Node passed in is not castable to *leafNodeS")
-		return false
+func (v *validator) interiorSize(node *interiorNodeS, path string, isRoot bool) {
+	min := intCeil(v.order, 2) - 1
+	if isRoot {
+		min = 1
 	}
-
-	if !validLeafKeys(node.keys, order) {
-		lgr.Printf("!validLeafKeys(node.keys, order) node=\n%v", node)
-		return false
-	}
-	if !validLeafVals(node.vals, order) {
-		lgr.Printf("!validLeafVals(node.vals, order) node=\n%v", node)
-		return false
+	if len(node.keys) < min || len(node.keys) > v.order-1 {
+		v.fail(path, node, "node size", "node has %d keys; expected %d to %d", len(node.keys), min, v.order-1)
 	}
-	if len(node.keys) != len(node.vals) {
-		lgr.Printf("len(node.keys),%d != len(node.vals),%d node=\n%v", len(node.keys), len(node.vals), node)
-		return false
+	if len(node.keys) != len(node.vals)-1 {
+		v.fail(path, node, "node size", "len(keys),%d != len(vals)-1,%d", len(node.keys), len(node.vals)-1)
 	}
-	return true
 }
 
-func intCeil(n, d int) int {
-	return int(math.Ceil(float64(n) / float64(d)))
+func nodeKeys(node nodeI) []BptKey {
+	if node.isLeaf() {
+		return node.(*leafNodeS).keys
+	}
+	return node.(*interiorNodeS).keys
 }
 
-func validLeafKeys(keys []BptKey, order int) bool {
-	if !(len(keys) >= intCeil(order-1, 2) && len(keys) <= order-1) {
-		lgr.Printf("!(len(keys),%d >= intCeil(order-1, 2),%d && len(keys),%d <= order-1),%d", len(keys), intCeil(order-1, 2), len(keys), order)
-		return false
+//nodeIsBLink(node) is true if node maintains B-link right-links.
+func nodeIsBLink(node nodeI) bool {
+	switch n := node.(type) {
+	case *leafNodeS:
+		return n.sync.isBLink()
+	case *interiorNodeS:
+		return n.sync.isBLink()
 	}
-	return true
+	return false
 }
 
-func validLeafVals(vals []interface{}, order int) bool {
-	if !(len(vals) >= intCeil(order-1, 2) && len(vals) <= order-1) {
-		lgr.Printf("!(len(vals),%d >= intCeil(order-1, 2),%d && len(vals),%d <= order-1),%d", len(vals), intCeil(order-1, 2), len(vals), order)
-		return false
+func keyString(k BptKey) string {
+	if k == nil {
+		return "+inf"
 	}
-	return true
+	return fmt.Sprintf("%q", k.String())
 }
 
-func validNodeKeys(keys []BptKey, order int) bool {
-	if !(len(keys) >= intCeil(order, 2)-1 && len(keys) <= order-1) {
-		lgr.Printf("!(len(keys),%d >= intCeil(order, 2)-1,%d && len(keys),%d <= order-1),%d", len(keys), intCeil(order, 2)-1, len(keys), order-1)
-		return false
+//validTree(t) is Validate() as a bool, logging each Violation at
+//slog.LevelWarn.
+func validTree(t *tree) bool {
+	err := t.Validate()
+	if err == nil {
+		return true
+	}
+	log := t.logger()
+	if log.Enabled(context.Background(), slog.LevelWarn) {
+		for _, v := range err.(*ValidationError).Violations {
+			log.Warn(v.Rule, slog.String("path", v.Path), slog.String("node", v.Node), slog.String("detail", v.Detail))
+		}
 	}
-	return true
+	return false
 }
 
-func validNodeVals(vals []nodeI, order int) bool {
-	if !(len(vals) >= intCeil(order, 2) && len(vals) <= order) {
-		lgr.Printf("!(len(vals),%d >= intCeil(order, 2),%d && len(vals),%d <= order,%d)", len(vals), intCeil(order, 2), len(vals), order)
-		return false
+//prefixViolations(err, prefix) prepends prefix to the Path of every
+//Violation in err, a *ValidationError.
+func prefixViolations(err error, prefix string) []Violation {
+	vs := append([]Violation(nil), err.(*ValidationError).Violations...)
+	for i := range vs {
+		vs[i].Path = prefix + vs[i].Path
 	}
-	return true
+	return vs
+}
+
+func intCeil(n, d int) int {
+	return int(math.Ceil(float64(n) / float64(d)))
 }
@@ -0,0 +1,102 @@
+package bptree
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateAllTrees(t *testing.T) {
+	trees := map[string]BpTree{
+		"plain":      NewBpTree(3),
+		"mvcc":       NewMVCCBpTree(4),
+		"concurrent": NewConcurrentBpTree(5),
+		"latched":    NewLatchedBpTree(3),
+		"blink":      NewBLinkBpTree(3),
+		"optimistic": NewOptimisticBpTree(4),
+		"sharded":    NewShardedBpTree(3, shardSplits(3)),
+	}
+	for name, bpt := range trees {
+		for _, ent := range genRandomizedEntries(largeNumEnts) {
+			bpt.Put(ent.key, ent.val)
+		}
+		if err := bpt.Validate(); err != nil {
+			t.Fatalf("%s: Validate() after Put() = %v", name, err)
+		}
+		delEnts := genRandomizedEntries(largeNumEnts)
+		for _, ent := range delEnts[:len(delEnts)/2] {
+			bpt.Del(ent.key)
+		}
+		if err := bpt.Validate(); err != nil {
+			t.Fatalf("%s: Validate() after Del() = %v", name, err)
+		}
+	}
+}
+
+//_violation(t, err, rule) fails unless err is a *ValidationError holding a
+//Violation of rule, and returns that Violation.
+func _violation(t *testing.T, err error, rule string) Violation {
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Validate() = %v; expected an error matching ErrCorrupt", err)
+	}
+	for _, v := range err.(*ValidationError).Violations {
+		if v.Rule == rule {
+			return v
+		}
+	}
+	t.Fatalf("Validate() = %v; expected a %q violation", err, rule)
+	return Violation{}
+}
+
+func TestValidateFindsViolations(t *testing.T) {
+	build := func() *tree {
+		bpt := NewBpTree(3)
+		for _, ent := range largeNumEnts {
+			bpt.Put(ent.key, ent.val)
+		}
+		return bpt.(*tree)
+	}
+
+	//keys out of order inside a leaf
+	tr := build()
+	leaf := tr.root.(*interiorNodeS).vals[0]
+	for !leaf.isLeaf() {
+		leaf = leaf.(*interiorNodeS).vals[0]
+	}
+	l := leaf.(*leafNodeS)
+	l.keys = append(l.keys, l.keys[0])
+	l.vals = append(l.vals, 0)
+	_violation(t, tr.Validate(), "key order")
+
+	//a separator that does not bound its subtree
+	tr = build()
+	root := tr.root.(*interiorNodeS)
+	root.keys[0] = largeNumEnts[0].key
+	v := _violation(t, tr.Validate(), "separator bound")
+	if !strings.HasPrefix(v.Path, "root.vals[0]") {
+		t.Fatalf("separator violation at %q; expected under root.vals[0]", v.Path)
+	}
+
+	//NumberOfEntries() does not match the leaves
+	tr = build()
+	tr.numEnts++
+	_violation(t, tr.Validate(), "entry count")
+
+	//a leaf one level higher than the others
+	tr = build()
+	root = tr.root.(*interiorNodeS)
+	lowest := root.vals[0]
+	for !lowest.isLeaf() {
+		lowest = lowest.(*interiorNodeS).vals[0]
+	}
+	root.vals[0] = lowest
+	_violation(t, tr.Validate(), "leaf depth")
+
+	//the sharded tree checks the shard bounds
+	st := NewShardedBpTree(3, shardSplits(2))
+	st.(*shardedTree).shards[0].Put(largeNumEnts[len(largeNumEnts)-1].key, 0)
+	v = _violation(t, st.Validate(), "shard bound")
+	if v.Path != "shard[0].root" {
+		t.Fatalf("shard violation at %q; expected shard[0].root", v.Path)
+	}
+}
@@ -0,0 +1,364 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//FsyncPolicy says when the write-ahead log of a DiskBpTree is flushed to
+//stable storage; see DiskWAL().
+type FsyncPolicy int
+
+const (
+	//FsyncCommit makes every Put() and Del() durable before it returns.
+	//Concurrent Put()s and Del()s share an fsync; group commit.
+	FsyncCommit FsyncPolicy = iota
+	//FsyncInterval flushes the log in the background every
+	//DiskWALInterval(); a crash loses at most the changes of the last
+	//interval.
+	FsyncInterval
+	//FsyncNever only flushes the log as a page is written back, and at a
+	//checkpoint; a crash of the operating system may lose any change since
+	//the last checkpoint, but a crash of the process loses none.
+	FsyncNever
+)
+
+func (fp FsyncPolicy) String() string {
+	switch fp {
+	case FsyncCommit:
+		return "FsyncCommit"
+	case FsyncInterval:
+		return "FsyncInterval"
+	case FsyncNever:
+		return "FsyncNever"
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", int(fp))
+}
+
+//DiskWAL(policy) makes the DiskBpTree log each Put() and Del() to a
+//write-ahead log, in the file at its path with "-wal" appended, before it
+//is applied to the tree. Opening the tree replays the log, so the file
+//holds every change logged before a crash. See wal.go.
+func DiskWAL(policy FsyncPolicy) DiskOption {
+	return func(do *diskOptions) {
+		do.wal = true
+		do.fsync = policy
+	}
+}
+
+//DiskWALInterval(d) sets how often FsyncInterval flushes the log; the
+//default is 100ms.
+func DiskWALInterval(d time.Duration) DiskOption {
+	return func(do *diskOptions) {
+		do.fsyncInterval = d
+	}
+}
+
+//DiskCheckpointSize(n) makes the DiskBpTree checkpoint, writing back every
+//dirty page and the header and emptying the log, once the log is larger
+//than n bytes; the default is 16MiB.
+func DiskCheckpointSize(n int64) DiskOption {
+	return func(do *diskOptions) {
+		do.checkpointSize = n
+	}
+}
+
+//The write-ahead log holds the after-images of the pages each Put() or Del()
+//changed, rather than the operation itself, so replaying it does not depend
+//on the state of the pages in the file; each record is, with every integer
+//little endian:
+//
+//    length   uint32   of the rest of the record, after the checksum
+//    checksum uint32   CRC-32C of the rest of the record
+//    header   [minPageSize]byte   the header page after the operation
+//    count    uint32
+//    pages    count times: uint64 pageID, then [pageSize]byte
+//
+//A page is never written back to the file before the record holding it is
+//durable, and the pages an operation changes are pinned in the buffer pool
+//until its record is logged; or, if the operation fails part way, until
+//they are rolled back, unlogged. So the pages of the file are, at any time,
+//those of the last checkpoint overwritten by some of the pages of the
+//records logged since. Replaying the records in order restores the tree of
+//the last one; a torn record at the end, whose length or checksum is wrong,
+//is dropped.
+//
+//A checkpoint writes back every dirty page and the header, flushes the file
+//and then empties the log.
+
+//pageFile is the part of an *os.File a DiskBpTree uses; the tests swap it
+//to inject crashes.
+type pageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+func openPageFile(name string) (pageFile, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+//errWALClosed is returned by wal methods after close().
+var errWALClosed = errors.New("bptree: write-ahead log is closed")
+
+//wal is a write-ahead log. Records are written to the file as they are
+//appended; sync() makes them durable.
+type wal struct {
+	f pageFile
+
+	mu   sync.Mutex //guards end, base and err
+	end  int64      //the LSN of the next record
+	base int64      //the LSN at the start of the file; see reset()
+	err  error      //sticky; the log is unusable after a failed write
+
+	syncMu sync.Mutex //held while flushing; see sync()
+	synced int64      //every record before this LSN is durable
+
+	stop chan struct{} //closes the FsyncInterval flusher
+	done chan struct{}
+}
+
+//newWAL(f, end, fsync, interval) returns the wal in f, which holds end bytes
+//of durable records already replayed; new records follow them.
+func newWAL(f pageFile, end int64, fsync FsyncPolicy, interval time.Duration) *wal {
+	var w = &wal{f: f, end: end, synced: end}
+	if fsync == FsyncInterval {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.flusher(interval)
+	}
+	return w
+}
+
+func (w *wal) flusher(interval time.Duration) {
+	defer close(w.done)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-tick.C:
+			w.sync(w.lsn())
+		}
+	}
+}
+
+//encodeRecord(hdr, ids, pages) returns the record of one operation.
+func encodeRecord(hdr *pageHeader, ids []pageID, pages [][]byte) []byte {
+	le := binary.LittleEndian
+	size := 8 + minPageSize + 4
+	for _, page := range pages {
+		size += 8 + len(page)
+	}
+	rec := make([]byte, size)
+	hdr.encode(rec[8 : 8+minPageSize])
+	off := 8 + minPageSize
+	le.PutUint32(rec[off:], uint32(len(ids)))
+	off += 4
+	for i, id := range ids {
+		le.PutUint64(rec[off:], uint64(id))
+		off += 8 + copy(rec[off+8:], pages[i])
+	}
+	le.PutUint32(rec[0:], uint32(size-8))
+	le.PutUint32(rec[4:], crc32.Checksum(rec[8:], castagnoli))
+	return rec
+}
+
+//append(rec) writes rec to the end of the log, and returns the LSN just
+//past it; sync() to that LSN makes it durable. An LSN is a byte offset in
+//every record ever appended, so LSNs keep increasing across reset()s.
+func (w *wal) append(rec []byte) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if _, err := w.f.WriteAt(rec, w.end-w.base); err != nil {
+		w.err = err
+		return 0, err
+	}
+	w.end += int64(len(rec))
+	return w.end, nil
+}
+
+//lsn() returns the LSN just past the last record.
+func (w *wal) lsn() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.end
+}
+
+//size() returns the number of bytes in the log.
+func (w *wal) size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.end - w.base
+}
+
+//sync(lsn) makes every record before lsn durable. Of the callers waiting at
+//once, the first flushes the records of them all; group commit.
+func (w *wal) sync(lsn int64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if w.synced >= lsn {
+		return nil
+	}
+	w.mu.Lock()
+	end, err := w.end, w.err
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.mu.Lock()
+		w.err = err
+		w.mu.Unlock()
+		return err
+	}
+	w.synced = end
+	return nil
+}
+
+//reset() empties the log; the tree must have been checkpointed.
+func (w *wal) reset() error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.f.Truncate(0); err != nil {
+		w.err = err
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.err = err
+		return err
+	}
+	w.base, w.synced = w.end, w.end
+	return nil
+}
+
+func (w *wal) close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	w.mu.Lock()
+	w.err = errWALClosed
+	w.mu.Unlock()
+	return w.f.Close()
+}
+
+//replayWAL(f, wf) writes the pages, and the last header, of every complete
+//record in wf to f, and flushes f. It returns the offset just past the last
+//complete record; anything after it is a torn record, see openDisk().
+func replayWAL(f, wf pageFile) (int64, error) {
+	le := binary.LittleEndian
+	fi, err := wf.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+
+	var hdr []byte
+	var lenCRC [8]byte
+	off := int64(0)
+	for off+8 <= size {
+		if _, err := wf.ReadAt(lenCRC[:], off); err != nil {
+			return 0, err
+		}
+		n := int64(le.Uint32(lenCRC[:]))
+		if n < minPageSize+4 || off+8+n > size {
+			break //torn
+		}
+		rec := make([]byte, n)
+		if _, err := wf.ReadAt(rec, off+8); err != nil {
+			return 0, err
+		}
+		if crc32.Checksum(rec, castagnoli) != le.Uint32(lenCRC[4:]) {
+			break //torn
+		}
+		h, err := decodePageHeader(rec[:minPageSize])
+		if err != nil {
+			break
+		}
+		count := int64(le.Uint32(rec[minPageSize:]))
+		if n != minPageSize+4+count*(8+int64(h.pageSize)) {
+			break
+		}
+		for i, p := int64(0), int64(minPageSize+4); i < count; i++ {
+			id := int64(le.Uint64(rec[p:]))
+			if id == 0 || id >= int64(h.pages) {
+				return 0, fmt.Errorf("%w: write-ahead log holds page %d of %d", ErrBadEncoding, id, h.pages)
+			}
+			page := rec[p+8 : p+8+int64(h.pageSize)]
+			if _, err := f.WriteAt(page, id*int64(h.pageSize)); err != nil {
+				return 0, err
+			}
+			p += 8 + int64(h.pageSize)
+		}
+		hdr = rec[:minPageSize]
+		off += 8 + n
+	}
+
+	if hdr == nil {
+		return 0, nil
+	}
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return 0, err
+	}
+	return off, f.Sync()
+}
+
+//dt.logOp() logs the pages the last Put() or Del() changed, and the
+//header, as one record, and checkpoints if the log has grown larger than
+//DiskCheckpointSize(). It returns the LSN of the record; 0 if nothing was
+//logged.
+func (dt *DiskBpTree) logOp() (int64, error) {
+	if dt.wal == nil {
+		return 0, nil
+	}
+	lsn, err := dt.p.pool.commit(func(ids []pageID, pages [][]byte) (int64, error) {
+		return dt.wal.append(encodeRecord(&dt.p.hdr, ids, pages))
+	})
+	if err != nil || dt.wal.size() <= dt.checkpointSize {
+		return lsn, err
+	}
+	return lsn, dt.checkpoint()
+}
+
+//dt.durable(lsn) waits for the record at lsn to be durable, if the
+//FsyncPolicy is FsyncCommit.
+func (dt *DiskBpTree) durable(lsn int64) error {
+	if dt.wal == nil || dt.fsync != FsyncCommit || lsn == 0 {
+		return nil
+	}
+	return dt.wal.sync(lsn)
+}
+
+//dt.checkpoint() makes the file hold every change so far, and empties the
+//log.
+func (dt *DiskBpTree) checkpoint() error {
+	if dt.wal == nil {
+		return dt.p.sync()
+	}
+	if err := dt.wal.sync(dt.wal.lsn()); err != nil {
+		return err
+	}
+	if err := dt.p.sync(); err != nil {
+		return err
+	}
+	return dt.wal.reset()
+}
@@ -0,0 +1,409 @@
+package bptree
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var errCrash = errors.New("injected crash")
+
+//crashDisk fails every write to its files once budget bytes have been
+//written, after writing only the part of the write that fits; as if the
+//machine stopped mid-write.
+type crashDisk struct {
+	mu      sync.Mutex
+	budget  int64
+	written int64
+	crashed bool
+}
+
+type crashFile struct {
+	*os.File
+	cd *crashDisk
+}
+
+func (cd *crashDisk) open(name string) (pageFile, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &crashFile{f, cd}, nil
+}
+
+func (cf *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	cd := cf.cd
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	if cd.crashed {
+		return 0, errCrash
+	}
+	if n := cd.budget - cd.written; int64(len(p)) > n {
+		cd.crashed = true
+		cf.File.WriteAt(p[:n], off)
+		return int(n), errCrash
+	}
+	cd.written += int64(len(p))
+	return cf.File.WriteAt(p, off)
+}
+
+func (cf *crashFile) Sync() error {
+	cf.cd.mu.Lock()
+	defer cf.cd.mu.Unlock()
+	if cf.cd.crashed {
+		return errCrash
+	}
+	return cf.File.Sync()
+}
+
+func (cf *crashFile) Truncate(size int64) error {
+	cf.cd.mu.Lock()
+	defer cf.cd.mu.Unlock()
+	if cf.cd.crashed {
+		return errCrash
+	}
+	return cf.File.Truncate(size)
+}
+
+//_diskEntries(t, dt) returns every entry of dt.
+func _diskEntries(t *testing.T, dt *DiskBpTree) map[BptKey]interface{} {
+	ents := make(map[BptKey]interface{})
+	err := dt.RangeContext(context.Background(), nil, nil, func(k BptKey, v interface{}) bool {
+		ents[k] = v
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Range() = %v", err)
+	}
+	return ents
+}
+
+func _entryMap(ents []entry) map[BptKey]interface{} {
+	m := make(map[BptKey]interface{}, len(ents))
+	for _, ent := range ents {
+		m[ent.key] = ent.val
+	}
+	return m
+}
+
+func _sameEntries(a, b map[BptKey]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+//_abandon(dt) closes the files of dt, after flushing the log, but without a
+//checkpoint; as if the process died.
+func _abandon(dt *DiskBpTree) {
+	dt.wal.sync(dt.wal.lsn())
+	dt.closed = true
+	if dt.wal.stop != nil {
+		close(dt.wal.stop)
+		<-dt.wal.done
+	}
+	dt.wal.f.Close()
+	dt.p.f.Close()
+}
+
+//TestWALCrash runs the same Put()s and Del()s, with FsyncCommit, until a
+//crash at a random byte offset, then checks that reopening the tree
+//recovers it with every acknowledged operation, and perhaps the one that
+//was cut short.
+func TestWALCrash(t *testing.T) {
+	type op struct {
+		del bool
+		ent entry
+	}
+	var ops []op
+	for i, ent := range genRandomizedEntries(largeNumEnts[:150]) {
+		ops = append(ops, op{false, ent})
+		if i%3 == 2 {
+			ops = append(ops, op{true, ops[len(ops)-2].ent})
+		}
+	}
+	//states[i] is the tree after ops[:i]
+	states := []map[BptKey]interface{}{{}}
+	for _, op := range ops {
+		next := make(map[BptKey]interface{})
+		for k, v := range states[len(states)-1] {
+			next[k] = v
+		}
+		if op.del {
+			delete(next, op.ent.key)
+		} else {
+			next[op.ent.key] = op.ent.val
+		}
+		states = append(states, next)
+	}
+
+	//run is one attempt at every op; it returns how many were acknowledged
+	//and the bytes written opening the tree and in all.
+	run := func(path string, budget int64) (acked int, opened, written int64) {
+		cd := &crashDisk{budget: budget}
+		dt, err := OpenDiskBpTree(path, DiskOrder(4), DiskPageSize(minPageSize), DiskCacheSize(8*minPageSize),
+			DiskWAL(FsyncCommit), DiskCheckpointSize(32*minPageSize), func(do *diskOptions) { do.openFile = cd.open })
+		if err != nil {
+			t.Fatalf("OpenDiskBpTree() = %v", err)
+		}
+		opened = cd.written
+		for _, op := range ops {
+			if op.del {
+				_, _, err = dt.DelE(op.ent.key)
+			} else {
+				_, err = dt.PutE(op.ent.key, op.ent.val)
+			}
+			if err != nil {
+				if err != errCrash {
+					t.Fatalf("op %d = %v; expected the injected crash", acked, err)
+				}
+				break
+			}
+			acked++
+		}
+		dt.Close()
+		return acked, opened, cd.written
+	}
+
+	acked, opened, total := run(filepath.Join(t.TempDir(), "tree"), 1<<62)
+	if acked != len(ops) {
+		t.Fatalf("%d of %d ops succeeded without a crash", acked, len(ops))
+	}
+
+	for trial := 0; trial < 20; trial++ {
+		path := filepath.Join(t.TempDir(), "tree")
+		budget := opened + rand.Int63n(total-opened)
+		acked, _, _ := run(path, budget)
+
+		dt, err := OpenDiskBpTree(path, DiskWAL(FsyncCommit))
+		if err != nil {
+			t.Fatalf("budget=%d: recovering after %d ops = %v", budget, acked, err)
+		}
+		_diskCheck(t, dt)
+		got := _diskEntries(t, dt)
+		if !_sameEntries(got, states[acked]) && (acked == len(ops) || !_sameEntries(got, states[acked+1])) {
+			t.Fatalf("budget=%d: recovered %d entries; expected the %d after %d ops", budget, len(got), len(states[acked]), acked)
+		}
+
+		//the recovered tree carries on
+		if _, err := dt.PutE(StringKey("after"), 1); err != nil {
+			t.Fatalf("Put() after recovery = %v", err)
+		}
+		if err := dt.Close(); err != nil {
+			t.Fatalf("Close() after recovery = %v", err)
+		}
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	for _, policy := range []FsyncPolicy{FsyncCommit, FsyncInterval, FsyncNever} {
+		path := filepath.Join(t.TempDir(), "tree")
+		dt, err := OpenDiskBpTree(path, DiskPageSize(minPageSize), DiskOrder(5), DiskWAL(policy))
+		if err != nil {
+			t.Fatalf("OpenDiskBpTree() = %v", err)
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := g; i < len(largeNumEnts); i += 4 {
+					if _, err := dt.PutE(largeNumEnts[i].key, largeNumEnts[i].val); err != nil {
+						t.Errorf("Put() = %v", err)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		if ds := dt.Stats(); ds.LogBytes == 0 {
+			t.Fatalf("%v: nothing was logged", policy)
+		}
+
+		//abandon the tree without a checkpoint; only the log has the header
+		_abandon(dt)
+
+		//reopened without DiskWAL(), the log is replayed and removed
+		if dt, err = OpenDiskBpTree(path); err != nil {
+			t.Fatalf("%v: recovering = %v", policy, err)
+		}
+		_diskCheck(t, dt)
+		if !_sameEntries(_diskEntries(t, dt), _entryMap(largeNumEnts)) {
+			t.Fatalf("%v: the log did not restore the entries", policy)
+		}
+		dt.Close()
+		if _, err := os.Stat(path + "-wal"); !os.IsNotExist(err) {
+			t.Fatalf("%v: the log was not removed: %v", policy, err)
+		}
+	}
+}
+
+//faultFile fails a write when fail() returns true.
+type faultFile struct {
+	*os.File
+	fail func() bool
+}
+
+func (ff *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if ff.fail != nil && ff.fail() {
+		return 0, errCrash
+	}
+	return ff.File.WriteAt(p, off)
+}
+
+//TestWALFailedOp makes a page fail to be written back in the middle of
+//Put()s and Del()s that split or merge; once the operation has already
+//changed some pages. The failed operations must change nothing, neither
+//in the tree nor in the log it is recovered from.
+func TestWALFailedOp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	var tree *faultFile
+	openFile := func(name string) (pageFile, error) {
+		f, err := openPageFile(name)
+		if err != nil || name != path {
+			return f, err
+		}
+		tree = &faultFile{File: f.(*os.File)}
+		return tree, nil
+	}
+	dt, err := OpenDiskBpTree(path, DiskOrder(4), DiskPageSize(minPageSize), DiskCacheSize(8*minPageSize),
+		DiskWAL(FsyncCommit), func(do *diskOptions) { do.openFile = openFile })
+	if err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	//the pool is locked while it writes back a page, so pending may be
+	//read; a page is pending once the operation changed it
+	failures := 0
+	tree.fail = func() bool {
+		if len(dt.p.pool.pending) == 0 || failures%7 != 6 {
+			failures++
+			return false
+		}
+		failures++
+		return true
+	}
+
+	want := make(map[BptKey]interface{})
+	failed := 0
+	check := func(op string, key BptKey, err error) {
+		if err == nil {
+			return
+		}
+		if err != errCrash {
+			t.Fatalf("%s(%q) = %v; expected the injected failure", op, key, err)
+		}
+		failed++
+		_diskCheck(t, dt)
+		if !_sameEntries(_diskEntries(t, dt), want) {
+			t.Fatalf("the failed %s(%q) changed the entries", op, key)
+		}
+	}
+	ents := genRandomizedEntries(largeNumEnts[:300])
+	for _, ent := range ents {
+		_, err := dt.PutE(ent.key, ent.val)
+		if err == nil {
+			want[ent.key] = ent.val
+		}
+		check("Put", ent.key, err)
+	}
+	putFailed := failed
+	for _, ent := range ents[:250] {
+		_, _, err := dt.DelE(ent.key)
+		if err == nil {
+			delete(want, ent.key)
+		}
+		check("Del", ent.key, err)
+	}
+	if putFailed == 0 || failed == putFailed {
+		t.Fatalf("%d Put()s and %d Del()s failed; expected some of each", putFailed, failed-putFailed)
+	}
+
+	_abandon(dt)
+	if dt, err = OpenDiskBpTree(path); err != nil {
+		t.Fatalf("recovering = %v", err)
+	}
+	defer dt.Close()
+	_diskCheck(t, dt)
+	if !_sameEntries(_diskEntries(t, dt), want) {
+		t.Fatalf("the log did not restore the entries of the operations that succeeded")
+	}
+}
+
+//A torn record at the end of the log is truncated when it is replayed, also
+//when there is no complete record before it, so it is never read back as
+//part of the records written after it.
+func TestWALTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	walPath := path + "-wal"
+	tear := func() int64 {
+		fi, err := os.Stat(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(walPath, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the length and checksum of a record of 5000 bytes, and a few of them
+		f.WriteAt([]byte{0x88, 0x13, 0, 0, 1, 2, 3, 4, 'p', 'a', 'g', 'e'}, fi.Size())
+		f.Close()
+		return fi.Size()
+	}
+	logSize := func() int64 {
+		fi, err := os.Stat(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	//only a torn record
+	dt, err := OpenDiskBpTree(path, DiskPageSize(minPageSize), DiskOrder(4), DiskWAL(FsyncCommit))
+	if err != nil {
+		t.Fatalf("OpenDiskBpTree() = %v", err)
+	}
+	dt.Close()
+	tear()
+	if dt, err = OpenDiskBpTree(path, DiskWAL(FsyncCommit)); err != nil {
+		t.Fatalf("OpenDiskBpTree() of a torn log = %v", err)
+	}
+	if n := logSize(); n != 0 {
+		t.Fatalf("the log of only a torn record holds %d bytes after replay; expected 0", n)
+	}
+
+	//complete records, then a torn one
+	for _, ent := range largeNumEnts[:10] {
+		dt.Put(ent.key, ent.val)
+	}
+	_abandon(dt)
+	good := tear()
+	if dt, err = OpenDiskBpTree(path, DiskWAL(FsyncCommit)); err != nil {
+		t.Fatalf("recovering = %v", err)
+	}
+	if n := logSize(); n != good {
+		t.Fatalf("the log holds %d bytes after replay; expected the %d of its complete records", n, good)
+	}
+
+	//records written after the replayed ones are replayed after them
+	for _, ent := range largeNumEnts[10:20] {
+		dt.Put(ent.key, ent.val)
+	}
+	_abandon(dt)
+	if dt, err = OpenDiskBpTree(path); err != nil {
+		t.Fatalf("recovering again = %v", err)
+	}
+	defer dt.Close()
+	_diskCheck(t, dt)
+	if !_sameEntries(_diskEntries(t, dt), _entryMap(largeNumEnts[:20])) {
+		t.Fatalf("the log did not restore the entries")
+	}
+}